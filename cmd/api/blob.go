@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/vishaaxl/cheershare/internal/data"
+)
+
+// blobPrefix is the storage prefix of the content addressed files shared by creatives.
+const blobPrefix = "blobs/"
+
+// blobKey returns the storage key of the file with the given SHA-256, keeping the
+// extension of key. The first bytes of the digest fan the files out over directories.
+func blobKey(sum, key string) string {
+	return blobPrefix + sum[:2] + "/" + sum + strings.ToLower(path.Ext(key))
+}
+
+// isBlobKey reports whether key holds a shared file, which must be left to the garbage
+// collector rather than deleted with the upload it came from.
+func isBlobKey(key string) bool {
+	return strings.HasPrefix(key, blobPrefix)
+}
+
+/*
+storeBlob makes the file stored under key, whose content has the given SHA-256, a blob
+that creatives can reference. If an identical file is already stored, the blob holding
+it is returned and the file under key is deleted; otherwise the file is moved to its
+content addressed key. Creatives must use the returned blob's key.
+
+The blob is not referenced until a creative with its digest is inserted. If that never
+happens it is removed by the garbage collector, so callers must not delete its object.
+On error the file is left under key.
+*/
+func (app *application) storeBlob(ctx context.Context, key, sum string, size int64) (*data.Blob, error) {
+	stored := key
+
+	blob, err := app.models.Blob.Get(ctx, sum)
+	if errors.Is(err, data.ErrRecordNotFound) {
+		blob = &data.Blob{SHA256: sum, Key: blobKey(sum, key), SizeBytes: size}
+		err = app.storage.Move(ctx, key, blob.Key)
+		if err == nil {
+			stored = blob.Key
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	/*
+		Insert keeps the blob from being collected until the creative references it. If a
+		concurrent upload of the same content recorded the blob first, its key is used
+		and the copy moved here is deleted below.
+	*/
+	err = app.models.Blob.Insert(ctx, blob)
+	if err != nil {
+		if stored != key {
+			if moveErr := app.storage.Move(ctx, stored, key); moveErr != nil {
+				app.logger.ErrorContext(ctx, "failed to restore file", "key", key, "error", moveErr)
+			}
+		}
+		return nil, err
+	}
+
+	if stored != blob.Key {
+		app.deleteStoredFile(ctx, stored)
+	}
+
+	return blob, nil
+}
+
+// hashStoredFile returns the hex encoded SHA-256 of the file stored under key, and the
+// content type sniffed from its first bytes.
+func (app *application) hashStoredFile(ctx context.Context, key string) (string, string, error) {
+	rc, err := app.storage.Open(ctx, key)
+	if err != nil {
+		return "", "", err
+	}
+	defer rc.Close()
+
+	var head bytes.Buffer
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(h, &limitedBuffer{buf: &head, n: sniffLen}), rc)
+	if err != nil {
+		return "", "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), http.DetectContentType(head.Bytes()), nil
+}
+
+// maxSimilarWarnings bounds the near-duplicates reported by duplicateWarnings.
+const maxSimilarWarnings = 10
+
+/*
+duplicateWarnings returns warnings about the creatives of the same owner that duplicate
+creative, which has not been inserted yet: those with an identical file scheduled on the
+same date, and those with a similar image (see similarCreativesHandler) scheduled within
+the configured window around its date. Duplicates are allowed, so failed lookups are
+logged rather than returned.
+*/
+func (app *application) duplicateWarnings(ctx context.Context, creative *data.Creative) []string {
+	var warnings []string
+	identical := make(map[int64]bool)
+
+	if creative.SHA256 != "" {
+		duplicates, err := app.models.Creative.List(ctx, data.CreativeFilter{
+			UserID: creative.UserID,
+			From:   creative.ScheduledAt,
+			To:     creative.ScheduledAt,
+			SHA256: creative.SHA256,
+		})
+		if err != nil {
+			app.logger.ErrorContext(ctx, "failed to look for duplicate creatives", "error", err)
+		}
+
+		for _, duplicate := range duplicates {
+			identical[duplicate.ID] = true
+			warnings = append(warnings, fmt.Sprintf("an identical image is already scheduled on %s as creative %d",
+				duplicate.ScheduledAt.Format("2006-01-02"), duplicate.ID))
+		}
+	}
+
+	if creative.PHash != nil {
+		window := app.config.similar.window
+		similar, err := app.models.Creative.Similar(ctx, data.SimilarFilter{
+			UserID:      creative.UserID,
+			PHash:       *creative.PHash,
+			MaxDistance: app.config.similar.maxDistance,
+			From:        creative.ScheduledAt.Add(-window),
+			To:          creative.ScheduledAt.Add(window),
+			Limit:       maxSimilarWarnings,
+		})
+		if err != nil {
+			app.logger.ErrorContext(ctx, "failed to look for similar creatives", "error", err)
+		}
+
+		for _, s := range similar {
+			if identical[s.ID] {
+				continue
+			}
+			warnings = append(warnings, fmt.Sprintf("a similar image is already scheduled on %s as creative %d (%d of 64 bits differ)",
+				s.ScheduledAt.Format("2006-01-02"), s.ID, s.Distance))
+		}
+	}
+
+	return warnings
+}
+
+// creativeEnvelope is the response to an upload: the creative, and the warnings about it
+// if there are any.
+func creativeEnvelope(creative *data.Creative, warnings []string) envelope {
+	env := envelope{"creative": creative}
+	if len(warnings) > 0 {
+		env["warnings"] = warnings
+	}
+	return env
+}
@@ -0,0 +1,665 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/julienschmidt/httprouter"
+	"github.com/vishaaxl/cheershare/internal/data"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+)
+
+/*
+Bulk uploads schedule many creatives at once. The client posts a multipart form with:
+
+  - archive: a ZIP of images.
+  - manifest (optional): a CSV or JSON file with one entry per creative, giving the
+    filename in the archive, the scheduled_at date and optionally the metadata accepted
+    by /upload-creative: title, caption, language, alt_text and tags. Without it, the
+    archive must contain manifest.csv or manifest.json at its root.
+
+A CSV manifest starts with a header row naming its columns; only filename and
+scheduled_at are required, and tags are separated by commas or semicolons. A JSON
+manifest is an array of objects with the same keys, tags being an array.
+
+The request is answered with 202 Accepted and the job, which is processed in the
+background. GET /v1/bulk-uploads/:id reports the status of every entry.
+*/
+
+const (
+	// maxManifestBytes bounds the size of a manifest.
+	maxManifestBytes = 1 << 20
+)
+
+// bulkManifestNames are the names a manifest included in the archive may have.
+var bulkManifestNames = []string{"manifest.csv", "manifest.json"}
+
+// createBulkUploadHandler stores the archive, validates the manifest if one was sent, and
+// starts the job.
+func (app *application) createBulkUploadHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	usage, err := app.models.Usage.Get(r.Context(), user.ID)
+	if err != nil {
+		app.logger.ErrorContext(r.Context(), "failed to fetch usage", "error", err)
+		app.errorResponse(w, http.StatusInternalServerError, "failed to check upload quota")
+		return
+	}
+
+	if usage.CreativesLeftToday() == 0 {
+		app.quotaExceededResponse(w, usage, data.ErrDailyQuotaExceeded)
+		return
+	}
+
+	maxBody := app.config.bulk.maxArchiveBytes + maxManifestBytes + multipartOverhead
+	if r.ContentLength > maxBody {
+		app.errorResponse(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("archives are limited to %d bytes", app.config.bulk.maxArchiveBytes))
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxBody)
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		app.errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	job := &data.BulkJob{
+		ID:     uuid.NewString(),
+		UserID: user.ID,
+		Status: data.BulkJobPending,
+		Items:  []data.BulkItem{},
+	}
+
+	var (
+		archiveSize int64
+		manifest    []data.BulkItem
+	)
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			switch part.FormName() {
+			case "archive":
+				if job.ArchiveKey != "" {
+					err = errors.New("only one archive can be uploaded")
+					break
+				}
+				job.ArchiveKey = "bulk/" + job.ID + ".zip"
+				archiveSize, err = app.storage.Put(r.Context(), job.ArchiveKey, io.LimitReader(part, app.config.bulk.maxArchiveBytes+1))
+				if err == nil && archiveSize > app.config.bulk.maxArchiveBytes {
+					err = &http.MaxBytesError{Limit: app.config.bulk.maxArchiveBytes}
+				}
+			case "manifest":
+				manifest, err = parseBulkManifest(part.FileName(), part.Header.Get("Content-Type"), part)
+			}
+			part.Close()
+		}
+
+		if err != nil {
+			if job.ArchiveKey != "" {
+				app.deleteStoredFile(r.Context(), job.ArchiveKey)
+			}
+
+			var maxBytesError *http.MaxBytesError
+			if errors.As(err, &maxBytesError) {
+				app.errorResponse(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("archives are limited to %d bytes", app.config.bulk.maxArchiveBytes))
+				return
+			}
+			app.errorResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	if job.ArchiveKey == "" {
+		app.errorResponse(w, http.StatusBadRequest, "archive is required")
+		return
+	}
+
+	if manifest != nil {
+		err = app.checkBulkManifest(manifest)
+		if err != nil {
+			app.deleteStoredFile(r.Context(), job.ArchiveKey)
+			app.errorResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		job.Items = manifest
+	}
+
+	err = app.models.BulkJob.Insert(r.Context(), job)
+	if err != nil {
+		app.deleteStoredFile(r.Context(), job.ArchiveKey)
+		app.logger.ErrorContext(r.Context(), "failed to create bulk upload job", "error", err)
+		app.errorResponse(w, http.StatusInternalServerError, "failed to create bulk upload")
+		return
+	}
+
+	app.logger.InfoContext(r.Context(), "bulk upload accepted", "job_id", job.ID, "archive_bytes", archiveSize, "entries", len(job.Items))
+
+	// The job outlives the request, but keeps its trace. The worker gets its own copy,
+	// as the response still reads this one.
+	link := trace.LinkFromContext(r.Context())
+	worker := *job
+	worker.Items = slices.Clone(job.Items)
+	app.background(func() {
+		app.processBulkJob(&worker, link)
+	})
+
+	headers := make(http.Header)
+	headers.Set("Location", "/v1/bulk-uploads/"+job.ID)
+	app.writeJSON(w, http.StatusAccepted, envelope{"job": job}, headers)
+}
+
+// getBulkUploadHandler reports the status of a bulk upload job and of each of its entries.
+func (app *application) getBulkUploadHandler(w http.ResponseWriter, r *http.Request) {
+	id := httprouter.ParamsFromContext(r.Context()).ByName("id")
+	if _, err := uuid.Parse(id); err != nil {
+		app.errorResponse(w, http.StatusNotFound, "bulk upload not found")
+		return
+	}
+
+	job, err := app.models.BulkJob.Get(r.Context(), id)
+	if err == nil && job.UserID != app.contextGetUser(r).ID {
+		err = data.ErrRecordNotFound
+	}
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			app.errorResponse(w, http.StatusNotFound, "bulk upload not found")
+			return
+		}
+		app.logger.ErrorContext(r.Context(), "failed to fetch bulk upload job", "error", err)
+		app.errorResponse(w, http.StatusInternalServerError, "failed to fetch bulk upload")
+		return
+	}
+
+	pending, created, failed := job.Counts()
+	summary := map[string]int{
+		"total":   len(job.Items),
+		"pending": pending,
+		"created": created,
+		"failed":  failed,
+	}
+
+	headers := make(http.Header)
+	headers.Set("Cache-Control", "no-store")
+	app.writeJSON(w, http.StatusOK, envelope{"job": job, "summary": summary}, headers)
+}
+
+/*
+processBulkJob runs a job to completion, recording the outcome of each entry as it goes.
+The archive is deleted once the job is finished, whatever its outcome.
+*/
+func (app *application) processBulkJob(job *data.BulkJob, link trace.Link) {
+	ctx, cancel := context.WithTimeout(context.Background(), app.config.bulk.timeout)
+	defer cancel()
+
+	ctx, span := tracer.Start(ctx, "bulk.Process",
+		trace.WithLinks(link),
+		trace.WithAttributes(attribute.String("bulk.job_id", job.ID)),
+	)
+	defer span.End()
+
+	archiveKey := job.ArchiveKey
+
+	err := app.runBulkJob(ctx, job)
+	if err != nil {
+		span.RecordError(err)
+		app.logger.ErrorContext(ctx, "bulk upload failed", "job_id", job.ID, "error", err)
+		job.Status = data.BulkJobFailed
+		job.Error = err.Error()
+		for i := range job.Items {
+			if job.Items[i].Status == data.BulkItemPending {
+				job.Items[i].Status = data.BulkItemFailed
+				job.Items[i].Error = "not processed: the job failed"
+			}
+		}
+	} else {
+		job.Status = data.BulkJobCompleted
+	}
+
+	// The job is recorded as finished even if it ran out of time.
+	err = app.models.BulkJob.Update(context.WithoutCancel(ctx), job)
+	if err != nil {
+		app.logger.ErrorContext(ctx, "failed to save bulk upload job", "job_id", job.ID, "error", err)
+	}
+
+	app.deleteStoredFile(ctx, archiveKey)
+
+	_, created, failed := job.Counts()
+	app.logger.InfoContext(ctx, "bulk upload finished", "job_id", job.ID, "status", job.Status, "created", created, "failed", failed)
+}
+
+// runBulkJob creates the creatives of every pending entry of the job. An error means the
+// archive or manifest could not be used, or the job could not be saved.
+func (app *application) runBulkJob(ctx context.Context, job *data.BulkJob) error {
+	job.Status = data.BulkJobRunning
+	err := app.models.BulkJob.Update(ctx, job)
+	if err != nil {
+		return err
+	}
+
+	archive, err := app.openBulkArchive(ctx, job.ArchiveKey)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	files := make(map[string]*zip.File)
+	for _, f := range archive.File {
+		name := path.Clean(f.Name)
+		if f.FileInfo().IsDir() || strings.HasPrefix(name, "__MACOSX/") || strings.HasPrefix(path.Base(name), ".") {
+			continue
+		}
+		files[name] = f
+	}
+
+	if len(job.Items) == 0 {
+		job.Items, err = app.readArchiveManifest(files)
+		if err != nil {
+			return err
+		}
+	}
+
+	usage, err := app.models.Usage.Get(ctx, job.UserID)
+	if err != nil {
+		return fmt.Errorf("check upload quota: %w", err)
+	}
+
+	for i := range job.Items {
+		item := &job.Items[i]
+		if item.Status != data.BulkItemPending {
+			continue
+		}
+
+		app.createBulkItem(ctx, job.UserID, usage.Limits.FileBytes, files, item)
+
+		err = app.models.BulkJob.Update(ctx, job)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+/*
+createBulkItem creates the creative of a manifest entry from its file in the archive.
+The outcome is recorded in the item; failures are expected (missing files, content
+not matching the extension, exhausted quotas) and do not stop the job.
+*/
+func (app *application) createBulkItem(ctx context.Context, userID, maxFileBytes int64, files map[string]*zip.File, item *data.BulkItem) {
+	fail := func(message string) {
+		item.Status = data.BulkItemFailed
+		item.Error = message
+	}
+
+	f, ok := files[path.Clean(item.Filename)]
+	if !ok {
+		fail("file not found in the archive")
+		return
+	}
+
+	if f.UncompressedSize64 > uint64(maxFileBytes) {
+		fail(data.ErrFileQuotaExceeded.Error())
+		return
+	}
+
+	rc, err := f.Open()
+	if err != nil {
+		fail("failed to read the file from the archive")
+		return
+	}
+	defer rc.Close()
+
+	// As with /upload-creative, the content must be the image its extension names.
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(rc, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		fail("failed to read the file from the archive")
+		return
+	}
+	head = head[:n]
+
+	if http.DetectContentType(head) != imageContentTypes[strings.ToLower(path.Ext(item.Filename))] {
+		fail(errInvalidImage.Error())
+		return
+	}
+
+	// The declared size can be forged, so the copy is bounded as well.
+	key := generateUUIDFilename(item.Filename)
+	hash := sha256.New()
+	body := io.LimitReader(io.MultiReader(bytes.NewReader(head), rc), maxFileBytes+1)
+	size, err := app.storage.Put(ctx, key, io.TeeReader(body, hash))
+	if err != nil || size > maxFileBytes {
+		app.deleteStoredFile(ctx, key)
+		if size > maxFileBytes {
+			fail(data.ErrFileQuotaExceeded.Error())
+		} else {
+			fail("failed to read the file from the archive")
+		}
+		return
+	}
+
+	sum := hex.EncodeToString(hash.Sum(nil))
+
+	blob, err := app.storeBlob(ctx, key, sum, size)
+	if err != nil {
+		app.deleteStoredFile(ctx, key)
+		app.logger.ErrorContext(ctx, "failed to store blob", "error", err)
+		fail("failed to store the file")
+		return
+	}
+
+	// Entries are validated when the manifest is parsed.
+	scheduledAt, _ := time.Parse("2006-01-02", item.ScheduledAt)
+
+	creative := &data.Creative{
+		CreativeURL: app.storage.URL(blob.Key),
+		SizeBytes:   size,
+		Title:       item.Title,
+		Caption:     item.Caption,
+		Language:    item.Language,
+		AltText:     item.AltText,
+		Tags:        item.Tags,
+		SHA256:      sum,
+		PHash:       app.perceptualHash(ctx, blob.Key),
+		ScheduledAt: scheduledAt,
+		UserID:      userID,
+	}
+
+	warnings := app.duplicateWarnings(ctx, creative)
+
+	// The blob is left to the garbage collector if the creative is not saved.
+	err = app.models.Creative.Insert(ctx, creative)
+	if err != nil {
+		if isQuotaError(err) {
+			fail(err.Error())
+			return
+		}
+		app.logger.ErrorContext(ctx, "failed to save creative", "error", err)
+		fail("failed to save creative")
+		return
+	}
+
+	app.queueConversion(creative)
+
+	item.Status = data.BulkItemCreated
+	item.CreativeID = creative.ID
+	item.Warnings = warnings
+}
+
+// bulkArchive is a ZIP archive copied to a temporary file, which Close removes.
+type bulkArchive struct {
+	*zip.Reader
+	file *os.File
+}
+
+func (a *bulkArchive) Close() error {
+	a.file.Close()
+	return os.Remove(a.file.Name())
+}
+
+// openBulkArchive copies the archive from storage to a temporary file, as reading a ZIP
+// needs random access.
+func (app *application) openBulkArchive(ctx context.Context, key string) (*bulkArchive, error) {
+	rc, err := app.storage.Open(ctx, key)
+	if err != nil {
+		return nil, fmt.Errorf("open archive: %w", err)
+	}
+	defer rc.Close()
+
+	f, err := os.CreateTemp("", "cheershare-bulk-*.zip")
+	if err != nil {
+		return nil, err
+	}
+	archive := &bulkArchive{file: f}
+
+	size, err := io.Copy(f, rc)
+	if err != nil {
+		archive.Close()
+		return nil, fmt.Errorf("copy archive: %w", err)
+	}
+
+	archive.Reader, err = zip.NewReader(f, size)
+	if err != nil {
+		archive.Close()
+		return nil, errors.New("the archive is not a valid ZIP file")
+	}
+
+	return archive, nil
+}
+
+// readArchiveManifest parses and checks the manifest included at the root of the archive.
+func (app *application) readArchiveManifest(files map[string]*zip.File) ([]data.BulkItem, error) {
+	for _, name := range bulkManifestNames {
+		f, ok := files[name]
+		if !ok {
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %w", name, err)
+		}
+		defer rc.Close()
+
+		items, err := parseBulkManifest(name, "", rc)
+		if err != nil {
+			return nil, err
+		}
+		return items, app.checkBulkManifest(items)
+	}
+
+	return nil, errors.New("no manifest was sent and the archive has no manifest.csv or manifest.json")
+}
+
+// checkBulkManifest rejects manifests that are empty or have more entries than allowed.
+func (app *application) checkBulkManifest(items []data.BulkItem) error {
+	switch {
+	case len(items) == 0:
+		return errors.New("the manifest has no entries")
+	case len(items) > app.config.bulk.maxEntries:
+		return fmt.Errorf("manifests are limited to %d entries", app.config.bulk.maxEntries)
+	}
+	return nil
+}
+
+/*
+parseBulkManifest reads a CSV or JSON manifest. The format is chosen by the file name's
+extension, then the content type, then whether the content starts with "[". An error is
+returned if the manifest cannot be parsed; entries that are invalid are returned with
+the failed status and the reason.
+*/
+func parseBulkManifest(filename, contentType string, r io.Reader) ([]data.BulkItem, error) {
+	content, err := io.ReadAll(io.LimitReader(r, maxManifestBytes+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(content) > maxManifestBytes {
+		return nil, fmt.Errorf("manifests are limited to %d bytes", maxManifestBytes)
+	}
+
+	mediaType, _, _ := mime.ParseMediaType(contentType)
+
+	var items []data.BulkItem
+	switch {
+	case strings.EqualFold(path.Ext(filename), ".json"),
+		path.Ext(filename) == "" && mediaType == "application/json",
+		path.Ext(filename) == "" && bytes.HasPrefix(bytes.TrimSpace(content), []byte("[")):
+		items, err = parseJSONManifest(content)
+	default:
+		items, err = parseCSVManifest(content)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	for i := range items {
+		validateBulkItem(&items[i])
+	}
+
+	return items, nil
+}
+
+func parseJSONManifest(content []byte) ([]data.BulkItem, error) {
+	var entries []struct {
+		Filename    string   `json:"filename"`
+		ScheduledAt string   `json:"scheduled_at"`
+		Title       string   `json:"title"`
+		Caption     string   `json:"caption"`
+		Language    string   `json:"language"`
+		AltText     string   `json:"alt_text"`
+		Tags        []string `json:"tags"`
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(content))
+	dec.DisallowUnknownFields()
+
+	err := dec.Decode(&entries)
+	if err != nil {
+		return nil, fmt.Errorf("invalid JSON manifest: %w", err)
+	}
+
+	items := make([]data.BulkItem, len(entries))
+	for i, entry := range entries {
+		items[i] = data.BulkItem{
+			Filename:    entry.Filename,
+			ScheduledAt: entry.ScheduledAt,
+			Title:       entry.Title,
+			Caption:     entry.Caption,
+			Language:    entry.Language,
+			AltText:     entry.AltText,
+			Tags:        entry.Tags,
+		}
+	}
+
+	return items, nil
+}
+
+func parseCSVManifest(content []byte) ([]data.BulkItem, error) {
+	cr := csv.NewReader(bytes.NewReader(bytes.TrimPrefix(content, []byte("\ufeff"))))
+	cr.TrimLeadingSpace = true
+
+	records, err := cr.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("invalid CSV manifest: %w", err)
+	}
+	if len(records) == 0 {
+		return nil, errors.New("invalid CSV manifest: the header row is missing")
+	}
+
+	columns := map[string]int{
+		"filename":     -1,
+		"scheduled_at": -1,
+		"title":        -1,
+		"caption":      -1,
+		"language":     -1,
+		"alt_text":     -1,
+		"tags":         -1,
+	}
+	for i, name := range records[0] {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("invalid CSV manifest: unknown column %q", name)
+		}
+		columns[name] = i
+	}
+	if columns["filename"] < 0 || columns["scheduled_at"] < 0 {
+		return nil, errors.New("invalid CSV manifest: the filename and scheduled_at columns are required")
+	}
+
+	field := func(record []string, column string) string {
+		if i := columns[column]; i >= 0 {
+			return strings.TrimSpace(record[i])
+		}
+		return ""
+	}
+
+	items := make([]data.BulkItem, 0, len(records)-1)
+	for _, record := range records[1:] {
+		items = append(items, data.BulkItem{
+			Filename:    field(record, "filename"),
+			ScheduledAt: field(record, "scheduled_at"),
+			Title:       field(record, "title"),
+			Caption:     field(record, "caption"),
+			Language:    field(record, "language"),
+			AltText:     field(record, "alt_text"),
+			Tags:        splitTags(field(record, "tags")),
+		})
+	}
+
+	return items, nil
+}
+
+/*
+validateBulkItem checks a manifest entry with the rules of /upload-creative, and
+normalises its metadata (see creativeMetadata.validate). The item is marked pending if
+it is valid, and failed with the reason otherwise.
+*/
+func validateBulkItem(item *data.BulkItem) {
+	item.Status = data.BulkItemPending
+	fail := func(message string) {
+		item.Status = data.BulkItemFailed
+		item.Error = message
+	}
+
+	if item.Filename == "" {
+		fail("filename is required")
+		return
+	}
+	if !isImageFile(item.Filename) {
+		fail("invalid file type: only images are allowed")
+		return
+	}
+
+	if item.ScheduledAt == "" {
+		fail("scheduled_at is required")
+		return
+	}
+	scheduledAt, err := time.Parse("2006-01-02", item.ScheduledAt)
+	if err != nil {
+		fail("invalid date format for scheduled_at")
+		return
+	}
+	if scheduledAt.Before(time.Now()) {
+		fail("cannot set scheduled_at before today")
+		return
+	}
+
+	metadata := creativeMetadata{
+		Title:    item.Title,
+		Caption:  item.Caption,
+		Language: item.Language,
+		AltText:  item.AltText,
+		Tags:     item.Tags,
+	}
+	if err := metadata.validate(); err != nil {
+		fail(err.Error())
+		return
+	}
+	item.Title = metadata.Title
+	item.Caption = metadata.Caption
+	item.Language = metadata.Language
+	item.AltText = metadata.AltText
+	item.Tags = metadata.Tags
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/vishaaxl/cheershare/internal/data"
+)
+
+func TestCreateBulkItemSniffsContent(t *testing.T) {
+	app, _ := newTestApplication(t)
+	user, _ := newTestUser(t, app, "9876543210")
+
+	entries := map[string][]byte{
+		"diwali.png":  testPNG(t),
+		"script.png":  []byte("#!/bin/sh\necho this is not an image\n"),
+		"renamed.jpg": testPNG(t),
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range entries {
+		fw, err := zw.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(content)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make(map[string]*zip.File)
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+
+	tests := []struct {
+		filename string
+		status   string
+		err      string
+	}{
+		{"diwali.png", data.BulkItemCreated, ""},
+		{"script.png", data.BulkItemFailed, errInvalidImage.Error()},
+		{"renamed.jpg", data.BulkItemFailed, errInvalidImage.Error()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.filename, func(t *testing.T) {
+			item := &data.BulkItem{Filename: tt.filename, ScheduledAt: tomorrow(), Status: data.BulkItemPending}
+			app.createBulkItem(context.Background(), user.ID, 1<<20, files, item)
+
+			if item.Status != tt.status || item.Error != tt.err {
+				t.Errorf("status = %q, error = %q, want %q, %q", item.Status, item.Error, tt.status, tt.err)
+			}
+		})
+	}
+
+	// Only the entry whose content matches its extension became a creative.
+	app.wg.Wait()
+	creatives, err := app.models.Creative.List(context.Background(), data.CreativeFilter{UserID: user.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(creatives) != 1 {
+		t.Errorf("%d creatives created, want 1", len(creatives))
+	}
+}
@@ -54,3 +54,29 @@ func (app *application) contextGetUser(r *http.Request) *data.User {
 	}
 	return user
 }
+
+// requestIDContextKey is the key used to store and retrieve the request ID from the context.
+const requestIDContextKey = contextKey("cheershare.request_id")
+
+// contextSetRequestID associates a request ID with the request's context.
+//
+// Usage:
+// This function is called by the requestID middleware so that every log line and error
+// response produced while serving the request can be correlated with it.
+func (app *application) contextSetRequestID(r *http.Request, id string) *http.Request {
+	ctx := context.WithValue(r.Context(), requestIDContextKey, id)
+	return r.WithContext(ctx)
+}
+
+// contextGetRequestID retrieves the request ID from a context.
+//
+// Returns:
+// - string: The request ID, or the empty string if none has been set.
+//
+// Usage:
+// Unlike contextGetUser this does not panic, because it is also used by the logger for
+// records that are not tied to any request (startup, background jobs).
+func contextGetRequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDContextKey).(string)
+	return id
+}
@@ -1,20 +1,25 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"mime/multipart"
 	"net/http"
-	"os"
 	"path"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/julienschmidt/httprouter"
 	"github.com/vishaaxl/cheershare/internal/data"
 )
 
-const MaxFileSize = 10 << 20
-
 /**
  * generateUUIDFilename generates a unique filename based on a UUID.
  * It uses the original file's extension to keep the file format intact.
@@ -42,137 +47,531 @@ func isImageFile(filename string) bool {
 	return false
 }
 
+// imageContentTypes maps the extensions accepted by isImageFile to the content type
+// their files must have.
+var imageContentTypes = map[string]string{
+	".jpg":  "image/jpeg",
+	".jpeg": "image/jpeg",
+	".png":  "image/png",
+	".gif":  "image/gif",
+}
+
+// sniffLen is the number of bytes http.DetectContentType looks at.
+const sniffLen = 512
+
+var (
+	// errInvalidImage is returned by uploadFile for files that are not one of the allowed images.
+	errInvalidImage = errors.New("invalid file type: only images are allowed")
+	// errStoreFailed wraps the errors of uploadFile that are not caused by the request.
+	errStoreFailed = errors.New("failed to store file")
+)
+
 /**
- * uploadFile handles the file upload logic.
- * It parses the incoming form data, checks for errors, and saves the file to disk.
- * The method also ensures that only images are uploaded by checking the file type.
+ * uploadedFile describes a file stored by uploadFile.
  */
-func (app *application) uploadFile(r *http.Request) (string, error) {
-	err := r.ParseMultipartForm(MaxFileSize)
-	if err != nil {
-		/**
-		 * If parsing the form fails (e.g., file size exceeds limit or form is malformed),
-		 * return an empty string and the error to notify the caller.
-		 */
-		return "", err
-	}
+type uploadedFile struct {
+	Key         string
+	Size        int64
+	SHA256      string
+	ContentType string
+}
+
+/**
+ * uploadFile streams the file part of a multipart request to the storage backend.
+ * Nothing is buffered beyond the first bytes, which are read to check that the content
+ * is one of the allowed images matching the file extension before anything is stored.
+ * The rest of the file is hashed as it is copied, and the copy is aborted as soon as the
+ * file exceeds the user's plan limits, in which case nothing is kept in storage.
+ * The stored file is then shared with any identical file uploaded before, see storeBlob.
+ */
+func (app *application) uploadFile(ctx context.Context, part *multipart.Part, usage *data.Usage) (*uploadedFile, error) {
+	filename := part.FileName()
 
 	/**
-	 * Retrieve the uploaded file from the form data using the key "file".
-	 * This returns the file object, its header (containing metadata like filename), and an error if any.
+	 * Check the extension first, then sniff the content; both must name the same type.
 	 */
-	file, header, err := r.FormFile("file")
-	if err != nil {
-		/**
-		 * If there was an error retrieving the file (e.g., missing file in the request),
-		 * return an empty string and the error to notify the caller.
-		 */
-		return "", err
+	if !isImageFile(filename) {
+		return nil, errInvalidImage
+	}
+
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(part, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, err
+	}
+	head = head[:n]
+
+	contentType := http.DetectContentType(head)
+	if contentType != imageContentTypes[strings.ToLower(path.Ext(filename))] {
+		return nil, errInvalidImage
 	}
-	defer file.Close()
 
 	/**
-	 * Check if the uploaded file is a valid image (using the file extension).
-	 * The isImageFile function verifies that the file is one of the allowed image types (e.g., .jpg, .png).
+	 * The file may not be larger than the plan allows for a single file, nor than the
+	 * storage left.
 	 */
-	if !isImageFile(header.Filename) {
-		return "", fmt.Errorf("invalid file type: only images are allowed")
+	quotaErr := data.ErrFileQuotaExceeded
+	limit := usage.Limits.FileBytes
+	if left := usage.BytesLeft(); left < limit {
+		quotaErr = data.ErrStorageQuotaExceeded
+		limit = left
 	}
 
+	hash := sha256.New()
+	body := &cappedReader{r: io.MultiReader(bytes.NewReader(head), part), remaining: limit}
+
 	/**
 	 * Generate a unique filename for the uploaded file using a UUID to avoid naming conflicts.
 	 * The generateUUIDFilename function ensures that each uploaded file gets a unique name,
 	 * while retaining the file's original extension.
 	 */
-	uploadDir := "./uploads"
-	destinationFilePath := fmt.Sprintf("%s/%s", uploadDir, generateUUIDFilename(header.Filename))
+	key := generateUUIDFilename(filename)
 
-	/**
-	 * Create the destination file in the specified upload directory.
-	 * The os.Create function returns a file pointer for the newly created file.
-	 */
-	destinationFile, err := os.Create(destinationFilePath)
+	size, err := app.storage.Put(ctx, key, io.TeeReader(body, hash))
+	switch {
+	case body.exceeded:
+		return nil, quotaErr
+	case body.err != nil:
+		return nil, body.err
+	case err != nil:
+		return nil, fmt.Errorf("%w: %w", errStoreFailed, err)
+	}
+
+	sum := hex.EncodeToString(hash.Sum(nil))
+
+	blob, err := app.storeBlob(ctx, key, sum, size)
 	if err != nil {
-		return "", err
+		app.deleteStoredFile(ctx, key)
+		return nil, fmt.Errorf("%w: %w", errStoreFailed, err)
 	}
-	defer destinationFile.Close()
 
-	/**
-	 * Copy the contents of the uploaded file to the newly created destination file.
-	 * The io.Copy function writes from the source (file) to the destination (destinationFile).
-	 */
-	_, err = io.Copy(destinationFile, file)
+	return &uploadedFile{
+		Key:         blob.Key,
+		Size:        size,
+		SHA256:      sum,
+		ContentType: contentType,
+	}, nil
+}
+
+// errUploadTooLarge aborts the copy of a file that exceeds its limit.
+var errUploadTooLarge = errors.New("upload exceeds the size limit")
+
+/**
+ * cappedReader reads at most remaining bytes from r. Reading past that fails with
+ * errUploadTooLarge and sets exceeded. Other errors of r are recorded in err, to tell
+ * them apart from the errors of whatever consumes the reader.
+ */
+type cappedReader struct {
+	r         io.Reader
+	remaining int64
+	exceeded  bool
+	err       error
+}
+
+func (c *cappedReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > c.remaining+1 {
+		p = p[:c.remaining+1]
+	}
+
+	n, err := c.r.Read(p)
+	if int64(n) > c.remaining {
+		c.exceeded = true
+		return 0, errUploadTooLarge
+	}
+
+	c.remaining -= int64(n)
+	if err != nil && err != io.EOF {
+		c.err = err
+	}
+	return n, err
+}
+
+// multipartOverhead is the room left in upload requests for the form fields and
+// multipart boundaries on top of the file itself.
+const multipartOverhead = 1 << 20
+
+// maxFieldBytes bounds the text form fields of an upload. It leaves room for the longest
+// caption in any script; lengths are checked in characters by creativeMetadata.validate.
+const maxFieldBytes = 4*maxCaptionLength + 1
+
+/**
+ * readField reads the value of a text form field, rejecting values over maxFieldBytes.
+ */
+func readField(part *multipart.Part) (string, error) {
+	value, err := io.ReadAll(io.LimitReader(part, maxFieldBytes+1))
 	if err != nil {
 		return "", err
 	}
+	if len(value) > maxFieldBytes {
+		return "", fmt.Errorf("%s is too long", part.FormName())
+	}
+	return string(value), nil
+}
+
+/**
+ * parseScheduledAt validates the scheduled_at value of an upload: a YYYY-MM-DD date that
+ * is not in the past.
+ */
+func parseScheduledAt(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, errors.New("scheduled_at is required")
+	}
+
+	scheduledAt, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, errors.New("invalid date format for scheduled_at")
+	}
+
+	if scheduledAt.Before(time.Now()) {
+		return time.Time{}, errors.New("cannot set scheduled_at before today")
+	}
 
-	return destinationFilePath, nil
+	return scheduledAt, nil
 }
 
 /**
  * uploadCreativeHandler handles the HTTP request for uploading a creative file.
- * It processes the file upload, checks for errors, and returns a response with the uploaded file path.
+ * The multipart form has a "file" and a "scheduled_at" field, read as they arrive: the
+ * file is streamed to storage rather than buffered, and a scheduled_at sent before it is
+ * validated before any of the file is read.
+ * The optional "title", "caption", "language", "alt_text" and "tags" fields describe the
+ * creative (see creativeMetadata); tags may be repeated or separated by commas.
+ * Uploads are subject to the user's plan quotas: files over the size limit are rejected
+ * with 413 Request Entity Too Large, and uploads over the daily or storage limits with
+ * 403 Forbidden.
+ * Identical files are stored once; the response has a "warnings" list when the user has
+ * already scheduled the same image on the same date, or a similar image on a nearby
+ * date (see duplicateWarnings).
  */
 func (app *application) uploadCreativeHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
 	/**
-	 * Extract the "scheduled_at" parameter from the request form data.
-	 * This represents the date when the creative will be scheduled.
-	 * If the "scheduled_at" parameter is missing, respond with a 400 Bad Request error.
+	 * Check the quotas that do not depend on the file before reading the request body,
+	 * and cap the body at the largest file the plan allows.
 	 */
-	scheduledAtStr := r.FormValue("scheduled_at")
-	if scheduledAtStr == "" {
-		app.errorResponse(w, http.StatusBadRequest, "scheduled_at is required")
+	usage, err := app.models.Usage.Get(r.Context(), user.ID)
+	if err != nil {
+		app.logger.ErrorContext(r.Context(), "failed to fetch usage", "error", err)
+		app.errorResponse(w, http.StatusInternalServerError, "failed to check upload quota")
 		return
 	}
 
-	scheduledAt, err := time.Parse("2006-01-02", scheduledAtStr)
-	if err != nil {
-		app.errorResponse(w, http.StatusBadRequest, "invalid date format for scheduled_at")
+	switch {
+	case usage.CreativesLeftToday() == 0:
+		app.quotaExceededResponse(w, usage, data.ErrDailyQuotaExceeded)
+		return
+	case usage.BytesLeft() == 0:
+		app.quotaExceededResponse(w, usage, data.ErrStorageQuotaExceeded)
 		return
 	}
 
-	/**
-	 * Validate that the scheduled date is not in the past.
-	 * If the date is earlier than the current date, respond with a 400 Bad Request error.
-	 */
-	if scheduledAt.Before(time.Now()) {
-		app.errorResponse(w, http.StatusBadRequest, "cannot set scheduled_at before today")
+	maxBody := usage.Limits.FileBytes + multipartOverhead
+	if r.ContentLength > maxBody {
+		app.quotaExceededResponse(w, usage, data.ErrFileQuotaExceeded)
+		return
+	}
+	r.Body = http.MaxBytesReader(w, r.Body, maxBody)
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		app.errorResponse(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
 	/**
-	 * Handle the file upload using the app.uploadFile method.
-	 * If the file upload fails, respond with a 400 Bad Request error containing the error message.
+	 * The file is stored as soon as it is read. If the creative is not saved, nothing
+	 * references it and the garbage collector removes it.
 	 */
-	uploadedFile, err := app.uploadFile(r)
-	if err != nil {
+	var (
+		scheduledAt time.Time
+		file        *uploadedFile
+		metadata    creativeMetadata
+	)
+
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err == nil {
+			switch part.FormName() {
+			/**
+			 * The scheduled_at field is the date when the creative will be scheduled.
+			 */
+			case "scheduled_at":
+				var value []byte
+				value, err = io.ReadAll(io.LimitReader(part, int64(len(time.DateOnly)+1)))
+				if err == nil {
+					scheduledAt, err = parseScheduledAt(string(value))
+				}
+			case "title":
+				metadata.Title, err = readField(part)
+			case "caption":
+				metadata.Caption, err = readField(part)
+			case "language":
+				metadata.Language, err = readField(part)
+			case "alt_text":
+				metadata.AltText, err = readField(part)
+			case "tags":
+				var value string
+				value, err = readField(part)
+				metadata.Tags = append(metadata.Tags, splitTags(value)...)
+			case "file":
+				if file != nil {
+					err = errors.New("only one file can be uploaded")
+					break
+				}
+				file, err = app.uploadFile(r.Context(), part, usage)
+			}
+			part.Close()
+		}
+
+		if err != nil {
+			var maxBytesError *http.MaxBytesError
+			switch {
+			case errors.As(err, &maxBytesError):
+				app.quotaExceededResponse(w, usage, data.ErrFileQuotaExceeded)
+			case isQuotaError(err):
+				app.quotaExceededResponse(w, usage, err)
+			case errors.Is(err, errStoreFailed):
+				app.logger.ErrorContext(r.Context(), "failed to store upload", "error", err)
+				app.errorResponse(w, http.StatusInternalServerError, "failed to upload file")
+			default:
+				app.errorResponse(w, http.StatusBadRequest, err.Error())
+			}
+			return
+		}
+	}
+
+	if file == nil {
+		app.errorResponse(w, http.StatusBadRequest, "file is required")
+		return
+	}
+	if scheduledAt.IsZero() {
+		app.errorResponse(w, http.StatusBadRequest, "scheduled_at is required")
+		return
+	}
+	if err := metadata.validate(); err != nil {
 		app.errorResponse(w, http.StatusBadRequest, err.Error())
 		return
 	}
 
 	creative := &data.Creative{
-		CreativeURL: uploadedFile,
+		CreativeURL: app.storage.URL(file.Key),
+		SizeBytes:   file.Size,
+		SHA256:      file.SHA256,
+		PHash:       app.perceptualHash(r.Context(), file.Key),
 		ScheduledAt: scheduledAt,
-		UserID:      app.contextGetUser(r).ID,
+		UserID:      user.ID,
 	}
+	metadata.apply(creative)
+
+	warnings := app.duplicateWarnings(r.Context(), creative)
 
-	err = app.models.Creative.Insert(creative)
+	err = app.models.Creative.Insert(r.Context(), creative)
 	if err != nil {
-		app.logger.Println("Error saving creative:", err)
+		if isQuotaError(err) {
+			app.quotaExceededResponse(w, usage, err)
+			return
+		}
+		app.logger.ErrorContext(r.Context(), "failed to save creative", "error", err)
 		app.errorResponse(w, http.StatusInternalServerError, "failed to save creative")
 		return
 	}
 
+	app.logger.InfoContext(r.Context(), "creative uploaded",
+		"creative_id", creative.ID,
+		"size", file.Size,
+		"content_type", file.ContentType,
+		"sha256", file.SHA256,
+	)
+
+	app.queueConversion(creative)
+
+	app.writeJSON(w, http.StatusOK, creativeEnvelope(creative, warnings), nil)
+}
+
+/**
+ * ownedCreative loads the creative named by the id route parameter. Creatives of other
+ * users are reported as missing. It writes the error response and returns false if the
+ * creative cannot be used.
+ */
+func (app *application) ownedCreative(w http.ResponseWriter, r *http.Request) (*data.Creative, bool) {
+	user := app.contextGetUser(r)
+	return app.visibleCreative(w, r, func(creative *data.Creative) bool {
+		return creative.UserID == user.ID
+	})
+}
+
+/**
+ * visibleCreative loads the creative named by the id route parameter, reporting it as
+ * missing unless visible returns true for it. It writes the error response and returns
+ * false if the creative cannot be used.
+ */
+func (app *application) visibleCreative(w http.ResponseWriter, r *http.Request, visible func(*data.Creative) bool) (*data.Creative, bool) {
+	id, err := strconv.ParseInt(httprouter.ParamsFromContext(r.Context()).ByName("id"), 10, 64)
+	if err != nil || id < 1 {
+		app.errorResponse(w, http.StatusNotFound, "creative not found")
+		return nil, false
+	}
+
+	creative, err := app.models.Creative.Get(r.Context(), id)
+	if err == nil && !visible(creative) {
+		err = data.ErrRecordNotFound
+	}
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			app.errorResponse(w, http.StatusNotFound, "creative not found")
+			return nil, false
+		}
+		app.logger.ErrorContext(r.Context(), "failed to fetch creative", "error", err)
+		app.errorResponse(w, http.StatusInternalServerError, "failed to fetch creative")
+		return nil, false
+	}
+
+	return creative, true
+}
+
+/**
+ * updateCreativeHandler changes the metadata and scheduled date of a creative of the
+ * current user. The JSON body has any of the title, caption, language, alt_text, tags
+ * and scheduled_at fields; fields left out are unchanged, and tags replaces the whole set.
+ * The values are validated as for uploads.
+ */
+func (app *application) updateCreativeHandler(w http.ResponseWriter, r *http.Request) {
+	creative, ok := app.ownedCreative(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Title       *string   `json:"title"`
+		Caption     *string   `json:"caption"`
+		Language    *string   `json:"language"`
+		AltText     *string   `json:"alt_text"`
+		Tags        *[]string `json:"tags"`
+		ScheduledAt *string   `json:"scheduled_at"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	metadata := metadataOf(creative)
+	if input.Title != nil {
+		metadata.Title = *input.Title
+	}
+	if input.Caption != nil {
+		metadata.Caption = *input.Caption
+	}
+	if input.Language != nil {
+		metadata.Language = *input.Language
+	}
+	if input.AltText != nil {
+		metadata.AltText = *input.AltText
+	}
+	if input.Tags != nil {
+		metadata.Tags = *input.Tags
+	}
+
+	if err := metadata.validate(); err != nil {
+		app.errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	metadata.apply(creative)
+
+	if input.ScheduledAt != nil {
+		creative.ScheduledAt, err = parseScheduledAt(*input.ScheduledAt)
+		if err != nil {
+			app.errorResponse(w, http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+
+	err = app.models.Creative.Update(r.Context(), creative)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			app.errorResponse(w, http.StatusNotFound, "creative not found")
+			return
+		}
+		app.logger.ErrorContext(r.Context(), "failed to update creative", "error", err)
+		app.errorResponse(w, http.StatusInternalServerError, "failed to update creative")
+		return
+	}
+
 	app.writeJSON(w, http.StatusOK, envelope{"creative": creative}, nil)
 }
 
+// storageKey returns the storage key of the file of creative, or false if the file is
+// not held by the configured storage backend.
+func (app *application) storageKey(creative *data.Creative) (string, bool) {
+	key, ok := strings.CutPrefix(creative.CreativeURL, app.storage.URL(""))
+	return key, ok && key != ""
+}
+
+// deleteStoredFile removes a file whose creative was not saved. It runs even if the
+// request was cancelled, and failures are only logged.
+func (app *application) deleteStoredFile(ctx context.Context, key string) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+
+	err := app.storage.Delete(ctx, key)
+	if err != nil {
+		app.logger.ErrorContext(ctx, "failed to delete unreferenced upload", "key", key, "error", err)
+	}
+}
+
+/*
+getScheduledCreativesHandler returns the creatives scheduled for today and tomorrow.
+The optional tz query parameter is an IANA time zone name (UTC by default) deciding
+which day is today. The optional tag parameter, which may be repeated or hold tags
+separated by commas, only keeps the creatives having every one of the tags. The
+response carries an ETag so that polling clients can send If-None-Match and get an
+empty 304 Not Modified while nothing changed.
+*/
 func (app *application) getScheduledCreativesHandler(w http.ResponseWriter, r *http.Request) {
-	scheduledCreatives, err := app.models.Creative.GetScheduledCreatives()
+	tz := r.URL.Query().Get("tz")
+	if tz == "" {
+		tz = "UTC"
+	}
+
+	loc, err := time.LoadLocation(tz)
+	if err != nil || tz == "Local" {
+		app.errorResponse(w, http.StatusBadRequest, "tz must be an IANA time zone name")
+		return
+	}
+
+	tags, err := normalizeTags(splitTags(r.URL.Query()["tag"]...))
 	if err != nil {
+		app.errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
 
+	scheduledCreatives, err := app.models.Creative.GetScheduledCreatives(r.Context(), time.Now().In(loc))
+	if err != nil {
+		app.logger.ErrorContext(r.Context(), "failed to fetch scheduled creatives", "error", err)
 		app.errorResponse(w, http.StatusInternalServerError, "failed to fetch scheduled creatives")
 		return
 	}
 
-	app.writeJSON(w, http.StatusOK, envelope{"scheduled_creatives": scheduledCreatives}, nil)
+	/*
+		Tags are filtered here rather than in the query so that every filter is served
+		from the same cached result.
+	*/
+	if len(tags) > 0 {
+		for day, creatives := range scheduledCreatives {
+			filtered := []data.Creative{}
+			for _, creative := range creatives {
+				if hasTags(creative, tags) {
+					filtered = append(filtered, creative)
+				}
+			}
+			scheduledCreatives[day] = filtered
+		}
+	}
+
+	app.writeConditionalJSON(w, r, envelope{"scheduled_creatives": scheduledCreatives})
 }
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// uploadRequest builds a POST /upload-creative request with the given form fields and,
+// unless it is nil, file.
+func uploadRequest(t *testing.T, fields map[string]string, file []byte) *http.Request {
+	t.Helper()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for name, value := range fields {
+		if err := mw.WriteField(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if file != nil {
+		fw, err := mw.CreateFormFile("file", "creative.png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		fw.Write(file)
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/upload-creative", &body)
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	return req
+}
+
+// tomorrow returns tomorrow's date in UTC, the earliest date a creative can be scheduled
+// for that is never in the past.
+func tomorrow() string {
+	return time.Now().UTC().AddDate(0, 0, 1).Format(time.DateOnly)
+}
+
+func TestUploadCreative(t *testing.T) {
+	app, _ := newTestApplication(t)
+	_, token := newTestUser(t, app, "9876543210")
+
+	rec := do(t, app, uploadRequest(t, map[string]string{"scheduled_at": tomorrow(), "title": "Diwali"}, testPNG(t)), token)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+
+	var body struct {
+		Creative struct {
+			ID          int64     `json:"id"`
+			Title       string    `json:"title"`
+			SHA256      string    `json:"sha256"`
+			SizeBytes   int64     `json:"size_bytes"`
+			ScheduledAt time.Time `json:"scheduled_at"`
+		} `json:"creative"`
+	}
+	decodeJSON(t, rec, &body)
+
+	if body.Creative.ID == 0 || body.Creative.SHA256 == "" || body.Creative.SizeBytes != int64(len(testPNG(t))) {
+		t.Errorf("unexpected creative %+v", body.Creative)
+	}
+	if body.Creative.Title != "Diwali" {
+		t.Errorf("title = %q, want %q", body.Creative.Title, "Diwali")
+	}
+
+	creative, err := app.models.Creative.Get(context.Background(), body.Creative.ID)
+	if err != nil {
+		t.Fatalf("creative not saved: %v", err)
+	}
+	key, ok := app.storageKey(creative)
+	if !ok {
+		t.Fatalf("creative URL %q is not in storage", creative.CreativeURL)
+	}
+	if _, err := app.storage.Stat(context.Background(), key); err != nil {
+		t.Errorf("stored file: %v", err)
+	}
+}
+
+func TestUploadCreativeRejectsInvalidRequests(t *testing.T) {
+	app, _ := newTestApplication(t)
+	_, token := newTestUser(t, app, "9876543210")
+
+	tests := []struct {
+		name   string
+		req    *http.Request
+		token  string
+		status int
+	}{
+		{"anonymous", uploadRequest(t, map[string]string{"scheduled_at": tomorrow()}, testPNG(t)), "", http.StatusUnauthorized},
+		{"missing file", uploadRequest(t, map[string]string{"scheduled_at": tomorrow()}, nil), token, http.StatusBadRequest},
+		{"missing date", uploadRequest(t, nil, testPNG(t)), token, http.StatusBadRequest},
+		{"past date", uploadRequest(t, map[string]string{"scheduled_at": "2020-01-01"}, testPNG(t)), token, http.StatusBadRequest},
+		{"not an image", uploadRequest(t, map[string]string{"scheduled_at": tomorrow()}, []byte("plain text, not an image")), token, http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := do(t, app, tt.req, tt.token)
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d: %s", rec.Code, tt.status, rec.Body)
+			}
+		})
+	}
+}
+
+func TestScheduledCreatives(t *testing.T) {
+	app, _ := newTestApplication(t)
+	_, token := newTestUser(t, app, "9876543210")
+
+	rec := do(t, app, uploadRequest(t, map[string]string{"scheduled_at": tomorrow(), "tags": "festival"}, testPNG(t)), token)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("upload: status = %d: %s", rec.Code, rec.Body)
+	}
+
+	type scheduled struct {
+		ScheduledCreatives map[string][]struct {
+			ID   int64    `json:"id"`
+			Tags []string `json:"tags"`
+		} `json:"scheduled_creatives"`
+	}
+
+	rec = do(t, app, httptest.NewRequest(http.MethodGet, "/scheduled?tz=UTC", nil), token)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+
+	var body scheduled
+	decodeJSON(t, rec, &body)
+	if n := len(body.ScheduledCreatives["today"]); n != 0 {
+		t.Errorf("%d creatives today, want 0", n)
+	}
+	if n := len(body.ScheduledCreatives["tomorrow"]); n != 1 {
+		t.Fatalf("%d creatives tomorrow, want 1", n)
+	}
+
+	// Polling with the returned ETag is answered with 304 while nothing changed.
+	req := httptest.NewRequest(http.MethodGet, "/scheduled?tz=UTC", nil)
+	req.Header.Set("If-None-Match", rec.Header().Get("ETag"))
+	if rec := do(t, app, req, token); rec.Code != http.StatusNotModified {
+		t.Errorf("conditional request: status = %d, want %d", rec.Code, http.StatusNotModified)
+	}
+
+	rec = do(t, app, httptest.NewRequest(http.MethodGet, "/scheduled?tz=UTC&tag=birthday", nil), token)
+	body = scheduled{}
+	decodeJSON(t, rec, &body)
+	if n := len(body.ScheduledCreatives["tomorrow"]); n != 0 {
+		t.Errorf("tag filter kept %d creatives, want 0", n)
+	}
+
+	rec = do(t, app, httptest.NewRequest(http.MethodGet, "/scheduled?tz=Mars/Olympus", nil), token)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid tz: status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/vishaaxl/cheershare/internal/data"
+	"github.com/vishaaxl/cheershare/internal/storage"
+)
+
+/*
+Direct uploads let clients send files straight to the storage backend, so the bytes
+never pass through the API:
+
+	POST /v1/creatives/uploads   declare the file and get a presigned PUT URL
+	PUT  <upload_url>            send the file to storage with the returned headers
+	POST /v1/creatives           verify the stored object and create the creative
+
+They need a backend that can presign URLs (STORAGE_BACKEND=s3).
+*/
+
+// sha256Pattern matches a lowercase hex encoded SHA-256 digest.
+var sha256Pattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+/*
+createDirectUploadHandler registers a direct upload. The client declares the file name,
+size, content type and SHA-256 of the file, which are checked against the user's plan,
+and receives a presigned URL to PUT the file to. The signature covers the Content-Type
+and x-amz-checksum-sha256 headers, so storage rejects a PUT whose body does not match
+the declared digest.
+*/
+func (app *application) createDirectUploadHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var input struct {
+		Filename    string `json:"filename"`
+		SizeBytes   int64  `json:"size_bytes"`
+		ContentType string `json:"content_type"`
+		SHA256      string `json:"sha256"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	input.SHA256 = strings.ToLower(input.SHA256)
+
+	switch {
+	case input.Filename == "":
+		app.errorResponse(w, http.StatusBadRequest, "filename is required")
+		return
+	case !isImageFile(input.Filename):
+		app.errorResponse(w, http.StatusBadRequest, "invalid file type: only images are allowed")
+		return
+	case input.ContentType != imageContentTypes[strings.ToLower(path.Ext(input.Filename))]:
+		app.errorResponse(w, http.StatusBadRequest, "content_type does not match the file extension")
+		return
+	case input.SizeBytes <= 0:
+		app.errorResponse(w, http.StatusBadRequest, "size_bytes must be a positive integer")
+		return
+	case !sha256Pattern.MatchString(input.SHA256):
+		app.errorResponse(w, http.StatusBadRequest, "sha256 must be a hex encoded SHA-256 digest")
+		return
+	}
+
+	presigner, ok := app.storage.(storage.Presigner)
+	if !ok {
+		app.errorResponse(w, http.StatusNotImplemented, "direct uploads are not supported by the storage backend")
+		return
+	}
+
+	usage, err := app.models.Usage.Get(r.Context(), user.ID)
+	if err != nil {
+		app.logger.ErrorContext(r.Context(), "failed to fetch usage", "error", err)
+		app.errorResponse(w, http.StatusInternalServerError, "failed to check upload quota")
+		return
+	}
+
+	switch {
+	case input.SizeBytes > usage.Limits.FileBytes:
+		app.quotaExceededResponse(w, usage, data.ErrFileQuotaExceeded)
+		return
+	case usage.CreativesLeftToday() == 0:
+		app.quotaExceededResponse(w, usage, data.ErrDailyQuotaExceeded)
+		return
+	case input.SizeBytes > usage.BytesLeft():
+		app.quotaExceededResponse(w, usage, data.ErrStorageQuotaExceeded)
+		return
+	}
+
+	upload := &data.DirectUpload{
+		ID:          uuid.NewString(),
+		UserID:      user.ID,
+		Filename:    input.Filename,
+		Key:         generateUUIDFilename(input.Filename),
+		SizeBytes:   input.SizeBytes,
+		ContentType: input.ContentType,
+		SHA256:      input.SHA256,
+		ExpiresAt:   time.Now().Add(app.config.storage.presignExpiry).Truncate(time.Second),
+	}
+
+	sum, _ := hex.DecodeString(upload.SHA256)
+	headers := http.Header{}
+	headers.Set("Content-Type", upload.ContentType)
+	headers.Set("X-Amz-Checksum-Sha256", base64.StdEncoding.EncodeToString(sum))
+
+	uploadURL, err := presigner.PresignPut(r.Context(), upload.Key, app.config.storage.presignExpiry, headers)
+	if err != nil {
+		if errors.Is(err, storage.ErrUnsupported) {
+			app.errorResponse(w, http.StatusNotImplemented, "direct uploads are not supported by the storage backend")
+			return
+		}
+		app.logger.ErrorContext(r.Context(), "failed to presign upload", "error", err)
+		app.errorResponse(w, http.StatusInternalServerError, "failed to create upload")
+		return
+	}
+
+	err = app.models.DirectUpload.Insert(r.Context(), upload)
+	if err != nil {
+		app.logger.ErrorContext(r.Context(), "failed to create upload", "error", err)
+		app.errorResponse(w, http.StatusInternalServerError, "failed to create upload")
+		return
+	}
+
+	uploadHeaders := make(map[string]string, len(headers))
+	for name := range headers {
+		uploadHeaders[name] = headers.Get(name)
+	}
+
+	app.writeJSON(w, http.StatusCreated, envelope{
+		"upload":         upload,
+		"upload_url":     uploadURL,
+		"upload_method":  http.MethodPut,
+		"upload_headers": uploadHeaders,
+	}, nil)
+}
+
+/*
+finalizeDirectUploadHandler creates a creative from a direct upload. The body is a JSON
+object with the upload_id and the scheduled_at date. The stored object must have the
+declared size, SHA-256 and content type, the latter sniffed from its first bytes;
+otherwise it is deleted and 422 Unprocessable Entity is returned, and the client can PUT
+the file again until the upload expires.
+*/
+func (app *application) finalizeDirectUploadHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	var input struct {
+		UploadID    string `json:"upload_id"`
+		ScheduledAt string `json:"scheduled_at"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if input.UploadID == "" {
+		app.errorResponse(w, http.StatusBadRequest, "upload_id is required")
+		return
+	}
+
+	if input.ScheduledAt == "" {
+		app.errorResponse(w, http.StatusBadRequest, "scheduled_at is required")
+		return
+	}
+
+	scheduledAt, err := time.Parse("2006-01-02", input.ScheduledAt)
+	if err != nil {
+		app.errorResponse(w, http.StatusBadRequest, "invalid date format for scheduled_at")
+		return
+	}
+
+	if scheduledAt.Before(time.Now()) {
+		app.errorResponse(w, http.StatusBadRequest, "cannot set scheduled_at before today")
+		return
+	}
+
+	if _, err := uuid.Parse(input.UploadID); err != nil {
+		app.errorResponse(w, http.StatusNotFound, "upload not found")
+		return
+	}
+
+	upload, err := app.models.DirectUpload.Get(r.Context(), input.UploadID)
+	if err == nil && upload.UserID != user.ID {
+		err = data.ErrRecordNotFound
+	}
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			app.errorResponse(w, http.StatusNotFound, "upload not found")
+			return
+		}
+		app.logger.ErrorContext(r.Context(), "failed to fetch upload", "error", err)
+		app.errorResponse(w, http.StatusInternalServerError, "failed to fetch upload")
+		return
+	}
+
+	if upload.Expired() {
+		app.errorResponse(w, http.StatusGone, "upload expired")
+		return
+	}
+
+	object, err := app.storage.Stat(r.Context(), upload.Key)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			app.errorResponse(w, http.StatusConflict, "the file has not been uploaded yet")
+			return
+		}
+		app.logger.ErrorContext(r.Context(), "failed to stat upload", "key", upload.Key, "error", err)
+		app.errorResponse(w, http.StatusInternalServerError, "failed to verify upload")
+		return
+	}
+
+	err = app.verifyDirectUpload(r.Context(), upload, object)
+	if err != nil {
+		var mismatch *uploadMismatchError
+		if errors.As(err, &mismatch) {
+			app.deleteStoredFile(r.Context(), upload.Key)
+			app.errorResponse(w, http.StatusUnprocessableEntity, mismatch.Error())
+			return
+		}
+		app.logger.ErrorContext(r.Context(), "failed to verify upload", "key", upload.Key, "error", err)
+		app.errorResponse(w, http.StatusInternalServerError, "failed to verify upload")
+		return
+	}
+
+	/*
+		Deleting the upload claims it, so that concurrent requests cannot create two
+		creatives from one object. It is recorded again if the creative is not saved.
+	*/
+	err = app.models.DirectUpload.Delete(r.Context(), upload.ID)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			app.errorResponse(w, http.StatusConflict, "upload already finalized")
+			return
+		}
+		app.logger.ErrorContext(r.Context(), "failed to claim upload", "error", err)
+		app.errorResponse(w, http.StatusInternalServerError, "failed to save creative")
+		return
+	}
+
+	blob, err := app.storeBlob(r.Context(), upload.Key, upload.SHA256, object.Size)
+	if err != nil {
+		app.restoreDirectUpload(r.Context(), upload)
+		app.logger.ErrorContext(r.Context(), "failed to store blob", "key", upload.Key, "error", err)
+		app.errorResponse(w, http.StatusInternalServerError, "failed to save creative")
+		return
+	}
+
+	creative := &data.Creative{
+		CreativeURL: app.storage.URL(blob.Key),
+		SizeBytes:   object.Size,
+		SHA256:      upload.SHA256,
+		PHash:       app.perceptualHash(r.Context(), blob.Key),
+		ScheduledAt: scheduledAt,
+		UserID:      user.ID,
+	}
+
+	warnings := app.duplicateWarnings(r.Context(), creative)
+
+	err = app.models.Creative.Insert(r.Context(), creative)
+	if err != nil {
+		// The file now lives in the blob, which the restored upload keeps alive.
+		upload.Key = blob.Key
+		app.restoreDirectUpload(r.Context(), upload)
+
+		if isQuotaError(err) {
+			usage, usageErr := app.models.Usage.Get(r.Context(), user.ID)
+			if usageErr == nil {
+				app.quotaExceededResponse(w, usage, err)
+				return
+			}
+		}
+		app.logger.ErrorContext(r.Context(), "failed to save creative", "error", err)
+		app.errorResponse(w, http.StatusInternalServerError, "failed to save creative")
+		return
+	}
+
+	app.queueConversion(creative)
+
+	app.writeJSON(w, http.StatusOK, creativeEnvelope(creative, warnings), nil)
+}
+
+// uploadMismatchError reports a stored object that differs from what was declared.
+type uploadMismatchError struct {
+	field    string
+	declared string
+	actual   string
+}
+
+func (e *uploadMismatchError) Error() string {
+	return fmt.Sprintf("uploaded file does not match the declared %s: expected %s, got %s", e.field, e.declared, e.actual)
+}
+
+/*
+verifyDirectUpload checks the stored object against the upload. The digest recorded by
+storage is used when there is one; otherwise the object is read and hashed. Either way
+only the first bytes are needed to sniff the content type.
+*/
+func (app *application) verifyDirectUpload(ctx context.Context, upload *data.DirectUpload, object storage.Object) error {
+	if object.Size != upload.SizeBytes {
+		return &uploadMismatchError{"size", fmt.Sprint(upload.SizeBytes), fmt.Sprint(object.Size)}
+	}
+	if object.SHA256 != "" && object.SHA256 != upload.SHA256 {
+		return &uploadMismatchError{"sha256", upload.SHA256, object.SHA256}
+	}
+
+	rc, err := app.storage.Open(ctx, upload.Key)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	var head bytes.Buffer
+	h := sha256.New()
+
+	body := io.LimitReader(rc, upload.SizeBytes+1)
+	if object.SHA256 != "" {
+		body = io.LimitReader(rc, sniffLen)
+	}
+
+	_, err = io.Copy(io.MultiWriter(h, &limitedBuffer{buf: &head, n: sniffLen}), body)
+	if err != nil {
+		return err
+	}
+
+	if contentType := http.DetectContentType(head.Bytes()); contentType != upload.ContentType {
+		return &uploadMismatchError{"content type", upload.ContentType, contentType}
+	}
+
+	if object.SHA256 == "" {
+		if sum := hex.EncodeToString(h.Sum(nil)); sum != upload.SHA256 {
+			return &uploadMismatchError{"sha256", upload.SHA256, sum}
+		}
+	}
+
+	return nil
+}
+
+// restoreDirectUpload records an upload claimed by a request that could not create its
+// creative again, so that the client can retry. Failures are only logged.
+func (app *application) restoreDirectUpload(ctx context.Context, upload *data.DirectUpload) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), 5*time.Second)
+	defer cancel()
+
+	err := app.models.DirectUpload.Insert(ctx, upload)
+	if err != nil {
+		app.logger.ErrorContext(ctx, "failed to restore direct upload", "upload_id", upload.ID, "error", err)
+	}
+}
+
+// limitedBuffer keeps the first n bytes written to it and discards the rest.
+type limitedBuffer struct {
+	buf *bytes.Buffer
+	n   int
+}
+
+func (lb *limitedBuffer) Write(p []byte) (int, error) {
+	if room := lb.n - lb.buf.Len(); room > 0 {
+		lb.buf.Write(p[:min(room, len(p))])
+	}
+	return len(p), nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+/*
+envReader reads optional configuration overrides from the environment (which includes
+the values loaded from .env). Parsing errors are remembered rather than returned from
+every call, so main can read all settings and check for a single error at the end.
+*/
+type envReader struct {
+	err error
+}
+
+func (e *envReader) string(key, fallback string) string {
+	if v, ok := os.LookupEnv(key); ok && v != "" {
+		return v
+	}
+	return fallback
+}
+
+func (e *envReader) int(key string, fallback int) int {
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return fallback
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		e.fail(key, err)
+		return fallback
+	}
+	return n
+}
+
+func (e *envReader) float(key string, fallback float64) float64 {
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return fallback
+	}
+
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		e.fail(key, err)
+		return fallback
+	}
+	return f
+}
+
+func (e *envReader) bool(key string, fallback bool) bool {
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return fallback
+	}
+
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		e.fail(key, err)
+		return fallback
+	}
+	return b
+}
+
+func (e *envReader) duration(key string, fallback time.Duration) time.Duration {
+	v, ok := os.LookupEnv(key)
+	if !ok || v == "" {
+		return fallback
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		e.fail(key, err)
+		return fallback
+	}
+	return d
+}
+
+func (e *envReader) fail(key string, err error) {
+	if e.err == nil {
+		e.err = fmt.Errorf("invalid value for %s: %w", key, err)
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"github.com/vishaaxl/cheershare/internal/data"
+	"github.com/vishaaxl/cheershare/internal/gc"
+)
+
+// gcLockKey is the Redis key used to run a single collection per interval across all
+// instances.
+const gcLockKey = "gc:lock"
+
+/*
+runGC collects orphaned uploads every gc.interval until ctx is cancelled: stored files
+that no creative, resumable upload, direct upload, unfinished bulk upload, blob,
+watermark logo or WebP rendition references. When several instances run, the first to
+take the Redis lock for an interval does the collection and the others skip it. Expired
+resumable and direct uploads, bulk upload jobs that stopped making progress, and blobs
+no creative has referenced for the grace period are cleared first so that their objects
+are collected too. Outcomes are logged and counted in the gc_* metrics.
+*/
+func (app *application) runGC(ctx context.Context) {
+	collector := &gc.Collector{
+		Storage: app.storage,
+		Sources: []gc.ReferenceSource{
+			app.models.Creative,
+			gc.KeySource{Storage: app.storage, Keys: app.models.Upload.ReferencedKeys},
+			gc.KeySource{Storage: app.storage, Keys: app.models.DirectUpload.ReferencedKeys},
+			gc.KeySource{Storage: app.storage, Keys: app.models.BulkJob.ReferencedKeys},
+			gc.KeySource{Storage: app.storage, Keys: app.models.Blob.ReferencedKeys},
+			gc.KeySource{Storage: app.storage, Keys: app.models.Watermark.ReferencedKeys},
+			gc.KeySource{Storage: app.storage, Keys: app.models.Rendition.ReferencedKeys},
+		},
+		Grace: app.config.gc.grace,
+	}
+
+	ticker := time.NewTicker(app.config.gc.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		// The lock expires shortly before the next tick so that clock drift between
+		// instances cannot skip an interval.
+		locked, err := app.cache.SetNX(ctx, gcLockKey, 1, app.config.gc.interval*9/10).Result()
+		if err != nil {
+			app.logger.ErrorContext(ctx, "failed to take the gc lock", "error", err)
+			continue
+		}
+		if !locked {
+			continue
+		}
+
+		app.collectGarbage(ctx, collector)
+	}
+}
+
+// collectGarbage performs one collection and reports its outcome.
+func (app *application) collectGarbage(ctx context.Context, collector *gc.Collector) {
+	ctx, span := tracer.Start(ctx, "gc.Run")
+	defer span.End()
+
+	if !app.config.gc.dryRun {
+		expired, err := deleteExpiredUploads(ctx, app.models)
+		if err != nil {
+			app.logger.ErrorContext(ctx, "failed to delete expired uploads", "error", err)
+		} else if expired > 0 {
+			app.logger.InfoContext(ctx, "deleted expired uploads", "count", expired)
+		}
+
+		stale, err := app.models.BulkJob.FailStale(ctx, time.Now().Add(-app.config.bulk.staleAfter))
+		if err != nil {
+			app.logger.ErrorContext(ctx, "failed to fail stale bulk upload jobs", "error", err)
+		} else if stale > 0 {
+			app.logger.WarnContext(ctx, "failed stale bulk upload jobs", "count", stale)
+		}
+
+		blobs, err := app.models.Blob.DeleteUnreferenced(ctx, time.Now().Add(-app.config.gc.grace))
+		if err != nil {
+			app.logger.ErrorContext(ctx, "failed to delete unreferenced blobs", "error", err)
+		} else if blobs > 0 {
+			app.logger.InfoContext(ctx, "deleted unreferenced blobs", "count", blobs)
+		}
+	}
+
+	start := time.Now()
+	report, err := collector.Run(ctx, app.config.gc.dryRun)
+	app.metrics.gcDuration.Observe(time.Since(start).Seconds())
+
+	if report != nil && !report.DryRun {
+		app.metrics.gcDeleted.Add(float64(len(report.Orphans) - len(report.Failed)))
+		app.metrics.gcBytesFreed.Add(float64(report.BytesFreed))
+	}
+
+	if err != nil {
+		span.RecordError(err)
+		app.metrics.gcRuns.WithLabelValues("error").Inc()
+		app.logger.ErrorContext(ctx, "garbage collection failed", "error", err)
+		if report == nil {
+			return
+		}
+	} else {
+		app.metrics.gcRuns.WithLabelValues("success").Inc()
+	}
+
+	app.logger.InfoContext(ctx, "garbage collection finished",
+		"dry_run", report.DryRun,
+		"scanned", report.Scanned,
+		"referenced", report.Referenced,
+		"recent", report.Recent,
+		"orphans", len(report.Orphans),
+		"failed", len(report.Failed),
+		"bytes_freed", report.BytesFreed,
+	)
+}
+
+// deleteExpiredUploads removes the expired resumable and direct uploads, and returns how
+// many were removed.
+func deleteExpiredUploads(ctx context.Context, models data.Models) (int64, error) {
+	resumable, err := models.Upload.DeleteExpired(ctx)
+	if err != nil {
+		return resumable, err
+	}
+
+	direct, err := models.DirectUpload.DeleteExpired(ctx)
+	return resumable + direct, err
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// dependencyCheck pings a single dependency and reports whether it is usable.
+type dependencyCheck func(ctx context.Context) error
+
+// checkResult is the per-dependency entry of the readiness response.
+type checkResult struct {
+	Status    string `json:"status"`
+	LatencyMS int64  `json:"latency_ms"`
+	Error     string `json:"error,omitempty"`
+}
+
+/*
+dependencyChecks lists everything the application needs to serve traffic.
+Each check is given its own timeout so a single hung dependency cannot stall the probe.
+*/
+func (app *application) dependencyChecks() map[string]dependencyCheck {
+	return map[string]dependencyCheck{
+		"postgres": app.db.PingContext,
+		"redis": func(ctx context.Context) error {
+			return app.cache.Ping(ctx).Err()
+		},
+		"storage": app.storage.Ping,
+	}
+}
+
+/*
+livenessHandler reports that the process is up and able to serve HTTP requests.
+It deliberately does not check any dependency: a Postgres outage should take the
+instance out of rotation, not get it restarted.
+*/
+func (app *application) livenessHandler(w http.ResponseWriter, r *http.Request) {
+	app.writeJSON(w, http.StatusOK, envelope{"status": "ok"}, nil)
+}
+
+/*
+readinessHandler pings every dependency concurrently and responds with 503 if any of
+them is down, or as soon as a graceful shutdown has started.
+*/
+func (app *application) readinessHandler(w http.ResponseWriter, r *http.Request) {
+	checks := app.dependencyChecks()
+	results := make(map[string]checkResult, len(checks))
+
+	var (
+		mu sync.Mutex
+		wg sync.WaitGroup
+	)
+
+	for name, check := range checks {
+		wg.Add(1)
+		go func(name string, check dependencyCheck) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(r.Context(), app.config.health.timeout)
+			defer cancel()
+
+			start := time.Now()
+			err := check(ctx)
+			result := checkResult{Status: "up", LatencyMS: time.Since(start).Milliseconds()}
+			if err != nil {
+				result.Status = "down"
+				result.Error = err.Error()
+			}
+
+			mu.Lock()
+			results[name] = result
+			mu.Unlock()
+		}(name, check)
+	}
+	wg.Wait()
+
+	status := http.StatusOK
+	env := envelope{"status": "ready", "checks": results}
+
+	for name, result := range results {
+		if result.Status != "up" {
+			status = http.StatusServiceUnavailable
+			env["status"] = "unavailable"
+			app.logger.WarnContext(r.Context(), "readiness check failed", "dependency", name, "error", result.Error)
+		}
+	}
+
+	if app.shuttingDown.Load() {
+		status = http.StatusServiceUnavailable
+		env["status"] = "shutting_down"
+	}
+
+	app.writeJSON(w, status, env, nil)
+}
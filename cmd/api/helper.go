@@ -1,25 +1,29 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
-	"os"
+	"strings"
 )
 
 type envelope map[string]interface{}
 
 func (app *application) background(fn func()) {
 	app.wg.Add(1)
+	app.metrics.backgroundJobs.Inc()
 
 	go func() {
 		defer app.wg.Done()
+		defer app.metrics.backgroundJobs.Dec()
 
 		defer func() {
 			if err := recover(); err != nil {
-				app.logger.Printf("Error in background function: %v\n", err)
+				app.logger.Error("panic in background function", "error", fmt.Sprint(err))
 			}
 		}()
 
@@ -27,15 +31,28 @@ func (app *application) background(fn func()) {
 	}()
 }
 
+// errorResponse writes a JSON error body. The request ID set by the requestID middleware is
+// read back from the response headers and included so clients can quote it in bug reports.
 func (app *application) errorResponse(w http.ResponseWriter, status int, message interface{}) {
+	app.errorDetailsResponse(w, status, message, nil)
+}
+
+// errorDetailsResponse writes a JSON error body like errorResponse, with the entries of
+// details added next to the error.
+func (app *application) errorDetailsResponse(w http.ResponseWriter, status int, message interface{}, details envelope) {
 	env := envelope{"error": message}
+	for key, value := range details {
+		env[key] = value
+	}
+	if id := w.Header().Get("X-Request-ID"); id != "" {
+		env["request_id"] = id
+	}
 
 	err := app.writeJSON(w, status, env, nil)
 	if err != nil {
-		app.logger.Println(err)
+		app.logger.Error("failed to write error response", "error", err)
 		w.WriteHeader(500)
 	}
-
 }
 
 func (app *application) writeJSON(w http.ResponseWriter, status int, body envelope, headers http.Header) error {
@@ -57,6 +74,52 @@ func (app *application) writeJSON(w http.ResponseWriter, status int, body envelo
 	return nil
 }
 
+/*
+writeConditionalJSON writes body with a 200 status like writeJSON, tagged with a strong
+ETag derived from its content. If the request's If-None-Match header lists that ETag,
+a bodiless 304 Not Modified is sent instead. Cache-Control keeps shared caches from
+storing the response to an authenticated request and makes clients revalidate on every
+use.
+*/
+func (app *application) writeConditionalJSON(w http.ResponseWriter, r *http.Request, body envelope) error {
+	js, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+
+	js = append(js, '\n')
+
+	sum := sha256.Sum256(js)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, no-cache")
+
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(js)
+
+	return nil
+}
+
+// etagMatches reports whether an If-None-Match header value lists etag, using the weak
+// comparison required for If-None-Match.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
 func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst interface{}) error {
 	maxBytes := 104856
 	r.Body = http.MaxBytesReader(w, r.Body, int64(maxBytes))
@@ -127,13 +190,3 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst int
 
 	return nil
 }
-
-func ensureUploadDirExists() {
-	uploadDir := "./uploads"
-	if _, err := os.Stat(uploadDir); os.IsNotExist(err) {
-		err := os.MkdirAll(uploadDir, os.ModePerm)
-		if err != nil {
-			fmt.Println("Unable to create uploads directory:", err)
-		}
-	}
-}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"regexp"
+	"strings"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// redacted is the placeholder written in place of secret values.
+const redacted = "[REDACTED]"
+
+// secretKeys lists attribute keys whose values must never be written to the logs.
+var secretKeys = map[string]bool{
+	"otp":           true,
+	"token":         true,
+	"authorization": true,
+	"password":      true,
+}
+
+// phoneKeys lists attribute keys that hold phone numbers. Their values are masked
+// rather than removed so that operators can still tell numbers apart.
+var phoneKeys = map[string]bool{
+	"phone":        true,
+	"phone_number": true,
+}
+
+var (
+	// phonePattern matches phone numbers embedded in free text such as error messages.
+	phonePattern = regexp.MustCompile(`\+?\b\d{10,15}\b`)
+	// tokenPattern matches plaintext authentication tokens (26 base32 characters).
+	tokenPattern = regexp.MustCompile(`\b[A-Z2-7]{26}\b`)
+)
+
+/*
+newLogger builds the application's structured JSON logger.
+Every attribute is passed through redactAttr so OTPs, tokens and phone numbers never
+reach the output, and records logged with one of the *Context methods are tagged with
+the request ID stored in that context.
+*/
+func newLogger(w io.Writer, level slog.Leveler) *slog.Logger {
+	handler := slog.NewJSONHandler(w, &slog.HandlerOptions{
+		Level:       level,
+		ReplaceAttr: redactAttr,
+	})
+
+	return slog.New(contextHandler{handler})
+}
+
+/*
+redactAttr is used as the slog ReplaceAttr hook.
+Attributes with a secret key are replaced entirely, phone number attributes are masked,
+and any other string value (including the message) is scrubbed for anything that looks
+like a phone number or a token.
+*/
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	key := strings.ToLower(a.Key)
+
+	switch {
+	case secretKeys[key]:
+		return slog.String(a.Key, redacted)
+	case phoneKeys[key]:
+		return slog.String(a.Key, maskPhone(a.Value.String()))
+	case key == "request_id" || key == "trace_id":
+		return a
+	}
+
+	switch a.Value.Kind() {
+	case slog.KindString:
+		return slog.String(a.Key, scrub(a.Value.String()))
+	case slog.KindAny:
+		if err, ok := a.Value.Any().(error); ok {
+			return slog.String(a.Key, scrub(err.Error()))
+		}
+	}
+
+	return a
+}
+
+// scrub masks phone numbers and removes tokens found in free text.
+func scrub(s string) string {
+	s = tokenPattern.ReplaceAllString(s, redacted)
+	return phonePattern.ReplaceAllStringFunc(s, maskPhone)
+}
+
+// maskPhone keeps only the last two digits of a phone number.
+func maskPhone(phone string) string {
+	if len(phone) <= 2 {
+		return strings.Repeat("*", len(phone))
+	}
+
+	return strings.Repeat("*", len(phone)-2) + phone[len(phone)-2:]
+}
+
+// contextHandler decorates a slog.Handler so that each record carries the request ID
+// and trace ID found in the context it was logged with.
+type contextHandler struct {
+	slog.Handler
+}
+
+func (h contextHandler) Handle(ctx context.Context, r slog.Record) error {
+	if id := contextGetRequestID(ctx); id != "" {
+		r.AddAttrs(slog.String("request_id", id))
+	}
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		r.AddAttrs(slog.String("trace_id", sc.TraceID().String()))
+	}
+
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h contextHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return contextHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h contextHandler) WithGroup(name string) slog.Handler {
+	return contextHandler{h.Handler.WithGroup(name)}
+}
@@ -3,17 +3,20 @@ package main
 import (
 	"context"
 	"database/sql"
-	"log"
-	"net/http"
+	"fmt"
+	"log/slog"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
+	// Embedded so that the tz parameter of /scheduled works on hosts without zoneinfo.
+	_ "time/tzdata"
 
 	"github.com/go-redis/redis/v8"
 	"github.com/joho/godotenv"
-	"github.com/julienschmidt/httprouter"
 	_ "github.com/lib/pq"
 	"github.com/vishaaxl/cheershare/internal/data"
+	"github.com/vishaaxl/cheershare/internal/storage"
 )
 
 /*
@@ -23,12 +26,34 @@ config struct:
   - `env`: The current environment (e.g., "development", "production").
   - `db`: Database-specific configurations.
   - `redis`: Redis-specific configurations.
+  - `logLevel`: The minimum level of log records that are written.
+  - `storage`: Where uploaded creatives are stored.
+  - `health`: Readiness probe and shutdown drain settings.
+  - `tracing`: OpenTelemetry exporter settings.
+  - `budgets`: Per-route deadlines applied to the request context.
+  - `limiter`: Redis-backed rate limiting policies.
+  - `cache`: Redis caching of query results.
+  - `gc`: Periodic removal of uploads no creative references.
+  - `tus`: Resumable uploads.
+  - `bulk`: Bulk uploads of ZIP archives.
+  - `similar`: Near-duplicate detection with perceptual hashes.
 */
 type config struct {
-	port  int
-	env   string
-	db    db
-	redis redisConfig
+	port     int
+	env      string
+	db       db
+	redis    redisConfig
+	logLevel slog.Level
+	storage  storageConfig
+	health   healthConfig
+	tracing  tracingConfig
+	budgets  budgetConfig
+	limiter  limiterConfig
+	cache    cacheConfig
+	gc       gcConfig
+	tus      tusConfig
+	bulk     bulkConfig
+	similar  similarConfig
 }
 
 type db struct {
@@ -36,6 +61,8 @@ type db struct {
 	maxOpenConns int
 	maxIdleConns int
 	maxIdleTime  time.Duration
+	// migrateOnStart applies pending embedded migrations before the server starts.
+	migrateOnStart bool
 }
 
 type redisConfig struct {
@@ -44,29 +71,143 @@ type redisConfig struct {
 	db       int
 }
 
+type storageConfig struct {
+	// backend is either "disk" or "s3". Direct uploads need "s3".
+	backend string
+	// dir is the root directory of the disk backend.
+	dir string
+	s3  storage.S3Config
+	// presignExpiry is how long a direct upload URL is valid and the upload can be
+	// finalized.
+	presignExpiry time.Duration
+}
+
+type healthConfig struct {
+	// timeout bounds each dependency ping made by /readyz.
+	timeout time.Duration
+	// drainDelay is how long /readyz reports failure before the server stops accepting
+	// connections, giving load balancers time to take the instance out of rotation.
+	drainDelay time.Duration
+}
+
+/*
+budgetConfig holds the deadline budgets for request handling.
+The deadline is applied to the request context, so every Redis, Postgres and storage
+call made while serving the request is cancelled once it is exceeded or as soon as the
+client disconnects.
+*/
+type budgetConfig struct {
+	// auth bounds the token lookup made by the authenticate middleware.
+	auth time.Duration
+	// defaultRoute applies to routes without an entry in routes.
+	defaultRoute time.Duration
+	// routes maps a route pattern, as registered in routes.go, to its budget.
+	routes map[string]time.Duration
+}
+
+// forRoute returns the deadline budget for a route pattern.
+func (b budgetConfig) forRoute(pattern string) time.Duration {
+	if d, ok := b.routes[pattern]; ok {
+		return d
+	}
+	return b.defaultRoute
+}
+
+type limiterConfig struct {
+	enabled bool
+	// trustProxy makes the limiter key anonymous clients by the address our proxy
+	// appended to X-Forwarded-For. Only enable it when the server is behind a proxy that
+	// appends to the header.
+	trustProxy bool
+	// policies maps the policy names used in routes.go to their token buckets.
+	policies map[string]rateLimitPolicy
+}
+
+type cacheConfig struct {
+	// scheduledTTL bounds how long a /scheduled result is cached; writes invalidate it
+	// earlier. Zero disables the cache.
+	scheduledTTL time.Duration
+	// tokenTTL is how long the user owning a token is cached in Redis. Zero disables
+	// the token cache.
+	tokenTTL time.Duration
+	// tokenLocalSize is the size of the in-process token cache. Zero disables it.
+	tokenLocalSize int
+	tokenLocalTTL  time.Duration
+}
+
+type gcConfig struct {
+	// interval between collections of orphaned uploads. Zero disables them.
+	interval time.Duration
+	// grace is the age below which unreferenced uploads are kept, as their creative may
+	// not be saved yet.
+	grace time.Duration
+	// dryRun only logs what would be deleted.
+	dryRun bool
+}
+
+type tusConfig struct {
+	// expiry is how long an upload can be resumed or attached to a creative after it
+	// is created.
+	expiry time.Duration
+}
+
+type bulkConfig struct {
+	// maxArchiveBytes is the largest archive accepted.
+	maxArchiveBytes int64
+	// maxEntries is the largest number of entries in a manifest.
+	maxEntries int
+	// timeout bounds the processing of a job.
+	timeout time.Duration
+	// staleAfter is how long an unfinished job can go without progress before it is
+	// marked as failed. It must be longer than timeout.
+	staleAfter time.Duration
+}
+
+type similarConfig struct {
+	// maxDistance is the largest number of differing hash bits for which two images are
+	// considered near-duplicates.
+	maxDistance int
+	// window is how far from its scheduled date an upload is checked for near-duplicates.
+	window time.Duration
+}
+
+type tracingConfig struct {
+	// exporter is either "otlp" or "none".
+	exporter string
+	// sampleRatio is the fraction of new traces that are recorded.
+	sampleRatio float64
+}
+
 /*
 applications struct:
 - Encapsulates the application's dependencies, including:
   - `config`: The application's configuration settings.
   - `logger`: A logger instance to handle log messages.
   - `redis`: A Redis client instance for caching.
+  - `metrics`: Prometheus collectors exposed on /metrics.
+  - `storage`: The backend holding uploaded creatives.
+  - `shuttingDown`: Set once a graceful shutdown begins so that /readyz starts failing.
 */
 type application struct {
 	wg     sync.WaitGroup
 	config config
 	models data.Models
 
-	logger *log.Logger
-	cache  *redis.Client
+	logger  *slog.Logger
+	db      *sql.DB
+	cache   *redis.Client
+	metrics *metrics
+	storage storage.Storage
+
+	shuttingDown atomic.Bool
 }
 
 func main() {
 	err := godotenv.Load()
 	if err != nil {
-		log.Fatalf("Error loading .env file: %v", err)
+		slog.Error("failed to load .env file", "error", err)
+		os.Exit(1)
 	}
-
-	ensureUploadDirExists()
 	/*
 	   Configuration includes:
 	   - `port`: The port on which the server will run (default is 4000).
@@ -88,14 +229,179 @@ func main() {
 			password: "mysecretpassword",
 			db:       0,
 		},
+		logLevel: slog.LevelInfo,
+		storage: storageConfig{
+			backend: "disk",
+			dir:     "./uploads",
+			s3: storage.S3Config{
+				Endpoint:  "localhost:9000",
+				Bucket:    "cheershare",
+				Region:    "us-east-1",
+				AccessKey: "minioadmin",
+				SecretKey: "minioadmin",
+			},
+			presignExpiry: 15 * time.Minute,
+		},
+		health: healthConfig{
+			timeout:    2 * time.Second,
+			drainDelay: 0,
+		},
+		tracing: tracingConfig{
+			exporter:    "none",
+			sampleRatio: 1,
+		},
+		budgets: budgetConfig{
+			auth:         3 * time.Second,
+			defaultRoute: 3 * time.Second,
+			routes: map[string]time.Duration{
+				"/signup":          5 * time.Second,
+				"/upload-creative": 25 * time.Second,
+				// Finalizing reads the object back from storage to hash and decode it.
+				"/v1/creatives":       25 * time.Second,
+				"/v1/tus/uploads/:id": 25 * time.Second,
+				// Serving streams the whole file, possibly to a slow client.
+				"/v1/creatives/:id/media": 30 * time.Second,
+				// Rendering decodes, draws onto and encodes the whole image.
+				"/v1/creatives/:id/render": 15 * time.Second,
+				"/v1/me/watermark/preview": 15 * time.Second,
+				// Attaching assembles, hashes and decodes the whole file.
+				"/v1/tus/uploads/:id/creative": 25 * time.Second,
+				"/v1/bulk-uploads":             60 * time.Second,
+			},
+		},
+		limiter: limiterConfig{
+			enabled:  true,
+			policies: defaultRateLimitPolicies(),
+		},
+		cache: cacheConfig{
+			scheduledTTL:   10 * time.Minute,
+			tokenTTL:       time.Minute,
+			tokenLocalSize: 0,
+			tokenLocalTTL:  5 * time.Second,
+		},
+		gc: gcConfig{
+			interval: time.Hour,
+			grace:    24 * time.Hour,
+		},
+		tus: tusConfig{
+			expiry: 24 * time.Hour,
+		},
+		bulk: bulkConfig{
+			maxArchiveBytes: 200 << 20,
+			maxEntries:      500,
+			timeout:         30 * time.Minute,
+			staleAfter:      time.Hour,
+		},
+		similar: similarConfig{
+			maxDistance: 10,
+			window:      7 * 24 * time.Hour,
+		},
+	}
+
+	env := &envReader{}
+	cfg.db.dsn = env.string("DB_DSN", cfg.db.dsn)
+	cfg.db.migrateOnStart = env.bool("DB_MIGRATE_ON_START", cfg.db.migrateOnStart)
+	cfg.redis.addr = env.string("REDIS_ADDR", cfg.redis.addr)
+	cfg.redis.password = env.string("REDIS_PASSWORD", cfg.redis.password)
+	cfg.storage.backend = env.string("STORAGE_BACKEND", cfg.storage.backend)
+	cfg.storage.dir = env.string("STORAGE_DIR", cfg.storage.dir)
+	cfg.storage.s3.Endpoint = env.string("S3_ENDPOINT", cfg.storage.s3.Endpoint)
+	cfg.storage.s3.Bucket = env.string("S3_BUCKET", cfg.storage.s3.Bucket)
+	cfg.storage.s3.Region = env.string("S3_REGION", cfg.storage.s3.Region)
+	cfg.storage.s3.AccessKey = env.string("S3_ACCESS_KEY", cfg.storage.s3.AccessKey)
+	cfg.storage.s3.SecretKey = env.string("S3_SECRET_KEY", cfg.storage.s3.SecretKey)
+	cfg.storage.s3.UseSSL = env.bool("S3_USE_SSL", cfg.storage.s3.UseSSL)
+	cfg.storage.presignExpiry = env.duration("PRESIGN_EXPIRY", cfg.storage.presignExpiry)
+	cfg.health.timeout = env.duration("HEALTH_CHECK_TIMEOUT", cfg.health.timeout)
+	cfg.health.drainDelay = env.duration("SHUTDOWN_DRAIN_DELAY", cfg.health.drainDelay)
+	cfg.tracing.exporter = env.string("TRACING_EXPORTER", cfg.tracing.exporter)
+	cfg.tracing.sampleRatio = env.float("TRACING_SAMPLE_RATIO", cfg.tracing.sampleRatio)
+	cfg.limiter.enabled = env.bool("RATE_LIMIT_ENABLED", cfg.limiter.enabled)
+	cfg.limiter.trustProxy = env.bool("RATE_LIMIT_TRUST_PROXY", cfg.limiter.trustProxy)
+	cfg.cache.scheduledTTL = env.duration("SCHEDULED_CACHE_TTL", cfg.cache.scheduledTTL)
+	cfg.cache.tokenTTL = env.duration("TOKEN_CACHE_TTL", cfg.cache.tokenTTL)
+	cfg.cache.tokenLocalSize = env.int("TOKEN_CACHE_LOCAL_SIZE", cfg.cache.tokenLocalSize)
+	cfg.cache.tokenLocalTTL = env.duration("TOKEN_CACHE_LOCAL_TTL", cfg.cache.tokenLocalTTL)
+	cfg.gc.interval = env.duration("GC_INTERVAL", cfg.gc.interval)
+	cfg.gc.grace = env.duration("GC_GRACE", cfg.gc.grace)
+	cfg.gc.dryRun = env.bool("GC_DRY_RUN", cfg.gc.dryRun)
+	cfg.tus.expiry = env.duration("TUS_UPLOAD_EXPIRY", cfg.tus.expiry)
+	cfg.bulk.maxArchiveBytes = int64(env.int("BULK_MAX_ARCHIVE_BYTES", int(cfg.bulk.maxArchiveBytes)))
+	cfg.bulk.maxEntries = env.int("BULK_MAX_ENTRIES", cfg.bulk.maxEntries)
+	cfg.bulk.timeout = env.duration("BULK_JOB_TIMEOUT", cfg.bulk.timeout)
+	cfg.bulk.staleAfter = env.duration("BULK_STALE_AFTER", cfg.bulk.staleAfter)
+	cfg.similar.maxDistance = env.int("SIMILAR_MAX_DISTANCE", cfg.similar.maxDistance)
+	cfg.similar.window = env.duration("SIMILAR_WINDOW", cfg.similar.window)
+	if env.err != nil {
+		slog.Error("invalid configuration", "error", env.err)
+		os.Exit(1)
+	}
+	// A job still running within its timeout must never be taken for a stale one.
+	if cfg.bulk.staleAfter <= cfg.bulk.timeout {
+		slog.Error("invalid configuration", "error", "BULK_STALE_AFTER must be longer than BULK_JOB_TIMEOUT",
+			"stale_after", cfg.bulk.staleAfter, "timeout", cfg.bulk.timeout)
+		os.Exit(1)
 	}
 
 	/*
 	   Logger settings:
-	   - Prefix: "INFO\t" indicates informational logs.
-	   - Flags: Includes date and time for log entries.
+	   - Structured JSON records written to stdout.
+	   - The level can be overridden with the LOG_LEVEL environment variable (debug, info, warn, error).
+	   - OTPs, tokens and phone numbers are redacted before they are written.
+	*/
+	if lvl := os.Getenv("LOG_LEVEL"); lvl != "" {
+		err = cfg.logLevel.UnmarshalText([]byte(lvl))
+		if err != nil {
+			slog.Error("invalid LOG_LEVEL", "value", lvl, "error", err)
+			os.Exit(1)
+		}
+	}
+	logger := newLogger(os.Stdout, cfg.logLevel)
+
+	/*
+	   `cheershare migrate ...` manages the embedded database migrations and exits
+	   without starting the server.
+	*/
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		db, err := connectDB(cfg.db)
+		if err != nil {
+			logger.Error("failed to connect to database", "error", err)
+			os.Exit(1)
+		}
+		defer db.Close()
+
+		err = runMigrateCommand(context.Background(), db, os.Args[2:], os.Stdout)
+		if err != nil {
+			logger.Error("migration failed", "error", err)
+			db.Close()
+			os.Exit(1)
+		}
+		return
+	}
+
+	/*
+	   - setupTracing installs the OpenTelemetry tracer provider and propagator.
+	   - Pending spans are flushed when the application exits.
 	*/
-	logger := log.New(os.Stdout, "INFO\t", log.Ldate|log.Ltime)
+	shutdownTracing, err := setupTracing(context.Background(), cfg.tracing)
+	if err != nil {
+		logger.Error("failed to set up tracing", "error", err)
+		os.Exit(1)
+	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		if err := shutdownTracing(ctx); err != nil {
+			logger.Error("failed to flush traces", "error", err)
+		}
+	}()
+
+	store, err := openStorage(context.Background(), cfg.storage)
+	if err != nil {
+		logger.Error("failed to open storage", "backend", cfg.storage.backend, "error", err)
+		os.Exit(1)
+	}
 
 	/*
 	   - connectDB establishes a connection using the database configuration.
@@ -104,11 +410,21 @@ func main() {
 	*/
 	db, err := connectDB(cfg.db)
 	if err != nil {
-		logger.Fatalf("Failed to connect to database: %s", err)
+		logger.Error("failed to connect to database", "error", err)
+		os.Exit(1)
 	}
-	logger.Println("Connected to PostgreSQL database")
+	logger.Info("connected to PostgreSQL database")
 	defer db.Close()
 
+	if cfg.db.migrateOnStart {
+		err = migrateOnStart(context.Background(), db)
+		if err != nil {
+			logger.Error("failed to apply migrations", "error", err)
+			os.Exit(1)
+		}
+		logger.Info("database migrations are up to date")
+	}
+
 	/*
 	   - connectRedis establishes a connection using the Redis configuration.
 	   - If the connection fails, the application logs a fatal error and exits.
@@ -116,37 +432,98 @@ func main() {
 	*/
 	redisClient, err := connectRedis(cfg.redis)
 	if err != nil {
-		logger.Fatalf("Failed to connect to Redis: %s", err)
+		logger.Error("failed to connect to Redis", "error", err)
+		os.Exit(1)
 	}
-	logger.Println("Connected to Redis server")
+	logger.Info("connected to Redis server")
 	defer redisClient.Close()
+	redisClient.AddHook(redisTracingHook{})
+
+	/*
+	   The scheduled creatives and token lookups are cached in Redis, and invalidated by
+	   every write made through these models, including inside transactions once they
+	   commit. The token cache's in-process layer listens for invalidations made by other
+	   instances until the server exits.
+	*/
+	models := data.NewModels(db)
+	if cfg.cache.scheduledTTL > 0 {
+		models = models.WithScheduledCache(redisClient, cfg.cache.scheduledTTL)
+	}
+
+	var tokenCache *data.TokenCache
+	if cfg.cache.tokenTTL > 0 {
+		tokenCache = data.NewTokenCache(redisClient, data.TokenCacheOptions{
+			TTL:       cfg.cache.tokenTTL,
+			LocalSize: cfg.cache.tokenLocalSize,
+			LocalTTL:  cfg.cache.tokenLocalTTL,
+		})
+		models = models.WithTokenCache(tokenCache)
+
+		listenCtx, stopListening := context.WithCancel(context.Background())
+		defer stopListening()
+		go tokenCache.Listen(listenCtx)
+	}
 
 	app := &application{
-		config: *cfg,
-		logger: logger,
-		cache:  redisClient,
-		models: data.NewModels(db),
+		config:  *cfg,
+		logger:  logger,
+		db:      db,
+		cache:   redisClient,
+		models:  models,
+		metrics: newMetrics(db, redisClient),
+		storage: store,
+	}
+	if tokenCache != nil {
+		app.metrics.registerTokenCache(tokenCache)
 	}
 
-	router := httprouter.New()
-	router.HandlerFunc(http.MethodPost, "/signup", app.handleUserSignupAndVerification)
-	router.HandlerFunc(http.MethodPost, "/upload-creative", app.requireAuthenticatedUser(app.uploadCreativeHandler))
-	router.HandlerFunc(http.MethodGet, "/scheduled", app.requireAuthenticatedUser(app.getScheduledCreativesHandler))
+	/*
+	   Orphaned uploads are collected in the background until the server exits.
+	*/
+	if cfg.gc.interval > 0 {
+		gcCtx, stopGC := context.WithCancel(context.Background())
+		defer stopGC()
+		go app.runGC(gcCtx)
+	}
 
 	/*
 	   Server configuration:
 	   - Address: Uses the configured port from `config`.
-	   - Handler: Routes handled by `httprouter`.
+	   - Handler: Routes handled by `httprouter`, see routes.go.
 	   - Timeouts: Configured for idle, read, and write operations.
 	   - Error logging: Logs errors during server startup or operation.
 	*/
-	err = app.serve(router)
+	err = app.serve(app.routes())
 	if err != nil {
-		logger.Fatal(err, nil)
+		logger.Error("server error", "error", err)
+		os.Exit(1)
 	}
 
 }
 
+// openStorage returns the configured storage backend, wrapped with tracing.
+func openStorage(ctx context.Context, cfg storageConfig) (storage.Storage, error) {
+	switch cfg.backend {
+	case "disk":
+		disk, err := storage.NewDisk(cfg.dir)
+		if err != nil {
+			return nil, err
+		}
+		return storage.WithTracing(disk, "disk"), nil
+	case "s3":
+		ctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+
+		s3, err := storage.NewS3(ctx, cfg.s3)
+		if err != nil {
+			return nil, err
+		}
+		return storage.WithTracing(s3, "s3"), nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", cfg.backend)
+	}
+}
+
 func connectDB(cfg db) (*sql.DB, error) {
 	db, err := sql.Open("postgres", cfg.dsn)
 
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/vishaaxl/cheershare/internal/data"
+	"github.com/vishaaxl/cheershare/internal/storage"
+)
+
+/*
+newTestApplication returns an application running entirely in process: the in-memory
+models, a miniredis server and disk storage in a temporary directory. Rate limiting is
+disabled; tests of the limiter enable it themselves.
+*/
+func newTestApplication(t *testing.T) (*application, *miniredis.Miniredis) {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	store, err := storage.NewDisk(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := &application{
+		config: config{
+			env: "testing",
+			budgets: budgetConfig{
+				auth:         time.Second,
+				defaultRoute: 5 * time.Second,
+			},
+			limiter: limiterConfig{
+				policies: defaultRateLimitPolicies(),
+			},
+			tus: tusConfig{
+				expiry: time.Hour,
+			},
+			similar: similarConfig{
+				maxDistance: 10,
+				window:      7 * 24 * time.Hour,
+			},
+		},
+		logger:  newLogger(io.Discard, slog.LevelError),
+		cache:   rdb,
+		models:  data.NewMemoryModels(),
+		metrics: newMetrics(nil, rdb),
+		storage: store,
+	}
+	// Background jobs, such as conversions queued by uploads, finish before the
+	// temporary directory is removed.
+	t.Cleanup(app.wg.Wait)
+
+	return app, mr
+}
+
+// newTestUser creates a user and returns them with a valid authentication token.
+func newTestUser(t *testing.T, app *application, phoneNumber string) (*data.User, string) {
+	t.Helper()
+
+	user := &data.User{Name: "Test User", PhoneNumber: phoneNumber}
+	err := app.models.User.Insert(context.Background(), user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := app.models.Token.New(context.Background(), user.ID, time.Hour, data.ScopeAuthentication)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return user, token.Plaintext
+}
+
+// do serves req through the full middleware chain, authenticated with token unless it
+// is empty.
+func do(t *testing.T, app *application, req *http.Request, token string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	rec := httptest.NewRecorder()
+	app.handler(app.routes()).ServeHTTP(rec, req)
+	return rec
+}
+
+// decodeJSON decodes a response body into dst.
+func decodeJSON(t *testing.T, rec *httptest.ResponseRecorder, dst interface{}) {
+	t.Helper()
+
+	err := json.Unmarshal(rec.Body.Bytes(), dst)
+	if err != nil {
+		t.Fatalf("invalid JSON response %q: %v", rec.Body.String(), err)
+	}
+}
+
+// testPNG returns a small PNG image with a gradient, so that it has a perceptual hash.
+func testPNG(t *testing.T) []byte {
+	t.Helper()
+
+	img := image.NewRGBA(image.Rect(0, 0, 32, 32))
+	for y := 0; y < 32; y++ {
+		for x := 0; x < 32; x++ {
+			img.Set(x, y, color.RGBA{uint8(x * 8), uint8(y * 8), 128, 255})
+		}
+	}
+
+	var buf bytes.Buffer
+	err := png.Encode(&buf, img)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
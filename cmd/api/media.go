@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/vishaaxl/cheershare/internal/data"
+	"github.com/vishaaxl/cheershare/internal/imaging"
+	"github.com/vishaaxl/cheershare/internal/storage"
+)
+
+const (
+	// renditionPrefix is the storage prefix of renditions.
+	renditionPrefix = "renditions/"
+	// conversionTimeout bounds the conversion of one file.
+	conversionTimeout = 2 * time.Minute
+)
+
+var (
+	// conversionSlots bounds the conversions running at once, as each holds a decoded
+	// image in memory.
+	conversionSlots = make(chan struct{}, 2)
+	// pendingConversions holds the digests of the blobs being converted, so that a blob
+	// requested many times before its rendition is saved is converted once.
+	pendingConversions sync.Map
+)
+
+/*
+convertible reports whether the file stored under key is converted to WebP. Only PNG
+files are: WebP renditions are lossless, so they would rarely be smaller than JPEG
+files, and GIF files may be animated.
+*/
+func convertible(key string) bool {
+	return strings.ToLower(path.Ext(key)) == ".png"
+}
+
+// renditionKey returns the storage key of the rendition of a blob in format.
+func renditionKey(sum, format string) string {
+	return renditionPrefix + sum[:2] + "/" + sum + "." + format
+}
+
+// queueConversion converts the file of creative to WebP in the background, unless it
+// cannot be converted or is already being converted. Failures are only logged.
+func (app *application) queueConversion(creative *data.Creative) {
+	sum := creative.SHA256
+	key, ok := app.storageKey(creative)
+	if sum == "" || !ok || !convertible(key) {
+		return
+	}
+
+	if _, pending := pendingConversions.LoadOrStore(sum, true); pending {
+		return
+	}
+
+	app.background(func() {
+		defer pendingConversions.Delete(sum)
+
+		conversionSlots <- struct{}{}
+		defer func() { <-conversionSlots }()
+
+		ctx, cancel := context.WithTimeout(context.Background(), conversionTimeout)
+		defer cancel()
+
+		err := app.convertBlob(ctx, sum, key)
+		if err != nil {
+			app.logger.ErrorContext(ctx, "failed to convert creative", "sha256", sum, "error", err)
+		}
+	})
+}
+
+/*
+convertBlob saves the WebP rendition of the blob with the given digest, stored under key,
+unless it already has one. The rendition is only stored if it is smaller than the blob.
+*/
+func (app *application) convertBlob(ctx context.Context, sum, key string) error {
+	_, err := app.models.Rendition.Get(ctx, sum, data.RenditionWebP)
+	if err == nil || !errors.Is(err, data.ErrRecordNotFound) {
+		return err
+	}
+
+	ctx, span := tracer.Start(ctx, "imaging.EncodeWebP")
+	defer span.End()
+
+	rc, err := app.storage.Open(ctx, key)
+	if err != nil {
+		return err
+	}
+	content, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return err
+	}
+
+	rendition := &data.Rendition{SHA256: sum, Format: data.RenditionWebP}
+
+	img, err := imaging.Decode(bytes.NewReader(content))
+	switch {
+	case errors.Is(err, imaging.ErrTooLarge):
+		// Recorded without a file so that the blob is not decoded again.
+	case err != nil:
+		return err
+	default:
+		var buf bytes.Buffer
+		err = imaging.EncodeWebP(&buf, img)
+		if err != nil {
+			return err
+		}
+
+		rendition.SizeBytes = int64(buf.Len())
+		if buf.Len() < len(content) {
+			rendition.Key = renditionKey(sum, data.RenditionWebP)
+			_, err = app.storage.Put(ctx, rendition.Key, &buf)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	/*
+		The key is derived from the digest, so a concurrent conversion of the same blob
+		stores the same file there. If the rendition cannot be recorded its file is left
+		to the garbage collector rather than deleted from under such a conversion.
+	*/
+	err = app.models.Rendition.Insert(ctx, rendition)
+	if errors.Is(err, data.ErrRecordNotFound) {
+		// The blob was collected while it was being converted.
+		return nil
+	}
+	return err
+}
+
+/*
+getCreativeMediaHandler serves the image of a creative. Users can fetch their own
+creatives and those on the schedule. Clients that accept WebP at least as well as the
+original format, and name it explicitly, get the WebP rendition of PNG files once it
+has been made; others get the original file. Responses vary with the Accept header and
+their ETag names the representation served.
+
+Files stored before renditions were made are converted the first time they are
+requested, and served as is until then. If the owner has a watermark, the file served is
+a copy with their logo drawn on (see watermarkedMedia).
+*/
+func (app *application) getCreativeMediaHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	creative, ok := app.visibleCreative(w, r, func(creative *data.Creative) bool {
+		return creative.UserID == user.ID || onSchedule(creative, time.Now())
+	})
+	if !ok {
+		return
+	}
+
+	key, ok := app.storageKey(creative)
+	if !ok {
+		app.errorResponse(w, http.StatusNotFound, "the file of this creative is not available")
+		return
+	}
+	contentType := mime.TypeByExtension(strings.ToLower(path.Ext(key)))
+
+	if creative.SHA256 != "" && convertible(key) {
+		w.Header().Add("Vary", "Accept")
+
+		rendition, err := app.models.Rendition.Get(r.Context(), creative.SHA256, data.RenditionWebP)
+		switch {
+		case errors.Is(err, data.ErrRecordNotFound):
+			app.queueConversion(creative)
+		case err != nil:
+			app.logger.ErrorContext(r.Context(), "failed to fetch rendition", "sha256", creative.SHA256, "error", err)
+		case rendition.Key != "" && prefersWebP(r.Header.Get("Accept"), contentType):
+			key, contentType = rendition.Key, "image/webp"
+		}
+	}
+
+	wm, err := app.models.Watermark.Get(r.Context(), creative.UserID)
+	switch {
+	case errors.Is(err, data.ErrRecordNotFound):
+	case err != nil:
+		app.logger.ErrorContext(r.Context(), "failed to fetch watermark", "error", err)
+		app.errorResponse(w, http.StatusInternalServerError, "failed to fetch creative file")
+		return
+	default:
+		key, contentType, err = app.watermarkedMedia(r.Context(), creative, key, contentType, wm)
+		if err != nil {
+			if errors.Is(err, storage.ErrNotFound) {
+				app.errorResponse(w, http.StatusNotFound, "the file of this creative is not available")
+				return
+			}
+			app.logger.ErrorContext(r.Context(), "failed to watermark creative", "creative_id", creative.ID, "error", err)
+			app.errorResponse(w, http.StatusInternalServerError, "failed to fetch creative file")
+			return
+		}
+	}
+
+	rc, err := app.storage.Open(r.Context(), key)
+	if err != nil {
+		if errors.Is(err, storage.ErrNotFound) {
+			app.errorResponse(w, http.StatusNotFound, "the file of this creative is not available")
+			return
+		}
+		app.logger.ErrorContext(r.Context(), "failed to open creative file", "key", key, "error", err)
+		app.errorResponse(w, http.StatusInternalServerError, "failed to fetch creative file")
+		return
+	}
+	defer rc.Close()
+
+	etag := `"` + path.Base(key) + `"`
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+
+	if content, ok := rc.(io.ReadSeeker); ok {
+		http.ServeContent(w, r, "", time.Time{}, content)
+		return
+	}
+
+	// Files that cannot seek are streamed whole, without range requests, rather than
+	// read into memory.
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if obj, err := app.storage.Stat(r.Context(), key); err == nil {
+		w.Header().Set("Content-Length", strconv.FormatInt(obj.Size, 10))
+	} else {
+		app.logger.WarnContext(r.Context(), "failed to stat creative file", "key", key, "error", err)
+	}
+	w.WriteHeader(http.StatusOK)
+	if r.Method == http.MethodHead {
+		return
+	}
+
+	_, err = io.Copy(w, rc)
+	if err != nil {
+		app.logger.ErrorContext(r.Context(), "failed to stream creative file", "key", key, "error", err)
+	}
+}
+
+/*
+watermarkedMedia returns the key and content type of a copy of the file of creative with
+the watermark wm drawn on, given the key and content type of the file that would be
+served without it. Copies are made from the original file on first request and stored
+under renderPrefix, like renders, so the file itself is never modified. They are
+encoded as WebP if the file served would be the WebP rendition, as JPEG for JPEG files
+and as PNG otherwise, so GIF files lose their animation. Their key names the version of
+the watermark, so that the ETag of the media changes with it.
+*/
+func (app *application) watermarkedMedia(ctx context.Context, creative *data.Creative, key, contentType string, wm *data.Watermark) (string, string, error) {
+	ext := ".png"
+	switch {
+	case contentType == "image/webp":
+		ext = ".webp"
+	case isJPEG(key):
+		ext, contentType = ".jpg", "image/jpeg"
+	default:
+		contentType = "image/png"
+	}
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%g\x00%g", key, wm.LogoKey, wm.Position, wm.Opacity, wm.Scale)
+	variant := fmt.Sprintf("%s%d/%s-w%d%s", renderPrefix, creative.ID, hex.EncodeToString(h.Sum(nil))[:32], wm.Version, ext)
+
+	_, err := app.storage.Stat(ctx, variant)
+	if err == nil || !errors.Is(err, storage.ErrNotFound) {
+		return variant, contentType, err
+	}
+
+	ctx, span := tracer.Start(ctx, "imaging.DrawWatermark")
+	defer span.End()
+
+	img, err := app.decodeCreative(ctx, creative)
+	if err != nil {
+		return "", "", err
+	}
+	logo, err := app.loadLogo(ctx, wm)
+	if err != nil {
+		return "", "", err
+	}
+
+	canvas := image.NewRGBA(img.Bounds())
+	draw.Draw(canvas, canvas.Bounds(), img, img.Bounds().Min, draw.Src)
+	drawWatermark(canvas, wm, logo)
+
+	var buf bytes.Buffer
+	switch ext {
+	case ".webp":
+		err = imaging.EncodeWebP(&buf, canvas)
+	case ".jpg":
+		err = jpeg.Encode(&buf, canvas, &jpeg.Options{Quality: 90})
+	default:
+		err = png.Encode(&buf, canvas)
+	}
+	if err != nil {
+		return "", "", err
+	}
+
+	_, err = app.storage.Put(ctx, variant, &buf)
+	if err != nil {
+		return "", "", err
+	}
+
+	return variant, contentType, nil
+}
+
+// prefersWebP reports whether an Accept header prefers WebP over the original content
+// type. Ties go to WebP only if the header names it, as "*/*" does not mean that the
+// client can decode it.
+func prefersWebP(accept, original string) bool {
+	webp, explicit := acceptQuality(accept, "image/webp")
+	other, _ := acceptQuality(accept, original)
+	return webp > 0 && (webp > other || webp == other && explicit)
+}
+
+/*
+acceptQuality returns the quality an Accept header gives to contentType, taken from the
+most specific media range matching it, and whether that range names it exactly. A
+missing header accepts everything.
+*/
+func acceptQuality(accept, contentType string) (float64, bool) {
+	if strings.TrimSpace(accept) == "" {
+		return 1, false
+	}
+
+	mainType, _, _ := strings.Cut(contentType, "/")
+
+	quality, specificity := 0.0, -1
+	for _, item := range strings.Split(accept, ",") {
+		params := strings.Split(item, ";")
+		mediaRange := strings.ToLower(strings.TrimSpace(params[0]))
+
+		var s int
+		switch mediaRange {
+		case contentType:
+			s = 2
+		case mainType + "/*":
+			s = 1
+		case "*/*":
+			s = 0
+		default:
+			continue
+		}
+		if s <= specificity {
+			continue
+		}
+
+		q := 1.0
+		for _, param := range params[1:] {
+			name, value, _ := strings.Cut(param, "=")
+			if strings.EqualFold(strings.TrimSpace(name), "q") {
+				v, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+				if err != nil || v < 0 || v > 1 {
+					v = 0
+				}
+				q = v
+			}
+		}
+
+		quality, specificity = q, s
+	}
+
+	return quality, specificity == 2
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/vishaaxl/cheershare/internal/data"
+	"github.com/vishaaxl/cheershare/internal/storage"
+)
+
+func TestAcceptQuality(t *testing.T) {
+	tests := []struct {
+		name         string
+		accept       string
+		contentType  string
+		wantQuality  float64
+		wantExplicit bool
+	}{
+		{"missing header", "", "image/webp", 1, false},
+		{"exact match", "image/webp", "image/webp", 1, true},
+		{"not listed", "image/png", "image/webp", 0, false},
+		{"type wildcard", "image/*;q=0.8", "image/webp", 0.8, false},
+		{"any", "*/*;q=0.5", "image/webp", 0.5, false},
+		{"exact beats type wildcard", "image/*;q=0.8, image/webp;q=0.2", "image/webp", 0.2, true},
+		{"type wildcard beats any", "*/*;q=0.1, image/*;q=0.7", "image/webp", 0.7, false},
+		{"specific range refuses", "image/webp;q=0, */*", "image/webp", 0, true},
+		{"case insensitive", "Image/WebP;Q=0.9", "image/webp", 0.9, true},
+		{"invalid quality", "image/webp;q=2", "image/webp", 0, true},
+		{"other parameters", "image/webp;level=1;q=0.6", "image/webp", 0.6, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			quality, explicit := acceptQuality(tt.accept, tt.contentType)
+			if quality != tt.wantQuality || explicit != tt.wantExplicit {
+				t.Errorf("acceptQuality(%q, %q) = %v, %v, want %v, %v",
+					tt.accept, tt.contentType, quality, explicit, tt.wantQuality, tt.wantExplicit)
+			}
+		})
+	}
+}
+
+func TestPrefersWebP(t *testing.T) {
+	tests := []struct {
+		name   string
+		accept string
+		want   bool
+	}{
+		{"missing header", "", false},
+		{"any", "*/*", false},
+		{"image wildcard", "image/*", false},
+		{"browser header", "image/avif,image/webp,image/apng,image/*,*/*;q=0.8", true},
+		{"tie named explicitly", "image/webp, image/png", true},
+		{"higher quality", "image/webp;q=0.9, image/png;q=0.5", true},
+		{"lower quality", "image/webp;q=0.5, image/png", false},
+		{"refused", "image/webp;q=0, */*", false},
+		{"only webp", "image/webp", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := prefersWebP(tt.accept, "image/png"); got != tt.want {
+				t.Errorf("prefersWebP(%q) = %v, want %v", tt.accept, got, tt.want)
+			}
+		})
+	}
+}
+
+// unseekableStorage hides the io.Seeker of opened files, as a streaming backend would.
+type unseekableStorage struct {
+	storage.Storage
+}
+
+func (s unseekableStorage) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	rc, err := s.Storage.Open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{rc, rc}, nil
+}
+
+func TestCreativeMediaStreamsUnseekableFiles(t *testing.T) {
+	app, _ := newTestApplication(t)
+	_, token := newTestUser(t, app, "9876543210")
+	file := testPNG(t)
+
+	rec := do(t, app, uploadRequest(t, map[string]string{"scheduled_at": tomorrow()}, file), token)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("upload: status = %d: %s", rec.Code, rec.Body)
+	}
+	var body struct {
+		Creative struct {
+			ID int64 `json:"id"`
+		} `json:"creative"`
+	}
+	decodeJSON(t, rec, &body)
+	app.wg.Wait()
+
+	app.storage = unseekableStorage{app.storage}
+	target := "/v1/creatives/" + strconv.FormatInt(body.Creative.ID, 10) + "/media"
+
+	rec = do(t, app, httptest.NewRequest(http.MethodGet, target, nil), token)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	if got := rec.Header().Get("Content-Length"); got != strconv.Itoa(len(file)) {
+		t.Errorf("Content-Length = %s, want %d", got, len(file))
+	}
+	if rec.Body.String() != string(file) {
+		t.Errorf("served %d bytes differing from the %d uploaded", rec.Body.Len(), len(file))
+	}
+
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	req.Header.Set("If-None-Match", rec.Header().Get("ETag"))
+	rec = do(t, app, req, token)
+	if rec.Code != http.StatusNotModified || rec.Body.Len() != 0 {
+		t.Errorf("revalidation: status = %d with %d bytes, want an empty 304", rec.Code, rec.Body.Len())
+	}
+}
+
+func TestCreativeMediaDrawsWatermark(t *testing.T) {
+	app, _ := newTestApplication(t)
+	user, token := newTestUser(t, app, "9876543210")
+	file := testPNG(t)
+
+	rec := do(t, app, uploadRequest(t, map[string]string{"scheduled_at": tomorrow()}, file), token)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("upload: status = %d: %s", rec.Code, rec.Body)
+	}
+	var body struct {
+		Creative struct {
+			ID int64 `json:"id"`
+		} `json:"creative"`
+	}
+	decodeJSON(t, rec, &body)
+	app.wg.Wait()
+
+	ctx := context.Background()
+	wm := &data.Watermark{
+		UserID:   user.ID,
+		LogoKey:  watermarkPrefix + strconv.FormatInt(user.ID, 10) + "/logo.png",
+		Position: data.WatermarkBottomRight,
+		Opacity:  1,
+		Scale:    0.5,
+	}
+	_, err := app.storage.Put(ctx, wm.LogoKey, bytes.NewReader(testPNG(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = app.models.Watermark.Upsert(ctx, wm)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target := "/v1/creatives/" + strconv.FormatInt(body.Creative.ID, 10) + "/media"
+	req := httptest.NewRequest(http.MethodGet, target, nil)
+	req.Header.Set("Accept", "image/png")
+	rec = do(t, app, req, token)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "image/png" {
+		t.Errorf("Content-Type = %q, want image/png", got)
+	}
+	if etag := rec.Header().Get("ETag"); !strings.HasSuffix(etag, "-w1.png\"") {
+		t.Errorf("ETag = %s, want one naming watermark version 1", etag)
+	}
+	if bytes.Equal(rec.Body.Bytes(), file) {
+		t.Error("served the original file, want it watermarked")
+	}
+
+	creative, err := app.models.Creative.Get(ctx, body.Creative.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := app.storageKey(creative)
+	rc, err := app.storage.Open(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	stored, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(stored, file) {
+		t.Error("the stored file was modified")
+	}
+
+	err = app.models.Watermark.Upsert(ctx, wm)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec = do(t, app, req, token)
+	if etag := rec.Header().Get("ETag"); !strings.HasSuffix(etag, "-w2.png\"") {
+		t.Errorf("ETag after an update = %s, want one naming watermark version 2", etag)
+	}
+}
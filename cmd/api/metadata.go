@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/vishaaxl/cheershare/internal/data"
+)
+
+const (
+	// maxTitleLength, maxCaptionLength and maxAltTextLength are the maximum number of
+	// characters in each text field of a creative.
+	maxTitleLength   = 200
+	maxCaptionLength = 1000
+	maxAltTextLength = 1000
+	// maxTags is the maximum number of tags on a creative, and maxTagLength the maximum
+	// number of characters in each.
+	maxTags      = 10
+	maxTagLength = 32
+)
+
+// allowedLanguages are the languages a creative can be written in, as ISO 639-1 codes.
+var allowedLanguages = map[string]bool{
+	"ar": true, "bn": true, "de": true, "en": true, "es": true, "fr": true,
+	"gu": true, "hi": true, "id": true, "it": true, "ja": true, "kn": true,
+	"ko": true, "ml": true, "mr": true, "nl": true, "pa": true, "pt": true,
+	"ru": true, "ta": true, "te": true, "tr": true, "ur": true, "zh": true,
+}
+
+/*
+creativeMetadata describes what a creative shows, as accepted by the upload, update and
+bulk upload endpoints. Every field is optional.
+*/
+type creativeMetadata struct {
+	Title    string
+	Caption  string
+	Language string
+	AltText  string
+	Tags     []string
+}
+
+// metadataOf returns the metadata of creative.
+func metadataOf(creative *data.Creative) creativeMetadata {
+	return creativeMetadata{
+		Title:    creative.Title,
+		Caption:  creative.Caption,
+		Language: creative.Language,
+		AltText:  creative.AltText,
+		Tags:     creative.Tags,
+	}
+}
+
+/*
+validate checks the metadata against the length limits and the allowed languages, and
+normalises it: text is trimmed, the language is written as "en" or "en-GB", and tags are
+normalised by normalizeTags. The error describes the first problem found.
+*/
+func (m *creativeMetadata) validate() error {
+	m.Title = strings.TrimSpace(m.Title)
+	m.Caption = strings.TrimSpace(m.Caption)
+	m.AltText = strings.TrimSpace(m.AltText)
+
+	switch {
+	case utf8.RuneCountInString(m.Title) > maxTitleLength:
+		return fmt.Errorf("title must not be more than %d characters long", maxTitleLength)
+	case utf8.RuneCountInString(m.Caption) > maxCaptionLength:
+		return fmt.Errorf("caption must not be more than %d characters long", maxCaptionLength)
+	case utf8.RuneCountInString(m.AltText) > maxAltTextLength:
+		return fmt.Errorf("alt_text must not be more than %d characters long", maxAltTextLength)
+	}
+
+	language, err := normalizeLanguage(m.Language)
+	if err != nil {
+		return err
+	}
+	m.Language = language
+
+	tags, err := normalizeTags(m.Tags)
+	if err != nil {
+		return err
+	}
+	m.Tags = tags
+
+	return nil
+}
+
+// apply sets the metadata of creative.
+func (m creativeMetadata) apply(creative *data.Creative) {
+	creative.Title = m.Title
+	creative.Caption = m.Caption
+	creative.Language = m.Language
+	creative.AltText = m.AltText
+	creative.Tags = m.Tags
+}
+
+// normalizeLanguage checks a language tag made of an allowed language and an optional
+// two letter region, e.g. "en" or "en-GB", and returns it in canonical case. The empty
+// string is returned unchanged.
+func normalizeLanguage(tag string) (string, error) {
+	tag = strings.TrimSpace(tag)
+	if tag == "" {
+		return "", nil
+	}
+
+	base, region, hasRegion := strings.Cut(strings.ReplaceAll(tag, "_", "-"), "-")
+	base = strings.ToLower(base)
+
+	if !allowedLanguages[base] {
+		return "", fmt.Errorf("language %q is not supported", tag)
+	}
+	if !hasRegion {
+		return base, nil
+	}
+
+	if len(region) != 2 || !isASCIILetters(region) {
+		return "", errors.New("language must be an ISO 639-1 code, optionally followed by a two letter region, e.g. en or en-GB")
+	}
+	return base + "-" + strings.ToUpper(region), nil
+}
+
+func isASCIILetters(s string) bool {
+	for _, r := range s {
+		if (r < 'a' || r > 'z') && (r < 'A' || r > 'Z') {
+			return false
+		}
+	}
+	return true
+}
+
+// normalizeTags trims and lower-cases tags and drops duplicates. Tags may only contain
+// letters, digits, '-' and '_'.
+func normalizeTags(tags []string) ([]string, error) {
+	normalized := make([]string, 0, len(tags))
+	seen := make(map[string]bool, len(tags))
+
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag == "" || seen[tag] {
+			continue
+		}
+
+		if utf8.RuneCountInString(tag) > maxTagLength {
+			return nil, fmt.Errorf("tags must not be more than %d characters long", maxTagLength)
+		}
+		for _, r := range tag {
+			if !unicode.IsLetter(r) && !unicode.IsDigit(r) && r != '-' && r != '_' {
+				return nil, fmt.Errorf("tag %q may only contain letters, digits, '-' and '_'", tag)
+			}
+		}
+
+		seen[tag] = true
+		normalized = append(normalized, tag)
+	}
+
+	if len(normalized) > maxTags {
+		return nil, fmt.Errorf("a creative can have at most %d tags", maxTags)
+	}
+
+	return normalized, nil
+}
+
+// splitTags splits lists of tags separated by commas or semicolons, as sent in form
+// fields, query parameters and CSV manifests.
+func splitTags(lists ...string) []string {
+	var tags []string
+	for _, list := range lists {
+		tags = append(tags, strings.FieldsFunc(list, func(r rune) bool { return r == ',' || r == ';' })...)
+	}
+	return tags
+}
+
+// hasTags reports whether creative has every one of tags.
+func hasTags(creative data.Creative, tags []string) bool {
+	for _, tag := range tags {
+		found := false
+		for _, t := range creative.Tags {
+			if t == tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
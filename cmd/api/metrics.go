@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/julienschmidt/httprouter"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/vishaaxl/cheershare/internal/data"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// metricsNamespace prefixes every metric exported by the application.
+const metricsNamespace = "cheershare"
+
+// unmatchedRoute is the route label used for requests that did not match any route,
+// so that scanners probing random paths cannot blow up the label cardinality.
+const unmatchedRoute = "unmatched"
+
+/*
+metrics holds the Prometheus collectors updated by the application.
+A dedicated registry is used (rather than the global default) so that only the
+metrics registered here are exposed on /metrics.
+*/
+type metrics struct {
+	registry *prometheus.Registry
+
+	httpRequests *prometheus.CounterVec
+	httpDuration *prometheus.HistogramVec
+
+	otpSent       prometheus.Counter
+	otpVerified   prometheus.Counter
+	otpFailed     *prometheus.CounterVec
+	twilioLatency *prometheus.HistogramVec
+
+	backgroundJobs prometheus.Gauge
+
+	gcRuns       *prometheus.CounterVec
+	gcDuration   prometheus.Histogram
+	gcDeleted    prometheus.Counter
+	gcBytesFreed prometheus.Counter
+}
+
+/*
+newMetrics creates and registers all collectors, including the Go runtime and process
+collectors, sql.DB pool statistics and Redis pool statistics.
+*/
+func newMetrics(db *sql.DB, rdb *redis.Client) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		httpRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_requests_total",
+			Help:      "Number of HTTP requests served, by route, method and status code.",
+		}, []string{"route", "method", "status"}),
+		httpDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "http_request_duration_seconds",
+			Help:      "Time taken to serve HTTP requests, by route and method.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"route", "method"}),
+		otpSent: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "otp_sent_total",
+			Help:      "Number of OTPs successfully delivered to the SMS provider.",
+		}),
+		otpVerified: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "otp_verified_total",
+			Help:      "Number of OTPs successfully verified.",
+		}),
+		otpFailed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "otp_failed_total",
+			Help:      "Number of OTP failures, by stage (send or verify).",
+		}, []string{"stage"}),
+		twilioLatency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "twilio_request_duration_seconds",
+			Help:      "Latency of Twilio message delivery requests, by outcome.",
+			Buckets:   []float64{.05, .1, .25, .5, 1, 2.5, 5, 10},
+		}, []string{"outcome"}),
+		backgroundJobs: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "background_jobs",
+			Help:      "Number of background jobs queued or running.",
+		}),
+		gcRuns: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "gc_runs_total",
+			Help:      "Number of orphaned upload collections, by outcome.",
+		}, []string{"outcome"}),
+		gcDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "gc_run_duration_seconds",
+			Help:      "Time taken by orphaned upload collections.",
+			Buckets:   []float64{.1, .5, 1, 5, 15, 60, 300},
+		}),
+		gcDeleted: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "gc_deleted_objects_total",
+			Help:      "Number of orphaned uploads deleted.",
+		}),
+		gcBytesFreed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "gc_freed_bytes_total",
+			Help:      "Total size of the orphaned uploads deleted.",
+		}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.httpRequests,
+		m.httpDuration,
+		m.otpSent,
+		m.otpVerified,
+		m.otpFailed,
+		m.twilioLatency,
+		m.backgroundJobs,
+		m.gcRuns,
+		m.gcDuration,
+		m.gcDeleted,
+		m.gcBytesFreed,
+	)
+
+	if db != nil {
+		m.registry.MustRegister(collectors.NewDBStatsCollector(db, "postgres"))
+	}
+	if rdb != nil {
+		m.registry.MustRegister(newRedisPoolCollector(rdb))
+	}
+
+	return m
+}
+
+// registerTokenCache exports the number of token lookups served by each layer of the
+// token cache, from which its hit rate is derived.
+func (m *metrics) registerTokenCache(cache *data.TokenCache) {
+	lookups := func(result string, value func(data.TokenCacheStats) uint64) prometheus.CounterFunc {
+		return prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace:   metricsNamespace,
+			Name:        "token_cache_lookups_total",
+			Help:        "Number of authentication token lookups, by the cache layer that served them (local, redis or miss).",
+			ConstLabels: prometheus.Labels{"result": result},
+		}, func() float64 { return float64(value(cache.Stats())) })
+	}
+
+	m.registry.MustRegister(
+		lookups("local", func(s data.TokenCacheStats) uint64 { return s.LocalHits }),
+		lookups("redis", func(s data.TokenCacheStats) uint64 { return s.RedisHits }),
+		lookups("miss", func(s data.TokenCacheStats) uint64 { return s.Misses }),
+	)
+}
+
+// handler returns the HTTP handler serving the registry in the Prometheus text format.
+func (m *metrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// routeTagContextKey is the key under which the metrics middleware stores a *routeTag.
+const routeTagContextKey = contextKey("cheershare.route")
+
+/*
+routeTag is filled in by the matched route handler so that the metrics middleware,
+which wraps the whole router, can label requests with the route pattern rather than
+the raw path.
+*/
+type routeTag struct {
+	pattern string
+}
+
+/*
+handle registers a handler on the router and records its pattern in the request's
+routeTag when it is invoked, and names the request's trace span after it. It also
+applies the route's deadline budget (see budgetConfig) to the request context. All
+routes must be registered through this helper, or handleSegment, so that their metrics,
+traces and deadlines are set correctly.
+*/
+func (app *application) handle(router *httprouter.Router, method, pattern string, handler http.HandlerFunc) {
+	router.HandlerFunc(method, pattern, app.route(method, pattern, handler))
+}
+
+/*
+handleSegment registers a route with a static segment, such as /v1/creatives/search,
+under the wildcard pattern holding it, e.g. /v1/creatives/:id, because httprouter
+cannot register a static segment next to a wildcard one. The handler is only served
+when the parameter name is value, under the static route for its metrics, trace and
+deadline; other values are answered with 404 Not Found, as unmatched requests.
+*/
+func (app *application) handleSegment(router *httprouter.Router, method, pattern, name, value string, handler http.HandlerFunc) {
+	route := app.route(method, strings.Replace(pattern, ":"+name, value, 1), handler)
+
+	router.HandlerFunc(method, pattern, func(w http.ResponseWriter, r *http.Request) {
+		if httprouter.ParamsFromContext(r.Context()).ByName(name) != value {
+			app.errorResponse(w, http.StatusNotFound, "not found")
+			return
+		}
+		route(w, r)
+	})
+}
+
+// route wraps handler with the route tag, span name and deadline of the route pattern.
+func (app *application) route(method, pattern string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if tag, ok := r.Context().Value(routeTagContextKey).(*routeTag); ok {
+			tag.pattern = pattern
+		}
+
+		span := trace.SpanFromContext(r.Context())
+		span.SetName(method + " " + pattern)
+		span.SetAttributes(semconv.HTTPRoute(pattern))
+
+		ctx, cancel := context.WithTimeout(r.Context(), app.config.budgets.forRoute(pattern))
+		defer cancel()
+
+		handler(w, r.WithContext(ctx))
+	}
+}
+
+// recordMetrics observes the count and duration of every request, labelled by route,
+// method and status code.
+func (app *application) recordMetrics(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		tag := &routeTag{pattern: unmatchedRoute}
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		r = r.WithContext(context.WithValue(r.Context(), routeTagContextKey, tag))
+		next.ServeHTTP(rec, r)
+
+		app.metrics.httpRequests.WithLabelValues(tag.pattern, r.Method, strconv.Itoa(rec.status)).Inc()
+		app.metrics.httpDuration.WithLabelValues(tag.pattern, r.Method).Observe(time.Since(start).Seconds())
+	})
+}
+
+/*
+redisPoolCollector exports the go-redis connection pool statistics. The pool keeps
+cumulative counters itself, so they are read on every scrape rather than mirrored.
+*/
+type redisPoolCollector struct {
+	client *redis.Client
+
+	hits       *prometheus.Desc
+	misses     *prometheus.Desc
+	timeouts   *prometheus.Desc
+	totalConns *prometheus.Desc
+	idleConns  *prometheus.Desc
+	staleConns *prometheus.Desc
+}
+
+func newRedisPoolCollector(client *redis.Client) *redisPoolCollector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc(prometheus.BuildFQName(metricsNamespace, "redis_pool", name), help, nil, nil)
+	}
+
+	return &redisPoolCollector{
+		client:     client,
+		hits:       desc("hits_total", "Number of times a free connection was found in the pool."),
+		misses:     desc("misses_total", "Number of times a free connection was not found in the pool."),
+		timeouts:   desc("timeouts_total", "Number of times a wait for a connection timed out."),
+		totalConns: desc("total_connections", "Number of connections in the pool."),
+		idleConns:  desc("idle_connections", "Number of idle connections in the pool."),
+		staleConns: desc("stale_connections_total", "Number of stale connections removed from the pool."),
+	}
+}
+
+func (c *redisPoolCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.hits
+	ch <- c.misses
+	ch <- c.timeouts
+	ch <- c.totalConns
+	ch <- c.idleConns
+	ch <- c.staleConns
+}
+
+func (c *redisPoolCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := c.client.PoolStats()
+
+	ch <- prometheus.MustNewConstMetric(c.hits, prometheus.CounterValue, float64(stats.Hits))
+	ch <- prometheus.MustNewConstMetric(c.misses, prometheus.CounterValue, float64(stats.Misses))
+	ch <- prometheus.MustNewConstMetric(c.timeouts, prometheus.CounterValue, float64(stats.Timeouts))
+	ch <- prometheus.MustNewConstMetric(c.totalConns, prometheus.GaugeValue, float64(stats.TotalConns))
+	ch <- prometheus.MustNewConstMetric(c.idleConns, prometheus.GaugeValue, float64(stats.IdleConns))
+	ch <- prometheus.MustNewConstMetric(c.staleConns, prometheus.CounterValue, float64(stats.StaleConns))
+}
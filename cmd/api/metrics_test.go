@@ -0,0 +1,64 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+func TestHandleSegmentLabelsStaticRoute(t *testing.T) {
+	app, _ := newTestApplication(t)
+	app.config.budgets.routes = map[string]time.Duration{"/v1/creatives/search": time.Minute}
+
+	var budget time.Duration
+	router := httprouter.New()
+	app.handleSegment(router, http.MethodGet, "/v1/creatives/:id", "id", "search", func(w http.ResponseWriter, r *http.Request) {
+		deadline, _ := r.Context().Deadline()
+		budget = time.Until(deadline)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	tests := []struct {
+		target string
+		status int
+		route  string
+	}{
+		{"/v1/creatives/search", http.StatusNoContent, "/v1/creatives/search"},
+		{"/v1/creatives/42", http.StatusNotFound, unmatchedRoute},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.target, func(t *testing.T) {
+			budget = 0
+			tag := &routeTag{pattern: unmatchedRoute}
+			req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+			req = req.WithContext(context.WithValue(req.Context(), routeTagContextKey, tag))
+
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+
+			if rec.Code != tt.status {
+				t.Fatalf("status = %d, want %d", rec.Code, tt.status)
+			}
+			if tag.pattern != tt.route {
+				t.Errorf("route = %q, want %q", tag.pattern, tt.route)
+			}
+
+			if tt.status == http.StatusNotFound {
+				var body struct {
+					Error string `json:"error"`
+				}
+				decodeJSON(t, rec, &body)
+				if body.Error == "" {
+					t.Error("404 without the JSON error envelope")
+				}
+			} else if budget < 30*time.Second {
+				t.Errorf("deadline in %s, want the static route's budget", budget)
+			}
+		})
+	}
+}
@@ -1,17 +1,109 @@
 package main
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/vishaaxl/cheershare/internal/data"
 )
 
+// maxRequestIDLength bounds the size of a client supplied X-Request-ID header.
+const maxRequestIDLength = 128
+
+// requestID propagates the caller's X-Request-ID header, or generates a new ID when the
+// header is missing or malformed. The ID is echoed back in the response headers and stored
+// in the request context so that it is attached to every log line for the request.
+func (app *application) requestID(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get("X-Request-ID")
+		if !isValidRequestID(id) {
+			id = uuid.NewString()
+		}
+
+		w.Header().Set("X-Request-ID", id)
+		r = app.contextSetRequestID(r, id)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// isValidRequestID accepts short IDs made of characters that are safe to log and echo.
+func isValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for _, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '_', c == '.', c == ':':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
+
+// statusRecorder wraps an http.ResponseWriter to remember the status code and the number
+// of bytes written, which the standard interface does not expose.
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int
+	wroteHeader bool
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if !rec.wroteHeader {
+		rec.status = status
+		rec.wroteHeader = true
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if !rec.wroteHeader {
+		rec.WriteHeader(http.StatusOK)
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += n
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// logRequest writes one structured access log line per request once it has been served.
+func (app *application) logRequest(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(rec, r)
+
+		app.logger.InfoContext(r.Context(), "request completed",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"bytes", rec.bytes,
+			"duration_ms", time.Since(start).Milliseconds(),
+			"remote_addr", r.RemoteAddr,
+		)
+	})
+}
+
 func (app *application) recoverPanic(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
 			if err := recover(); err != nil {
+				app.logger.ErrorContext(r.Context(), "recovered from panic", "error", fmt.Sprint(err))
 				w.Header().Set("Connection", "close")
 				app.errorResponse(w, http.StatusInternalServerError, "Failed to recover")
 			}
@@ -43,24 +135,28 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 
 		headerParts := strings.Split(authorizationHeader, " ")
 		if len(headerParts) != 2 || headerParts[0] != "Bearer" {
-			app.errorResponse(w, http.StatusUnauthorized, "Invalid authorization header")
+			app.authenticationFailedResponse(w, r)
 			return
 		}
 
 		token := headerParts[1]
 		if len(token) != 26 {
-			app.errorResponse(w, http.StatusUnauthorized, "Invalid authorization header")
+			app.authenticationFailedResponse(w, r)
 			return
 		}
 		// validate the token for length and required params
 
-		user, err := app.models.User.GetForToken(data.ScopeAuthentication, token)
+		ctx, cancel := context.WithTimeout(r.Context(), app.config.budgets.auth)
+		defer cancel()
+
+		user, _, err := app.models.User.GetForToken(ctx, data.ScopeAuthentication, token)
 
 		if err != nil {
 			switch {
 			case errors.Is(err, data.ErrRecordNotFound):
-				app.errorResponse(w, http.StatusUnauthorized, "Invalid authorization header")
+				app.authenticationFailedResponse(w, r)
 			default:
+				app.logger.ErrorContext(r.Context(), "failed to look up user for token", "error", err)
 				app.errorResponse(w, http.StatusInternalServerError, "Can't find user for specified token")
 			}
 			return
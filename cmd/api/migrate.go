@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/vishaaxl/cheershare/internal/migrate"
+	"github.com/vishaaxl/cheershare/migrations"
+)
+
+const migrateUsage = `usage: cheershare migrate <command>
+
+commands:
+  up          apply all pending migrations
+  down [N]    roll back the last N migrations (default 1)
+  status      show applied and pending migrations
+  to N        migrate up or down to version N (0 rolls back everything)`
+
+/*
+runMigrateCommand implements the "migrate" subcommand using the migrations embedded in
+the binary. A concurrent run from another replica waits on the advisory lock rather than
+failing, and "no change" is not treated as an error.
+*/
+func runMigrateCommand(ctx context.Context, db *sql.DB, args []string, out io.Writer) error {
+	if len(args) == 0 {
+		return errors.New(migrateUsage)
+	}
+
+	migrator, err := migrate.New(db, migrations.FS)
+	if err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "up":
+		err = migrator.Up(ctx)
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				return fmt.Errorf("invalid number of steps %q", args[1])
+			}
+		}
+		err = migrator.Down(ctx, steps)
+	case "to":
+		if len(args) < 2 {
+			return errors.New(migrateUsage)
+		}
+		version, parseErr := strconv.ParseUint(args[1], 10, 64)
+		if parseErr != nil {
+			return fmt.Errorf("invalid version %q", args[1])
+		}
+		err = migrator.To(ctx, uint(version))
+	case "status":
+		return printMigrationStatus(ctx, migrator, out)
+	default:
+		return errors.New(migrateUsage)
+	}
+
+	if errors.Is(err, migrate.ErrNoChange) {
+		fmt.Fprintln(out, "no change")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return printMigrationStatus(ctx, migrator, out)
+}
+
+func printMigrationStatus(ctx context.Context, migrator *migrate.Migrator, out io.Writer) error {
+	current, statuses, err := migrator.Status(ctx)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(out, "current version: %d\n\n", current)
+
+	tw := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tNAME\tSTATUS")
+	for _, s := range statuses {
+		state := "pending"
+		if s.Applied {
+			state = "applied"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\n", s.Version, s.Name, state)
+	}
+
+	return tw.Flush()
+}
+
+// migrateOnStart applies pending migrations before the server starts serving traffic.
+func migrateOnStart(ctx context.Context, db *sql.DB) error {
+	migrator, err := migrate.New(db, migrations.FS)
+	if err != nil {
+		return err
+	}
+
+	err = migrator.Up(ctx)
+	if errors.Is(err, migrate.ErrNoChange) {
+		return nil
+	}
+	return err
+}
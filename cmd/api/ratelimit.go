@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+)
+
+/*
+rateLimitPolicy describes a token bucket: clients may make up to burst requests at once,
+and regain rate tokens per second after that.
+*/
+type rateLimitPolicy struct {
+	name  string
+	burst int
+	rate  float64
+}
+
+// window returns the time, in seconds, that an empty bucket takes to refill completely.
+func (p rateLimitPolicy) window() int {
+	return int(math.Ceil(float64(p.burst) / p.rate))
+}
+
+/*
+tokenBucketScript implements the bucket atomically in Redis so that all replicas share
+the same limits. The bucket is a hash holding the remaining tokens and the time of the
+last update; it expires once it would have refilled completely. Time is taken from the
+Redis server so replicas with skewed clocks agree.
+
+It returns {allowed, remaining, seconds until full, seconds until next token}.
+*/
+var tokenBucketScript = redis.NewScript(`
+local burst = tonumber(ARGV[1])
+local rate = tonumber(ARGV[2]) / 1000
+
+local time = redis.call("TIME")
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+local state = redis.call("HMGET", KEYS[1], "tokens", "ts")
+local tokens = tonumber(state[1])
+local ts = tonumber(state[2])
+if tokens == nil or ts == nil then
+	tokens = burst
+	ts = now
+end
+
+tokens = math.min(burst, tokens + math.max(0, now - ts) * rate)
+
+local allowed = 0
+local retry = 0
+if tokens >= 1 then
+	tokens = tokens - 1
+	allowed = 1
+else
+	retry = math.ceil((1 - tokens) / rate / 1000)
+end
+
+local full = math.ceil((burst - tokens) / rate)
+redis.call("HSET", KEYS[1], "tokens", tostring(tokens), "ts", now)
+redis.call("PEXPIRE", KEYS[1], full + 1000)
+
+return {allowed, math.floor(tokens), math.ceil(full / 1000), retry}
+`)
+
+// rateLimitResult is the outcome of taking a token from a bucket.
+type rateLimitResult struct {
+	allowed    bool
+	remaining  int64
+	reset      int64
+	retryAfter int64
+}
+
+// takeToken takes one token from the bucket identified by policy and subject.
+func (app *application) takeToken(ctx context.Context, policy rateLimitPolicy, subject string) (rateLimitResult, error) {
+	key := fmt.Sprintf("ratelimit:%s:%s", policy.name, subject)
+
+	values, err := tokenBucketScript.Run(ctx, app.cache, []string{key}, policy.burst, policy.rate).Int64Slice()
+	if err != nil {
+		return rateLimitResult{}, err
+	}
+	if len(values) != 4 {
+		return rateLimitResult{}, fmt.Errorf("unexpected rate limit script result %v", values)
+	}
+
+	return rateLimitResult{
+		allowed:    values[0] == 1,
+		remaining:  values[1],
+		reset:      values[2],
+		retryAfter: values[3],
+	}, nil
+}
+
+/*
+rateLimit applies the named policy to a route. Authenticated users are limited by user
+ID and anonymous requests by client IP, so it must run after the authenticate middleware
+(route handlers always do) and wrap requireAuthenticatedUser, so that anonymous requests
+to protected routes are counted before they are rejected.
+*/
+func (app *application) rateLimit(name string, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		subject := "ip:" + app.clientIP(r)
+		if user := app.contextGetUser(r); !user.IsAnonymous() {
+			subject = "user:" + strconv.FormatInt(user.ID, 10)
+		}
+
+		if app.allow(w, r, name, subject) {
+			next(w, r)
+		}
+	}
+}
+
+/*
+authenticationFailedResponse answers a request whose Authorization header is malformed
+or names no valid token. The failure is charged to the client's IP in the "auth" policy,
+and answered with 401 Unauthorized until the IP has used the policy up, then with 429
+Too Many Requests. Valid tokens are never charged, so the users signed in behind one
+NAT or proxy do not share a bucket.
+*/
+func (app *application) authenticationFailedResponse(w http.ResponseWriter, r *http.Request) {
+	if app.allow(w, r, "auth", "ip:"+app.clientIP(r)) {
+		app.errorResponse(w, http.StatusUnauthorized, "Invalid authorization header")
+	}
+}
+
+/*
+allow takes a token from the subject's bucket of the named policy and reports whether
+the request may proceed; otherwise it has answered 429 Too Many Requests. The
+RateLimit-* headers follow the IETF draft. If Redis is unavailable the request is let
+through: an outage of the limiter should not take the API down with it.
+*/
+func (app *application) allow(w http.ResponseWriter, r *http.Request, name, subject string) bool {
+	if !app.config.limiter.enabled {
+		return true
+	}
+
+	policy, ok := app.config.limiter.policies[name]
+	if !ok {
+		policy = app.config.limiter.policies["default"]
+	}
+
+	result, err := app.takeToken(r.Context(), policy, subject)
+	if err != nil {
+		app.logger.WarnContext(r.Context(), "rate limiter unavailable, allowing request", "policy", policy.name, "error", err)
+		return true
+	}
+
+	w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", policy.burst, policy.window()))
+	w.Header().Set("RateLimit-Limit", strconv.Itoa(policy.burst))
+	w.Header().Set("RateLimit-Remaining", strconv.FormatInt(result.remaining, 10))
+	w.Header().Set("RateLimit-Reset", strconv.FormatInt(result.reset, 10))
+
+	if !result.allowed {
+		w.Header().Set("Retry-After", strconv.FormatInt(result.retryAfter, 10))
+		app.errorResponse(w, http.StatusTooManyRequests, "rate limit exceeded")
+		return false
+	}
+
+	return true
+}
+
+/*
+clientIP returns the address of the client. X-Forwarded-For is only honoured when the
+server is configured to run behind a trusted proxy, and then only its rightmost entry:
+proxies append the address they received the request from to the header, so every
+entry before the one added by our proxy may have been set by the client.
+*/
+func (app *application) clientIP(r *http.Request) string {
+	if app.config.limiter.trustProxy {
+		if forwarded := r.Header.Values("X-Forwarded-For"); len(forwarded) > 0 {
+			entries := strings.Split(forwarded[len(forwarded)-1], ",")
+			if ip := strings.TrimSpace(entries[len(entries)-1]); ip != "" {
+				return ip
+			}
+		}
+	}
+
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// defaultRateLimitPolicies are the policies used unless overridden in config.
+func defaultRateLimitPolicies() map[string]rateLimitPolicy {
+	return map[string]rateLimitPolicy{
+		// Every signup request can trigger an SMS, so keep this one tight:
+		// 5 requests, then one every 3 minutes.
+		"signup": {name: "signup", burst: 5, rate: 1.0 / 180},
+		// Clients poll the schedule, so allow frequent reads.
+		"scheduled": {name: "scheduled", burst: 120, rate: 2},
+		"upload":    {name: "upload", burst: 20, rate: 1.0 / 30},
+		// A resumable upload is sent as many PATCH requests, and retried ones are cheap.
+		"tus": {name: "tus", burst: 120, rate: 2},
+		// Clients fetch the image of every creative on the schedule.
+		"media": {name: "media", burst: 120, rate: 2},
+		// Rendering a personalised creative decodes and encodes the whole image.
+		"render": {name: "render", burst: 30, rate: 0.5},
+		// Charged by client IP for every malformed or unknown token, to stop token
+		// guessing. Valid tokens are not charged.
+		"auth":    {name: "auth", burst: 300, rate: 10},
+		"default": {name: "default", burst: 60, rate: 1},
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenBucketScript(t *testing.T) {
+	app, mr := newTestApplication(t)
+	ctx := context.Background()
+
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	mr.SetTime(now)
+
+	policy := rateLimitPolicy{name: "test", burst: 3, rate: 1}
+
+	for i, want := range []rateLimitResult{
+		{allowed: true, remaining: 2, reset: 1},
+		{allowed: true, remaining: 1, reset: 2},
+		{allowed: true, remaining: 0, reset: 3},
+		{allowed: false, remaining: 0, reset: 3, retryAfter: 1},
+	} {
+		got, err := app.takeToken(ctx, policy, "user:1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != want {
+			t.Errorf("request %d: got %+v, want %+v", i+1, got, want)
+		}
+	}
+
+	// Buckets are per subject.
+	got, err := app.takeToken(ctx, policy, "user:2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.allowed || got.remaining != 2 {
+		t.Errorf("other subject: got %+v, want a full bucket", got)
+	}
+
+	// Tokens are regained at rate per second, up to burst.
+	mr.SetTime(now.Add(1500 * time.Millisecond))
+	got, err = app.takeToken(ctx, policy, "user:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.allowed || got.remaining != 0 {
+		t.Errorf("after 1.5s: got %+v, want allowed with 0.5 tokens left", got)
+	}
+
+	mr.SetTime(now.Add(time.Hour))
+	got, err = app.takeToken(ctx, policy, "user:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.allowed || got.remaining != 2 {
+		t.Errorf("after an hour: got %+v, want a full bucket", got)
+	}
+
+	// The bucket expires once it would have refilled completely.
+	ttl := mr.TTL("ratelimit:test:user:1")
+	if ttl <= 0 || ttl > time.Duration(policy.window()+1)*time.Second {
+		t.Errorf("bucket TTL = %v, want at most the policy window", ttl)
+	}
+}
+
+func TestRateLimitAppliesBeforeAuthentication(t *testing.T) {
+	app, _ := newTestApplication(t)
+	app.config.limiter.enabled = true
+	app.config.limiter.policies["scheduled"] = rateLimitPolicy{name: "scheduled", burst: 2, rate: 0.001}
+	app.config.limiter.policies["auth"] = rateLimitPolicy{name: "auth", burst: 2, rate: 0.001}
+
+	_, token := newTestUser(t, app, "9876543210")
+	invalidToken := strings.Repeat("A", 26)
+
+	tests := []struct {
+		name  string
+		token string
+		want  []int
+	}{
+		// Anonymous requests to a protected route count against the route's IP bucket.
+		{"anonymous", "", []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests}},
+		// Unknown tokens are charged to the IP's auth bucket.
+		{"invalid token", invalidToken, []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for i, want := range tt.want {
+				req := httptest.NewRequest(http.MethodGet, "/scheduled", nil)
+				req.RemoteAddr = "192.0.2.1:1234"
+
+				rec := do(t, app, req, tt.token)
+				if rec.Code != want {
+					t.Errorf("request %d: status = %d, want %d", i+1, rec.Code, want)
+				}
+				if want == http.StatusTooManyRequests && rec.Header().Get("Retry-After") == "" {
+					t.Errorf("request %d: missing Retry-After", i+1)
+				}
+			}
+		})
+	}
+
+	// Authenticated users are limited by their own bucket, not by their address's.
+	req := httptest.NewRequest(http.MethodGet, "/scheduled", nil)
+	req.RemoteAddr = "192.0.2.2:1234"
+	if rec := do(t, app, req, token); rec.Code != http.StatusOK {
+		t.Errorf("authenticated request: status = %d, want %d", rec.Code, http.StatusOK)
+	}
+}
+
+func TestRateLimitDoesNotChargeValidTokens(t *testing.T) {
+	app, _ := newTestApplication(t)
+	app.config.limiter.enabled = true
+	app.config.limiter.policies["auth"] = rateLimitPolicy{name: "auth", burst: 2, rate: 0.001}
+
+	// Users behind one address each have their own bucket, and none of their requests
+	// use up the address's auth bucket.
+	for i := 0; i < 5; i++ {
+		_, token := newTestUser(t, app, "98765432"+strconv.Itoa(10+i))
+
+		req := httptest.NewRequest(http.MethodGet, "/scheduled", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		if rec := do(t, app, req, token); rec.Code != http.StatusOK {
+			t.Fatalf("user %d: status = %d, want %d", i+1, rec.Code, http.StatusOK)
+		}
+	}
+
+	// The address's auth bucket is still full for failed authentications.
+	for i, want := range []int{http.StatusUnauthorized, http.StatusUnauthorized, http.StatusTooManyRequests} {
+		req := httptest.NewRequest(http.MethodGet, "/scheduled", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		req.Header.Set("Authorization", "Basic dXNlcjpwYXNz")
+		if rec := do(t, app, req, ""); rec.Code != want {
+			t.Errorf("malformed header %d: status = %d, want %d", i+1, rec.Code, want)
+		}
+	}
+}
+
+func TestClientIP(t *testing.T) {
+	tests := []struct {
+		name       string
+		trustProxy bool
+		forwarded  []string
+		want       string
+	}{
+		{"no proxy", false, nil, "192.0.2.1"},
+		{"untrusted header", false, []string{"203.0.113.7"}, "192.0.2.1"},
+		{"single entry", true, []string{"203.0.113.7"}, "203.0.113.7"},
+		{"spoofed entries", true, []string{"10.0.0.1, 198.51.100.2, 203.0.113.7"}, "203.0.113.7"},
+		{"several headers", true, []string{"10.0.0.1", "203.0.113.7"}, "203.0.113.7"},
+		{"trusted without header", true, nil, "192.0.2.1"},
+		{"empty last entry", true, []string{"10.0.0.1,"}, "192.0.2.1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			app := &application{config: config{limiter: limiterConfig{trustProxy: tt.trustProxy}}}
+
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.RemoteAddr = "192.0.2.1:1234"
+			for _, value := range tt.forwarded {
+				req.Header.Add("X-Forwarded-For", value)
+			}
+
+			if got := app.clientIP(req); got != tt.want {
+				t.Errorf("clientIP = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
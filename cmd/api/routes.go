@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+/*
+routes builds the application's router.
+Every route is registered through app.handle (or app.handleSegment) so that the metrics
+middleware can label requests with the route pattern. API routes are wrapped with
+app.rateLimit and the name of their rate limiting policy (see defaultRateLimitPolicies),
+outside of requireAuthenticatedUser so that anonymous requests are limited too.
+*/
+func (app *application) routes() http.Handler {
+	router := httprouter.New()
+
+	app.handle(router, http.MethodPost, "/signup", app.rateLimit("signup", app.handleUserSignupAndVerification))
+	app.handle(router, http.MethodPost, "/logout", app.rateLimit("default", app.requireAuthenticatedUser(app.logoutHandler)))
+	app.handle(router, http.MethodPost, "/upload-creative", app.rateLimit("upload", app.requireAuthenticatedUser(app.uploadCreativeHandler)))
+	app.handle(router, http.MethodPost, "/v1/creatives/uploads", app.rateLimit("upload", app.requireAuthenticatedUser(app.createDirectUploadHandler)))
+	app.handle(router, http.MethodPost, "/v1/creatives", app.rateLimit("default", app.requireAuthenticatedUser(app.finalizeDirectUploadHandler)))
+	app.handle(router, http.MethodPost, "/v1/bulk-uploads", app.rateLimit("upload", app.requireAuthenticatedUser(app.createBulkUploadHandler)))
+	app.handle(router, http.MethodGet, "/v1/bulk-uploads/:id", app.rateLimit("default", app.requireAuthenticatedUser(app.getBulkUploadHandler)))
+	app.handle(router, http.MethodOptions, "/v1/tus/uploads", app.tusOptionsHandler)
+	app.handle(router, http.MethodPost, "/v1/tus/uploads", app.rateLimit("upload", app.requireAuthenticatedUser(app.tusResumable(app.tusCreateHandler))))
+	app.handle(router, http.MethodHead, "/v1/tus/uploads/:id", app.rateLimit("tus", app.requireAuthenticatedUser(app.tusResumable(app.tusHeadHandler))))
+	app.handle(router, http.MethodPatch, "/v1/tus/uploads/:id", app.rateLimit("tus", app.requireAuthenticatedUser(app.tusResumable(app.tusPatchHandler))))
+	app.handle(router, http.MethodDelete, "/v1/tus/uploads/:id", app.rateLimit("default", app.requireAuthenticatedUser(app.tusResumable(app.tusDeleteHandler))))
+	app.handle(router, http.MethodPost, "/v1/tus/uploads/:id/creative", app.rateLimit("default", app.requireAuthenticatedUser(app.tusAttachHandler)))
+	app.handle(router, http.MethodPatch, "/v1/creatives/:id", app.rateLimit("default", app.requireAuthenticatedUser(app.updateCreativeHandler)))
+	app.handleSegment(router, http.MethodGet, "/v1/creatives/:id", "id", "search", app.rateLimit("default", app.requireAuthenticatedUser(app.searchCreativesHandler)))
+	app.handle(router, http.MethodGet, "/v1/creatives/:id/similar", app.rateLimit("default", app.requireAuthenticatedUser(app.similarCreativesHandler)))
+	app.handle(router, http.MethodGet, "/v1/creatives/:id/template", app.rateLimit("default", app.requireAuthenticatedUser(app.getTemplateHandler)))
+	app.handle(router, http.MethodPut, "/v1/creatives/:id/template", app.rateLimit("default", app.requireAuthenticatedUser(app.putTemplateHandler)))
+	app.handle(router, http.MethodDelete, "/v1/creatives/:id/template", app.rateLimit("default", app.requireAuthenticatedUser(app.deleteTemplateHandler)))
+	app.handle(router, http.MethodGet, "/v1/creatives/:id/media", app.rateLimit("media", app.requireAuthenticatedUser(app.getCreativeMediaHandler)))
+	app.handle(router, http.MethodGet, "/v1/creatives/:id/render", app.rateLimit("render", app.requireAuthenticatedUser(app.renderCreativeHandler)))
+	app.handle(router, http.MethodGet, "/v1/me/usage", app.rateLimit("default", app.requireAuthenticatedUser(app.getUsageHandler)))
+	app.handle(router, http.MethodGet, "/v1/me/watermark", app.rateLimit("default", app.requireAuthenticatedUser(app.getWatermarkHandler)))
+	app.handle(router, http.MethodPut, "/v1/me/watermark", app.rateLimit("upload", app.requireAuthenticatedUser(app.putWatermarkHandler)))
+	app.handle(router, http.MethodDelete, "/v1/me/watermark", app.rateLimit("default", app.requireAuthenticatedUser(app.deleteWatermarkHandler)))
+	app.handle(router, http.MethodPost, "/v1/me/watermark/preview", app.rateLimit("render", app.requireAuthenticatedUser(app.previewWatermarkHandler)))
+	app.handle(router, http.MethodGet, "/scheduled", app.rateLimit("scheduled", app.requireAuthenticatedUser(app.getScheduledCreativesHandler)))
+
+	app.handle(router, http.MethodGet, "/metrics", app.metrics.handler().ServeHTTP)
+	app.handle(router, http.MethodGet, "/healthz", app.livenessHandler)
+	app.handle(router, http.MethodGet, "/readyz", app.readinessHandler)
+
+	return router
+}
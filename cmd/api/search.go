@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/vishaaxl/cheershare/internal/data"
+)
+
+const (
+	// maxSearchQueryLength is the maximum number of characters in a search query.
+	maxSearchQueryLength = 200
+	// defaultSearchPageSize and maxSearchPageSize bound the results on a page of
+	// /v1/creatives/search.
+	defaultSearchPageSize = 20
+	maxSearchPageSize     = 100
+	// maxSearchPage keeps the offset of a page within reach of the index.
+	maxSearchPage = 1000
+)
+
+// paginationMetadata describes a page of results.
+type paginationMetadata struct {
+	CurrentPage  int `json:"current_page"`
+	PageSize     int `json:"page_size"`
+	LastPage     int `json:"last_page"`
+	TotalRecords int `json:"total_records"`
+}
+
+func newPaginationMetadata(page, pageSize, total int) paginationMetadata {
+	return paginationMetadata{
+		CurrentPage:  page,
+		PageSize:     pageSize,
+		LastPage:     (total + pageSize - 1) / pageSize,
+		TotalRecords: total,
+	}
+}
+
+/*
+searchCreativesHandler searches the title, tags, caption and alt text of creatives. The
+query parameters are:
+
+  - q (required): the words to search for, with the syntax of data.SearchFilter.Query.
+  - language: the language of q, e.g. "en" or "fr" (see normalizeLanguage), used to stem
+    its words. Words are also matched as written.
+  - from, to: only return creatives scheduled within these dates (YYYY-MM-DD).
+  - owner: "me" (the default) searches the current user's creatives. Admins may also
+    search "all" creatives or those of a user ID.
+  - page, page_size: the page of results, by default the first 20.
+
+Results are ranked best first and carry highlighted snippets of their title and caption.
+*/
+func (app *application) searchCreativesHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+	query := r.URL.Query()
+
+	filter := data.SearchFilter{Query: query.Get("q"), UserID: user.ID}
+
+	switch n := utf8.RuneCountInString(filter.Query); {
+	case n == 0:
+		app.errorResponse(w, http.StatusBadRequest, "q is required")
+		return
+	case n > maxSearchQueryLength:
+		app.errorResponse(w, http.StatusBadRequest, fmt.Sprintf("q must not be more than %d characters long", maxSearchQueryLength))
+		return
+	}
+
+	language, err := normalizeLanguage(query.Get("language"))
+	if err != nil {
+		app.errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	filter.Language = language
+
+	for _, bound := range []struct {
+		name string
+		dst  *time.Time
+	}{{"from", &filter.From}, {"to", &filter.To}} {
+		if s := query.Get(bound.name); s != "" {
+			*bound.dst, err = time.Parse("2006-01-02", s)
+			if err != nil {
+				app.errorResponse(w, http.StatusBadRequest, fmt.Sprintf("invalid date format for %s", bound.name))
+				return
+			}
+		}
+	}
+
+	switch owner := query.Get("owner"); owner {
+	case "", "me":
+	default:
+		if user.Role != data.RoleAdmin {
+			app.errorResponse(w, http.StatusForbidden, "only admins can search the creatives of other users")
+			return
+		}
+		filter.UserID = 0
+		if owner != "all" {
+			filter.UserID, err = strconv.ParseInt(owner, 10, 64)
+			if err != nil || filter.UserID < 1 {
+				app.errorResponse(w, http.StatusBadRequest, "owner must be me, all or a user ID")
+				return
+			}
+		}
+	}
+
+	filter.Page = 1
+	if s := query.Get("page"); s != "" {
+		filter.Page, err = strconv.Atoi(s)
+		if err != nil || filter.Page < 1 || filter.Page > maxSearchPage {
+			app.errorResponse(w, http.StatusBadRequest, fmt.Sprintf("page must be an integer between 1 and %d", maxSearchPage))
+			return
+		}
+	}
+
+	filter.PageSize = defaultSearchPageSize
+	if s := query.Get("page_size"); s != "" {
+		filter.PageSize, err = strconv.Atoi(s)
+		if err != nil || filter.PageSize < 1 || filter.PageSize > maxSearchPageSize {
+			app.errorResponse(w, http.StatusBadRequest, fmt.Sprintf("page_size must be an integer between 1 and %d", maxSearchPageSize))
+			return
+		}
+	}
+
+	results, total, err := app.models.Creative.Search(r.Context(), filter)
+	if err != nil {
+		app.logger.ErrorContext(r.Context(), "failed to search creatives", "error", err)
+		app.errorResponse(w, http.StatusInternalServerError, "failed to search creatives")
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, envelope{
+		"results":  results,
+		"metadata": newPaginationMetadata(filter.Page, filter.PageSize, total),
+	}, nil)
+}
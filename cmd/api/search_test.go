@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/vishaaxl/cheershare/internal/data"
+)
+
+func TestSearchReportsTotalOnEveryPage(t *testing.T) {
+	app, _ := newTestApplication(t)
+	user, token := newTestUser(t, app, "9876543210")
+
+	for i := 0; i < 3; i++ {
+		err := app.models.Creative.Insert(context.Background(), &data.Creative{
+			UserID:      user.ID,
+			Title:       "Happy Diwali",
+			ScheduledAt: time.Now().UTC().AddDate(0, 0, i+1),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		page        string
+		wantResults int
+	}{
+		{"1", 2},
+		{"2", 1},
+		{"5", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run("page "+tt.page, func(t *testing.T) {
+			target := "/v1/creatives/search?q=diwali&page_size=2&page=" + tt.page
+			rec := do(t, app, httptest.NewRequest(http.MethodGet, target, nil), token)
+			if rec.Code != http.StatusOK {
+				t.Fatalf("status = %d: %s", rec.Code, rec.Body)
+			}
+
+			var body struct {
+				Results  []data.SearchResult `json:"results"`
+				Metadata paginationMetadata  `json:"metadata"`
+			}
+			decodeJSON(t, rec, &body)
+
+			if len(body.Results) != tt.wantResults {
+				t.Errorf("%d results, want %d", len(body.Results), tt.wantResults)
+			}
+			if body.Metadata.TotalRecords != 3 || body.Metadata.LastPage != 2 {
+				t.Errorf("metadata = %+v, want 3 records on 2 pages", body.Metadata)
+			}
+		})
+	}
+}
@@ -4,22 +4,36 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"os"
 	"os/signal"
 	"syscall"
 	"time"
+
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 )
 
+/*
+handler wraps the router in the middleware chain: it starts a trace span (continuing any
+W3C trace context sent by the caller), assigns a request ID, records metrics, logs each
+request, and applies middleware for panic recovery and authentication, which rate limits
+failed authentications.
+*/
+func (app *application) handler(router http.Handler) http.Handler {
+	return otelhttp.NewHandler(app.requestID(app.recordMetrics(app.logRequest(app.recoverPanic(app.authenticate(router))))), "http.server")
+}
+
 func (app *application) serve(router http.Handler) error {
 	/**
 	 * Initialize a new HTTP server instance with configurations defined in the application config.
 	 * The server includes timeouts for idle, read, and write operations to handle connections gracefully.
-	 * The "Handler" chain applies middleware for panic recovery and authentication.
+	 * The "Handler" is the router wrapped in the middleware chain, see app.handler.
 	 */
 	srv := &http.Server{
 		Addr:         fmt.Sprintf(":%d", app.config.port),
-		Handler:      app.recoverPanic(app.authenticate(router)),
+		Handler:      app.handler(router),
+		ErrorLog:     slog.NewLogLogger(app.logger.Handler(), slog.LevelError),
 		IdleTimeout:  time.Minute,
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 30 * time.Second,
@@ -40,7 +54,14 @@ func (app *application) serve(router http.Handler) error {
 		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
 
 		s := <-quit
-		app.logger.Printf("Received %v, starting shutdown", s.String())
+		app.logger.Info("shutting down server", "signal", s.String())
+
+		/**
+		 * Flip readiness to failing first and give load balancers the configured drain
+		 * delay to stop routing new requests here before connections are closed.
+		 */
+		app.shuttingDown.Store(true)
+		time.Sleep(app.config.health.drainDelay)
 
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
@@ -54,7 +75,7 @@ func (app *application) serve(router http.Handler) error {
 		 * Wait for any background tasks to complete.
 		 * The application's WaitGroup (app.wg) ensures that no tasks are left running.
 		 */
-		app.logger.Printf("completing background tasks: port %d", app.config.port)
+		app.logger.Info("completing background tasks", "port", app.config.port)
 		app.wg.Wait()
 
 		shutdownError <- nil
@@ -64,7 +85,7 @@ func (app *application) serve(router http.Handler) error {
 	 * Log the server startup details, including the configured port and environment mode.
 	 * The server will start listening for incoming connections.
 	 */
-	app.logger.Printf("Starting server on port %d in %s mode", app.config.port, app.config.env)
+	app.logger.Info("starting server", "port", app.config.port, "env", app.config.env)
 	err := srv.ListenAndServe()
 
 	/**
@@ -86,7 +107,7 @@ func (app *application) serve(router http.Handler) error {
 	/**
 	 * Log that the server stopped successfully and return nil to indicate no errors.
 	 */
-	app.logger.Println("server stopped :)")
+	app.logger.Info("server stopped")
 
 	return nil
 }
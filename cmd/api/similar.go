@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/vishaaxl/cheershare/internal/data"
+	"github.com/vishaaxl/cheershare/internal/imaging"
+)
+
+const (
+	// defaultSimilarLimit and maxSimilarLimit bound the creatives returned by
+	// /v1/creatives/:id/similar.
+	defaultSimilarLimit = 20
+	maxSimilarLimit     = 100
+)
+
+/*
+perceptualHash returns the perceptual hash of the image stored under key, or nil if it
+cannot be computed, e.g. for a file that is not a decodable image. Creatives are saved
+without a hash in that case, so failures are only logged.
+*/
+func (app *application) perceptualHash(ctx context.Context, key string) *int64 {
+	ctx, span := tracer.Start(ctx, "imaging.DHash")
+	defer span.End()
+
+	rc, err := app.storage.Open(ctx, key)
+	if err != nil {
+		app.logger.ErrorContext(ctx, "failed to open file for hashing", "key", key, "error", err)
+		return nil
+	}
+	defer rc.Close()
+
+	img, err := imaging.Decode(rc)
+	if err != nil {
+		app.logger.WarnContext(ctx, "failed to decode image for hashing", "key", key, "error", err)
+		return nil
+	}
+
+	phash := int64(imaging.DHash(img))
+	return &phash
+}
+
+/*
+similarCreativesHandler lists the creatives of the current user that look like the
+creative named by the id route parameter: those whose perceptual hash differs from its
+hash in at most max_distance bits (0 to 64, by default the configured threshold),
+closest first. At most limit creatives are returned (default 20, at most 100). A
+creative without a hash has no similar creatives.
+*/
+func (app *application) similarCreativesHandler(w http.ResponseWriter, r *http.Request) {
+	creative, ok := app.ownedCreative(w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+
+	maxDistance := app.config.similar.maxDistance
+	if s := query.Get("max_distance"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 || n > 64 {
+			app.errorResponse(w, http.StatusBadRequest, "max_distance must be an integer between 0 and 64")
+			return
+		}
+		maxDistance = n
+	}
+
+	limit := defaultSimilarLimit
+	if s := query.Get("limit"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxSimilarLimit {
+			app.errorResponse(w, http.StatusBadRequest, fmt.Sprintf("limit must be an integer between 1 and %d", maxSimilarLimit))
+			return
+		}
+		limit = n
+	}
+
+	similar := []data.SimilarCreative{}
+	if creative.PHash != nil {
+		var err error
+		similar, err = app.models.Creative.Similar(r.Context(), data.SimilarFilter{
+			UserID:      creative.UserID,
+			PHash:       *creative.PHash,
+			MaxDistance: maxDistance,
+			ExcludeID:   creative.ID,
+			Limit:       limit,
+		})
+		if err != nil {
+			app.logger.ErrorContext(r.Context(), "failed to fetch similar creatives", "error", err)
+			app.errorResponse(w, http.StatusInternalServerError, "failed to fetch similar creatives")
+			return
+		}
+	}
+
+	app.writeJSON(w, http.StatusOK, envelope{"creative": creative, "similar": similar}, nil)
+}
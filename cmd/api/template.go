@@ -0,0 +1,471 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/vishaaxl/cheershare/internal/data"
+	"github.com/vishaaxl/cheershare/internal/imaging"
+	"github.com/vishaaxl/cheershare/internal/storage"
+)
+
+const (
+	// maxOverlays is the maximum number of text overlays on a template.
+	maxOverlays = 10
+	// maxOverlayTextLength is the maximum number of characters in the text of an overlay.
+	maxOverlayTextLength = 200
+	// maxTextSize is the largest font size, in pixels, of an overlay.
+	maxTextSize = 512
+	// maxRecipientNameLength is the maximum number of characters in a rendered name.
+	maxRecipientNameLength = 64
+
+	// namePlaceholder is replaced by the recipient's name in the text of overlays.
+	namePlaceholder = "{name}"
+	// renderPrefix is the storage prefix of rendered creatives and watermarked media.
+	// Renders are not referenced by anything, so the garbage collector evicts them
+	// after its grace period and they are rendered again on demand.
+	renderPrefix = "renders/"
+)
+
+// overlayAligns maps the align values of overlays to imaging alignments.
+var overlayAligns = map[string]imaging.Align{
+	"left":   imaging.AlignLeft,
+	"center": imaging.AlignCenter,
+	"right":  imaging.AlignRight,
+}
+
+/*
+validateOverlays checks the overlays of a template on an image of the given size, and
+fills in their defaults: the text defaults to {name}, drawn centered in white with the
+bold font at 48 pixels. Every region must lie within the image.
+*/
+func validateOverlays(overlays []data.TextOverlay, size image.Point) error {
+	if len(overlays) == 0 {
+		return errors.New("overlays must not be empty")
+	}
+	if len(overlays) > maxOverlays {
+		return fmt.Errorf("a template can have at most %d overlays", maxOverlays)
+	}
+
+	for i := range overlays {
+		o := &overlays[i]
+		field := func(name string) string { return fmt.Sprintf("overlays[%d].%s", i, name) }
+
+		if o.Text == "" {
+			o.Text = namePlaceholder
+		}
+		if o.Font == "" {
+			o.Font = "bold"
+		}
+		if o.Size == 0 {
+			o.Size = 48
+		}
+		if o.Color == "" {
+			o.Color = "#ffffff"
+		}
+		if o.Align == "" {
+			o.Align = "center"
+		}
+
+		switch {
+		case utf8.RuneCountInString(o.Text) > maxOverlayTextLength:
+			return fmt.Errorf("%s must not be more than %d characters long", field("text"), maxOverlayTextLength)
+		case !imaging.HasFont(o.Font):
+			return fmt.Errorf("%s must be one of %s", field("font"), strings.Join(imaging.Fonts(), ", "))
+		case o.Size < imaging.MinTextSize || o.Size > maxTextSize:
+			return fmt.Errorf("%s must be between %d and %d", field("size"), imaging.MinTextSize, maxTextSize)
+		case !isAlign(o.Align):
+			return fmt.Errorf("%s must be left, center or right", field("align"))
+		case o.MaxWidth < 1:
+			return fmt.Errorf("%s must be positive", field("max_width"))
+		case o.X < 0 || o.Y < 0 || o.X+o.MaxWidth > size.X || float64(o.Y)+o.Size > float64(size.Y):
+			return fmt.Errorf("overlays[%d] must lie within the %dx%d image", i, size.X, size.Y)
+		}
+
+		if _, err := parseColor(o.Color); err != nil {
+			return fmt.Errorf("%s must be written #RRGGBB or #RRGGBBAA", field("color"))
+		}
+	}
+
+	return nil
+}
+
+func isAlign(align string) bool {
+	_, ok := overlayAligns[align]
+	return ok
+}
+
+// parseColor parses a color written #RRGGBB or #RRGGBBAA.
+func parseColor(s string) (color.NRGBA, error) {
+	hex, ok := strings.CutPrefix(s, "#")
+	if !ok || (len(hex) != 6 && len(hex) != 8) {
+		return color.NRGBA{}, errors.New("invalid color")
+	}
+	if len(hex) == 6 {
+		hex += "ff"
+	}
+
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return color.NRGBA{}, errors.New("invalid color")
+	}
+
+	return color.NRGBA{R: uint8(v >> 24), G: uint8(v >> 16), B: uint8(v >> 8), A: uint8(v)}, nil
+}
+
+// imageSize returns the dimensions of the image stored under key.
+func (app *application) imageSize(ctx context.Context, key string) (image.Point, error) {
+	rc, err := app.storage.Open(ctx, key)
+	if err != nil {
+		return image.Point{}, err
+	}
+	defer rc.Close()
+
+	cfg, _, err := image.DecodeConfig(rc)
+	if err != nil {
+		return image.Point{}, err
+	}
+
+	return image.Pt(cfg.Width, cfg.Height), nil
+}
+
+// getTemplateHandler returns the template of a creative of the current user.
+func (app *application) getTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	creative, ok := app.ownedCreative(w, r)
+	if !ok {
+		return
+	}
+
+	template, err := app.models.Template.Get(r.Context(), creative.ID)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			app.errorResponse(w, http.StatusNotFound, "creative has no template")
+			return
+		}
+		app.logger.ErrorContext(r.Context(), "failed to fetch template", "error", err)
+		app.errorResponse(w, http.StatusInternalServerError, "failed to fetch template")
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, envelope{"template": template}, nil)
+}
+
+/*
+putTemplateHandler makes a creative of the current user a template, or replaces the
+overlays of its template. The JSON body has the overlays (see data.TextOverlay and
+validateOverlays for their defaults), whose regions must lie within the image.
+*/
+func (app *application) putTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	creative, ok := app.ownedCreative(w, r)
+	if !ok {
+		return
+	}
+
+	var input struct {
+		Overlays []data.TextOverlay `json:"overlays"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	key, ok := app.storageKey(creative)
+	if !ok {
+		app.errorResponse(w, http.StatusUnprocessableEntity, "the file of this creative cannot be rendered")
+		return
+	}
+
+	size, err := app.imageSize(r.Context(), key)
+	if err != nil {
+		app.logger.ErrorContext(r.Context(), "failed to read image size", "key", key, "error", err)
+		app.errorResponse(w, http.StatusUnprocessableEntity, "the file of this creative cannot be rendered")
+		return
+	}
+	if int64(size.X)*int64(size.Y) > imaging.MaxPixels {
+		app.errorResponse(w, http.StatusUnprocessableEntity, "the image of this creative is too large to be rendered")
+		return
+	}
+
+	err = validateOverlays(input.Overlays, size)
+	if err != nil {
+		app.errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	template := &data.Template{CreativeID: creative.ID, Overlays: input.Overlays}
+
+	err = app.models.Template.Upsert(r.Context(), template)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			app.errorResponse(w, http.StatusNotFound, "creative not found")
+			return
+		}
+		app.logger.ErrorContext(r.Context(), "failed to save template", "error", err)
+		app.errorResponse(w, http.StatusInternalServerError, "failed to save template")
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, envelope{"template": template}, nil)
+}
+
+// deleteTemplateHandler turns a template of the current user back into a plain creative.
+func (app *application) deleteTemplateHandler(w http.ResponseWriter, r *http.Request) {
+	creative, ok := app.ownedCreative(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.models.Template.Delete(r.Context(), creative.ID)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			app.errorResponse(w, http.StatusNotFound, "creative has no template")
+			return
+		}
+		app.logger.ErrorContext(r.Context(), "failed to delete template", "error", err)
+		app.errorResponse(w, http.StatusInternalServerError, "failed to delete template")
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, envelope{"message": "template deleted"}, nil)
+}
+
+// onSchedule reports whether creative is scheduled for today or tomorrow in some time
+// zone, and so is listed by /scheduled to every user.
+func onSchedule(creative *data.Creative, now time.Time) bool {
+	today := now.UTC().Truncate(24 * time.Hour)
+	return !creative.ScheduledAt.Before(today.AddDate(0, 0, -1)) && !creative.ScheduledAt.After(today.AddDate(0, 0, 2))
+}
+
+// recipientName validates the name drawn by renderCreativeHandler.
+func recipientName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+
+	switch {
+	case name == "":
+		return "", errors.New("name must not be empty")
+	case utf8.RuneCountInString(name) > maxRecipientNameLength:
+		return "", fmt.Errorf("name must not be more than %d characters long", maxRecipientNameLength)
+	case strings.IndexFunc(name, unicode.IsControl) >= 0:
+		return "", errors.New("name must not contain control characters")
+	}
+
+	return name, nil
+}
+
+// renderKey returns the storage key of a render, which changes whenever the image, the
+// template, the name or the owner's watermark does. wm is nil if the owner has none.
+func renderKey(creative *data.Creative, template *data.Template, name string, wm *data.Watermark) string {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%d\x00%s", creative.CreativeURL, template.Version, name)
+	if wm != nil {
+		fmt.Fprintf(h, "\x00%s\x00%d", wm.LogoKey, wm.Version)
+	}
+
+	ext := ".png"
+	if isJPEG(creative.CreativeURL) {
+		ext = ".jpg"
+	}
+
+	return fmt.Sprintf("%s%d/%s%s", renderPrefix, creative.ID, hex.EncodeToString(h.Sum(nil))[:32], ext)
+}
+
+func isJPEG(name string) bool {
+	ext := strings.ToLower(path.Ext(name))
+	return ext == ".jpg" || ext == ".jpeg"
+}
+
+/*
+renderCreativeHandler returns the image of a template with the recipient's name drawn in
+its overlays: the name query parameter, or the current user's name by default. Users can
+render their own creatives and those on the schedule. JPEG images are rendered as JPEG,
+others as PNG.
+
+The watermark of the creative's owner, if they have one, is drawn over the overlays, so
+that creatives carry the brand of whoever published them.
+
+Renders of the user's own name are cached in storage under a key derived from the image,
+template version, name and watermark, so each user adds at most one render per creative
+and the cache cannot be grown by varying the name. Every render is served with that key
+as its ETag.
+*/
+func (app *application) renderCreativeHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	creative, ok := app.visibleCreative(w, r, func(creative *data.Creative) bool {
+		return creative.UserID == user.ID || onSchedule(creative, time.Now())
+	})
+	if !ok {
+		return
+	}
+
+	name := user.Name
+	if r.URL.Query().Has("name") {
+		name = r.URL.Query().Get("name")
+	}
+	name, err := recipientName(name)
+	if err != nil {
+		app.errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	cache := name == strings.TrimSpace(user.Name)
+
+	template, err := app.models.Template.Get(r.Context(), creative.ID)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			app.errorResponse(w, http.StatusNotFound, "creative has no template")
+			return
+		}
+		app.logger.ErrorContext(r.Context(), "failed to fetch template", "error", err)
+		app.errorResponse(w, http.StatusInternalServerError, "failed to fetch template")
+		return
+	}
+
+	wm, err := app.models.Watermark.Get(r.Context(), creative.UserID)
+	if err != nil {
+		if !errors.Is(err, data.ErrRecordNotFound) {
+			app.logger.ErrorContext(r.Context(), "failed to fetch watermark", "error", err)
+			app.errorResponse(w, http.StatusInternalServerError, "failed to render creative")
+			return
+		}
+		wm = nil
+	}
+
+	key := renderKey(creative, template, name, wm)
+
+	var content []byte
+	if cache {
+		content, err = app.cachedRender(r.Context(), key)
+		if err != nil && !errors.Is(err, storage.ErrNotFound) {
+			app.logger.ErrorContext(r.Context(), "failed to read cached render", "key", key, "error", err)
+			app.errorResponse(w, http.StatusInternalServerError, "failed to render creative")
+			return
+		}
+	}
+
+	if content == nil {
+		content, err = app.render(r.Context(), creative, template, name, wm)
+		if err != nil {
+			app.logger.ErrorContext(r.Context(), "failed to render creative", "creative_id", creative.ID, "error", err)
+			app.errorResponse(w, http.StatusInternalServerError, "failed to render creative")
+			return
+		}
+
+		if cache {
+			_, err = app.storage.Put(r.Context(), key, bytes.NewReader(content))
+			if err != nil {
+				app.logger.ErrorContext(r.Context(), "failed to cache render", "key", key, "error", err)
+			}
+		}
+	}
+
+	contentType := "image/png"
+	if isJPEG(key) {
+		contentType = "image/jpeg"
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("ETag", `"`+strings.TrimSuffix(path.Base(key), path.Ext(key))+`"`)
+	w.Header().Set("Cache-Control", "private, max-age=86400")
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+}
+
+// cachedRender returns the render stored under key. storage.ErrNotFound is returned if
+// it has not been rendered yet or was evicted.
+func (app *application) cachedRender(ctx context.Context, key string) ([]byte, error) {
+	rc, err := app.storage.Open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	return io.ReadAll(rc)
+}
+
+// decodeCreative decodes the image of creative.
+func (app *application) decodeCreative(ctx context.Context, creative *data.Creative) (image.Image, error) {
+	key, ok := app.storageKey(creative)
+	if !ok {
+		return nil, fmt.Errorf("creative URL %q is not in storage", creative.CreativeURL)
+	}
+
+	rc, err := app.storage.Open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	return imaging.Decode(rc)
+}
+
+// render draws the overlays of template, then the watermark wm if it is not nil, onto the
+// image of creative and returns the encoded result.
+func (app *application) render(ctx context.Context, creative *data.Creative, template *data.Template, name string, wm *data.Watermark) ([]byte, error) {
+	ctx, span := tracer.Start(ctx, "imaging.Render")
+	defer span.End()
+
+	img, err := app.decodeCreative(ctx, creative)
+	if err != nil {
+		return nil, err
+	}
+
+	texts := make([]imaging.Text, len(template.Overlays))
+	for i, o := range template.Overlays {
+		c, err := parseColor(o.Color)
+		if err != nil {
+			return nil, err
+		}
+		texts[i] = imaging.Text{
+			Text:     strings.ReplaceAll(o.Text, namePlaceholder, name),
+			X:        o.X,
+			Y:        o.Y,
+			MaxWidth: o.MaxWidth,
+			Font:     o.Font,
+			Size:     o.Size,
+			Color:    c,
+			Align:    overlayAligns[o.Align],
+		}
+	}
+
+	rendered, err := imaging.Render(img, texts)
+	if err != nil {
+		return nil, err
+	}
+
+	if wm != nil {
+		logo, err := app.loadLogo(ctx, wm)
+		if err != nil {
+			return nil, err
+		}
+		drawWatermark(rendered, wm, logo)
+	}
+
+	var buf bytes.Buffer
+	if isJPEG(creative.CreativeURL) {
+		err = jpeg.Encode(&buf, rendered, &jpeg.Options{Quality: 90})
+	} else {
+		err = png.Encode(&buf, rendered)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
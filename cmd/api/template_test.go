@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+
+	"github.com/vishaaxl/cheershare/internal/data"
+)
+
+func TestRenderCachesOnlyTheUsersOwnName(t *testing.T) {
+	app, _ := newTestApplication(t)
+	_, token := newTestUser(t, app, "9876543210")
+	ctx := context.Background()
+
+	rec := do(t, app, uploadRequest(t, map[string]string{"scheduled_at": tomorrow()}, testPNG(t)), token)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("upload: status = %d: %s", rec.Code, rec.Body)
+	}
+	var body struct {
+		Creative struct {
+			ID int64 `json:"id"`
+		} `json:"creative"`
+	}
+	decodeJSON(t, rec, &body)
+	id := body.Creative.ID
+
+	err := app.models.Template.Upsert(ctx, &data.Template{
+		CreativeID: id,
+		Overlays: []data.TextOverlay{
+			{Text: "Dear {name}", X: 2, Y: 2, MaxWidth: 28, Font: "regular", Size: 8, Color: "#FFFFFF", Align: "left"},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	renders := func() int {
+		objects, err := app.storage.List(ctx, renderPrefix+strconv.FormatInt(id, 10)+"/")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(objects)
+	}
+	render := func(query url.Values) {
+		t.Helper()
+		target := "/v1/creatives/" + strconv.FormatInt(id, 10) + "/render?" + query.Encode()
+		rec := do(t, app, httptest.NewRequest(http.MethodGet, target, nil), token)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("render %s: status = %d: %s", query.Encode(), rec.Code, rec.Body)
+		}
+		if rec.Header().Get("ETag") == "" {
+			t.Errorf("render %s: no ETag", query.Encode())
+		}
+	}
+
+	for _, name := range []string{"Asha", "Ravi", "Meera"} {
+		render(url.Values{"name": {name}})
+	}
+	if n := renders(); n != 0 {
+		t.Fatalf("%d renders cached for other names, want 0", n)
+	}
+
+	render(nil)
+	render(url.Values{"name": {"Test User"}})
+	if n := renders(); n != 1 {
+		t.Errorf("%d renders cached for the user's own name, want 1", n)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+func TestHandleNamesServerSpanAfterRoute(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	tp := newTracerProvider(exporter, 1)
+	t.Cleanup(func() { tp.Shutdown(context.Background()) })
+
+	app := &application{config: config{budgets: budgetConfig{defaultRoute: time.Second}}}
+
+	router := httprouter.New()
+	app.handle(router, http.MethodGet, "/v1/creatives/:id/similar", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	handler := otelhttp.NewHandler(router, "http.server", otelhttp.WithTracerProvider(tp))
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/v1/creatives/42/similar", nil))
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusNoContent)
+	}
+
+	if err := tp.ForceFlush(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	spans := exporter.GetSpans()
+	if len(spans) != 1 {
+		t.Fatalf("got %d spans, want 1", len(spans))
+	}
+
+	span := spans[0]
+	if want := "GET /v1/creatives/:id/similar"; span.Name != want {
+		t.Errorf("span name = %q, want %q", span.Name, want)
+	}
+
+	var route string
+	for _, attr := range span.Attributes {
+		if attr.Key == semconv.HTTPRouteKey {
+			route = attr.Value.AsString()
+		}
+	}
+	if route != "/v1/creatives/:id/similar" {
+		t.Errorf("http.route = %q, want the route pattern", route)
+	}
+}
@@ -0,0 +1,542 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/julienschmidt/httprouter"
+	"github.com/vishaaxl/cheershare/internal/data"
+)
+
+/*
+Resumable uploads implement the tus 1.0.0 core protocol with the creation, expiration
+and termination extensions (https://tus.io/protocols/resumable-upload):
+
+	POST   /v1/tus/uploads             create an upload (Upload-Length, Upload-Metadata)
+	HEAD   /v1/tus/uploads/:id         get the current Upload-Offset
+	PATCH  /v1/tus/uploads/:id         append bytes at Upload-Offset
+	DELETE /v1/tus/uploads/:id         abandon the upload
+
+Once every byte is received, POST /v1/tus/uploads/:id/creative attaches the file to a
+new creative, the same way /upload-creative does. Each PATCH request is stored as its
+own chunk object, so a request cut short by a flaky connection keeps the bytes it
+delivered; the chunks are concatenated when the upload completes.
+*/
+
+const (
+	tusVersion    = "1.0.0"
+	tusExtensions = "creation,expiration,termination"
+	tusUploadsURL = "/v1/tus/uploads"
+)
+
+// tusResumable checks that a request speaks the supported tus version and tags the
+// response with it, as every tus response except OPTIONS must carry it.
+func (app *application) tusResumable(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Resumable", tusVersion)
+
+		if r.Header.Get("Tus-Resumable") != tusVersion {
+			w.Header().Set("Tus-Version", tusVersion)
+			app.errorResponse(w, http.StatusPreconditionFailed, "unsupported tus version, expected "+tusVersion)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// tusOptionsHandler advertises the server's tus capabilities. Tus-Max-Size is only
+// known, and sent, for authenticated requests as it depends on the user's plan.
+func (app *application) tusOptionsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Tus-Resumable", tusVersion)
+	w.Header().Set("Tus-Version", tusVersion)
+	w.Header().Set("Tus-Extension", tusExtensions)
+
+	if user := app.contextGetUser(r); !user.IsAnonymous() {
+		usage, err := app.models.Usage.Get(r.Context(), user.ID)
+		if err == nil {
+			w.Header().Set("Tus-Max-Size", strconv.FormatInt(usage.Limits.FileBytes, 10))
+		}
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// tusCreateHandler creates an upload. The file name must be sent in Upload-Metadata, and
+// the length is checked against the user's plan before any byte is sent.
+func (app *application) tusCreateHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	if r.Header.Get("Upload-Defer-Length") != "" {
+		app.errorResponse(w, http.StatusBadRequest, "Upload-Defer-Length is not supported")
+		return
+	}
+
+	length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+	if err != nil || length <= 0 {
+		app.errorResponse(w, http.StatusBadRequest, "Upload-Length must be a positive integer")
+		return
+	}
+
+	metadata, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+	if err != nil {
+		app.errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	filename := metadata["filename"]
+	if filename == "" {
+		app.errorResponse(w, http.StatusBadRequest, "Upload-Metadata must include the filename")
+		return
+	}
+	if !isImageFile(filename) {
+		app.errorResponse(w, http.StatusBadRequest, "invalid file type: only images are allowed")
+		return
+	}
+
+	usage, err := app.models.Usage.Get(r.Context(), user.ID)
+	if err != nil {
+		app.logger.ErrorContext(r.Context(), "failed to fetch usage", "error", err)
+		app.errorResponse(w, http.StatusInternalServerError, "failed to check upload quota")
+		return
+	}
+
+	switch {
+	case length > usage.Limits.FileBytes:
+		app.quotaExceededResponse(w, usage, data.ErrFileQuotaExceeded)
+		return
+	case usage.CreativesLeftToday() == 0:
+		app.quotaExceededResponse(w, usage, data.ErrDailyQuotaExceeded)
+		return
+	case length > usage.BytesLeft():
+		app.quotaExceededResponse(w, usage, data.ErrStorageQuotaExceeded)
+		return
+	}
+
+	upload := &data.Upload{
+		ID:        uuid.NewString(),
+		UserID:    user.ID,
+		Filename:  filename,
+		Length:    length,
+		ExpiresAt: time.Now().Add(app.config.tus.expiry).Truncate(time.Second),
+	}
+
+	err = app.models.Upload.Insert(r.Context(), upload)
+	if err != nil {
+		app.logger.ErrorContext(r.Context(), "failed to create upload", "error", err)
+		app.errorResponse(w, http.StatusInternalServerError, "failed to create upload")
+		return
+	}
+
+	w.Header().Set("Location", tusUploadsURL+"/"+upload.ID)
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// tusHeadHandler reports how many bytes of an upload have been received.
+func (app *application) tusHeadHandler(w http.ResponseWriter, r *http.Request) {
+	upload, ok := app.tusUpload(w, r)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Length", strconv.FormatInt(upload.Length, 10))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.Header().Set("Upload-Metadata", "filename "+base64.StdEncoding.EncodeToString([]byte(upload.Filename)))
+	w.WriteHeader(http.StatusOK)
+}
+
+/*
+tusPatchHandler appends the request body to an upload at Upload-Offset. The bytes
+received are kept even if the body is cut short, and the new offset is returned. The
+request that receives the last byte concatenates the chunks; if that fails, it is
+retried when the upload is attached to a creative.
+*/
+func (app *application) tusPatchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		app.errorResponse(w, http.StatusUnsupportedMediaType, "Content-Type must be application/offset+octet-stream")
+		return
+	}
+
+	offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+	if err != nil || offset < 0 {
+		app.errorResponse(w, http.StatusBadRequest, "Upload-Offset must be a non-negative integer")
+		return
+	}
+
+	upload, ok := app.tusUpload(w, r)
+	if !ok {
+		return
+	}
+
+	if offset != upload.Offset {
+		app.errorResponse(w, http.StatusConflict, "Upload-Offset does not match the current offset")
+		return
+	}
+
+	remaining := upload.Length - upload.Offset
+	if r.ContentLength > remaining {
+		app.errorResponse(w, http.StatusRequestEntityTooLarge, "request body exceeds the remaining upload length")
+		return
+	}
+
+	/*
+		The chunk is written even if the client goes away, so the context is detached
+		from the request and bounded on its own.
+	*/
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), app.config.budgets.forRoute(tusUploadsURL+"/:id"))
+	defer cancel()
+
+	key, err := tusChunkKey(upload)
+	if err != nil {
+		app.logger.ErrorContext(r.Context(), "failed to generate chunk key", "error", err)
+		app.errorResponse(w, http.StatusInternalServerError, "failed to store chunk")
+		return
+	}
+
+	size, err := app.storage.Put(ctx, key, &partialReader{r: io.LimitReader(r.Body, remaining)})
+	if err != nil {
+		app.logger.ErrorContext(r.Context(), "failed to store chunk", "error", err)
+		app.errorResponse(w, http.StatusInternalServerError, "failed to store chunk")
+		return
+	}
+
+	if size > 0 {
+		err = app.models.Upload.AppendChunk(ctx, upload, key, size)
+	} else {
+		app.deleteStoredFile(ctx, key)
+	}
+	if err != nil {
+		app.deleteStoredFile(ctx, key)
+
+		if errors.Is(err, data.ErrEditConflict) {
+			app.errorResponse(w, http.StatusConflict, "the upload was modified by another request")
+			return
+		}
+		app.logger.ErrorContext(r.Context(), "failed to record chunk", "error", err)
+		app.errorResponse(w, http.StatusInternalServerError, "failed to store chunk")
+		return
+	}
+
+	if upload.Done() {
+		err = app.finishTusUpload(ctx, upload)
+		if err != nil {
+			app.logger.ErrorContext(r.Context(), "failed to assemble upload", "upload_id", upload.ID, "error", err)
+		}
+	}
+
+	w.Header().Set("Upload-Offset", strconv.FormatInt(upload.Offset, 10))
+	w.Header().Set("Upload-Expires", upload.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// tusDeleteHandler abandons an upload and removes its stored data.
+func (app *application) tusDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	upload, ok := app.tusUpload(w, r)
+	if !ok {
+		return
+	}
+
+	err := app.models.Upload.Delete(r.Context(), upload.ID)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.logger.ErrorContext(r.Context(), "failed to delete upload", "error", err)
+		app.errorResponse(w, http.StatusInternalServerError, "failed to delete upload")
+		return
+	}
+
+	// Anything left behind is collected by the garbage collector.
+	for _, key := range upload.Chunks {
+		app.deleteStoredFile(r.Context(), key)
+	}
+	if upload.Key != "" && !isBlobKey(upload.Key) {
+		app.deleteStoredFile(r.Context(), upload.Key)
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+/*
+tusAttachHandler creates a creative from a completed upload. The body is a JSON object
+with the scheduled_at date, validated as by /upload-creative. As there, the content
+must match the file extension, the file is shared with identical files and the response
+warns about duplicates. The upload is removed once the creative is saved, or once its
+content is found not to match, with 422 Unprocessable Entity.
+*/
+func (app *application) tusAttachHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		ScheduledAt string `json:"scheduled_at"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if input.ScheduledAt == "" {
+		app.errorResponse(w, http.StatusBadRequest, "scheduled_at is required")
+		return
+	}
+
+	scheduledAt, err := time.Parse("2006-01-02", input.ScheduledAt)
+	if err != nil {
+		app.errorResponse(w, http.StatusBadRequest, "invalid date format for scheduled_at")
+		return
+	}
+
+	if scheduledAt.Before(time.Now()) {
+		app.errorResponse(w, http.StatusBadRequest, "cannot set scheduled_at before today")
+		return
+	}
+
+	upload, ok := app.tusUpload(w, r)
+	if !ok {
+		return
+	}
+
+	if !upload.Done() {
+		app.errorResponse(w, http.StatusConflict, fmt.Sprintf("upload is incomplete: %d of %d bytes received", upload.Offset, upload.Length))
+		return
+	}
+
+	err = app.finishTusUpload(r.Context(), upload)
+	if err != nil {
+		app.logger.ErrorContext(r.Context(), "failed to assemble upload", "upload_id", upload.ID, "error", err)
+		app.errorResponse(w, http.StatusInternalServerError, "failed to assemble upload")
+		return
+	}
+
+	sum, contentType, err := app.hashStoredFile(r.Context(), upload.Key)
+	if err != nil {
+		app.logger.ErrorContext(r.Context(), "failed to hash upload", "upload_id", upload.ID, "error", err)
+		app.errorResponse(w, http.StatusInternalServerError, "failed to save creative")
+		return
+	}
+
+	// As with /upload-creative, the content must be the image its extension names. It
+	// cannot change any more, so the upload is abandoned.
+	if contentType != imageContentTypes[strings.ToLower(path.Ext(upload.Filename))] {
+		err = app.models.Upload.Delete(r.Context(), upload.ID)
+		if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+			app.logger.ErrorContext(r.Context(), "failed to delete upload", "upload_id", upload.ID, "error", err)
+		}
+		if !isBlobKey(upload.Key) {
+			app.deleteStoredFile(r.Context(), upload.Key)
+		}
+		app.errorResponse(w, http.StatusUnprocessableEntity, errInvalidImage.Error())
+		return
+	}
+
+	blob, err := app.storeBlob(r.Context(), upload.Key, sum, upload.Length)
+	if err == nil && blob.Key != upload.Key {
+		// The upload keeps the blob alive until the creative is saved.
+		err = app.models.Upload.Complete(r.Context(), upload, blob.Key)
+	}
+	if err != nil {
+		app.logger.ErrorContext(r.Context(), "failed to store blob", "upload_id", upload.ID, "error", err)
+		app.errorResponse(w, http.StatusInternalServerError, "failed to save creative")
+		return
+	}
+
+	creative := &data.Creative{
+		CreativeURL: app.storage.URL(upload.Key),
+		SizeBytes:   upload.Length,
+		SHA256:      sum,
+		PHash:       app.perceptualHash(r.Context(), upload.Key),
+		ScheduledAt: scheduledAt,
+		UserID:      upload.UserID,
+	}
+
+	warnings := app.duplicateWarnings(r.Context(), creative)
+
+	err = app.models.Creative.Insert(r.Context(), creative)
+	if err != nil {
+		if isQuotaError(err) {
+			usage, usageErr := app.models.Usage.Get(r.Context(), upload.UserID)
+			if usageErr == nil {
+				app.quotaExceededResponse(w, usage, err)
+				return
+			}
+		}
+		app.logger.ErrorContext(r.Context(), "failed to save creative", "error", err)
+		app.errorResponse(w, http.StatusInternalServerError, "failed to save creative")
+		return
+	}
+
+	// The creative now references the object, so only the upload record goes.
+	err = app.models.Upload.Delete(r.Context(), upload.ID)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.logger.ErrorContext(r.Context(), "failed to delete attached upload", "upload_id", upload.ID, "error", err)
+	}
+
+	app.queueConversion(creative)
+
+	app.writeJSON(w, http.StatusOK, creativeEnvelope(creative, warnings), nil)
+}
+
+/*
+tusUpload loads the upload named by the id route parameter. Uploads of other users are
+reported as missing, and expired uploads as gone. It writes the error response and
+returns false if the upload cannot be used.
+*/
+func (app *application) tusUpload(w http.ResponseWriter, r *http.Request) (*data.Upload, bool) {
+	id := httprouter.ParamsFromContext(r.Context()).ByName("id")
+	if _, err := uuid.Parse(id); err != nil {
+		app.errorResponse(w, http.StatusNotFound, "upload not found")
+		return nil, false
+	}
+
+	upload, err := app.models.Upload.Get(r.Context(), id)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			app.errorResponse(w, http.StatusNotFound, "upload not found")
+			return nil, false
+		}
+		app.logger.ErrorContext(r.Context(), "failed to fetch upload", "error", err)
+		app.errorResponse(w, http.StatusInternalServerError, "failed to fetch upload")
+		return nil, false
+	}
+
+	if upload.UserID != app.contextGetUser(r).ID {
+		app.errorResponse(w, http.StatusNotFound, "upload not found")
+		return nil, false
+	}
+
+	if upload.Expired() {
+		app.errorResponse(w, http.StatusGone, "upload expired")
+		return nil, false
+	}
+
+	return upload, true
+}
+
+/*
+finishTusUpload concatenates the chunks of a completed upload into a single object
+named like the files of /upload-creative, then removes the chunks. It does nothing if
+the upload was already assembled.
+*/
+func (app *application) finishTusUpload(ctx context.Context, upload *data.Upload) error {
+	if upload.Key != "" {
+		return nil
+	}
+
+	key := generateUUIDFilename(upload.Filename)
+	chunks := append([]string(nil), upload.Chunks...)
+
+	size, err := app.storage.Put(ctx, key, &chunkReader{ctx: ctx, app: app, keys: chunks})
+	if err == nil && size != upload.Length {
+		err = fmt.Errorf("assembled %d bytes, expected %d", size, upload.Length)
+	}
+	if err == nil {
+		err = app.models.Upload.Complete(ctx, upload, key)
+	}
+	if err != nil {
+		app.deleteStoredFile(ctx, key)
+		return err
+	}
+
+	for _, chunk := range chunks {
+		app.deleteStoredFile(ctx, chunk)
+	}
+
+	return nil
+}
+
+// tusChunkKey returns a new storage key for a chunk of upload starting at its current
+// offset. The random suffix keeps concurrent requests for the same offset apart.
+func tusChunkKey(upload *data.Upload) (string, error) {
+	suffix := make([]byte, 4)
+	if _, err := rand.Read(suffix); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("tus/%s/%020d-%s", upload.ID, upload.Offset, hex.EncodeToString(suffix)), nil
+}
+
+// parseTusMetadata decodes an Upload-Metadata header: comma separated pairs of a key and
+// an optional base64 encoded value, separated by a space.
+func parseTusMetadata(header string) (map[string]string, error) {
+	metadata := make(map[string]string)
+	if strings.TrimSpace(header) == "" {
+		return metadata, nil
+	}
+
+	for _, pair := range strings.Split(header, ",") {
+		key, encoded, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if key == "" {
+			return nil, errors.New("Upload-Metadata contains an empty key")
+		}
+
+		value, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("Upload-Metadata value of %q is not valid base64", key)
+		}
+		metadata[key] = string(value)
+	}
+
+	return metadata, nil
+}
+
+// partialReader ends the stream at the first read error, so that the bytes received
+// before a connection drops are stored rather than discarded.
+type partialReader struct {
+	r io.Reader
+}
+
+func (pr *partialReader) Read(p []byte) (int, error) {
+	n, err := pr.r.Read(p)
+	if err != nil {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// chunkReader reads the chunk objects one after the other, opening each only when the
+// previous one is exhausted.
+type chunkReader struct {
+	ctx     context.Context
+	app     *application
+	keys    []string
+	current io.ReadCloser
+}
+
+func (cr *chunkReader) Read(p []byte) (int, error) {
+	for {
+		if cr.current == nil {
+			if len(cr.keys) == 0 {
+				return 0, io.EOF
+			}
+
+			rc, err := cr.app.storage.Open(cr.ctx, cr.keys[0])
+			if err != nil {
+				return 0, err
+			}
+			cr.current = rc
+			cr.keys = cr.keys[1:]
+		}
+
+		n, err := cr.current.Read(p)
+		if err == io.EOF {
+			cr.current.Close()
+			cr.current = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestParseTusMetadata(t *testing.T) {
+	tests := []struct {
+		name    string
+		header  string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"empty", "", map[string]string{}, false},
+		{"blank", "   ", map[string]string{}, false},
+		{"single pair", "filename d29ybGQucG5n", map[string]string{"filename": "world.png"}, false},
+		{"key without value", "is_confidential", map[string]string{"is_confidential": ""}, false},
+		{
+			"several pairs",
+			"filename d29ybGQucG5n, filetype aW1hZ2UvcG5n,is_confidential",
+			map[string]string{"filename": "world.png", "filetype": "image/png", "is_confidential": ""},
+			false,
+		},
+		{"empty key", "filename d29ybGQucG5n,", nil, true},
+		{"leading comma", ",filename d29ybGQucG5n", nil, true},
+		{"invalid base64", "filename not-base64!", nil, true},
+		{"unpadded base64", "filename d29ybGQ", nil, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseTusMetadata(tt.header)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPartialReader(t *testing.T) {
+	errDropped := errors.New("connection reset")
+
+	tests := []struct {
+		name string
+		r    io.Reader
+		want string
+	}{
+		{"complete body", strings.NewReader("hello world"), "hello world"},
+		{"empty body", strings.NewReader(""), ""},
+		{"error with the last bytes", iotest.DataErrReader(strings.NewReader("hello")), "hello"},
+		{"error after some bytes", io.MultiReader(strings.NewReader("hel"), iotest.ErrReader(errDropped)), "hel"},
+		{"error before any byte", iotest.ErrReader(errDropped), ""},
+		{"timeout after the first read", iotest.TimeoutReader(strings.NewReader("hello")), "hello"},
+		{"one byte at a time", iotest.OneByteReader(strings.NewReader("hello")), "hello"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := io.ReadAll(&partialReader{r: tt.r})
+			if err != nil {
+				t.Fatalf("error = %v, want the stream to end cleanly", err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("read %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChunkReader(t *testing.T) {
+	app, _ := newTestApplication(t)
+	ctx := context.Background()
+
+	chunks := map[string]string{
+		"tus/a/00000000000000000000-00": "hello",
+		"tus/a/00000000000000000005-00": "",
+		"tus/a/00000000000000000005-01": " ",
+		"tus/a/00000000000000000006-00": "world",
+	}
+	for key, content := range chunks {
+		if _, err := app.storage.Put(ctx, key, strings.NewReader(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		keys    []string
+		oneByte bool
+		want    string
+		wantErr bool
+	}{
+		{"no chunks", nil, false, "", false},
+		{"single chunk", []string{"tus/a/00000000000000000000-00"}, false, "hello", false},
+		{
+			"chunks in order",
+			[]string{"tus/a/00000000000000000000-00", "tus/a/00000000000000000005-01", "tus/a/00000000000000000006-00"},
+			false, "hello world", false,
+		},
+		{
+			"empty chunk in between",
+			[]string{"tus/a/00000000000000000000-00", "tus/a/00000000000000000005-00", "tus/a/00000000000000000005-01", "tus/a/00000000000000000006-00"},
+			false, "hello world", false,
+		},
+		{
+			"reads smaller than a chunk",
+			[]string{"tus/a/00000000000000000000-00", "tus/a/00000000000000000005-01", "tus/a/00000000000000000006-00"},
+			true, "hello world", false,
+		},
+		{"missing chunk", []string{"tus/a/00000000000000000000-00", "tus/a/missing"}, false, "hello", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var r io.Reader = &chunkReader{ctx: ctx, app: app, keys: tt.keys}
+			if tt.oneByte {
+				r = iotest.OneByteReader(r)
+			}
+
+			var got bytes.Buffer
+			_, err := io.Copy(&got, r)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error = %v, want error %v", err, tt.wantErr)
+			}
+			if got.String() != tt.want {
+				t.Errorf("read %q, want %q", got.String(), tt.want)
+			}
+		})
+	}
+}
+
+// tusRequest builds a tus request carrying the protocol version header.
+func tusRequest(method, target string, body []byte, headers map[string]string) *http.Request {
+	req := httptest.NewRequest(method, target, bytes.NewReader(body))
+	req.Header.Set("Tus-Resumable", tusVersion)
+	for key, value := range headers {
+		req.Header.Set(key, value)
+	}
+	return req
+}
+
+// createTusUpload creates an upload of length bytes and returns its URL.
+func createTusUpload(t *testing.T, app *application, token, filename string, length int) string {
+	t.Helper()
+
+	rec := do(t, app, tusRequest(http.MethodPost, tusUploadsURL, nil, map[string]string{
+		"Upload-Length":   strconv.Itoa(length),
+		"Upload-Metadata": "filename " + base64.StdEncoding.EncodeToString([]byte(filename)),
+	}), token)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create: status = %d: %s", rec.Code, rec.Body)
+	}
+	return rec.Header().Get("Location")
+}
+
+func TestTusUploadInChunks(t *testing.T) {
+	app, _ := newTestApplication(t)
+	_, token := newTestUser(t, app, "9876543210")
+	file := testPNG(t)
+	split := len(file) / 3
+
+	location := createTusUpload(t, app, token, "creative.png", len(file))
+
+	patch := func(offset int, chunk []byte) *httptest.ResponseRecorder {
+		return do(t, app, tusRequest(http.MethodPatch, location, chunk, map[string]string{
+			"Content-Type":  "application/offset+octet-stream",
+			"Upload-Offset": strconv.Itoa(offset),
+		}), token)
+	}
+
+	steps := []struct {
+		name       string
+		offset     int
+		chunk      []byte
+		status     int
+		wantOffset int
+	}{
+		{"first chunk", 0, file[:split], http.StatusNoContent, split},
+		{"stale offset", 0, file[:split], http.StatusConflict, split},
+		{"offset ahead", split + 1, file[split+1:], http.StatusConflict, split},
+		{"second chunk", split, file[split : 2*split], http.StatusNoContent, 2 * split},
+		{"past the length", 2 * split, append(append([]byte(nil), file[2*split:]...), 0), http.StatusRequestEntityTooLarge, 2 * split},
+		{"last chunk", 2 * split, file[2*split:], http.StatusNoContent, len(file)},
+	}
+
+	for _, step := range steps {
+		rec := patch(step.offset, step.chunk)
+		if rec.Code != step.status {
+			t.Fatalf("%s: status = %d, want %d: %s", step.name, rec.Code, step.status, rec.Body)
+		}
+
+		rec = do(t, app, tusRequest(http.MethodHead, location, nil, nil), token)
+		if got := rec.Header().Get("Upload-Offset"); got != strconv.Itoa(step.wantOffset) {
+			t.Fatalf("%s: Upload-Offset = %s, want %d", step.name, got, step.wantOffset)
+		}
+	}
+
+	rec := do(t, app, httptest.NewRequest(http.MethodPost, location+"/creative", strings.NewReader(`{"scheduled_at": "`+tomorrow()+`"}`)), token)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("attach: status = %d: %s", rec.Code, rec.Body)
+	}
+
+	var body struct {
+		Creative struct {
+			ID int64 `json:"id"`
+		} `json:"creative"`
+	}
+	decodeJSON(t, rec, &body)
+
+	creative, err := app.models.Creative.Get(context.Background(), body.Creative.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, _ := app.storageKey(creative)
+	rc, err := app.storage.Open(context.Background(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+
+	assembled, err := io.ReadAll(rc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(assembled, file) {
+		t.Errorf("assembled %d bytes differing from the %d uploaded", len(assembled), len(file))
+	}
+}
+
+func TestTusAttachRejectsMismatchedContent(t *testing.T) {
+	app, _ := newTestApplication(t)
+	_, token := newTestUser(t, app, "9876543210")
+	file := []byte("#!/bin/sh\necho this is not an image\n")
+
+	location := createTusUpload(t, app, token, "creative.png", len(file))
+	rec := do(t, app, tusRequest(http.MethodPatch, location, file, map[string]string{
+		"Content-Type":  "application/offset+octet-stream",
+		"Upload-Offset": "0",
+	}), token)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("patch: status = %d: %s", rec.Code, rec.Body)
+	}
+
+	rec = do(t, app, httptest.NewRequest(http.MethodPost, location+"/creative", strings.NewReader(`{"scheduled_at": "`+tomorrow()+`"}`)), token)
+	if rec.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("attach: status = %d, want %d: %s", rec.Code, http.StatusUnprocessableEntity, rec.Body)
+	}
+
+	// The upload is abandoned along with its file.
+	rec = do(t, app, tusRequest(http.MethodHead, location, nil, nil), token)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("head after rejection: status = %d, want %d", rec.Code, http.StatusNotFound)
+	}
+	objects, err := app.storage.List(context.Background(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 0 {
+		t.Errorf("%d files left in storage, want none", len(objects))
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/vishaaxl/cheershare/internal/data"
+)
+
+// isQuotaError reports whether err is one of the plan quota errors.
+func isQuotaError(err error) bool {
+	return errors.Is(err, data.ErrFileQuotaExceeded) ||
+		errors.Is(err, data.ErrDailyQuotaExceeded) ||
+		errors.Is(err, data.ErrStorageQuotaExceeded)
+}
+
+/*
+quotaExceededResponse reports a plan quota error. Files over the size limit are answered
+with 413 Request Entity Too Large, and exhausted daily or storage quotas with 403
+Forbidden. The user's usage is included so clients can show what is left.
+*/
+func (app *application) quotaExceededResponse(w http.ResponseWriter, usage *data.Usage, err error) {
+	status := http.StatusForbidden
+	var message string
+
+	switch {
+	case errors.Is(err, data.ErrFileQuotaExceeded):
+		status = http.StatusRequestEntityTooLarge
+		message = fmt.Sprintf("files are limited to %d bytes on the %s plan", usage.Limits.FileBytes, usage.Plan)
+	case errors.Is(err, data.ErrDailyQuotaExceeded):
+		message = fmt.Sprintf("daily limit of %d creatives reached on the %s plan", usage.Limits.CreativesPerDay, usage.Plan)
+	default:
+		message = fmt.Sprintf("storage limit of %d bytes reached on the %s plan", usage.Limits.TotalBytes, usage.Plan)
+	}
+
+	app.errorDetailsResponse(w, status, message, envelope{"usage": usage})
+}
+
+// getUsageHandler returns the authenticated user's plan limits and current usage.
+func (app *application) getUsageHandler(w http.ResponseWriter, r *http.Request) {
+	usage, err := app.models.Usage.Get(r.Context(), app.contextGetUser(r).ID)
+	if err != nil {
+		app.logger.ErrorContext(r.Context(), "failed to fetch usage", "error", err)
+		app.errorResponse(w, http.StatusInternalServerError, "failed to fetch usage")
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, envelope{"usage": usage}, nil)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/vishaaxl/cheershare/internal/data"
+)
+
+func TestQuotaExceededResponse(t *testing.T) {
+	app, _ := newTestApplication(t)
+	usage := &data.Usage{Plan: data.PlanFree, Limits: data.DefaultPlans[data.PlanFree]}
+
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{data.ErrFileQuotaExceeded, http.StatusRequestEntityTooLarge},
+		{data.ErrDailyQuotaExceeded, http.StatusForbidden},
+		{data.ErrStorageQuotaExceeded, http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.err.Error(), func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			rec.Header().Set("X-Request-ID", "req-1")
+
+			app.quotaExceededResponse(rec, usage, tt.err)
+			if rec.Code != tt.status {
+				t.Errorf("status = %d, want %d", rec.Code, tt.status)
+			}
+
+			// The body has the same envelope as every other error, plus the usage.
+			var body struct {
+				Error     string      `json:"error"`
+				RequestID string      `json:"request_id"`
+				Usage     *data.Usage `json:"usage"`
+			}
+			decodeJSON(t, rec, &body)
+
+			if body.Error == "" || body.RequestID != "req-1" {
+				t.Errorf("error = %q, request_id = %q", body.Error, body.RequestID)
+			}
+			if body.Usage == nil || body.Usage.Plan != data.PlanFree {
+				t.Errorf("usage = %+v, want the user's usage", body.Usage)
+			}
+		})
+	}
+}
@@ -3,15 +3,19 @@ package main
 import (
 	"context"
 	"crypto/rand"
+	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
+	"strings"
 	"time"
 
 	"github.com/twilio/twilio-go"
 	api "github.com/twilio/twilio-go/rest/api/v2010"
 	"github.com/vishaaxl/cheershare/internal/data"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
 )
 
 /*
@@ -20,20 +24,20 @@ The function creates a random byte array and uses modulus operation to generate
 a number between 0 and 9999. The result is formatted into a zero-padded string
 to ensure it is always 4 digits long.
 */
-func generateOTP() string {
+func generateOTP() (string, error) {
 	otp := make([]byte, 2)
 
 	_, err := rand.Read(otp)
 	if err != nil {
-		log.Fatal("Error generating OTP:", err)
+		return "", fmt.Errorf("failed to generate OTP: %w", err)
 	}
-	return fmt.Sprintf("%04d", int(otp[0])%10000)
+	return fmt.Sprintf("%04d", int(otp[0])%10000), nil
 }
 
 /*
 storeOTPInRedis stores user data, including the OTP, into Redis.
 It uses the phone number as the key and stores the data as a hash.
-A timeout context is created to prevent blocking indefinitely, and
+The caller's context (bounded by the route budget) prevents blocking indefinitely, and
 the key is set to expire after 5 minutes to ensure security.
 */
 func (app *application) storeOTPInRedis(ctx context.Context, phoneNumber, name, otp string) error {
@@ -75,41 +79,51 @@ func (app *application) verifyOTPInRedis(ctx context.Context, phoneNumber, otp s
 }
 
 /*
-createUserIfNotExists checks if a user already exists in the database for the provided phone number.
-If the user exists, their record is returned. Otherwise, a new user is created with the given name
-and phone number. Any errors during database operations are propagated back to the caller.
+registerUser creates the user for the provided phone number if it does not exist yet, issues
+an authentication token valid for 48 hours and records an audit event, all in one transaction.
+The user is created with an upsert, so concurrent verifications for the same phone number
+both succeed and receive the same user. Any errors are propagated back to the caller and
+leave no partial writes behind.
 */
-func (app *application) createUserIfNotExists(phoneNumber, name string) (*data.User, error) {
-	user, err := app.models.User.GetByPhoneNumber(phoneNumber)
-	if err == nil && user != nil {
-		return user, nil
-	}
-
-	newUser := data.User{
+func (app *application) registerUser(ctx context.Context, phoneNumber, name string) (*data.User, string, error) {
+	user := &data.User{
 		Name:        name,
 		PhoneNumber: phoneNumber,
 	}
+	var token *data.Token
 
-	err = app.models.User.Insert(&newUser)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create user: %w", err)
-	}
+	err := app.models.WithTx(ctx, func(tx data.Models) error {
+		created, err := tx.User.Upsert(ctx, user)
+		if err != nil {
+			return fmt.Errorf("failed to create user: %w", err)
+		}
 
-	return &newUser, nil
-}
+		token, err = tx.Token.New(ctx, user.ID, 48*time.Hour, data.ScopeAuthentication)
+		if err != nil {
+			return fmt.Errorf("failed to generate token: %w", err)
+		}
 
-/*
-generateTokenForUser creates a new authentication token for the given user ID.
-The token is valid for 48 hours and is associated with the "authentication" scope.
-If token generation fails, an error is returned to the caller.
-*/
-func (app *application) generateTokenForUser(userID int64) (string, error) {
-	token, err := app.models.Token.New(userID, 48*time.Hour, data.ScopeAuthentication)
+		action := data.AuditUserLogin
+		if created {
+			action = data.AuditUserSignup
+		}
+
+		err = tx.Audit.Insert(ctx, &data.AuditEvent{
+			UserID:   user.ID,
+			Action:   action,
+			Metadata: map[string]interface{}{"request_id": contextGetRequestID(ctx)},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to record audit event: %w", err)
+		}
+
+		return nil
+	})
 	if err != nil {
-		return "", fmt.Errorf("failed to generate token: %w", err)
+		return nil, "", err
 	}
 
-	return token.Plaintext, nil
+	return user, token.Plaintext, nil
 }
 
 /*
@@ -140,7 +154,7 @@ func (app *application) handleUserSignupAndVerification(w http.ResponseWriter, r
 	err := app.readJSON(w, r, &input)
 	if err != nil {
 		app.errorResponse(w, http.StatusBadRequest, "Invalid request payload")
-		app.logger.Println("Error reading JSON:", err)
+		app.logger.WarnContext(r.Context(), "invalid signup payload", "error", err)
 		return
 	}
 
@@ -168,26 +182,31 @@ func (app *application) handleUserSignupAndVerification(w http.ResponseWriter, r
 			return
 		}
 
-		otp := generateOTP()
-
-		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-		defer cancel()
+		otp, err := generateOTP()
+		if err != nil {
+			app.errorResponse(w, http.StatusInternalServerError, "Failed to generate OTP")
+			app.logger.ErrorContext(r.Context(), "failed to generate OTP", "error", err)
+			return
+		}
 
-		err = app.storeOTPInRedis(ctx, input.PhoneNumber, input.Name, otp)
+		err = app.storeOTPInRedis(r.Context(), input.PhoneNumber, input.Name, otp)
 		if err != nil {
 			app.errorResponse(w, http.StatusInternalServerError, "Failed to store OTP")
-			app.logger.Println("Error storing OTP in Redis:", err)
+			app.logger.ErrorContext(r.Context(), "failed to store OTP in Redis", "error", err)
 			return
 		}
 
+		// The request context is cancelled once the response is written, so the background
+		// job keeps only its values (the request ID) for logging.
+		bgCtx := context.WithoutCancel(r.Context())
 		app.background(func() {
-			err := app.sendOTPViaTwilio(otp, input.PhoneNumber)
+			err := app.sendOTPViaTwilio(bgCtx, otp, input.PhoneNumber)
 			if err != nil {
-				app.logger.Println("Error sending OTP via Twilio:", err)
+				app.metrics.otpFailed.WithLabelValues("send").Inc()
+				app.logger.ErrorContext(bgCtx, "failed to send OTP via Twilio", "phone_number", input.PhoneNumber, "error", err)
 			}
 		})
 
-		app.logger.Println(otp)
 		app.writeJSON(w, http.StatusOK, envelope{"success": true, "message": "OTP sent successfully"}, nil)
 		return
 	}
@@ -197,32 +216,24 @@ func (app *application) handleUserSignupAndVerification(w http.ResponseWriter, r
 		1. Retrieve the stored OTP and user data from Redis using the phone number as the key.
 		2. Validate the provided OTP against the stored OTP.
 		3. If valid:
-			a. Create or fetch the user in the database.
-			b. Generate an authentication token for the user.
-			c. Return a success response with user details and the token.
+			a. Create or fetch the user, generate an authentication token and record an
+			   audit event in a single transaction.
+			b. Return a success response with user details and the token.
 		4. If invalid, respond with an error indicating the OTP is invalid or expired.
 	*/
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-
-	userName, err := app.verifyOTPInRedis(ctx, input.PhoneNumber, input.OTP)
+	userName, err := app.verifyOTPInRedis(r.Context(), input.PhoneNumber, input.OTP)
 	if err != nil {
+		app.metrics.otpFailed.WithLabelValues("verify").Inc()
 		app.errorResponse(w, http.StatusUnauthorized, "Invalid or expired OTP")
-		app.logger.Println("OTP verification failed for", input.PhoneNumber, ":", err)
+		app.logger.InfoContext(r.Context(), "OTP verification failed", "phone_number", input.PhoneNumber, "error", err)
 		return
 	}
+	app.metrics.otpVerified.Inc()
 
-	user, err := app.createUserIfNotExists(input.PhoneNumber, userName)
+	user, token, err := app.registerUser(r.Context(), input.PhoneNumber, userName)
 	if err != nil {
 		app.errorResponse(w, http.StatusInternalServerError, "Failed to register user")
-		app.logger.Println("Error registering user:", err)
-		return
-	}
-
-	token, err := app.generateTokenForUser(user.ID)
-	if err != nil {
-		app.errorResponse(w, http.StatusInternalServerError, "Failed to generate authentication token")
-		app.logger.Println("Error generating token for user ID", user.ID, ":", err)
+		app.logger.ErrorContext(r.Context(), "failed to register user", "error", err)
 		return
 	}
 
@@ -234,9 +245,28 @@ func (app *application) handleUserSignupAndVerification(w http.ResponseWriter, r
 	}, nil)
 }
 
+/*
+logoutHandler revokes the token the request was authenticated with. The authenticate
+middleware has already validated the Authorization header, so the token is read back
+from it.
+*/
+func (app *application) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+
+	err := app.models.Token.Delete(r.Context(), data.ScopeAuthentication, token)
+	if err != nil && !errors.Is(err, data.ErrRecordNotFound) {
+		app.errorResponse(w, http.StatusInternalServerError, "Failed to log out")
+		app.logger.ErrorContext(r.Context(), "failed to delete token", "error", err)
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, envelope{"success": true, "message": "Logged out successfully"}, nil)
+}
+
 // sendOTPViaTwilio sends an OTP to the specified phone number using Twilio's messaging API.
 //
 // Parameters:
+// - ctx: Carries the request ID of the signup request, used for logging.
 // - otp: The one-time password to be sent in the message body.
 // - phoneNumber: The recipient's phone number without the country code.
 //
@@ -246,7 +276,7 @@ func (app *application) handleUserSignupAndVerification(w http.ResponseWriter, r
 // Returns:
 // - An error if the OTP could not be sent successfully.
 // - nil if the message was sent without issues.
-func (app *application) sendOTPViaTwilio(otp, phoneNumber string) error {
+func (app *application) sendOTPViaTwilio(ctx context.Context, otp, phoneNumber string) error {
 	client := twilio.NewRestClientWithParams(twilio.ClientParams{
 		Username: os.Getenv("TWILIO_SID"),
 		Password: os.Getenv("TWILIO_API_KEY"),
@@ -266,18 +296,40 @@ func (app *application) sendOTPViaTwilio(otp, phoneNumber string) error {
 
 	// Attempt to send the message with retries.
 	for attempt := 1; attempt <= maxRetries; attempt++ {
+		_, span := tracer.Start(ctx, "twilio.CreateMessage",
+			trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(attribute.Int("twilio.attempt", attempt)),
+		)
+
+		start := time.Now()
 		resp, err := client.Api.CreateMessage(params)
 		if err == nil {
-			fmt.Printf("OTP sent successfully. Twilio response SID: %v\n", resp.Sid)
+			span.End()
+			app.metrics.twilioLatency.WithLabelValues("success").Observe(time.Since(start).Seconds())
+			app.metrics.otpSent.Inc()
+			app.logger.InfoContext(ctx, "OTP sent", "twilio_sid", derefString(resp.Sid), "attempt", attempt)
 			return nil
 		}
 
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.End()
+		app.metrics.twilioLatency.WithLabelValues("error").Observe(time.Since(start).Seconds())
+
 		// Log the error for debugging.
 		lastErr = fmt.Errorf("attempt %d: failed to send OTP via Twilio: %w", attempt, err)
-		fmt.Println(lastErr)
+		app.logger.WarnContext(ctx, "OTP send attempt failed", "attempt", attempt, "error", err)
 
 		time.Sleep(2 * time.Second)
 	}
 
 	return fmt.Errorf("all retries failed to send OTP via Twilio: %w", lastErr)
 }
+
+// derefString returns the value of an optional string field from the Twilio SDK.
+func derefString(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
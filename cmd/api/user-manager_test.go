@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/vishaaxl/cheershare/internal/data"
+)
+
+func TestSignupVerifiesOTP(t *testing.T) {
+	app, _ := newTestApplication(t)
+
+	err := app.storeOTPInRedis(context.Background(), "9876543210", "Asha", "1234")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := do(t, app, httptest.NewRequest(http.MethodPost, "/signup", strings.NewReader(`{"phone_number": "9876543210", "otp": "0000"}`)), "")
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("wrong OTP: status = %d, want %d", rec.Code, http.StatusUnauthorized)
+	}
+
+	rec = do(t, app, httptest.NewRequest(http.MethodPost, "/signup", strings.NewReader(`{"phone_number": "9876543210", "otp": "1234"}`)), "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+
+	var body struct {
+		Token string `json:"token"`
+		Data  struct {
+			ID   int64  `json:"id"`
+			Name string `json:"name"`
+		} `json:"data"`
+	}
+	decodeJSON(t, rec, &body)
+
+	if body.Data.Name != "Asha" {
+		t.Errorf("name = %q, want the name stored with the OTP", body.Data.Name)
+	}
+
+	// The returned token authenticates the new user.
+	user, _, err := app.models.User.GetForToken(context.Background(), data.ScopeAuthentication, body.Token)
+	if err != nil {
+		t.Fatalf("token not usable: %v", err)
+	}
+	if user.ID != body.Data.ID || user.PhoneNumber != "9876543210" {
+		t.Errorf("token belongs to user %d (%s), want %d", user.ID, user.PhoneNumber, body.Data.ID)
+	}
+}
+
+func TestSignupLogsInExistingUser(t *testing.T) {
+	app, _ := newTestApplication(t)
+	existing, _ := newTestUser(t, app, "9876543210")
+
+	err := app.storeOTPInRedis(context.Background(), "9876543210", "Someone Else", "4321")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := do(t, app, httptest.NewRequest(http.MethodPost, "/signup", strings.NewReader(`{"phone_number": "9876543210", "otp": "4321"}`)), "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusOK, rec.Body)
+	}
+
+	var body struct {
+		Data struct {
+			ID   int64  `json:"id"`
+			Name string `json:"name"`
+		} `json:"data"`
+	}
+	decodeJSON(t, rec, &body)
+
+	if body.Data.ID != existing.ID || body.Data.Name != existing.Name {
+		t.Errorf("got user %d %q, want the existing user %d %q", body.Data.ID, body.Data.Name, existing.ID, existing.Name)
+	}
+}
+
+func TestSignupRequiresPhoneNumber(t *testing.T) {
+	app, _ := newTestApplication(t)
+
+	rec := do(t, app, httptest.NewRequest(http.MethodPost, "/signup", strings.NewReader(`{"name": "Asha"}`)), "")
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusBadRequest)
+	}
+
+	var body struct {
+		Error     string `json:"error"`
+		RequestID string `json:"request_id"`
+	}
+	decodeJSON(t, rec, &body)
+
+	if body.Error == "" || body.RequestID == "" {
+		t.Errorf("error body %s lacks the error or request ID", rec.Body)
+	}
+}
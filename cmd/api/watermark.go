@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/vishaaxl/cheershare/internal/data"
+	"github.com/vishaaxl/cheershare/internal/imaging"
+)
+
+const (
+	// maxLogoBytes and maxLogoSide bound the logos of watermarks.
+	maxLogoBytes = 1 << 20
+	maxLogoSide  = 4096
+	// minWatermarkScale and maxWatermarkScale bound the width of a watermark, as a
+	// fraction of the width of the image.
+	minWatermarkScale = 0.02
+	maxWatermarkScale = 0.5
+	// watermarkPrefix is the storage prefix of logos.
+	watermarkPrefix = "watermarks/"
+)
+
+// watermarkCorners maps the positions of watermarks to imaging corners.
+var watermarkCorners = map[string]imaging.Corner{
+	data.WatermarkTopLeft:     imaging.TopLeft,
+	data.WatermarkTopRight:    imaging.TopRight,
+	data.WatermarkBottomLeft:  imaging.BottomLeft,
+	data.WatermarkBottomRight: imaging.BottomRight,
+}
+
+// logoExtensions maps the content types accepted for logos to the extension they are
+// stored with.
+var logoExtensions = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+}
+
+/*
+watermarkForm is the multipart form accepted by the watermark settings and preview
+endpoints. Every field is optional: "logo" is a PNG, JPEG or GIF file, "position" one of
+data.WatermarkPositions, "opacity" a number in (0, 1] and "scale" a number between 0.02
+and 0.5. The preview also accepts "creative_id", the creative to preview on.
+*/
+type watermarkForm struct {
+	logo       []byte
+	logoExt    string
+	logoImage  image.Image
+	position   string
+	opacity    string
+	scale      string
+	creativeID string
+}
+
+// readWatermarkForm reads and checks the logo of a watermarkForm. The other fields are
+// checked by apply.
+func (app *application) readWatermarkForm(w http.ResponseWriter, r *http.Request) (*watermarkForm, error) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxLogoBytes+multipartOverhead)
+
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+
+	form := &watermarkForm{}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		switch part.FormName() {
+		case "logo":
+			form.logo, err = io.ReadAll(io.LimitReader(part, maxLogoBytes+1))
+			if err == nil && len(form.logo) > maxLogoBytes {
+				err = fmt.Errorf("logos are limited to %d bytes", maxLogoBytes)
+			}
+		case "position":
+			form.position, err = readField(part)
+		case "opacity":
+			form.opacity, err = readField(part)
+		case "scale":
+			form.scale, err = readField(part)
+		case "creative_id":
+			form.creativeID, err = readField(part)
+		}
+		part.Close()
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if form.logo != nil {
+		ext, ok := logoExtensions[http.DetectContentType(form.logo)]
+		if !ok {
+			return nil, errors.New("invalid logo type: only PNG, JPEG and GIF images are allowed")
+		}
+		form.logoExt = ext
+
+		cfg, _, err := image.DecodeConfig(bytes.NewReader(form.logo))
+		if err != nil {
+			return nil, errors.New("logo is not a valid image")
+		}
+		if cfg.Width > maxLogoSide || cfg.Height > maxLogoSide {
+			return nil, fmt.Errorf("logos are limited to %dx%d pixels", maxLogoSide, maxLogoSide)
+		}
+
+		form.logoImage, err = imaging.Decode(bytes.NewReader(form.logo))
+		if err != nil {
+			return nil, errors.New("logo is not a valid image")
+		}
+	}
+
+	return form, nil
+}
+
+// apply sets the position, opacity and scale sent in the form on wm.
+func (form *watermarkForm) apply(wm *data.Watermark) error {
+	if form.position != "" {
+		if _, ok := watermarkCorners[form.position]; !ok {
+			return fmt.Errorf("position must be one of %s", strings.Join(data.WatermarkPositions, ", "))
+		}
+		wm.Position = form.position
+	}
+
+	if form.opacity != "" {
+		opacity, err := strconv.ParseFloat(form.opacity, 64)
+		if err != nil || !(opacity > 0 && opacity <= 1) {
+			return errors.New("opacity must be a number greater than 0 and at most 1")
+		}
+		wm.Opacity = opacity
+	}
+
+	if form.scale != "" {
+		scale, err := strconv.ParseFloat(form.scale, 64)
+		if err != nil || !(scale >= minWatermarkScale && scale <= maxWatermarkScale) {
+			return fmt.Errorf("scale must be a number between %g and %g", minWatermarkScale, maxWatermarkScale)
+		}
+		wm.Scale = scale
+	}
+
+	return nil
+}
+
+// currentWatermark returns the watermark of a user, or a new one with the default
+// settings and no logo if they have none.
+func (app *application) currentWatermark(ctx context.Context, userID int64) (*data.Watermark, error) {
+	wm, err := app.models.Watermark.Get(ctx, userID)
+	if errors.Is(err, data.ErrRecordNotFound) {
+		return &data.Watermark{UserID: userID, Position: data.WatermarkBottomRight, Opacity: 0.8, Scale: 0.2}, nil
+	}
+	return wm, err
+}
+
+// loadLogo decodes the logo of a watermark.
+func (app *application) loadLogo(ctx context.Context, wm *data.Watermark) (image.Image, error) {
+	rc, err := app.storage.Open(ctx, wm.LogoKey)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	return imaging.Decode(rc)
+}
+
+// drawWatermark draws wm onto dst, with logo already decoded.
+func drawWatermark(dst draw.Image, wm *data.Watermark, logo image.Image) {
+	imaging.DrawWatermark(dst, imaging.Watermark{
+		Logo:    logo,
+		Corner:  watermarkCorners[wm.Position],
+		Scale:   wm.Scale,
+		Opacity: wm.Opacity,
+	})
+}
+
+// getWatermarkHandler returns the watermark settings of the current user.
+func (app *application) getWatermarkHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	wm, err := app.models.Watermark.Get(r.Context(), user.ID)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			app.errorResponse(w, http.StatusNotFound, "no watermark is set")
+			return
+		}
+		app.logger.ErrorContext(r.Context(), "failed to fetch watermark", "error", err)
+		app.errorResponse(w, http.StatusInternalServerError, "failed to fetch watermark")
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, envelope{"watermark": wm}, nil)
+}
+
+/*
+putWatermarkHandler saves the watermark settings of the current user from a
+watermarkForm. Fields left out keep their current value, or their default for a new
+watermark: the bottom-right corner, an opacity of 0.8 and a scale of 0.2. A logo is
+required the first time. The watermark is drawn onto the user's rendered creatives and
+the media served for them; their files are never modified.
+*/
+func (app *application) putWatermarkHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	form, err := app.readWatermarkForm(w, r)
+	if err != nil {
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			app.errorResponse(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("logos are limited to %d bytes", maxLogoBytes))
+			return
+		}
+		app.errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	wm, err := app.currentWatermark(r.Context(), user.ID)
+	if err != nil {
+		app.logger.ErrorContext(r.Context(), "failed to fetch watermark", "error", err)
+		app.errorResponse(w, http.StatusInternalServerError, "failed to save watermark")
+		return
+	}
+
+	err = form.apply(wm)
+	if err != nil {
+		app.errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	/*
+		The new logo is stored under a new key so that renders in progress can still read
+		the previous one, which is left to the garbage collector once it is unreferenced.
+	*/
+	var newKey string
+	if form.logo != nil {
+		newKey = fmt.Sprintf("%s%d/%s%s", watermarkPrefix, user.ID, uuid.NewString(), form.logoExt)
+		_, err = app.storage.Put(r.Context(), newKey, bytes.NewReader(form.logo))
+		if err != nil {
+			app.logger.ErrorContext(r.Context(), "failed to store logo", "error", err)
+			app.errorResponse(w, http.StatusInternalServerError, "failed to save watermark")
+			return
+		}
+		wm.LogoKey = newKey
+	}
+	if wm.LogoKey == "" {
+		app.errorResponse(w, http.StatusBadRequest, "logo is required")
+		return
+	}
+
+	err = app.models.Watermark.Upsert(r.Context(), wm)
+	if err != nil {
+		if newKey != "" {
+			app.deleteStoredFile(r.Context(), newKey)
+		}
+		app.logger.ErrorContext(r.Context(), "failed to save watermark", "error", err)
+		app.errorResponse(w, http.StatusInternalServerError, "failed to save watermark")
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, envelope{"watermark": wm}, nil)
+}
+
+// deleteWatermarkHandler removes the watermark of the current user.
+func (app *application) deleteWatermarkHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	err := app.models.Watermark.Delete(r.Context(), user.ID)
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			app.errorResponse(w, http.StatusNotFound, "no watermark is set")
+			return
+		}
+		app.logger.ErrorContext(r.Context(), "failed to delete watermark", "error", err)
+		app.errorResponse(w, http.StatusInternalServerError, "failed to delete watermark")
+		return
+	}
+
+	app.writeJSON(w, http.StatusOK, envelope{"message": "watermark deleted"}, nil)
+}
+
+/*
+previewWatermarkHandler returns, as a PNG image, the current user's watermark with the
+changes in a watermarkForm applied, without saving them. It is drawn onto the creative
+named by creative_id, which must belong to the user, or onto a blank 1200x630 image.
+*/
+func (app *application) previewWatermarkHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	form, err := app.readWatermarkForm(w, r)
+	if err != nil {
+		var maxBytesError *http.MaxBytesError
+		if errors.As(err, &maxBytesError) {
+			app.errorResponse(w, http.StatusRequestEntityTooLarge, fmt.Sprintf("logos are limited to %d bytes", maxLogoBytes))
+			return
+		}
+		app.errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	wm, err := app.currentWatermark(r.Context(), user.ID)
+	if err != nil {
+		app.logger.ErrorContext(r.Context(), "failed to fetch watermark", "error", err)
+		app.errorResponse(w, http.StatusInternalServerError, "failed to preview watermark")
+		return
+	}
+
+	err = form.apply(wm)
+	if err != nil {
+		app.errorResponse(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	logo := form.logoImage
+	if logo == nil {
+		if wm.LogoKey == "" {
+			app.errorResponse(w, http.StatusBadRequest, "logo is required")
+			return
+		}
+		logo, err = app.loadLogo(r.Context(), wm)
+		if err != nil {
+			app.logger.ErrorContext(r.Context(), "failed to load logo", "error", err)
+			app.errorResponse(w, http.StatusInternalServerError, "failed to preview watermark")
+			return
+		}
+	}
+
+	var canvas *image.RGBA
+	if form.creativeID == "" {
+		canvas = image.NewRGBA(image.Rect(0, 0, 1200, 630))
+		draw.Draw(canvas, canvas.Bounds(), image.NewUniform(color.RGBA{R: 0xee, G: 0xee, B: 0xee, A: 0xff}), image.Point{}, draw.Src)
+	} else {
+		var ok bool
+		canvas, ok = app.previewCanvas(w, r, user.ID, form.creativeID)
+		if !ok {
+			return
+		}
+	}
+
+	drawWatermark(canvas, wm, logo)
+
+	var buf bytes.Buffer
+	err = png.Encode(&buf, canvas)
+	if err != nil {
+		app.logger.ErrorContext(r.Context(), "failed to encode preview", "error", err)
+		app.errorResponse(w, http.StatusInternalServerError, "failed to preview watermark")
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/png")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(buf.Bytes())
+}
+
+// previewCanvas decodes the image of a creative of the user to preview a watermark on. It
+// writes the error response and returns false if the creative cannot be used.
+func (app *application) previewCanvas(w http.ResponseWriter, r *http.Request, userID int64, creativeID string) (*image.RGBA, bool) {
+	id, err := strconv.ParseInt(creativeID, 10, 64)
+	if err != nil || id < 1 {
+		app.errorResponse(w, http.StatusBadRequest, "creative_id must be the ID of one of your creatives")
+		return nil, false
+	}
+
+	creative, err := app.models.Creative.Get(r.Context(), id)
+	if err == nil && creative.UserID != userID {
+		err = data.ErrRecordNotFound
+	}
+	if err != nil {
+		if errors.Is(err, data.ErrRecordNotFound) {
+			app.errorResponse(w, http.StatusBadRequest, "creative_id must be the ID of one of your creatives")
+			return nil, false
+		}
+		app.logger.ErrorContext(r.Context(), "failed to fetch creative", "error", err)
+		app.errorResponse(w, http.StatusInternalServerError, "failed to preview watermark")
+		return nil, false
+	}
+
+	img, err := app.decodeCreative(r.Context(), creative)
+	if err != nil {
+		app.logger.ErrorContext(r.Context(), "failed to decode creative", "creative_id", creative.ID, "error", err)
+		app.errorResponse(w, http.StatusUnprocessableEntity, "the file of this creative cannot be rendered")
+		return nil, false
+	}
+
+	canvas := image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+	draw.Draw(canvas, canvas.Bounds(), img, img.Bounds().Min, draw.Src)
+
+	return canvas, true
+}
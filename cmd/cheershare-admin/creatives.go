@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/vishaaxl/cheershare/internal/data"
+)
+
+// creativeView exposes the owner of a creative, which data.Creative hides from API
+// responses.
+type creativeView struct {
+	ID          int64     `json:"id"`
+	UserID      int64     `json:"user_id"`
+	CreativeURL string    `json:"creative_url"`
+	SizeBytes   int64     `json:"size_bytes"`
+	ScheduledAt string    `json:"scheduled_at"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+func (a *admin) printCreatives(creatives []data.Creative) error {
+	views := make([]creativeView, 0, len(creatives))
+	rows := make([][]string, 0, len(creatives))
+
+	for _, c := range creatives {
+		views = append(views, creativeView{
+			ID:          c.ID,
+			UserID:      c.UserID,
+			CreativeURL: c.CreativeURL,
+			SizeBytes:   c.SizeBytes,
+			ScheduledAt: c.ScheduledAt.Format(dateLayout),
+			CreatedAt:   c.CreatedAt,
+		})
+		rows = append(rows, []string{
+			strconv.FormatInt(c.ID, 10),
+			strconv.FormatInt(c.UserID, 10),
+			c.ScheduledAt.Format(dateLayout),
+			c.CreativeURL,
+			strconv.FormatInt(c.SizeBytes, 10),
+			c.CreatedAt.Format("2006-01-02 15:04:05"),
+		})
+	}
+
+	return a.out.print(views, []string{"ID", "USER", "SCHEDULED", "URL", "SIZE", "CREATED"}, rows)
+}
+
+func (a *admin) creativesList(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("creatives list", flag.ContinueOnError)
+	userID := fs.Int64("user-id", 0, "only list creatives of this user")
+	from := fs.String("from", "", "only list creatives scheduled on or after this date")
+	to := fs.String("to", "", "only list creatives scheduled on or before this date")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	filter := data.CreativeFilter{UserID: *userID}
+
+	var err error
+	filter.From, err = parseDate("from", *from)
+	if err != nil {
+		return err
+	}
+	filter.To, err = parseDate("to", *to)
+	if err != nil {
+		return err
+	}
+
+	creatives, err := a.models.Creative.List(ctx, filter)
+	if err != nil {
+		return err
+	}
+
+	return a.printCreatives(creatives)
+}
+
+func (a *admin) creativesReschedule(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("creatives reschedule", flag.ContinueOnError)
+	id := fs.Int64("id", 0, "ID of the creative")
+	date := fs.String("date", "", "new scheduled date (YYYY-MM-DD)")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *id == 0 || *date == "" {
+		return errors.New("-id and -date are required")
+	}
+
+	scheduledAt, err := parseDate("date", *date)
+	if err != nil {
+		return err
+	}
+
+	creative, err := a.models.Creative.Get(ctx, *id)
+	if errors.Is(err, data.ErrRecordNotFound) {
+		return errors.New("creative not found")
+	}
+	if err != nil {
+		return err
+	}
+
+	creative.ScheduledAt = scheduledAt
+
+	err = a.models.Creative.Update(ctx, creative)
+	if err != nil {
+		return err
+	}
+
+	return a.printCreatives([]data.Creative{*creative})
+}
+
+func (a *admin) creativesDelete(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("creatives delete", flag.ContinueOnError)
+	id := fs.Int64("id", 0, "ID of the creative")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *id == 0 {
+		return errors.New("-id is required")
+	}
+
+	err := a.models.Creative.Delete(ctx, *id)
+	if errors.Is(err, data.ErrRecordNotFound) {
+		return errors.New("creative not found")
+	}
+	if err != nil {
+		return err
+	}
+
+	return a.out.message(
+		map[string]interface{}{"deleted": true, "id": *id},
+		fmt.Sprintf("deleted creative %d", *id),
+	)
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/vishaaxl/cheershare/internal/gc"
+	"github.com/vishaaxl/cheershare/internal/storage"
+)
+
+/*
+gcRun removes stored files that no creative, resumable upload, direct upload,
+unfinished bulk upload, blob, watermark logo or WebP rendition references, after
+deleting the expired uploads, failing the stale bulk upload jobs and deleting the blobs
+left unreferenced for the grace period. The orphans are listed as a table (or as the
+JSON report), followed by a summary. With -dry-run nothing is deleted.
+*/
+func (a *admin) gcRun(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("gc run", flag.ContinueOnError)
+	backend := fs.String("storage-backend", envOr("STORAGE_BACKEND", "disk"), "storage backend, disk or s3, as configured for the API (defaults to $STORAGE_BACKEND); s3 is configured by the S3_* variables")
+	dir := fs.String("storage-dir", envOr("STORAGE_DIR", "./uploads"), "directory holding uploaded creatives, exactly as configured for the API (defaults to $STORAGE_DIR)")
+	grace := fs.Duration("grace", 24*time.Hour, "keep unreferenced files modified more recently than this")
+	staleAfter := fs.Duration("bulk-stale-after", time.Hour, "mark unfinished bulk uploads without progress for this long as failed, as configured for the API (defaults to $BULK_STALE_AFTER)")
+	dryRun := fs.Bool("dry-run", false, "only report the files that would be deleted")
+
+	if v, ok := os.LookupEnv("BULK_STALE_AFTER"); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return fmt.Errorf("invalid BULK_STALE_AFTER: %w", err)
+		}
+		*staleAfter = d
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	store, err := openStorage(ctx, *backend, *dir)
+	if err != nil {
+		return err
+	}
+
+	if !*dryRun {
+		var expired int64
+		for _, expire := range []func(context.Context) (int64, error){a.models.Upload.DeleteExpired, a.models.DirectUpload.DeleteExpired} {
+			n, err := expire(ctx)
+			if err != nil {
+				return err
+			}
+			expired += n
+		}
+		if !a.out.json && expired > 0 {
+			fmt.Fprintf(a.out.w, "deleted %d expired uploads\n\n", expired)
+		}
+
+		// Failing stale jobs first lets their archives be collected below.
+		stale, err := a.models.BulkJob.FailStale(ctx, time.Now().Add(-*staleAfter))
+		if err != nil {
+			return err
+		}
+		if !a.out.json && stale > 0 {
+			fmt.Fprintf(a.out.w, "failed %d stale bulk upload jobs\n\n", stale)
+		}
+
+		blobs, err := a.models.Blob.DeleteUnreferenced(ctx, time.Now().Add(-*grace))
+		if err != nil {
+			return err
+		}
+		if !a.out.json && blobs > 0 {
+			fmt.Fprintf(a.out.w, "deleted %d unreferenced blobs\n\n", blobs)
+		}
+	}
+
+	collector := &gc.Collector{
+		Storage: store,
+		Sources: []gc.ReferenceSource{
+			a.models.Creative,
+			gc.KeySource{Storage: store, Keys: a.models.Upload.ReferencedKeys},
+			gc.KeySource{Storage: store, Keys: a.models.DirectUpload.ReferencedKeys},
+			gc.KeySource{Storage: store, Keys: a.models.BulkJob.ReferencedKeys},
+			gc.KeySource{Storage: store, Keys: a.models.Blob.ReferencedKeys},
+			gc.KeySource{Storage: store, Keys: a.models.Watermark.ReferencedKeys},
+			gc.KeySource{Storage: store, Keys: a.models.Rendition.ReferencedKeys},
+		},
+		Grace: *grace,
+	}
+
+	report, runErr := collector.Run(ctx, *dryRun)
+	if report == nil {
+		return runErr
+	}
+
+	if a.out.json {
+		if err := a.out.print(report, nil, nil); err != nil {
+			return err
+		}
+		return runErr
+	}
+
+	rows := make([][]string, 0, len(report.Orphans))
+	for _, object := range report.Orphans {
+		rows = append(rows, []string{
+			object.Key,
+			strconv.FormatInt(object.Size, 10),
+			object.ModTime.Format("2006-01-02 15:04:05"),
+		})
+	}
+	if err := a.out.print(report, []string{"ORPHAN", "SIZE", "MODIFIED"}, rows); err != nil {
+		return err
+	}
+
+	verb := "deleted"
+	if report.DryRun {
+		verb = "would delete"
+	}
+	fmt.Fprintf(a.out.w, "\nscanned %d files: %d referenced, %d within the grace period, %s %d (%d bytes), %d failed\n",
+		report.Scanned, report.Referenced, report.Recent, verb, len(report.Orphans)-len(report.Failed), report.BytesFreed, len(report.Failed))
+
+	return runErr
+}
+
+// openStorage opens the named storage backend. The s3 backend reads the same S3_*
+// environment variables as the API.
+func openStorage(ctx context.Context, backend, dir string) (storage.Storage, error) {
+	switch backend {
+	case "disk":
+		return storage.NewDisk(dir)
+	case "s3":
+		useSSL, _ := strconv.ParseBool(os.Getenv("S3_USE_SSL"))
+		return storage.NewS3(ctx, storage.S3Config{
+			Endpoint:  envOr("S3_ENDPOINT", "localhost:9000"),
+			Bucket:    envOr("S3_BUCKET", "cheershare"),
+			Region:    envOr("S3_REGION", "us-east-1"),
+			AccessKey: envOr("S3_ACCESS_KEY", "minioadmin"),
+			SecretKey: envOr("S3_SECRET_KEY", "minioadmin"),
+			UseSSL:    useSSL,
+		})
+	default:
+		return nil, fmt.Errorf("unknown storage backend %q", backend)
+	}
+}
+
+// envOr returns the value of the environment variable key, or fallback if it is unset.
+func envOr(key, fallback string) string {
+	if v, ok := os.LookupEnv(key); ok {
+		return v
+	}
+	return fallback
+}
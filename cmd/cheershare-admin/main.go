@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/joho/godotenv"
+	_ "github.com/lib/pq"
+	"github.com/vishaaxl/cheershare/internal/data"
+)
+
+const usage = `usage: cheershare-admin [-dsn DSN] [-redis ADDR] [-format table|json] <resource> <command> [flags]
+
+users:
+  users get          -phone P | -id N
+  users set-name     -phone P | -id N  -name NAME
+  users set-role     -phone P | -id N  -role user|admin
+  users set-plan     -phone P | -id N  -plan NAME
+
+tokens:
+  tokens revoke      -phone P | -id N  revoke every authentication token of a user
+  tokens purge-expired                 delete all expired tokens
+
+creatives:
+  creatives list       [-user-id N] [-from YYYY-MM-DD] [-to YYYY-MM-DD]
+  creatives reschedule -id N -date YYYY-MM-DD
+  creatives delete     -id N
+
+gc:
+  gc run  [-storage-backend disk|s3] [-storage-dir DIR] [-grace 24h] [-bulk-stale-after 1h] [-dry-run]
+          delete files no creative or pending upload references
+
+Run "cheershare-admin <resource> <command> -h" for the flags of a command.`
+
+// dateLayout is the format used for scheduled dates, as accepted by /upload-creative.
+const dateLayout = "2006-01-02"
+
+/*
+admin carries what every command needs: the models shared with the API server and the
+printer for the selected output format.
+*/
+type admin struct {
+	models data.Models
+	out    *printer
+}
+
+// command is the signature of every subcommand; args excludes the resource and command names.
+type command func(ctx context.Context, args []string) error
+
+func main() {
+	// The .env file is optional for the CLI; DB_DSN may come from the environment.
+	_ = godotenv.Load()
+
+	err := run(os.Args[1:], os.Stdout)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		os.Exit(1)
+	}
+}
+
+func run(args []string, stdout io.Writer) error {
+	fs := flag.NewFlagSet("cheershare-admin", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprintln(fs.Output(), usage) }
+
+	dsn := fs.String("dsn", os.Getenv("DB_DSN"), "PostgreSQL DSN (defaults to $DB_DSN)")
+	redisAddr := fs.String("redis", os.Getenv("REDIS_ADDR"), "Redis address used to invalidate cached results (defaults to $REDIS_ADDR)")
+	format := fs.String("format", "table", "output format: table or json")
+	timeout := fs.Duration("timeout", 30*time.Second, "timeout for the whole command")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if *format != "table" && *format != "json" {
+		return fmt.Errorf("unknown format %q", *format)
+	}
+
+	if fs.NArg() < 2 {
+		fs.Usage()
+		return errors.New("missing resource or command")
+	}
+	if *dsn == "" {
+		return errors.New("no database DSN: set DB_DSN or pass -dsn")
+	}
+
+	db, err := sql.Open("postgres", *dsn)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	err = db.PingContext(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to connect to database: %w", err)
+	}
+
+	/*
+	   Without Redis, changes only show on /scheduled and revoked tokens only stop
+	   working once the API's cached results expire.
+	*/
+	models := data.NewModels(db)
+	if *redisAddr != "" {
+		rdb := redis.NewClient(&redis.Options{
+			Addr:     *redisAddr,
+			Password: os.Getenv("REDIS_PASSWORD"),
+		})
+		defer rdb.Close()
+
+		// The TTLs only apply to entries stored by reads, which the CLI does not make.
+		models = models.WithScheduledCache(rdb, time.Minute)
+		models = models.WithTokenCache(data.NewTokenCache(rdb, data.TokenCacheOptions{TTL: time.Minute}))
+	}
+
+	a := &admin{
+		models: models,
+		out:    &printer{w: stdout, json: *format == "json"},
+	}
+
+	commands := map[string]map[string]command{
+		"users": {
+			"get":      a.usersGet,
+			"set-name": a.usersSetName,
+			"set-role": a.usersSetRole,
+			"set-plan": a.usersSetPlan,
+		},
+		"tokens": {
+			"revoke":        a.tokensRevoke,
+			"purge-expired": a.tokensPurgeExpired,
+		},
+		"creatives": {
+			"list":       a.creativesList,
+			"reschedule": a.creativesReschedule,
+			"delete":     a.creativesDelete,
+		},
+		"gc": {
+			"run": a.gcRun,
+		},
+	}
+
+	resource, name := fs.Arg(0), fs.Arg(1)
+	cmd, ok := commands[resource][name]
+	if !ok {
+		fs.Usage()
+		return fmt.Errorf("unknown command %q %q", resource, name)
+	}
+
+	return cmd(ctx, fs.Args()[2:])
+}
+
+/*
+userSelector registers the -phone and -id flags used by the user and token commands to
+pick a single user.
+*/
+type userSelector struct {
+	phone string
+	id    int64
+}
+
+func (s *userSelector) register(fs *flag.FlagSet) {
+	fs.StringVar(&s.phone, "phone", "", "phone number of the user")
+	fs.Int64Var(&s.id, "id", 0, "ID of the user")
+}
+
+func (s *userSelector) lookup(ctx context.Context, models data.Models) (*data.User, error) {
+	var (
+		user *data.User
+		err  error
+	)
+
+	switch {
+	case s.phone != "" && s.id != 0:
+		return nil, errors.New("use either -phone or -id, not both")
+	case s.phone != "":
+		user, err = models.User.GetByPhoneNumber(ctx, s.phone)
+	case s.id != 0:
+		user, err = models.User.Get(ctx, s.id)
+	default:
+		return nil, errors.New("-phone or -id is required")
+	}
+
+	if errors.Is(err, data.ErrRecordNotFound) {
+		return nil, errors.New("user not found")
+	}
+	return user, err
+}
+
+// parseDate parses an optional YYYY-MM-DD flag value.
+func parseDate(name, value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	t, err := time.Parse(dateLayout, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid -%s %q: expected YYYY-MM-DD", name, value)
+	}
+	return t, nil
+}
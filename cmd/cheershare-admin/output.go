@@ -0,0 +1,45 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+)
+
+// printer writes command results either as an aligned table for humans or as JSON for
+// scripts.
+type printer struct {
+	w    io.Writer
+	json bool
+}
+
+/*
+print writes v as indented JSON, or the given header and rows as a table. Commands pass
+both representations so that the JSON output keeps full field names and types.
+*/
+func (p *printer) print(v interface{}, header []string, rows [][]string) error {
+	if p.json {
+		enc := json.NewEncoder(p.w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	}
+
+	tw := tabwriter.NewWriter(p.w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(header, "\t"))
+	for _, row := range rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
+
+// message prints the outcome of a command that does not return records.
+func (p *printer) message(v map[string]interface{}, text string) error {
+	if p.json {
+		return p.print(v, nil, nil)
+	}
+
+	_, err := fmt.Fprintln(p.w, text)
+	return err
+}
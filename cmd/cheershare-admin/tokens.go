@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+
+	"github.com/vishaaxl/cheershare/internal/data"
+)
+
+func (a *admin) tokensRevoke(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("tokens revoke", flag.ContinueOnError)
+	var sel userSelector
+	sel.register(fs)
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	user, err := sel.lookup(ctx, a.models)
+	if err != nil {
+		return err
+	}
+
+	err = a.models.Token.DeleteAllForUser(ctx, data.ScopeAuthentication, user.ID)
+	if err != nil {
+		return err
+	}
+
+	return a.out.message(
+		map[string]interface{}{"revoked": true, "user_id": user.ID},
+		fmt.Sprintf("revoked all authentication tokens of user %d", user.ID),
+	)
+}
+
+func (a *admin) tokensPurgeExpired(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("tokens purge-expired", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	n, err := a.models.Token.DeleteExpired(ctx)
+	if err != nil {
+		return err
+	}
+
+	return a.out.message(
+		map[string]interface{}{"deleted": n},
+		fmt.Sprintf("deleted %d expired tokens", n),
+	)
+}
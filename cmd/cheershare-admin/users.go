@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/vishaaxl/cheershare/internal/data"
+)
+
+func (a *admin) printUser(user *data.User) error {
+	return a.out.print(user,
+		[]string{"ID", "NAME", "PHONE", "ROLE", "PLAN", "CREATED", "VERSION"},
+		[][]string{{
+			strconv.FormatInt(user.ID, 10),
+			user.Name,
+			user.PhoneNumber,
+			user.Role,
+			user.Plan,
+			user.CreatedAt.Format("2006-01-02 15:04:05"),
+			strconv.Itoa(user.Version),
+		}},
+	)
+}
+
+func (a *admin) usersGet(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("users get", flag.ContinueOnError)
+	var sel userSelector
+	sel.register(fs)
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	user, err := sel.lookup(ctx, a.models)
+	if err != nil {
+		return err
+	}
+
+	return a.printUser(user)
+}
+
+func (a *admin) usersSetName(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("users set-name", flag.ContinueOnError)
+	var sel userSelector
+	sel.register(fs)
+	name := fs.String("name", "", "new name of the user")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if strings.TrimSpace(*name) == "" {
+		return errors.New("-name is required")
+	}
+
+	return a.updateUser(ctx, sel, func(user *data.User) { user.Name = strings.TrimSpace(*name) })
+}
+
+func (a *admin) usersSetRole(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("users set-role", flag.ContinueOnError)
+	var sel userSelector
+	sel.register(fs)
+	role := fs.String("role", "", "new role: "+strings.Join(data.Roles, " or "))
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if !slices.Contains(data.Roles, *role) {
+		return fmt.Errorf("-role must be one of %s", strings.Join(data.Roles, ", "))
+	}
+
+	return a.updateUser(ctx, sel, func(user *data.User) { user.Role = *role })
+}
+
+func (a *admin) usersSetPlan(ctx context.Context, args []string) error {
+	fs := flag.NewFlagSet("users set-plan", flag.ContinueOnError)
+	var sel userSelector
+	sel.register(fs)
+	plan := fs.String("plan", "", "new plan, as listed in the plans table")
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *plan == "" {
+		return errors.New("-plan is required")
+	}
+
+	return a.updateUser(ctx, sel, func(user *data.User) { user.Plan = *plan })
+}
+
+// updateUser loads the selected user, applies change and saves it, reporting an edit
+// conflict if the user was modified concurrently.
+func (a *admin) updateUser(ctx context.Context, sel userSelector, change func(*data.User)) error {
+	user, err := sel.lookup(ctx, a.models)
+	if err != nil {
+		return err
+	}
+
+	change(user)
+
+	err = a.models.User.Update(ctx, user)
+	if errors.Is(err, data.ErrEditConflict) {
+		return errors.New("the user was modified concurrently, please retry")
+	}
+	if errors.Is(err, data.ErrUnknownPlan) {
+		return fmt.Errorf("unknown plan %q", user.Plan)
+	}
+	if err != nil {
+		return err
+	}
+
+	return a.printUser(user)
+}
@@ -0,0 +1,46 @@
+package data
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+const (
+	AuditUserSignup = "user.signup"
+	AuditUserLogin  = "user.login"
+)
+
+// AuditEvent records a security relevant action taken by (or on behalf of) a user.
+type AuditEvent struct {
+	ID        int64                  `json:"id"`
+	UserID    int64                  `json:"user_id"`
+	Action    string                 `json:"action"`
+	Metadata  map[string]interface{} `json:"metadata"`
+	CreatedAt time.Time              `json:"created_at"`
+}
+
+type AuditModel struct {
+	DB DBTX
+}
+
+func (m AuditModel) Insert(ctx context.Context, event *AuditEvent) (err error) {
+	query := `INSERT INTO audit_events (user_id, action, metadata)
+	VALUES ($1, $2, $3)
+	RETURNING id, created_at`
+
+	metadata := event.Metadata
+	if metadata == nil {
+		metadata = map[string]interface{}{}
+	}
+
+	js, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+
+	ctx, span := startSpan(ctx, "AuditModel.Insert", "audit_events", "INSERT")
+	defer func() { endSpan(span, err) }()
+
+	return m.DB.QueryRowContext(ctx, query, event.UserID, event.Action, js).Scan(&event.ID, &event.CreatedAt)
+}
@@ -0,0 +1,129 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+/*
+Blob is a stored file shared by every creative with the same content. RefCount is the
+number of creatives referencing it, maintained by the database as creatives are inserted
+and deleted. A blob that is no longer referenced is removed by DeleteUnreferenced, after
+which the garbage collector deletes its object.
+*/
+type Blob struct {
+	SHA256    string    `json:"sha256"`
+	Key       string    `json:"-"`
+	SizeBytes int64     `json:"size_bytes"`
+	RefCount  int       `json:"ref_count"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type BlobModel struct {
+	DB DBTX
+}
+
+func (m BlobModel) Get(ctx context.Context, sha256 string) (_ *Blob, err error) {
+	query := `
+		SELECT sha256, storage_key, size_bytes, ref_count, created_at, updated_at
+		FROM blobs
+		WHERE sha256 = $1
+	`
+
+	ctx, span := startSpan(ctx, "BlobModel.Get", "blobs", "SELECT")
+	defer func() { endSpan(span, err) }()
+
+	var blob Blob
+	err = m.DB.QueryRowContext(ctx, query, sha256).Scan(
+		&blob.SHA256,
+		&blob.Key,
+		&blob.SizeBytes,
+		&blob.RefCount,
+		&blob.CreatedAt,
+		&blob.UpdatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &blob, nil
+}
+
+/*
+Insert records a blob. If a blob with the same digest already exists it is kept, and
+blob is updated to match it: callers must use blob.Key afterwards rather than the key
+they inserted. Either way UpdatedAt is bumped, which keeps an unreferenced blob from
+being collected while a creative referencing it is being created.
+*/
+func (m BlobModel) Insert(ctx context.Context, blob *Blob) (err error) {
+	query := `
+		INSERT INTO blobs (sha256, storage_key, size_bytes)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (sha256) DO UPDATE SET updated_at = NOW()
+		RETURNING storage_key, size_bytes, ref_count, created_at, updated_at
+	`
+
+	ctx, span := startSpan(ctx, "BlobModel.Insert", "blobs", "INSERT")
+	defer func() { endSpan(span, err) }()
+
+	return m.DB.QueryRowContext(ctx, query, blob.SHA256, blob.Key, blob.SizeBytes).Scan(
+		&blob.Key,
+		&blob.SizeBytes,
+		&blob.RefCount,
+		&blob.CreatedAt,
+		&blob.UpdatedAt,
+	)
+}
+
+// DeleteUnreferenced removes the blobs that no creative has referenced since before, and
+// returns how many were removed. Their objects are left to the garbage collector.
+func (m BlobModel) DeleteUnreferenced(ctx context.Context, before time.Time) (_ int64, err error) {
+	query := `DELETE FROM blobs WHERE ref_count = 0 AND updated_at < $1`
+
+	ctx, span := startSpan(ctx, "BlobModel.DeleteUnreferenced", "blobs", "DELETE")
+	defer func() { endSpan(span, err) }()
+
+	result, err := m.DB.ExecContext(ctx, query, before)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// ReferencedKeys returns the storage keys of every blob.
+func (m BlobModel) ReferencedKeys(ctx context.Context) (_ []string, err error) {
+	query := `SELECT storage_key FROM blobs`
+
+	ctx, span := startSpan(ctx, "BlobModel.ReferencedKeys", "blobs", "SELECT")
+	defer func() { endSpan(span, err) }()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []string{}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,232 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+const (
+	BulkJobPending   = "pending"
+	BulkJobRunning   = "running"
+	BulkJobCompleted = "completed"
+	BulkJobFailed    = "failed"
+
+	BulkItemPending = "pending"
+	BulkItemCreated = "created"
+	BulkItemFailed  = "failed"
+)
+
+/*
+BulkJob is a bulk upload: a ZIP archive of images and a manifest listing which file to
+schedule on which date. The manifest entries become Items, processed one by one in the
+background. A job is completed once every item is processed, even if some failed; it
+only fails as a whole if the archive cannot be read.
+*/
+type BulkJob struct {
+	ID         string     `json:"id"`
+	UserID     int64      `json:"-"`
+	Status     string     `json:"status"`
+	ArchiveKey string     `json:"-"`
+	Items      []BulkItem `json:"items"`
+	Error      string     `json:"error,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+}
+
+// BulkItem is a manifest entry and the outcome of creating its creative.
+type BulkItem struct {
+	Filename    string   `json:"filename"`
+	ScheduledAt string   `json:"scheduled_at"`
+	Title       string   `json:"title,omitempty"`
+	Caption     string   `json:"caption,omitempty"`
+	Language    string   `json:"language,omitempty"`
+	AltText     string   `json:"alt_text,omitempty"`
+	Tags        []string `json:"tags,omitempty"`
+	Status      string   `json:"status"`
+	Error       string   `json:"error,omitempty"`
+	CreativeID  int64    `json:"creative_id,omitempty"`
+	// Warnings are reported for created items, e.g. when the same image is already
+	// scheduled on the same date.
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// Counts returns how many items are pending, created and failed.
+func (j *BulkJob) Counts() (pending, created, failed int) {
+	for _, item := range j.Items {
+		switch item.Status {
+		case BulkItemCreated:
+			created++
+		case BulkItemFailed:
+			failed++
+		default:
+			pending++
+		}
+	}
+	return pending, created, failed
+}
+
+// Finished reports whether the job will not change any more.
+func (j *BulkJob) Finished() bool {
+	return j.Status == BulkJobCompleted || j.Status == BulkJobFailed
+}
+
+type BulkJobModel struct {
+	DB DBTX
+}
+
+func (m BulkJobModel) Insert(ctx context.Context, job *BulkJob) (err error) {
+	query := `
+		INSERT INTO bulk_upload_jobs (id, user_id, status, archive_key, items)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING created_at, updated_at
+	`
+
+	items, err := json.Marshal(job.Items)
+	if err != nil {
+		return err
+	}
+
+	args := []interface{}{job.ID, job.UserID, job.Status, job.ArchiveKey, items}
+
+	ctx, span := startSpan(ctx, "BulkJobModel.Insert", "bulk_upload_jobs", "INSERT")
+	defer func() { endSpan(span, err) }()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&job.CreatedAt, &job.UpdatedAt)
+}
+
+func (m BulkJobModel) Get(ctx context.Context, id string) (_ *BulkJob, err error) {
+	query := `
+		SELECT id, user_id, status, coalesce(archive_key, ''), items, error, created_at, updated_at, finished_at
+		FROM bulk_upload_jobs
+		WHERE id = $1
+	`
+
+	ctx, span := startSpan(ctx, "BulkJobModel.Get", "bulk_upload_jobs", "SELECT")
+	defer func() { endSpan(span, err) }()
+
+	var (
+		job   BulkJob
+		items []byte
+	)
+	err = m.DB.QueryRowContext(ctx, query, id).Scan(
+		&job.ID,
+		&job.UserID,
+		&job.Status,
+		&job.ArchiveKey,
+		&items,
+		&job.Error,
+		&job.CreatedAt,
+		&job.UpdatedAt,
+		&job.FinishedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	err = json.Unmarshal(items, &job.Items)
+	if err != nil {
+		return nil, err
+	}
+
+	return &job, nil
+}
+
+/*
+Update saves the job's status, items and error, and sets UpdatedAt. FinishedAt is set
+when the job moves to a finished status, and the archive is forgotten as it is no longer
+needed.
+*/
+func (m BulkJobModel) Update(ctx context.Context, job *BulkJob) (err error) {
+	query := `
+		UPDATE bulk_upload_jobs
+		SET status = $1, items = $2, error = $3, updated_at = NOW(),
+			finished_at = CASE WHEN $4 THEN coalesce(finished_at, NOW()) END,
+			archive_key = CASE WHEN $4 THEN NULL ELSE archive_key END
+		WHERE id = $5
+		RETURNING updated_at, finished_at
+	`
+
+	items, err := json.Marshal(job.Items)
+	if err != nil {
+		return err
+	}
+
+	ctx, span := startSpan(ctx, "BulkJobModel.Update", "bulk_upload_jobs", "UPDATE")
+	defer func() { endSpan(span, err) }()
+
+	err = m.DB.QueryRowContext(ctx, query, job.Status, items, job.Error, job.Finished(), job.ID).Scan(&job.UpdatedAt, &job.FinishedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return err
+		}
+	}
+
+	if job.Finished() {
+		job.ArchiveKey = ""
+	}
+	return nil
+}
+
+/*
+FailStale marks the unfinished jobs that have not been updated since before as failed,
+and returns how many were marked. A job is updated after every item, so this catches
+jobs whose server stopped while processing them.
+*/
+func (m BulkJobModel) FailStale(ctx context.Context, before time.Time) (_ int64, err error) {
+	query := `
+		UPDATE bulk_upload_jobs
+		SET status = 'failed', error = 'processing was interrupted', updated_at = NOW(), finished_at = NOW(), archive_key = NULL
+		WHERE status IN ('pending', 'running') AND updated_at < $1
+	`
+
+	ctx, span := startSpan(ctx, "BulkJobModel.FailStale", "bulk_upload_jobs", "UPDATE")
+	defer func() { endSpan(span, err) }()
+
+	result, err := m.DB.ExecContext(ctx, query, before)
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// ReferencedKeys returns the storage keys of the archives of unfinished jobs.
+func (m BulkJobModel) ReferencedKeys(ctx context.Context) (_ []string, err error) {
+	query := `SELECT archive_key FROM bulk_upload_jobs WHERE archive_key IS NOT NULL`
+
+	ctx, span := startSpan(ctx, "BulkJobModel.ReferencedKeys", "bulk_upload_jobs", "SELECT")
+	defer func() { endSpan(span, err) }()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []string{}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
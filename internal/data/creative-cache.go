@@ -0,0 +1,225 @@
+package data
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"fmt"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// scheduledGenerationTTL bounds how long an untouched date's generation counter is
+// kept. It must be longer than any cache entry's TTL, see CachedCreativeModel.
+const scheduledGenerationTTL = 72 * time.Hour
+
+/*
+CachedCreativeModel decorates a CreativeRepository with a Redis cache of the
+GetScheduledCreatives result. Entries are keyed by the requested dates and time zone,
+plus a generation counter for each of the two dates. Insert, Update and Delete bump the
+counters of the dates they touch once the write succeeded, so later reads compute a
+different key and never see the old entry; a read that raced with the write can only
+store its result under the old, unreachable key. Day rollover needs no invalidation as
+the dates are part of the key.
+
+Inside a transaction the counters are only bumped once it has committed (see
+Models.AfterCommit), as a read made before then would cache the old result under the
+new key. Redis errors never fail a call: reads fall back to the wrapped repository and
+failed invalidations are recorded on the current span, leaving stale entries to expire
+after ttl. All other methods are passed through.
+*/
+type CachedCreativeModel struct {
+	CreativeRepository
+	rdb *redis.Client
+	ttl time.Duration
+	// afterCommit defers invalidations until the transaction the model is bound to
+	// commits. It is nil outside of transactions.
+	afterCommit func(fn func())
+}
+
+var _ CreativeRepository = (*CachedCreativeModel)(nil)
+
+// NewCachedCreativeModel returns next with GetScheduledCreatives cached in rdb for ttl.
+// Use Models.WithScheduledCache to cache the creatives of transactions too.
+func NewCachedCreativeModel(next CreativeRepository, rdb *redis.Client, ttl time.Duration) *CachedCreativeModel {
+	return &CachedCreativeModel{CreativeRepository: next, rdb: rdb, ttl: ttl}
+}
+
+/*
+WithScheduledCache returns m with the scheduled creatives cached in rdb for ttl, see
+CachedCreativeModel, including in the models of its transactions. Deleting a user also
+invalidates the dates of their creatives, which are deleted with them.
+*/
+func (m Models) WithScheduledCache(rdb *redis.Client, ttl time.Duration) Models {
+	return m.decorate(func(m Models) Models {
+		creatives := NewCachedCreativeModel(m.Creative, rdb, ttl)
+		creatives.afterCommit = m.afterCommit
+
+		m.Creative = creatives
+		m.User = &scheduledCacheUserModel{UserRepository: m.User, creatives: creatives}
+		return m
+	})
+}
+
+func (c *CachedCreativeModel) GetScheduledCreatives(ctx context.Context, now time.Time) (map[string][]Creative, error) {
+	dates := scheduledDates(now)
+
+	key, err := c.scheduledKey(ctx, now, dates)
+	if err == nil {
+		cached, err := c.rdb.Get(ctx, key).Bytes()
+		if err == nil {
+			var creatives map[string][]Creative
+			if gob.NewDecoder(bytes.NewReader(cached)).Decode(&creatives) == nil {
+				// gob decodes empty slices as nil, which would be encoded as JSON null.
+				for day, list := range creatives {
+					if list == nil {
+						creatives[day] = []Creative{}
+					}
+					for i := range list {
+						if list[i].Tags == nil {
+							list[i].Tags = []string{}
+						}
+					}
+				}
+				return creatives, nil
+			}
+		}
+	}
+
+	creatives, err := c.CreativeRepository.GetScheduledCreatives(ctx, now)
+	if err != nil {
+		return nil, err
+	}
+
+	if key != "" {
+		// gob rather than JSON, as Creative hides UserID from its JSON encoding.
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(creatives); err == nil {
+			c.rdb.Set(ctx, key, buf.Bytes(), c.ttl)
+		}
+	}
+
+	return creatives, nil
+}
+
+func (c *CachedCreativeModel) Insert(ctx context.Context, creative *Creative) error {
+	err := c.CreativeRepository.Insert(ctx, creative)
+	if err != nil {
+		return err
+	}
+
+	afterCommit(c.afterCommit, func() { c.invalidate(ctx, creative.ScheduledAt) })
+	return nil
+}
+
+// Update reads the creative first so that the cache entries for both its old and its new
+// scheduled date are invalidated.
+func (c *CachedCreativeModel) Update(ctx context.Context, creative *Creative) error {
+	old, err := c.CreativeRepository.Get(ctx, creative.ID)
+	if err != nil {
+		return err
+	}
+
+	err = c.CreativeRepository.Update(ctx, creative)
+	if err != nil {
+		return err
+	}
+
+	afterCommit(c.afterCommit, func() { c.invalidate(ctx, old.ScheduledAt, creative.ScheduledAt) })
+	return nil
+}
+
+func (c *CachedCreativeModel) Delete(ctx context.Context, id int64) error {
+	old, err := c.CreativeRepository.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	err = c.CreativeRepository.Delete(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	afterCommit(c.afterCommit, func() { c.invalidate(ctx, old.ScheduledAt) })
+	return nil
+}
+
+// scheduledKey returns the cache key for the scheduled creatives of dates, as seen from
+// now's time zone, at the dates' current generations.
+func (c *CachedCreativeModel) scheduledKey(ctx context.Context, now time.Time, dates []time.Time) (string, error) {
+	gens, err := c.rdb.MGet(ctx, generationKey(dates[0]), generationKey(dates[1])).Result()
+	if err != nil {
+		return "", err
+	}
+
+	for i, gen := range gens {
+		if gen == nil {
+			gens[i] = "0"
+		}
+	}
+
+	return fmt.Sprintf("scheduled:%s:%s:%s.%s", dates[0].Format(dateLayout), now.Location(), gens[0], gens[1]), nil
+}
+
+// invalidate bumps the generation of every date so that cached results including them
+// are no longer read. It runs even if ctx was cancelled after the write went through.
+func (c *CachedCreativeModel) invalidate(ctx context.Context, dates ...time.Time) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Second)
+	defer cancel()
+
+	_, err := c.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, date := range dates {
+			key := generationKey(date)
+			pipe.Incr(ctx, key)
+			pipe.Expire(ctx, key, max(scheduledGenerationTTL, 2*c.ttl))
+		}
+		return nil
+	})
+	if err != nil {
+		trace.SpanFromContext(ctx).RecordError(fmt.Errorf("invalidate scheduled creatives cache: %w", err))
+	}
+}
+
+/*
+scheduledCacheUserModel invalidates the scheduled dates of a user's creatives when the
+user is deleted, as the database deletes the creatives with them without going through
+the CreativeRepository.
+*/
+type scheduledCacheUserModel struct {
+	UserRepository
+	creatives *CachedCreativeModel
+}
+
+func (m *scheduledCacheUserModel) Delete(ctx context.Context, id int64) error {
+	owned, err := m.creatives.CreativeRepository.List(ctx, CreativeFilter{UserID: id})
+	if err != nil {
+		return err
+	}
+
+	err = m.UserRepository.Delete(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	seen := make(map[time.Time]bool)
+	var dates []time.Time
+	for _, creative := range owned {
+		if !seen[creative.ScheduledAt] {
+			seen[creative.ScheduledAt] = true
+			dates = append(dates, creative.ScheduledAt)
+		}
+	}
+	if len(dates) > 0 {
+		afterCommit(m.creatives.afterCommit, func() { m.creatives.invalidate(ctx, dates...) })
+	}
+	return nil
+}
+
+// dateLayout is the format of the dates used in cache keys.
+const dateLayout = "2006-01-02"
+
+func generationKey(date time.Time) string {
+	return "scheduled:gen:" + date.UTC().Format(dateLayout)
+}
@@ -0,0 +1,142 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+// newCachedMemoryModels returns in-memory models with the scheduled creatives cached in
+// a miniredis server.
+func newCachedMemoryModels(t *testing.T) (Models, *miniredis.Miniredis) {
+	t.Helper()
+
+	mr := miniredis.RunT(t)
+	rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { rdb.Close() })
+
+	return NewMemoryModels().WithScheduledCache(rdb, time.Hour), mr
+}
+
+// scheduledToday returns the number of creatives scheduled for today.
+func scheduledToday(t *testing.T, models Models, now time.Time) int {
+	t.Helper()
+
+	creatives, err := models.Creative.GetScheduledCreatives(context.Background(), now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(creatives["today"])
+}
+
+func TestScheduledCacheInvalidatedByTransactions(t *testing.T) {
+	ctx := context.Background()
+	models, mr := newCachedMemoryModels(t)
+	now := time.Now().UTC()
+	genKey := generationKey(scheduledDates(now)[0])
+
+	user := &User{Name: "Asha", PhoneNumber: "9876543210"}
+	if err := models.User.Insert(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+
+	// Prime the cache.
+	if n := scheduledToday(t, models, now); n != 0 {
+		t.Fatalf("%d creatives today, want 0", n)
+	}
+
+	err := models.WithTx(ctx, func(tx Models) error {
+		err := tx.Creative.Insert(ctx, &Creative{UserID: user.ID, ScheduledAt: now})
+		if err != nil {
+			return err
+		}
+
+		// Invalidating before the commit would let a concurrent read cache the old
+		// result under the new generation.
+		if mr.Exists(genKey) {
+			t.Error("generation bumped before the transaction committed")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := scheduledToday(t, models, now); n != 1 {
+		t.Fatalf("after a transactional insert: %d creatives today, want 1", n)
+	}
+
+	// Deleting the user deletes their creatives without going through the creatives
+	// repository, and must invalidate their dates too.
+	err = models.WithTx(ctx, func(tx Models) error {
+		return tx.User.Delete(ctx, user.ID)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := scheduledToday(t, models, now); n != 0 {
+		t.Fatalf("after deleting the owner: %d creatives today, want 0", n)
+	}
+}
+
+func TestScheduledCacheNotInvalidatedByRollback(t *testing.T) {
+	ctx := context.Background()
+	models, mr := newCachedMemoryModels(t)
+	now := time.Now().UTC()
+	genKey := generationKey(scheduledDates(now)[0])
+
+	user := &User{Name: "Asha", PhoneNumber: "9876543210"}
+	if err := models.User.Insert(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+
+	errAbort := errors.New("abort")
+	err := models.WithTx(ctx, func(tx Models) error {
+		err := tx.Creative.Insert(ctx, &Creative{UserID: user.ID, ScheduledAt: now})
+		if err != nil {
+			return err
+		}
+		return errAbort
+	})
+	if !errors.Is(err, errAbort) {
+		t.Fatalf("WithTx = %v, want %v", err, errAbort)
+	}
+
+	if mr.Exists(genKey) {
+		t.Error("rolled back transaction bumped the generation")
+	}
+	if n := scheduledToday(t, models, now); n != 0 {
+		t.Errorf("%d creatives today, want 0", n)
+	}
+}
+
+func TestScheduledCacheInvalidatedByDeletingOwner(t *testing.T) {
+	ctx := context.Background()
+	models, _ := newCachedMemoryModels(t)
+	now := time.Now().UTC()
+
+	user := &User{Name: "Asha", PhoneNumber: "9876543210"}
+	if err := models.User.Insert(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	if err := models.Creative.Insert(ctx, &Creative{UserID: user.ID, ScheduledAt: now}); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := scheduledToday(t, models, now); n != 1 {
+		t.Fatalf("%d creatives today, want 1", n)
+	}
+
+	if err := models.User.Delete(ctx, user.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := scheduledToday(t, models, now); n != 0 {
+		t.Errorf("after deleting the owner: %d creatives today, want 0", n)
+	}
+}
@@ -0,0 +1,141 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SearchFilter selects the creatives returned by Search. Zero values of UserID, From and
+// To are ignored.
+type SearchFilter struct {
+	// Query is written in the syntax of websearch_to_tsquery: words must all match,
+	// "quoted phrases" must match in order, "or" separates alternatives and a leading -
+	// excludes a word.
+	Query string
+	// Language is the language of Query (see Creative.Language). Its words are stemmed
+	// accordingly, and also matched as written.
+	Language string
+	UserID   int64
+	From     time.Time
+	To       time.Time
+	Page     int
+	PageSize int
+}
+
+// SearchHighlights are the title and caption of a search result, HTML escaped, with the
+// matching words wrapped in <mark> elements. The caption is cut down to the fragments
+// around the matches.
+type SearchHighlights struct {
+	Title   string `json:"title"`
+	Caption string `json:"caption"`
+}
+
+// SearchResult is a creative returned by Search, with its rank and highlights.
+type SearchResult struct {
+	Creative
+	Rank       float64          `json:"rank"`
+	Highlights SearchHighlights `json:"highlights"`
+}
+
+// htmlEscaped returns a SQL expression escaping the text column for HTML, so that only
+// the <mark> elements added by ts_headline are markup.
+func htmlEscaped(column string) string {
+	return fmt.Sprintf(`replace(replace(replace(%s, '&', '&amp;'), '<', '&lt;'), '>', '&gt;')`, column)
+}
+
+const (
+	titleHeadlineOptions   = `HighlightAll=true, StartSel=<mark>, StopSel=</mark>`
+	captionHeadlineOptions = `StartSel=<mark>, StopSel=</mark>, MinWords=10, MaxWords=30, MaxFragments=2, FragmentDelimiter=" … "`
+)
+
+/*
+Search returns a page of the creatives matching filter.Query, best first, and the number
+of matching creatives on every page. Creatives are ranked by ts_rank_cd over the search
+column, which weighs words in the title over those in the tags, caption and alt text.
+*/
+func (c *CreativeModel) Search(ctx context.Context, filter SearchFilter) (_ []SearchResult, _ int, err error) {
+	args := []interface{}{filter.Language, filter.Query}
+	conditions := []string{"search @@ q.query"}
+
+	if filter.UserID != 0 {
+		args = append(args, filter.UserID)
+		conditions = append(conditions, fmt.Sprintf("user_id = $%d", len(args)))
+	}
+	if !filter.From.IsZero() {
+		args = append(args, filter.From)
+		conditions = append(conditions, fmt.Sprintf("scheduled_at >= $%d", len(args)))
+	}
+	if !filter.To.IsZero() {
+		args = append(args, filter.To)
+		conditions = append(conditions, fmt.Sprintf("scheduled_at <= $%d", len(args)))
+	}
+
+	// The total is counted apart from the page, so that pages past the last one still
+	// report it.
+	matches := `
+		WITH q AS (
+			SELECT websearch_to_tsquery(creative_search_config($1), $2) || websearch_to_tsquery('simple', $2) AS query
+		)
+		%s
+		FROM creatives, q
+		WHERE ` + strings.Join(conditions, " AND ")
+
+	ctx, span := startSpan(ctx, "CreativeModel.Search", "creatives", "SELECT")
+	defer func() { endSpan(span, err) }()
+
+	var total int
+	err = c.DB.QueryRowContext(ctx, fmt.Sprintf(matches, "SELECT count(*)"), args...).Scan(&total)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	results := []SearchResult{}
+	offset := (filter.Page - 1) * filter.PageSize
+	if offset >= total {
+		return results, total, nil
+	}
+
+	args = append(args, filter.PageSize, offset)
+
+	query := fmt.Sprintf(matches, `SELECT `+creativeColumns+`,
+			ts_rank_cd(search, q.query) AS rank,
+			ts_headline(creative_search_config(language), `+htmlEscaped("title")+`, q.query, '`+titleHeadlineOptions+`'),
+			ts_headline(creative_search_config(language), `+htmlEscaped("caption")+`, q.query, '`+captionHeadlineOptions+`')`) + `
+		ORDER BY rank DESC, scheduled_at, id
+		LIMIT $` + fmt.Sprint(len(args)-1) + ` OFFSET $` + fmt.Sprint(len(args))
+
+	rows, err := c.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var result SearchResult
+		err := scanCreative(searchScanner{rows, &result}, &result.Creative)
+		if err != nil {
+			return nil, 0, err
+		}
+		results = append(results, result)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	return results, total, nil
+}
+
+// searchScanner scans a row of creativeColumns followed by the rank and highlights of a
+// search result.
+type searchScanner struct {
+	rows   *sql.Rows
+	result *SearchResult
+}
+
+func (s searchScanner) Scan(dest ...interface{}) error {
+	return s.rows.Scan(append(dest, &s.result.Rank, &s.result.Highlights.Title, &s.result.Highlights.Caption)...)
+}
@@ -3,55 +3,128 @@ package data
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
 	"time"
 
 	"github.com/lib/pq"
 )
 
 type Creative struct {
-	ID          int64     `json:"id"`
-	UserID      int64     `json:"-"`
-	CreativeURL string    `json:"creative_url"`
+	ID          int64  `json:"id"`
+	UserID      int64  `json:"-"`
+	CreativeURL string `json:"creative_url"`
+	SizeBytes   int64  `json:"size_bytes"`
+	Title       string `json:"title"`
+	Caption     string `json:"caption"`
+	// Language is an ISO 639-1 code with an optional region, e.g. "en" or "en-GB", or
+	// empty if it is not known.
+	Language string   `json:"language"`
+	AltText  string   `json:"alt_text"`
+	Tags     []string `json:"tags"`
+	// SHA256 names the blob holding the file. It is empty for creatives uploaded before
+	// files were deduplicated.
+	SHA256 string `json:"sha256,omitempty"`
+	// PHash is the perceptual hash of the image (see imaging.DHash), or nil if it is not
+	// known.
+	PHash       *int64    `json:"-"`
 	ScheduledAt time.Time `json:"scheduled_at"`
 	CreatedAt   time.Time `json:"created_at"`
 }
 
+// creativeColumns are the columns read into a Creative by scanCreative, in order.
+const creativeColumns = `id, user_id, creative_url, size_bytes, title, caption, language, alt_text, tags, coalesce(sha256, ''), phash, scheduled_at, created_at`
+
+// scanCreative reads a row of creativeColumns into creative.
+func scanCreative(row interface{ Scan(...interface{}) error }, creative *Creative) error {
+	return row.Scan(
+		&creative.ID,
+		&creative.UserID,
+		&creative.CreativeURL,
+		&creative.SizeBytes,
+		&creative.Title,
+		&creative.Caption,
+		&creative.Language,
+		&creative.AltText,
+		pq.Array(&creative.Tags),
+		&creative.SHA256,
+		&creative.PHash,
+		&creative.ScheduledAt,
+		&creative.CreatedAt,
+	)
+}
+
 type CreativeModel struct {
-	DB *sql.DB
+	DB DBTX
 }
 
-func (c *CreativeModel) Insert(creative *Creative) error {
-	query := `INSERT INTO creatives (user_id, creative_url, scheduled_at)
-			VALUES ($1, $2, $3)
+/*
+Insert saves a new creative. The database enforces the owner's plan quotas on insert, and
+ErrFileQuotaExceeded, ErrDailyQuotaExceeded or ErrStorageQuotaExceeded is returned if
+the creative would exceed them.
+*/
+func (c *CreativeModel) Insert(ctx context.Context, creative *Creative) (err error) {
+	query := `INSERT INTO creatives (user_id, creative_url, size_bytes, title, caption, language, alt_text, tags, sha256, phash, scheduled_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NULLIF($9, ''), $10, $11)
 			RETURNING id, created_at`
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
-	defer cancel()
+	ctx, span := startSpan(ctx, "CreativeModel.Insert", "creatives", "INSERT")
+	defer func() { endSpan(span, err) }()
 
-	args := []interface{}{creative.UserID, creative.CreativeURL, creative.ScheduledAt}
-	err := c.DB.QueryRowContext(ctx, query, args...).Scan(&creative.ID, &creative.CreatedAt)
+	if creative.Tags == nil {
+		creative.Tags = []string{}
+	}
+
+	args := []interface{}{
+		creative.UserID,
+		creative.CreativeURL,
+		creative.SizeBytes,
+		creative.Title,
+		creative.Caption,
+		creative.Language,
+		creative.AltText,
+		pq.Array(creative.Tags),
+		creative.SHA256,
+		creative.PHash,
+		creative.ScheduledAt,
+	}
+	err = c.DB.QueryRowContext(ctx, query, args...).Scan(&creative.ID, &creative.CreatedAt)
 
 	if err != nil {
-		return err
+		return quotaError(err)
 	}
 
 	return nil
 }
 
-func (c *CreativeModel) GetScheduledCreatives() (map[string][]Creative, error) {
+/*
+scheduledDates returns the dates (today and tomorrow) returned by GetScheduledCreatives.
+The calendar day of now is taken in now's location, so a client's time zone decides
+which day is "today". The dates are returned as UTC midnights, which is how DATE
+columns are scanned.
+*/
+func scheduledDates(now time.Time) []time.Time {
+	y, m, d := now.Date()
+	return []time.Time{
+		time.Date(y, m, d, 0, 0, 0, 0, time.UTC),
+		time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC),
+	}
+}
+
+// GetScheduledCreatives returns the creatives scheduled for the day of now and the day
+// after, keyed "today" and "tomorrow". See scheduledDates for how now's location is used.
+func (c *CreativeModel) GetScheduledCreatives(ctx context.Context, now time.Time) (_ map[string][]Creative, err error) {
 	query := `
-		SELECT id, user_id, creative_url, scheduled_at, created_at 
+		SELECT ` + creativeColumns + `
 		FROM creatives 
 		WHERE scheduled_at = ANY($1)
 	`
 
-	dates := []time.Time{
-		time.Now().Truncate(24 * time.Hour),
-		time.Now().AddDate(0, 0, 1).Truncate(24 * time.Hour),
-	}
+	dates := scheduledDates(now)
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
-	defer cancel()
+	ctx, span := startSpan(ctx, "CreativeModel.GetScheduledCreatives", "creatives", "SELECT")
+	defer func() { endSpan(span, err) }()
 
 	rows, err := c.DB.QueryContext(ctx, query, pq.Array(dates))
 	if err != nil {
@@ -66,7 +139,7 @@ func (c *CreativeModel) GetScheduledCreatives() (map[string][]Creative, error) {
 
 	for rows.Next() {
 		var creative Creative
-		err := rows.Scan(&creative.ID, &creative.UserID, &creative.CreativeURL, &creative.ScheduledAt, &creative.CreatedAt)
+		err := scanCreative(rows, &creative)
 		if err != nil {
 			return nil, err
 		}
@@ -84,3 +157,275 @@ func (c *CreativeModel) GetScheduledCreatives() (map[string][]Creative, error) {
 
 	return creatives, nil
 }
+
+// CreativeFilter restricts the creatives returned by List. Zero values are ignored.
+type CreativeFilter struct {
+	UserID int64
+	From   time.Time
+	To     time.Time
+	// SHA256 selects the creatives sharing a blob.
+	SHA256 string
+}
+
+func (c *CreativeModel) Get(ctx context.Context, id int64) (_ *Creative, err error) {
+	query := `
+		SELECT ` + creativeColumns + `
+		FROM creatives
+		WHERE id = $1
+	`
+
+	ctx, span := startSpan(ctx, "CreativeModel.Get", "creatives", "SELECT")
+	defer func() { endSpan(span, err) }()
+
+	var creative Creative
+	err = scanCreative(c.DB.QueryRowContext(ctx, query, id), &creative)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &creative, nil
+}
+
+// List returns the creatives matching filter, ordered by scheduled date and ID.
+func (c *CreativeModel) List(ctx context.Context, filter CreativeFilter) (_ []Creative, err error) {
+	var (
+		conditions []string
+		args       []interface{}
+	)
+
+	if filter.UserID != 0 {
+		args = append(args, filter.UserID)
+		conditions = append(conditions, fmt.Sprintf("user_id = $%d", len(args)))
+	}
+	if !filter.From.IsZero() {
+		args = append(args, filter.From)
+		conditions = append(conditions, fmt.Sprintf("scheduled_at >= $%d", len(args)))
+	}
+	if !filter.To.IsZero() {
+		args = append(args, filter.To)
+		conditions = append(conditions, fmt.Sprintf("scheduled_at <= $%d", len(args)))
+	}
+	if filter.SHA256 != "" {
+		args = append(args, filter.SHA256)
+		conditions = append(conditions, fmt.Sprintf("sha256 = $%d", len(args)))
+	}
+
+	query := `SELECT ` + creativeColumns + ` FROM creatives`
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	query += " ORDER BY scheduled_at, id"
+
+	ctx, span := startSpan(ctx, "CreativeModel.List", "creatives", "SELECT")
+	defer func() { endSpan(span, err) }()
+
+	rows, err := c.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	creatives := []Creative{}
+	for rows.Next() {
+		var creative Creative
+		err := scanCreative(rows, &creative)
+		if err != nil {
+			return nil, err
+		}
+		creatives = append(creatives, creative)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return creatives, nil
+}
+
+// SimilarFilter selects the creatives returned by Similar. Zero values of From, To,
+// ExcludeID and Limit are ignored.
+type SimilarFilter struct {
+	UserID int64
+	// PHash is the hash searched for, and MaxDistance the largest number of bits in which
+	// the hash of a returned creative may differ from it.
+	PHash       int64
+	MaxDistance int
+	From        time.Time
+	To          time.Time
+	// ExcludeID leaves out a creative, usually the one whose hash is searched for.
+	ExcludeID int64
+	Limit     int
+}
+
+// SimilarCreative is a creative returned by Similar, with the distance of its hash.
+type SimilarCreative struct {
+	Creative
+	Distance int `json:"distance"`
+}
+
+/*
+Similar returns the creatives of filter.UserID whose perceptual hash is within
+filter.MaxDistance of filter.PHash, closest first. The distances are computed for each of
+the user's creatives, which is fine at the number of creatives a user schedules.
+*/
+func (c *CreativeModel) Similar(ctx context.Context, filter SimilarFilter) (_ []SimilarCreative, err error) {
+	args := []interface{}{filter.UserID, filter.PHash, filter.MaxDistance}
+	conditions := []string{"user_id = $1", "phash IS NOT NULL", "hamming_distance(phash, $2) <= $3"}
+
+	if filter.ExcludeID != 0 {
+		args = append(args, filter.ExcludeID)
+		conditions = append(conditions, fmt.Sprintf("id <> $%d", len(args)))
+	}
+	if !filter.From.IsZero() {
+		args = append(args, filter.From)
+		conditions = append(conditions, fmt.Sprintf("scheduled_at >= $%d", len(args)))
+	}
+	if !filter.To.IsZero() {
+		args = append(args, filter.To)
+		conditions = append(conditions, fmt.Sprintf("scheduled_at <= $%d", len(args)))
+	}
+
+	query := `SELECT ` + creativeColumns + `, hamming_distance(phash, $2) AS distance
+		FROM creatives
+		WHERE ` + strings.Join(conditions, " AND ") + `
+		ORDER BY distance, scheduled_at, id`
+	if filter.Limit > 0 {
+		args = append(args, filter.Limit)
+		query += fmt.Sprintf(" LIMIT $%d", len(args))
+	}
+
+	ctx, span := startSpan(ctx, "CreativeModel.Similar", "creatives", "SELECT")
+	defer func() { endSpan(span, err) }()
+
+	rows, err := c.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	creatives := []SimilarCreative{}
+	for rows.Next() {
+		var similar SimilarCreative
+		err := scanCreative(distanceScanner{rows, &similar.Distance}, &similar.Creative)
+		if err != nil {
+			return nil, err
+		}
+		creatives = append(creatives, similar)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return creatives, nil
+}
+
+// distanceScanner scans a row of creativeColumns followed by a distance.
+type distanceScanner struct {
+	rows     *sql.Rows
+	distance *int
+}
+
+func (s distanceScanner) Scan(dest ...interface{}) error {
+	return s.rows.Scan(append(dest, s.distance)...)
+}
+
+// Update saves the creative's URL, metadata and scheduled date.
+func (c *CreativeModel) Update(ctx context.Context, creative *Creative) (err error) {
+	query := `
+		UPDATE creatives
+		SET creative_url = $1, title = $2, caption = $3, language = $4, alt_text = $5, tags = $6, scheduled_at = $7
+		WHERE id = $8
+	`
+
+	if creative.Tags == nil {
+		creative.Tags = []string{}
+	}
+
+	ctx, span := startSpan(ctx, "CreativeModel.Update", "creatives", "UPDATE")
+	defer func() { endSpan(span, err) }()
+
+	args := []interface{}{
+		creative.CreativeURL,
+		creative.Title,
+		creative.Caption,
+		creative.Language,
+		creative.AltText,
+		pq.Array(creative.Tags),
+		creative.ScheduledAt,
+		creative.ID,
+	}
+
+	result, err := c.DB.ExecContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+func (c *CreativeModel) Delete(ctx context.Context, id int64) (err error) {
+	query := `DELETE FROM creatives WHERE id = $1`
+
+	ctx, span := startSpan(ctx, "CreativeModel.Delete", "creatives", "DELETE")
+	defer func() { endSpan(span, err) }()
+
+	result, err := c.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// ReferencedURLs returns the distinct creative URLs. It implements gc.ReferenceSource.
+func (c *CreativeModel) ReferencedURLs(ctx context.Context) (_ []string, err error) {
+	query := `SELECT DISTINCT creative_url FROM creatives`
+
+	ctx, span := startSpan(ctx, "CreativeModel.ReferencedURLs", "creatives", "SELECT")
+	defer func() { endSpan(span, err) }()
+
+	rows, err := c.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	urls := []string{}
+	for rows.Next() {
+		var url string
+		if err := rows.Scan(&url); err != nil {
+			return nil, err
+		}
+		urls = append(urls, url)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return urls, nil
+}
@@ -0,0 +1,161 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+/*
+DirectUpload is an upload a client sends straight to the storage backend with a
+presigned URL. It records what the client declared, so that the object can be verified
+before a creative is created from it, and keeps the object from being collected until
+it expires.
+*/
+type DirectUpload struct {
+	ID          string    `json:"id"`
+	UserID      int64     `json:"-"`
+	Filename    string    `json:"filename"`
+	Key         string    `json:"-"`
+	SizeBytes   int64     `json:"size_bytes"`
+	ContentType string    `json:"content_type"`
+	SHA256      string    `json:"sha256"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Expired reports whether the upload can no longer be finalized.
+func (u *DirectUpload) Expired() bool {
+	return !time.Now().Before(u.ExpiresAt)
+}
+
+type DirectUploadModel struct {
+	DB DBTX
+}
+
+func (m DirectUploadModel) Insert(ctx context.Context, upload *DirectUpload) (err error) {
+	query := `
+		INSERT INTO direct_uploads (id, user_id, filename, storage_key, size_bytes, content_type, sha256, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING created_at
+	`
+
+	args := []interface{}{
+		upload.ID,
+		upload.UserID,
+		upload.Filename,
+		upload.Key,
+		upload.SizeBytes,
+		upload.ContentType,
+		upload.SHA256,
+		upload.ExpiresAt,
+	}
+
+	ctx, span := startSpan(ctx, "DirectUploadModel.Insert", "direct_uploads", "INSERT")
+	defer func() { endSpan(span, err) }()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&upload.CreatedAt)
+}
+
+func (m DirectUploadModel) Get(ctx context.Context, id string) (_ *DirectUpload, err error) {
+	query := `
+		SELECT id, user_id, filename, storage_key, size_bytes, content_type, sha256, expires_at, created_at
+		FROM direct_uploads
+		WHERE id = $1
+	`
+
+	ctx, span := startSpan(ctx, "DirectUploadModel.Get", "direct_uploads", "SELECT")
+	defer func() { endSpan(span, err) }()
+
+	var upload DirectUpload
+	err = m.DB.QueryRowContext(ctx, query, id).Scan(
+		&upload.ID,
+		&upload.UserID,
+		&upload.Filename,
+		&upload.Key,
+		&upload.SizeBytes,
+		&upload.ContentType,
+		&upload.SHA256,
+		&upload.ExpiresAt,
+		&upload.CreatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &upload, nil
+}
+
+func (m DirectUploadModel) Delete(ctx context.Context, id string) (err error) {
+	query := `DELETE FROM direct_uploads WHERE id = $1`
+
+	ctx, span := startSpan(ctx, "DirectUploadModel.Delete", "direct_uploads", "DELETE")
+	defer func() { endSpan(span, err) }()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// DeleteExpired removes every expired upload and returns how many were removed. Their
+// objects are left to the garbage collector.
+func (m DirectUploadModel) DeleteExpired(ctx context.Context) (_ int64, err error) {
+	query := `DELETE FROM direct_uploads WHERE expires_at <= $1`
+
+	ctx, span := startSpan(ctx, "DirectUploadModel.DeleteExpired", "direct_uploads", "DELETE")
+	defer func() { endSpan(span, err) }()
+
+	result, err := m.DB.ExecContext(ctx, query, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// ReferencedKeys returns the storage keys of every pending upload.
+func (m DirectUploadModel) ReferencedKeys(ctx context.Context) (_ []string, err error) {
+	query := `SELECT storage_key FROM direct_uploads`
+
+	ctx, span := startSpan(ctx, "DirectUploadModel.ReferencedKeys", "direct_uploads", "SELECT")
+	defer func() { endSpan(span, err) }()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []string{}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
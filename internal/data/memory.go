@@ -0,0 +1,1591 @@
+package data
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"html"
+	"math/bits"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+)
+
+/*
+memoryStore holds every table of the in-memory implementation behind a single mutex.
+It mirrors the constraints of the Postgres schema: phone numbers are unique, tokens and
+creatives must reference an existing user, and deleting a user cascades to their tokens
+creatives and watermark, deleting a creative to its template, and deleting a blob to its
+renditions.
+*/
+type memoryStore struct {
+	// mu is held for every call, and for the whole of a transaction, see
+	// memoryStore.withTx.
+	mu sync.Mutex
+
+	nextUserID     int64
+	nextCreativeID int64
+	nextAuditID    int64
+
+	users      map[int64]User
+	tokens     map[string]Token
+	creatives  map[int64]Creative
+	audit      []AuditEvent
+	uploads    map[string]Upload
+	direct     map[string]DirectUpload
+	bulkJobs   map[string]BulkJob
+	blobs      map[string]Blob
+	templates  map[int64]Template
+	watermarks map[int64]Watermark
+	renditions map[renditionID]Rendition
+}
+
+// renditionID is the primary key of renditions.
+type renditionID struct {
+	sha256, format string
+}
+
+/*
+withTx gives transactions all-or-nothing semantics: fn runs against a copy of the store,
+whose tables replace the store's once fn succeeds. The store stays locked until then, so
+other callers wait for the transaction instead of having their writes lost when its copy
+is committed; fn must therefore only use the models it is given.
+*/
+func (s *memoryStore) withTx(ctx context.Context, fn func(Models) error) error {
+	var hooks commitHooks
+
+	err := func() error {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		work := s.clone()
+
+		err := fn(work.models().joinTx(hooks.add))
+		if err != nil {
+			return err
+		}
+
+		s.replace(work)
+		return nil
+	}()
+	if err != nil {
+		return err
+	}
+
+	hooks.run()
+	return nil
+}
+
+// clone copies the tables; the caller must hold s.mu.
+func (s *memoryStore) clone() *memoryStore {
+	c := &memoryStore{
+		nextUserID:     s.nextUserID,
+		nextCreativeID: s.nextCreativeID,
+		nextAuditID:    s.nextAuditID,
+		users:          make(map[int64]User, len(s.users)),
+		tokens:         make(map[string]Token, len(s.tokens)),
+		creatives:      make(map[int64]Creative, len(s.creatives)),
+		audit:          append([]AuditEvent(nil), s.audit...),
+		uploads:        make(map[string]Upload, len(s.uploads)),
+		direct:         make(map[string]DirectUpload, len(s.direct)),
+		bulkJobs:       make(map[string]BulkJob, len(s.bulkJobs)),
+		blobs:          make(map[string]Blob, len(s.blobs)),
+		templates:      make(map[int64]Template, len(s.templates)),
+		watermarks:     make(map[int64]Watermark, len(s.watermarks)),
+		renditions:     make(map[renditionID]Rendition, len(s.renditions)),
+	}
+	for k, v := range s.users {
+		c.users[k] = v
+	}
+	for k, v := range s.tokens {
+		c.tokens[k] = v
+	}
+	for k, v := range s.creatives {
+		c.creatives[k] = v
+	}
+	for k, v := range s.uploads {
+		c.uploads[k] = v
+	}
+	for k, v := range s.direct {
+		c.direct[k] = v
+	}
+	for k, v := range s.bulkJobs {
+		c.bulkJobs[k] = v
+	}
+	for k, v := range s.blobs {
+		c.blobs[k] = v
+	}
+	for k, v := range s.templates {
+		c.templates[k] = v
+	}
+	for k, v := range s.watermarks {
+		c.watermarks[k] = v
+	}
+	for k, v := range s.renditions {
+		c.renditions[k] = v
+	}
+	return c
+}
+
+// replace swaps in the tables of a transaction's copy; the caller must hold s.mu.
+func (s *memoryStore) replace(work *memoryStore) {
+	s.nextUserID = work.nextUserID
+	s.nextCreativeID = work.nextCreativeID
+	s.nextAuditID = work.nextAuditID
+	s.users = work.users
+	s.tokens = work.tokens
+	s.creatives = work.creatives
+	s.audit = work.audit
+	s.uploads = work.uploads
+	s.direct = work.direct
+	s.bulkJobs = work.bulkJobs
+	s.blobs = work.blobs
+	s.templates = work.templates
+	s.watermarks = work.watermarks
+	s.renditions = work.renditions
+}
+
+// models returns repositories over the store.
+func (s *memoryStore) models() Models {
+	return Models{
+		User:     memoryUsers{s},
+		Token:    memoryTokens{s},
+		Creative: memoryCreatives{s},
+		Audit:    memoryAudit{s},
+		Usage:    memoryUsage{s},
+		Upload:   memoryUploads{s},
+
+		DirectUpload: memoryDirectUploads{s},
+		BulkJob:      memoryBulkJobs{s},
+		Blob:         memoryBlobs{s},
+		Template:     memoryTemplates{s},
+		Watermark:    memoryWatermarks{s},
+		Rendition:    memoryRenditions{s},
+	}
+}
+
+// NewMemoryModels returns Models backed by an in-memory store. It is intended for tests
+// that exercise the handlers without Postgres.
+func NewMemoryModels() Models {
+	store := &memoryStore{
+		users:      make(map[int64]User),
+		tokens:     make(map[string]Token),
+		creatives:  make(map[int64]Creative),
+		uploads:    make(map[string]Upload),
+		direct:     make(map[string]DirectUpload),
+		bulkJobs:   make(map[string]BulkJob),
+		blobs:      make(map[string]Blob),
+		templates:  make(map[int64]Template),
+		watermarks: make(map[int64]Watermark),
+		renditions: make(map[renditionID]Rendition),
+	}
+
+	m := store.models()
+	m.tx = store.withTx
+	return m
+}
+
+// errForeignKey mimics the error Postgres returns when a referenced user is missing.
+func errForeignKey(table string) error {
+	return fmt.Errorf("insert on table %q violates foreign key constraint on users", table)
+}
+
+type memoryUsers struct {
+	s *memoryStore
+}
+
+func (m memoryUsers) Insert(ctx context.Context, user *User) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	for _, existing := range m.s.users {
+		if existing.PhoneNumber == user.PhoneNumber {
+			return ErrDuplicatePhoneNumber
+		}
+	}
+
+	m.s.nextUserID++
+	user.ID = m.s.nextUserID
+	user.CreatedAt = time.Now().Truncate(time.Second)
+	user.Role = RoleUser
+	user.Plan = PlanFree
+	user.Version = 1
+	m.s.users[user.ID] = *user
+
+	return nil
+}
+
+func (m memoryUsers) Upsert(ctx context.Context, user *User) (bool, error) {
+	if err := ctx.Err(); err != nil {
+		return false, err
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	for _, existing := range m.s.users {
+		if existing.PhoneNumber == user.PhoneNumber {
+			*user = existing
+			return false, nil
+		}
+	}
+
+	m.s.nextUserID++
+	user.ID = m.s.nextUserID
+	user.CreatedAt = time.Now().Truncate(time.Second)
+	user.Role = RoleUser
+	user.Plan = PlanFree
+	user.Version = 1
+	m.s.users[user.ID] = *user
+
+	return true, nil
+}
+
+func (m memoryUsers) GetByPhoneNumber(ctx context.Context, phoneNumber string) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	for _, user := range m.s.users {
+		if user.PhoneNumber == phoneNumber {
+			return &user, nil
+		}
+	}
+
+	return nil, ErrRecordNotFound
+}
+
+func (m memoryUsers) GetForToken(ctx context.Context, tokenScope, tokenPlainText string) (*User, time.Time, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, time.Time{}, err
+	}
+
+	hash := sha256.Sum256([]byte(tokenPlainText))
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	token, ok := m.s.tokens[string(hash[:])]
+	if !ok || token.Scope != tokenScope || !token.Expiry.After(time.Now()) {
+		return nil, time.Time{}, ErrRecordNotFound
+	}
+
+	user, ok := m.s.users[token.UserId]
+	if !ok {
+		return nil, time.Time{}, ErrRecordNotFound
+	}
+
+	return &user, token.Expiry, nil
+}
+
+func (m memoryUsers) Get(ctx context.Context, id int64) (*User, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	user, ok := m.s.users[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+
+	return &user, nil
+}
+
+func (m memoryUsers) Update(ctx context.Context, user *User) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	existing, ok := m.s.users[user.ID]
+	if !ok || existing.Version != user.Version {
+		return ErrEditConflict
+	}
+	if _, ok := DefaultPlans[user.Plan]; !ok {
+		return ErrUnknownPlan
+	}
+
+	existing.Name = user.Name
+	existing.Role = user.Role
+	existing.Plan = user.Plan
+	existing.Version++
+	m.s.users[user.ID] = existing
+	user.Version = existing.Version
+
+	return nil
+}
+
+func (m memoryUsers) Delete(ctx context.Context, id int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	if _, ok := m.s.users[id]; !ok {
+		return ErrRecordNotFound
+	}
+	delete(m.s.users, id)
+
+	for key, token := range m.s.tokens {
+		if token.UserId == id {
+			delete(m.s.tokens, key)
+		}
+	}
+	for key, creative := range m.s.creatives {
+		if creative.UserID == id {
+			delete(m.s.creatives, key)
+			delete(m.s.templates, key)
+			m.s.countBlobRef(creative.SHA256, -1)
+		}
+	}
+	for key, upload := range m.s.uploads {
+		if upload.UserID == id {
+			delete(m.s.uploads, key)
+		}
+	}
+	delete(m.s.watermarks, id)
+	for key, upload := range m.s.direct {
+		if upload.UserID == id {
+			delete(m.s.direct, key)
+		}
+	}
+	for key, job := range m.s.bulkJobs {
+		if job.UserID == id {
+			delete(m.s.bulkJobs, key)
+		}
+	}
+	for i := range m.s.audit {
+		if m.s.audit[i].UserID == id {
+			m.s.audit[i].UserID = 0
+		}
+	}
+
+	return nil
+}
+
+type memoryTokens struct {
+	s *memoryStore
+}
+
+func (m memoryTokens) New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error) {
+	token, err := generateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	err = m.Insert(ctx, token)
+	return token, err
+}
+
+func (m memoryTokens) Insert(ctx context.Context, token *Token) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	if _, ok := m.s.users[token.UserId]; !ok {
+		return errForeignKey("tokens")
+	}
+	if _, ok := m.s.tokens[string(token.Hash)]; ok {
+		return fmt.Errorf("duplicate token hash")
+	}
+
+	m.s.tokens[string(token.Hash)] = *token
+	return nil
+}
+
+func (m memoryTokens) Delete(ctx context.Context, scope, tokenPlaintext string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	token, ok := m.s.tokens[string(hash[:])]
+	if !ok || token.Scope != scope {
+		return ErrRecordNotFound
+	}
+
+	delete(m.s.tokens, string(hash[:]))
+	return nil
+}
+
+func (m memoryTokens) DeleteAllForUser(ctx context.Context, scope string, userID int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	for key, token := range m.s.tokens {
+		if token.UserId == userID && token.Scope == scope {
+			delete(m.s.tokens, key)
+		}
+	}
+
+	return nil
+}
+
+func (m memoryTokens) DeleteExpired(ctx context.Context) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	var n int64
+	now := time.Now()
+	for key, token := range m.s.tokens {
+		if !token.Expiry.After(now) {
+			delete(m.s.tokens, key)
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+type memoryCreatives struct {
+	s *memoryStore
+}
+
+func (m memoryCreatives) Insert(ctx context.Context, creative *Creative) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	owner, ok := m.s.users[creative.UserID]
+	if !ok {
+		return errForeignKey("creatives")
+	}
+	if _, ok := m.s.blobs[creative.SHA256]; creative.SHA256 != "" && !ok {
+		return fmt.Errorf("insert on table %q violates foreign key constraint on blobs", "creatives")
+	}
+
+	// Mirrors the enforce_creative_quota trigger.
+	usage := m.s.usage(owner)
+	switch {
+	case creative.SizeBytes > usage.Limits.FileBytes:
+		return ErrFileQuotaExceeded
+	case usage.CreativesToday >= usage.Limits.CreativesPerDay:
+		return ErrDailyQuotaExceeded
+	case usage.BytesStored+creative.SizeBytes > usage.Limits.TotalBytes:
+		return ErrStorageQuotaExceeded
+	}
+
+	m.s.nextCreativeID++
+	creative.ID = m.s.nextCreativeID
+	creative.CreatedAt = time.Now().Truncate(time.Second)
+	// scheduled_at is a DATE column, so only the day is kept.
+	creative.ScheduledAt = creative.ScheduledAt.UTC().Truncate(24 * time.Hour)
+	if creative.Tags == nil {
+		creative.Tags = []string{}
+	}
+	stored := *creative
+	stored.Tags = slices.Clone(creative.Tags)
+	if creative.PHash != nil {
+		phash := *creative.PHash
+		stored.PHash = &phash
+	}
+	m.s.creatives[creative.ID] = stored
+	m.s.countBlobRef(creative.SHA256, 1)
+
+	return nil
+}
+
+func (m memoryCreatives) GetScheduledCreatives(ctx context.Context, now time.Time) (map[string][]Creative, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	dates := scheduledDates(now)
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	creatives := map[string][]Creative{
+		"today":    {},
+		"tomorrow": {},
+	}
+
+	for _, creative := range m.s.creatives {
+		if creative.ScheduledAt.Equal(dates[0]) {
+			creatives["today"] = append(creatives["today"], creative)
+		} else if creative.ScheduledAt.Equal(dates[1]) {
+			creatives["tomorrow"] = append(creatives["tomorrow"], creative)
+		}
+	}
+
+	// Map iteration order is random; return creatives in the order they were inserted.
+	for _, list := range creatives {
+		sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	}
+
+	return creatives, nil
+}
+
+func (m memoryCreatives) Get(ctx context.Context, id int64) (*Creative, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	creative, ok := m.s.creatives[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+
+	return &creative, nil
+}
+
+func (m memoryCreatives) List(ctx context.Context, filter CreativeFilter) ([]Creative, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	creatives := []Creative{}
+	for _, creative := range m.s.creatives {
+		switch {
+		case filter.UserID != 0 && creative.UserID != filter.UserID:
+		case !filter.From.IsZero() && creative.ScheduledAt.Before(filter.From):
+		case !filter.To.IsZero() && creative.ScheduledAt.After(filter.To):
+		case filter.SHA256 != "" && creative.SHA256 != filter.SHA256:
+		default:
+			creatives = append(creatives, creative)
+		}
+	}
+
+	sort.Slice(creatives, func(i, j int) bool {
+		if !creatives[i].ScheduledAt.Equal(creatives[j].ScheduledAt) {
+			return creatives[i].ScheduledAt.Before(creatives[j].ScheduledAt)
+		}
+		return creatives[i].ID < creatives[j].ID
+	})
+
+	return creatives, nil
+}
+
+func (m memoryCreatives) Update(ctx context.Context, creative *Creative) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	existing, ok := m.s.creatives[creative.ID]
+	if !ok {
+		return ErrRecordNotFound
+	}
+
+	if creative.Tags == nil {
+		creative.Tags = []string{}
+	}
+	existing.CreativeURL = creative.CreativeURL
+	existing.Title = creative.Title
+	existing.Caption = creative.Caption
+	existing.Language = creative.Language
+	existing.AltText = creative.AltText
+	existing.Tags = slices.Clone(creative.Tags)
+	existing.ScheduledAt = creative.ScheduledAt.UTC().Truncate(24 * time.Hour)
+	m.s.creatives[creative.ID] = existing
+
+	return nil
+}
+
+func (m memoryCreatives) Delete(ctx context.Context, id int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	creative, ok := m.s.creatives[id]
+	if !ok {
+		return ErrRecordNotFound
+	}
+	delete(m.s.creatives, id)
+	delete(m.s.templates, id)
+	m.s.countBlobRef(creative.SHA256, -1)
+
+	return nil
+}
+
+func (m memoryCreatives) Similar(ctx context.Context, filter SimilarFilter) ([]SimilarCreative, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	creatives := []SimilarCreative{}
+	for _, creative := range m.s.creatives {
+		if creative.UserID != filter.UserID || creative.PHash == nil {
+			continue
+		}
+
+		// Mirrors the hamming_distance function.
+		distance := bits.OnesCount64(uint64(*creative.PHash ^ filter.PHash))
+
+		switch {
+		case distance > filter.MaxDistance:
+		case filter.ExcludeID != 0 && creative.ID == filter.ExcludeID:
+		case !filter.From.IsZero() && creative.ScheduledAt.Before(filter.From):
+		case !filter.To.IsZero() && creative.ScheduledAt.After(filter.To):
+		default:
+			creatives = append(creatives, SimilarCreative{Creative: creative, Distance: distance})
+		}
+	}
+
+	sort.Slice(creatives, func(i, j int) bool {
+		a, b := creatives[i], creatives[j]
+		if a.Distance != b.Distance {
+			return a.Distance < b.Distance
+		}
+		if !a.ScheduledAt.Equal(b.ScheduledAt) {
+			return a.ScheduledAt.Before(b.ScheduledAt)
+		}
+		return a.ID < b.ID
+	})
+
+	if filter.Limit > 0 && len(creatives) > filter.Limit {
+		creatives = creatives[:filter.Limit]
+	}
+
+	return creatives, nil
+}
+
+/*
+Search approximates the Postgres full-text search: words are matched as written, without
+stemming, every word of the query must match except those excluded with a leading -, and
+"or" and quotes are ignored. Ranks use the weights of ts_rank_cd but not its formula.
+*/
+func (m memoryCreatives) Search(ctx context.Context, filter SearchFilter) ([]SearchResult, int, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	var required, excluded []string
+	for _, term := range strings.Fields(filter.Query) {
+		switch {
+		case strings.EqualFold(term, "or"):
+		case strings.HasPrefix(term, "-"):
+			excluded = append(excluded, searchWords(term)...)
+		default:
+			required = append(required, searchWords(term)...)
+		}
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	results := []SearchResult{}
+	for _, creative := range m.s.creatives {
+		switch {
+		case len(required) == 0:
+			continue
+		case filter.UserID != 0 && creative.UserID != filter.UserID:
+			continue
+		case !filter.From.IsZero() && creative.ScheduledAt.Before(filter.From):
+			continue
+		case !filter.To.IsZero() && creative.ScheduledAt.After(filter.To):
+			continue
+		}
+
+		// The weights of the A, B, C and D labels in ts_rank_cd.
+		fields := []struct {
+			words  []string
+			weight float64
+		}{
+			{searchWords(creative.Title), 1.0},
+			{searchWords(strings.Join(creative.Tags, " ")), 0.4},
+			{searchWords(creative.Caption), 0.2},
+			{searchWords(creative.AltText), 0.1},
+		}
+
+		rank := 0.0
+		for _, word := range required {
+			best := 0.0
+			for _, field := range fields {
+				if slices.Contains(field.words, word) {
+					best = max(best, field.weight)
+				}
+			}
+			if best == 0 {
+				rank = 0
+				break
+			}
+			rank += best
+		}
+		for _, word := range excluded {
+			for _, field := range fields {
+				if slices.Contains(field.words, word) {
+					rank = 0
+				}
+			}
+		}
+		if rank == 0 {
+			continue
+		}
+
+		results = append(results, SearchResult{
+			Creative: creative,
+			Rank:     rank,
+			Highlights: SearchHighlights{
+				Title:   highlightWords(creative.Title, required),
+				Caption: highlightWords(creative.Caption, required),
+			},
+		})
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		a, b := results[i], results[j]
+		if a.Rank != b.Rank {
+			return a.Rank > b.Rank
+		}
+		if !a.ScheduledAt.Equal(b.ScheduledAt) {
+			return a.ScheduledAt.Before(b.ScheduledAt)
+		}
+		return a.ID < b.ID
+	})
+
+	total := len(results)
+	start := min((filter.Page-1)*filter.PageSize, total)
+	results = results[start:min(start+filter.PageSize, total)]
+	for i := range results {
+		results[i].Tags = slices.Clone(results[i].Tags)
+	}
+
+	return results, total, nil
+}
+
+// searchWords splits text into lower-cased words of letters and digits.
+func searchWords(text string) []string {
+	return strings.FieldsFunc(strings.ToLower(text), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// highlightWords HTML escapes text and wraps its words found in words in <mark>
+// elements, like ts_headline.
+func highlightWords(text string, words []string) string {
+	var b strings.Builder
+	start := -1
+	flush := func(end int) {
+		if start < 0 {
+			return
+		}
+		word := text[start:end]
+		if slices.Contains(words, strings.ToLower(word)) {
+			b.WriteString("<mark>" + html.EscapeString(word) + "</mark>")
+		} else {
+			b.WriteString(html.EscapeString(word))
+		}
+		start = -1
+	}
+
+	for i, r := range text {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if start < 0 {
+				start = i
+			}
+			continue
+		}
+		flush(i)
+		b.WriteString(html.EscapeString(string(r)))
+	}
+	flush(len(text))
+
+	return b.String()
+}
+
+func (m memoryCreatives) ReferencedURLs(ctx context.Context) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	seen := make(map[string]bool)
+	urls := []string{}
+	for _, creative := range m.s.creatives {
+		if !seen[creative.CreativeURL] {
+			seen[creative.CreativeURL] = true
+			urls = append(urls, creative.CreativeURL)
+		}
+	}
+
+	return urls, nil
+}
+
+// usage computes a user's usage. The caller must hold s.mu.
+func (s *memoryStore) usage(user User) *Usage {
+	usage := &Usage{Plan: user.Plan, Limits: DefaultPlans[user.Plan]}
+	today := startOfUTCDay(time.Now())
+
+	for _, creative := range s.creatives {
+		if creative.UserID != user.ID {
+			continue
+		}
+		if !creative.CreatedAt.Before(today) {
+			usage.CreativesToday++
+		}
+		usage.BytesStored += creative.SizeBytes
+	}
+
+	return usage
+}
+
+type memoryUsage struct {
+	s *memoryStore
+}
+
+func (m memoryUsage) Get(ctx context.Context, userID int64) (*Usage, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	user, ok := m.s.users[userID]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+
+	return m.s.usage(user), nil
+}
+
+type memoryUploads struct {
+	s *memoryStore
+}
+
+func (m memoryUploads) Insert(ctx context.Context, upload *Upload) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	if _, ok := m.s.users[upload.UserID]; !ok {
+		return errForeignKey("tus_uploads")
+	}
+	if _, ok := m.s.uploads[upload.ID]; ok {
+		return fmt.Errorf("duplicate upload id")
+	}
+
+	upload.CreatedAt = time.Now().Truncate(time.Second)
+	stored := *upload
+	stored.Chunks = nil
+	m.s.uploads[upload.ID] = stored
+
+	return nil
+}
+
+func (m memoryUploads) Get(ctx context.Context, id string) (*Upload, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	upload, ok := m.s.uploads[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+
+	upload.Chunks = append([]string(nil), upload.Chunks...)
+	return &upload, nil
+}
+
+func (m memoryUploads) AppendChunk(ctx context.Context, upload *Upload, key string, size int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	stored, ok := m.s.uploads[upload.ID]
+	if !ok || stored.Offset != upload.Offset {
+		return ErrEditConflict
+	}
+
+	stored.Offset += size
+	stored.Chunks = append(append([]string(nil), stored.Chunks...), key)
+	m.s.uploads[upload.ID] = stored
+
+	upload.Offset = stored.Offset
+	upload.Chunks = append([]string(nil), stored.Chunks...)
+	return nil
+}
+
+func (m memoryUploads) Complete(ctx context.Context, upload *Upload, key string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	stored, ok := m.s.uploads[upload.ID]
+	if !ok || !stored.Done() {
+		return ErrRecordNotFound
+	}
+
+	stored.Key = key
+	stored.Chunks = nil
+	m.s.uploads[upload.ID] = stored
+
+	upload.Key = key
+	upload.Chunks = nil
+	return nil
+}
+
+func (m memoryUploads) Delete(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	if _, ok := m.s.uploads[id]; !ok {
+		return ErrRecordNotFound
+	}
+	delete(m.s.uploads, id)
+
+	return nil
+}
+
+func (m memoryUploads) DeleteExpired(ctx context.Context) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	var n int64
+	for id, upload := range m.s.uploads {
+		if upload.Expired() {
+			delete(m.s.uploads, id)
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+func (m memoryUploads) ReferencedKeys(ctx context.Context) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	keys := []string{}
+	for _, upload := range m.s.uploads {
+		keys = append(keys, upload.Chunks...)
+		if upload.Key != "" {
+			keys = append(keys, upload.Key)
+		}
+	}
+
+	return keys, nil
+}
+
+type memoryDirectUploads struct {
+	s *memoryStore
+}
+
+func (m memoryDirectUploads) Insert(ctx context.Context, upload *DirectUpload) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	if _, ok := m.s.users[upload.UserID]; !ok {
+		return errForeignKey("direct_uploads")
+	}
+	for id, existing := range m.s.direct {
+		if id == upload.ID || existing.Key == upload.Key {
+			return fmt.Errorf("duplicate direct upload")
+		}
+	}
+
+	upload.CreatedAt = time.Now().Truncate(time.Second)
+	m.s.direct[upload.ID] = *upload
+
+	return nil
+}
+
+func (m memoryDirectUploads) Get(ctx context.Context, id string) (*DirectUpload, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	upload, ok := m.s.direct[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+
+	return &upload, nil
+}
+
+func (m memoryDirectUploads) Delete(ctx context.Context, id string) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	if _, ok := m.s.direct[id]; !ok {
+		return ErrRecordNotFound
+	}
+	delete(m.s.direct, id)
+
+	return nil
+}
+
+func (m memoryDirectUploads) DeleteExpired(ctx context.Context) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	var n int64
+	for id, upload := range m.s.direct {
+		if upload.Expired() {
+			delete(m.s.direct, id)
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+func (m memoryDirectUploads) ReferencedKeys(ctx context.Context) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	keys := []string{}
+	for _, upload := range m.s.direct {
+		keys = append(keys, upload.Key)
+	}
+
+	return keys, nil
+}
+
+type memoryBulkJobs struct {
+	s *memoryStore
+}
+
+// cloneBulkJob copies a job so that its items are not shared with the caller.
+func cloneBulkJob(job BulkJob) BulkJob {
+	job.Items = slices.Clone(job.Items)
+	for i := range job.Items {
+		job.Items[i].Tags = slices.Clone(job.Items[i].Tags)
+	}
+	return job
+}
+
+func (m memoryBulkJobs) Insert(ctx context.Context, job *BulkJob) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	if _, ok := m.s.users[job.UserID]; !ok {
+		return errForeignKey("bulk_upload_jobs")
+	}
+	if _, ok := m.s.bulkJobs[job.ID]; ok {
+		return fmt.Errorf("duplicate bulk job id")
+	}
+
+	job.CreatedAt = time.Now().Truncate(time.Second)
+	job.UpdatedAt = job.CreatedAt
+	m.s.bulkJobs[job.ID] = cloneBulkJob(*job)
+
+	return nil
+}
+
+func (m memoryBulkJobs) Get(ctx context.Context, id string) (*BulkJob, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	job, ok := m.s.bulkJobs[id]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+
+	job = cloneBulkJob(job)
+	return &job, nil
+}
+
+func (m memoryBulkJobs) Update(ctx context.Context, job *BulkJob) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	stored, ok := m.s.bulkJobs[job.ID]
+	if !ok {
+		return ErrRecordNotFound
+	}
+
+	now := time.Now().Truncate(time.Second)
+	stored.Status = job.Status
+	stored.Items = job.Items
+	stored.Error = job.Error
+	stored.UpdatedAt = now
+	if job.Finished() {
+		if stored.FinishedAt == nil {
+			stored.FinishedAt = &now
+		}
+		stored.ArchiveKey = ""
+	} else {
+		stored.FinishedAt = nil
+	}
+	stored = cloneBulkJob(stored)
+	m.s.bulkJobs[job.ID] = stored
+
+	job.UpdatedAt = stored.UpdatedAt
+	job.FinishedAt = stored.FinishedAt
+	job.ArchiveKey = stored.ArchiveKey
+	return nil
+}
+
+func (m memoryBulkJobs) FailStale(ctx context.Context, before time.Time) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	var n int64
+	now := time.Now().Truncate(time.Second)
+	for id, job := range m.s.bulkJobs {
+		if job.Finished() || !job.UpdatedAt.Before(before) {
+			continue
+		}
+		job.Status = BulkJobFailed
+		job.Error = "processing was interrupted"
+		job.UpdatedAt = now
+		job.FinishedAt = &now
+		job.ArchiveKey = ""
+		m.s.bulkJobs[id] = job
+		n++
+	}
+
+	return n, nil
+}
+
+func (m memoryBulkJobs) ReferencedKeys(ctx context.Context) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	keys := []string{}
+	for _, job := range m.s.bulkJobs {
+		if job.ArchiveKey != "" {
+			keys = append(keys, job.ArchiveKey)
+		}
+	}
+
+	return keys, nil
+}
+
+type memoryAudit struct {
+	s *memoryStore
+}
+
+func (m memoryAudit) Insert(ctx context.Context, event *AuditEvent) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	m.s.nextAuditID++
+	event.ID = m.s.nextAuditID
+	event.CreatedAt = time.Now().Truncate(time.Second)
+	m.s.audit = append(m.s.audit, *event)
+
+	return nil
+}
+
+var (
+	_ AuditRepository    = memoryAudit{}
+	_ UserRepository     = memoryUsers{}
+	_ TokenRepository    = memoryTokens{}
+	_ CreativeRepository = memoryCreatives{}
+)
+
+// countBlobRef mirrors the count_blob_refs trigger. The caller must hold s.mu.
+func (s *memoryStore) countBlobRef(sum string, delta int) {
+	blob, ok := s.blobs[sum]
+	if !ok {
+		return
+	}
+
+	blob.RefCount += delta
+	blob.UpdatedAt = time.Now().Truncate(time.Second)
+	s.blobs[sum] = blob
+}
+
+type memoryBlobs struct {
+	s *memoryStore
+}
+
+func (m memoryBlobs) Get(ctx context.Context, sum string) (*Blob, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	blob, ok := m.s.blobs[sum]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+
+	return &blob, nil
+}
+
+func (m memoryBlobs) Insert(ctx context.Context, blob *Blob) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	now := time.Now().Truncate(time.Second)
+
+	stored, ok := m.s.blobs[blob.SHA256]
+	if !ok {
+		for _, other := range m.s.blobs {
+			if other.Key == blob.Key {
+				return fmt.Errorf("duplicate storage key %q", blob.Key)
+			}
+		}
+		stored = Blob{SHA256: blob.SHA256, Key: blob.Key, SizeBytes: blob.SizeBytes, CreatedAt: now}
+	}
+	stored.UpdatedAt = now
+	m.s.blobs[blob.SHA256] = stored
+
+	*blob = stored
+	return nil
+}
+
+func (m memoryBlobs) DeleteUnreferenced(ctx context.Context, before time.Time) (int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	var n int64
+	for sum, blob := range m.s.blobs {
+		if blob.RefCount == 0 && blob.UpdatedAt.Before(before) {
+			delete(m.s.blobs, sum)
+			for id := range m.s.renditions {
+				if id.sha256 == sum {
+					delete(m.s.renditions, id)
+				}
+			}
+			n++
+		}
+	}
+
+	return n, nil
+}
+
+func (m memoryBlobs) ReferencedKeys(ctx context.Context) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	keys := []string{}
+	for _, blob := range m.s.blobs {
+		keys = append(keys, blob.Key)
+	}
+
+	return keys, nil
+}
+
+type memoryTemplates struct {
+	s *memoryStore
+}
+
+func (m memoryTemplates) Get(ctx context.Context, creativeID int64) (*Template, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	template, ok := m.s.templates[creativeID]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+
+	template.Overlays = slices.Clone(template.Overlays)
+	return &template, nil
+}
+
+func (m memoryTemplates) Upsert(ctx context.Context, template *Template) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	if _, ok := m.s.creatives[template.CreativeID]; !ok {
+		return ErrRecordNotFound
+	}
+
+	now := time.Now().Truncate(time.Second)
+	existing, ok := m.s.templates[template.CreativeID]
+	if ok {
+		template.Version = existing.Version + 1
+		template.CreatedAt = existing.CreatedAt
+	} else {
+		template.Version = 1
+		template.CreatedAt = now
+	}
+	template.UpdatedAt = now
+
+	stored := *template
+	stored.Overlays = slices.Clone(template.Overlays)
+	m.s.templates[template.CreativeID] = stored
+
+	return nil
+}
+
+func (m memoryTemplates) Delete(ctx context.Context, creativeID int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	if _, ok := m.s.templates[creativeID]; !ok {
+		return ErrRecordNotFound
+	}
+	delete(m.s.templates, creativeID)
+
+	return nil
+}
+
+type memoryWatermarks struct {
+	s *memoryStore
+}
+
+func (m memoryWatermarks) Get(ctx context.Context, userID int64) (*Watermark, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	watermark, ok := m.s.watermarks[userID]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+
+	return &watermark, nil
+}
+
+func (m memoryWatermarks) Upsert(ctx context.Context, watermark *Watermark) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	if _, ok := m.s.users[watermark.UserID]; !ok {
+		return ErrRecordNotFound
+	}
+
+	now := time.Now().Truncate(time.Second)
+	existing, ok := m.s.watermarks[watermark.UserID]
+	if ok {
+		watermark.Version = existing.Version + 1
+		watermark.CreatedAt = existing.CreatedAt
+	} else {
+		watermark.Version = 1
+		watermark.CreatedAt = now
+	}
+	watermark.UpdatedAt = now
+	m.s.watermarks[watermark.UserID] = *watermark
+
+	return nil
+}
+
+func (m memoryWatermarks) Delete(ctx context.Context, userID int64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	if _, ok := m.s.watermarks[userID]; !ok {
+		return ErrRecordNotFound
+	}
+	delete(m.s.watermarks, userID)
+
+	return nil
+}
+
+func (m memoryWatermarks) ReferencedKeys(ctx context.Context) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	keys := []string{}
+	for _, watermark := range m.s.watermarks {
+		keys = append(keys, watermark.LogoKey)
+	}
+
+	return keys, nil
+}
+
+type memoryRenditions struct {
+	s *memoryStore
+}
+
+func (m memoryRenditions) Get(ctx context.Context, sha256, format string) (*Rendition, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	rendition, ok := m.s.renditions[renditionID{sha256, format}]
+	if !ok {
+		return nil, ErrRecordNotFound
+	}
+
+	return &rendition, nil
+}
+
+func (m memoryRenditions) Insert(ctx context.Context, rendition *Rendition) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	if _, ok := m.s.blobs[rendition.SHA256]; !ok {
+		return ErrRecordNotFound
+	}
+
+	id := renditionID{rendition.SHA256, rendition.Format}
+	if _, ok := m.s.renditions[id]; ok {
+		return nil
+	}
+
+	rendition.CreatedAt = time.Now().Truncate(time.Second)
+	m.s.renditions[id] = *rendition
+
+	return nil
+}
+
+func (m memoryRenditions) ReferencedKeys(ctx context.Context) ([]string, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	m.s.mu.Lock()
+	defer m.s.mu.Unlock()
+
+	keys := []string{}
+	for _, rendition := range m.s.renditions {
+		if rendition.Key != "" {
+			keys = append(keys, rendition.Key)
+		}
+	}
+
+	return keys, nil
+}
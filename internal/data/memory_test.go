@@ -0,0 +1,80 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestMemoryTxRollsBack(t *testing.T) {
+	ctx := context.Background()
+	models := NewMemoryModels()
+
+	errAbort := errors.New("abort")
+	err := models.WithTx(ctx, func(tx Models) error {
+		err := tx.User.Insert(ctx, &User{Name: "Asha", PhoneNumber: "9876543210"})
+		if err != nil {
+			return err
+		}
+		return errAbort
+	})
+	if !errors.Is(err, errAbort) {
+		t.Fatalf("WithTx = %v, want %v", err, errAbort)
+	}
+
+	_, err = models.User.GetByPhoneNumber(ctx, "9876543210")
+	if !errors.Is(err, ErrRecordNotFound) {
+		t.Fatalf("user written by a rolled back transaction: %v", err)
+	}
+
+	err = models.WithTx(ctx, func(tx Models) error {
+		return tx.User.Insert(ctx, &User{Name: "Asha", PhoneNumber: "9876543210"})
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = models.User.GetByPhoneNumber(ctx, "9876543210")
+	if err != nil {
+		t.Fatalf("user written by a committed transaction: %v", err)
+	}
+}
+
+func TestMemoryTxBlocksOtherWrites(t *testing.T) {
+	ctx := context.Background()
+	models := NewMemoryModels()
+
+	inTx := make(chan struct{})
+	written := make(chan error)
+
+	go func() {
+		<-inTx
+		written <- models.User.Insert(ctx, &User{Name: "Ravi", PhoneNumber: "9000000000"})
+	}()
+
+	err := models.WithTx(ctx, func(tx Models) error {
+		close(inTx)
+
+		select {
+		case err := <-written:
+			t.Errorf("write outside the transaction finished before it: %v", err)
+		case <-time.After(50 * time.Millisecond):
+		}
+
+		return errors.New("abort")
+	})
+	if err == nil {
+		t.Fatal("WithTx succeeded, want the abort error")
+	}
+
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+
+	// The rollback did not discard the write that waited for it.
+	_, err = models.User.GetByPhoneNumber(ctx, "9000000000")
+	if err != nil {
+		t.Fatalf("write made during the transaction was lost: %v", err)
+	}
+}
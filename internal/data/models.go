@@ -1,21 +1,171 @@
 package data
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"time"
+
+	"github.com/lib/pq"
 )
 
+// Models groups the repositories used by the application. Handlers only depend on the
+// interfaces below, so they can run against Postgres (NewModels) or entirely in memory
+// (NewMemoryModels). Use WithTx to group several writes atomically.
 type Models struct {
-	User     UserModel
-	Creative CreativeModel
-	Token    TokenModel
+	User     UserRepository
+	Creative CreativeRepository
+	Token    TokenRepository
+	Audit    AuditRepository
+	Usage    UsageRepository
+	Upload   UploadRepository
+	// DirectUpload records uploads sent straight to storage with presigned URLs.
+	DirectUpload DirectUploadRepository
+	BulkJob      BulkJobRepository
+	// Blob records the stored files, shared by creatives with identical content.
+	Blob BlobRepository
+	// Template records the text overlays of personalised creatives.
+	Template TemplateRepository
+	// Watermark records the logo each user has drawn onto their creatives.
+	Watermark WatermarkRepository
+	// Rendition records the blobs converted to more efficient formats.
+	Rendition RenditionRepository
+
+	tx func(ctx context.Context, fn func(Models) error) error
+	// afterCommit queues a function until the transaction the models are bound to
+	// commits. It is nil outside of transactions.
+	afterCommit func(fn func())
+}
+
+var (
+	ErrRecordNotFound       = errors.New("record not found")
+	ErrDuplicatePhoneNumber = errors.New("duplicate phone number")
+	ErrEditConflict         = errors.New("edit conflict")
+	ErrUnknownPlan          = errors.New("unknown plan")
+
+	// Quota errors are returned by CreativeRepository.Insert when the creative would
+	// exceed its owner's plan limits.
+	ErrFileQuotaExceeded    = errors.New("file exceeds the plan's size limit")
+	ErrDailyQuotaExceeded   = errors.New("daily creative limit reached")
+	ErrStorageQuotaExceeded = errors.New("storage limit reached")
+)
+
+type UserRepository interface {
+	Insert(ctx context.Context, user *User) error
+	Upsert(ctx context.Context, user *User) (bool, error)
+	GetByPhoneNumber(ctx context.Context, phoneNumber string) (*User, error)
+	// GetForToken returns the user owning an unexpired token, and the token's expiry.
+	GetForToken(ctx context.Context, tokenScope, tokenPlainText string) (*User, time.Time, error)
+	Get(ctx context.Context, id int64) (*User, error)
+	Update(ctx context.Context, user *User) error
+	Delete(ctx context.Context, id int64) error
+}
+
+type TokenRepository interface {
+	New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error)
+	Insert(ctx context.Context, token *Token) error
+	Delete(ctx context.Context, scope, tokenPlaintext string) error
+	DeleteAllForUser(ctx context.Context, scope string, userID int64) error
+	DeleteExpired(ctx context.Context) (int64, error)
+}
+
+type AuditRepository interface {
+	Insert(ctx context.Context, event *AuditEvent) error
+}
+
+type UsageRepository interface {
+	Get(ctx context.Context, userID int64) (*Usage, error)
+}
+
+type UploadRepository interface {
+	Insert(ctx context.Context, upload *Upload) error
+	Get(ctx context.Context, id string) (*Upload, error)
+	AppendChunk(ctx context.Context, upload *Upload, key string, size int64) error
+	Complete(ctx context.Context, upload *Upload, key string) error
+	Delete(ctx context.Context, id string) error
+	DeleteExpired(ctx context.Context) (int64, error)
+	ReferencedKeys(ctx context.Context) ([]string, error)
+}
+
+type DirectUploadRepository interface {
+	Insert(ctx context.Context, upload *DirectUpload) error
+	Get(ctx context.Context, id string) (*DirectUpload, error)
+	Delete(ctx context.Context, id string) error
+	DeleteExpired(ctx context.Context) (int64, error)
+	ReferencedKeys(ctx context.Context) ([]string, error)
+}
+
+type BulkJobRepository interface {
+	Insert(ctx context.Context, job *BulkJob) error
+	Get(ctx context.Context, id string) (*BulkJob, error)
+	Update(ctx context.Context, job *BulkJob) error
+	FailStale(ctx context.Context, before time.Time) (int64, error)
+	ReferencedKeys(ctx context.Context) ([]string, error)
+}
+
+type BlobRepository interface {
+	Get(ctx context.Context, sha256 string) (*Blob, error)
+	Insert(ctx context.Context, blob *Blob) error
+	DeleteUnreferenced(ctx context.Context, before time.Time) (int64, error)
+	ReferencedKeys(ctx context.Context) ([]string, error)
+}
+
+type TemplateRepository interface {
+	Get(ctx context.Context, creativeID int64) (*Template, error)
+	Upsert(ctx context.Context, template *Template) error
+	Delete(ctx context.Context, creativeID int64) error
+}
+
+type WatermarkRepository interface {
+	Get(ctx context.Context, userID int64) (*Watermark, error)
+	Upsert(ctx context.Context, watermark *Watermark) error
+	Delete(ctx context.Context, userID int64) error
+	ReferencedKeys(ctx context.Context) ([]string, error)
+}
+
+type RenditionRepository interface {
+	Get(ctx context.Context, sha256, format string) (*Rendition, error)
+	Insert(ctx context.Context, rendition *Rendition) error
+	ReferencedKeys(ctx context.Context) ([]string, error)
+}
+
+type CreativeRepository interface {
+	Insert(ctx context.Context, creative *Creative) error
+	GetScheduledCreatives(ctx context.Context, now time.Time) (map[string][]Creative, error)
+	Get(ctx context.Context, id int64) (*Creative, error)
+	List(ctx context.Context, filter CreativeFilter) ([]Creative, error)
+	Update(ctx context.Context, creative *Creative) error
+	Delete(ctx context.Context, id int64) error
+	Similar(ctx context.Context, filter SimilarFilter) ([]SimilarCreative, error)
+	Search(ctx context.Context, filter SearchFilter) ([]SearchResult, int, error)
+	ReferencedURLs(ctx context.Context) ([]string, error)
 }
 
 var (
-	ErrRecordNotFound = errors.New("record not found")
+	_ UserRepository     = UserModel{}
+	_ TokenRepository    = TokenModel{}
+	_ CreativeRepository = (*CreativeModel)(nil)
+	_ AuditRepository    = AuditModel{}
+	_ UsageRepository    = UsageModel{}
+	_ UploadRepository   = UploadModel{}
+
+	_ DirectUploadRepository = DirectUploadModel{}
+	_ BulkJobRepository      = BulkJobModel{}
+	_ BlobRepository         = BlobModel{}
+	_ TemplateRepository     = TemplateModel{}
+	_ WatermarkRepository    = WatermarkModel{}
+	_ RenditionRepository    = RenditionModel{}
 )
 
 func NewModels(db *sql.DB) Models {
+	m := newModels(db)
+	m.tx = postgresTx(db)
+	return m
+}
+
+// newModels builds the Postgres models on top of either the connection pool or a
+// transaction.
+func newModels(db DBTX) Models {
 	return Models{
 		User: UserModel{
 			DB: db,
@@ -23,8 +173,69 @@ func NewModels(db *sql.DB) Models {
 		Token: TokenModel{
 			DB: db,
 		},
-		Creative: CreativeModel{
+		Creative: &CreativeModel{
+			DB: db,
+		},
+		Audit: AuditModel{
+			DB: db,
+		},
+		Usage: UsageModel{
+			DB: db,
+		},
+		Upload: UploadModel{
+			DB: db,
+		},
+		DirectUpload: DirectUploadModel{
+			DB: db,
+		},
+		BulkJob: BulkJobModel{
+			DB: db,
+		},
+		Blob: BlobModel{
+			DB: db,
+		},
+		Template: TemplateModel{
+			DB: db,
+		},
+		Watermark: WatermarkModel{
+			DB: db,
+		},
+		Rendition: RenditionModel{
 			DB: db,
 		},
 	}
 }
+
+// isForeignKeyViolation reports whether err is a Postgres foreign_key_violation on the
+// named constraint.
+func isForeignKeyViolation(err error, constraint string) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23503" && pqErr.Constraint == constraint
+}
+
+// quotaError maps the errors raised by the enforce_creative_quota trigger, which name a
+// pseudo constraint, to the quota errors. Other errors are returned unchanged.
+func quotaError(err error) error {
+	var pqErr *pq.Error
+	if !errors.As(err, &pqErr) || pqErr.Code != "23514" {
+		return err
+	}
+
+	switch pqErr.Constraint {
+	case "creatives_file_size_quota":
+		return ErrFileQuotaExceeded
+	case "creatives_daily_quota":
+		return ErrDailyQuotaExceeded
+	case "creatives_storage_quota":
+		return ErrStorageQuotaExceeded
+	default:
+		return err
+	}
+}
+
+// isUniqueViolation reports whether err is a Postgres unique_violation on the named
+// constraint.
+func isUniqueViolation(err error, constraint string) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505" && pqErr.Constraint == constraint
+}
@@ -0,0 +1,115 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// RenditionWebP is the only format blobs are converted to so far. AVIF would need an
+// encoder built with cgo.
+const RenditionWebP = "webp"
+
+/*
+Rendition is a blob converted to another format. Key is empty when the blob is served
+as is instead: when the converted file was no smaller, or the image is too large to be
+converted. SizeBytes is the size of the converted file, or 0 if there is none.
+Renditions are removed with their blob.
+*/
+type Rendition struct {
+	SHA256    string
+	Format    string
+	Key       string
+	SizeBytes int64
+	CreatedAt time.Time
+}
+
+type RenditionModel struct {
+	DB DBTX
+}
+
+func (m RenditionModel) Get(ctx context.Context, sha256, format string) (_ *Rendition, err error) {
+	query := `
+		SELECT sha256, format, COALESCE(storage_key, ''), size_bytes, created_at
+		FROM renditions
+		WHERE sha256 = $1 AND format = $2
+	`
+
+	ctx, span := startSpan(ctx, "RenditionModel.Get", "renditions", "SELECT")
+	defer func() { endSpan(span, err) }()
+
+	var rendition Rendition
+	err = m.DB.QueryRowContext(ctx, query, sha256, format).Scan(
+		&rendition.SHA256,
+		&rendition.Format,
+		&rendition.Key,
+		&rendition.SizeBytes,
+		&rendition.CreatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &rendition, nil
+}
+
+/*
+Insert records a rendition. A rendition already recorded for the same blob and format
+is kept, since conversions are deterministic. ErrRecordNotFound is returned if the blob
+no longer exists.
+*/
+func (m RenditionModel) Insert(ctx context.Context, rendition *Rendition) (err error) {
+	query := `
+		INSERT INTO renditions (sha256, format, storage_key, size_bytes)
+		VALUES ($1, $2, NULLIF($3, ''), $4)
+		ON CONFLICT (sha256, format) DO NOTHING
+	`
+
+	ctx, span := startSpan(ctx, "RenditionModel.Insert", "renditions", "INSERT")
+	defer func() { endSpan(span, err) }()
+
+	_, err = m.DB.ExecContext(ctx, query, rendition.SHA256, rendition.Format, rendition.Key, rendition.SizeBytes)
+	if err != nil {
+		if isForeignKeyViolation(err, "renditions_sha256_fkey") {
+			return ErrRecordNotFound
+		}
+		return err
+	}
+
+	return nil
+}
+
+// ReferencedKeys returns the storage keys of every rendition.
+func (m RenditionModel) ReferencedKeys(ctx context.Context) (_ []string, err error) {
+	query := `SELECT storage_key FROM renditions WHERE storage_key IS NOT NULL`
+
+	ctx, span := startSpan(ctx, "RenditionModel.ReferencedKeys", "renditions", "SELECT")
+	defer func() { endSpan(span, err) }()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []string{}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,132 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+/*
+TextOverlay is a region of a template's image where text is drawn. X and Y are the top
+left corner of the region in pixels, and the text is shrunk from Size down to fit within
+MaxWidth. Text may contain the {name} placeholder, replaced by the recipient's name.
+*/
+type TextOverlay struct {
+	Text     string  `json:"text"`
+	X        int     `json:"x"`
+	Y        int     `json:"y"`
+	MaxWidth int     `json:"max_width"`
+	Font     string  `json:"font"`
+	Size     float64 `json:"size"`
+	// Color is written #RRGGBB or #RRGGBBAA.
+	Color string `json:"color"`
+	// Align is left, center or right within the region.
+	Align string `json:"align"`
+}
+
+// Template turns a creative into a personalised greeting. Version is incremented every
+// time the overlays change, which invalidates the images rendered from older versions.
+type Template struct {
+	CreativeID int64         `json:"creative_id"`
+	Overlays   []TextOverlay `json:"overlays"`
+	Version    int           `json:"version"`
+	CreatedAt  time.Time     `json:"created_at"`
+	UpdatedAt  time.Time     `json:"updated_at"`
+}
+
+type TemplateModel struct {
+	DB DBTX
+}
+
+func (m TemplateModel) Get(ctx context.Context, creativeID int64) (_ *Template, err error) {
+	query := `
+		SELECT creative_id, overlays, version, created_at, updated_at
+		FROM creative_templates
+		WHERE creative_id = $1
+	`
+
+	ctx, span := startSpan(ctx, "TemplateModel.Get", "creative_templates", "SELECT")
+	defer func() { endSpan(span, err) }()
+
+	var (
+		template Template
+		overlays []byte
+	)
+	err = m.DB.QueryRowContext(ctx, query, creativeID).Scan(
+		&template.CreativeID,
+		&overlays,
+		&template.Version,
+		&template.CreatedAt,
+		&template.UpdatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	err = json.Unmarshal(overlays, &template.Overlays)
+	if err != nil {
+		return nil, err
+	}
+
+	return &template, nil
+}
+
+// Upsert saves the template of a creative, replacing its overlays and incrementing its
+// version if it already has one. ErrRecordNotFound is returned if the creative is missing.
+func (m TemplateModel) Upsert(ctx context.Context, template *Template) (err error) {
+	query := `
+		INSERT INTO creative_templates (creative_id, overlays)
+		VALUES ($1, $2)
+		ON CONFLICT (creative_id) DO UPDATE
+		SET overlays = EXCLUDED.overlays, version = creative_templates.version + 1, updated_at = NOW()
+		RETURNING version, created_at, updated_at
+	`
+
+	overlays, err := json.Marshal(template.Overlays)
+	if err != nil {
+		return err
+	}
+
+	ctx, span := startSpan(ctx, "TemplateModel.Upsert", "creative_templates", "INSERT")
+	defer func() { endSpan(span, err) }()
+
+	err = m.DB.QueryRowContext(ctx, query, template.CreativeID, overlays).Scan(&template.Version, &template.CreatedAt, &template.UpdatedAt)
+	if err != nil {
+		if isForeignKeyViolation(err, "creative_templates_creative_id_fkey") {
+			return ErrRecordNotFound
+		}
+		return err
+	}
+
+	return nil
+}
+
+func (m TemplateModel) Delete(ctx context.Context, creativeID int64) (err error) {
+	query := `DELETE FROM creative_templates WHERE creative_id = $1`
+
+	ctx, span := startSpan(ctx, "TemplateModel.Delete", "creative_templates", "DELETE")
+	defer func() { endSpan(span, err) }()
+
+	result, err := m.DB.ExecContext(ctx, query, creativeID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,505 @@
+package data
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"go.opentelemetry.io/otel/trace"
+)
+
+const (
+	// tokenInvalidationChannel is the Redis pub/sub channel on which invalidations are
+	// broadcast to the in-process caches of every instance.
+	tokenInvalidationChannel = "auth:invalidate"
+
+	/*
+		tokenInvalidationWindow is how long an invalidated user or token is remembered.
+		A lookup that read the database before the invalidation must not store its result
+		afterwards; lookups are bounded by the auth deadline budget, which is well below
+		this window.
+	*/
+	tokenInvalidationWindow = 10 * time.Second
+)
+
+// TokenCacheOptions configures a TokenCache. Lookups are never kept past the expiry of
+// their token.
+type TokenCacheOptions struct {
+	// TTL is how long a token lookup is kept in Redis.
+	TTL time.Duration
+	// LocalSize is the number of lookups kept in the in-process LRU. Zero disables it.
+	LocalSize int
+	// LocalTTL is how long a lookup is kept in the in-process LRU.
+	LocalTTL time.Duration
+}
+
+// TokenCacheStats counts the lookups served by each cache layer.
+type TokenCacheStats struct {
+	LocalHits uint64
+	RedisHits uint64
+	Misses    uint64
+}
+
+/*
+TokenCache caches the user owning an authentication token, keyed by the token's SHA-256
+hash so that plaintext tokens never reach Redis. Lookups go through an optional
+in-process LRU, then Redis, then the wrapped UserRepository.
+
+Logging out, revoking a user's tokens and updating or deleting a user remove the affected
+entries from Redis straight away and broadcast the invalidation so that every instance
+drops them from its LRU; an instance that misses the broadcast (e.g. while reconnecting
+to Redis) keeps its entries for at most LocalTTL. Invalidated users and tokens are
+remembered for tokenInvalidationWindow so that a lookup racing with the invalidation
+cannot store what it read before it.
+
+The cache is wired in through CachedUserModel and CachedTokenModel, see
+Models.WithTokenCache. Inside a transaction, entries are invalidated once it commits and
+lookups bypass the cache.
+*/
+type TokenCache struct {
+	rdb  *redis.Client
+	ttl  time.Duration
+	lru  *tokenLRU
+	stat struct {
+		localHits, redisHits, misses atomic.Uint64
+	}
+}
+
+// NewTokenCache returns a TokenCache storing lookups in rdb.
+func NewTokenCache(rdb *redis.Client, opts TokenCacheOptions) *TokenCache {
+	c := &TokenCache{rdb: rdb, ttl: opts.TTL}
+	if opts.LocalSize > 0 {
+		c.lru = newTokenLRU(opts.LocalSize, opts.LocalTTL)
+	}
+
+	return c
+}
+
+// Stats returns the number of lookups served so far by each layer.
+func (c *TokenCache) Stats() TokenCacheStats {
+	return TokenCacheStats{
+		LocalHits: c.stat.localHits.Load(),
+		RedisHits: c.stat.redisHits.Load(),
+		Misses:    c.stat.misses.Load(),
+	}
+}
+
+/*
+Listen applies the invalidations broadcast by other instances (and by
+cheershare-admin) to the in-process LRU until ctx is cancelled. It returns immediately
+if the LRU is disabled. go-redis resubscribes after connection errors.
+*/
+func (c *TokenCache) Listen(ctx context.Context) {
+	if c.lru == nil {
+		return
+	}
+
+	pubsub := c.rdb.Subscribe(ctx, tokenInvalidationChannel)
+	defer pubsub.Close()
+
+	ch := pubsub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-ch:
+			if !ok {
+				return
+			}
+			c.applyLocal(msg.Payload)
+		}
+	}
+}
+
+// applyLocal applies an invalidation message, "user:<id>" or "token:<key>", to the LRU.
+func (c *TokenCache) applyLocal(msg string) {
+	if c.lru == nil {
+		return
+	}
+
+	kind, value, _ := strings.Cut(msg, ":")
+	switch kind {
+	case "user":
+		id, err := strconv.ParseInt(value, 10, 64)
+		if err == nil {
+			c.lru.invalidateUser(id)
+		}
+	case "token":
+		c.lru.invalidateKey(value)
+	}
+}
+
+func tokenCacheKey(scope, tokenPlaintext string) string {
+	hash := sha256.Sum256([]byte(tokenPlaintext))
+	return "auth:token:" + scope + ":" + hex.EncodeToString(hash[:])
+}
+
+func userIndexKey(userID int64) string {
+	return "auth:user:" + strconv.FormatInt(userID, 10)
+}
+
+// tombstoneKey marks a user index or token key as recently invalidated.
+func tombstoneKey(key string) string {
+	return key + ":invalidated"
+}
+
+// tokenCacheEntry is a lookup as stored in Redis: the user and the token's expiry.
+type tokenCacheEntry struct {
+	User   *User     `json:"user"`
+	Expiry time.Time `json:"expiry"`
+}
+
+// get looks key up in the LRU then in Redis, and returns the user and the token's
+// expiry. Redis errors are reported as misses.
+func (c *TokenCache) get(ctx context.Context, key string) (*User, time.Time, bool) {
+	if c.lru != nil {
+		if user, expiry, ok := c.lru.get(key); ok {
+			c.stat.localHits.Add(1)
+			return user, expiry, true
+		}
+	}
+
+	fetchedAt := time.Now()
+
+	cached, err := c.rdb.Get(ctx, key).Bytes()
+	if err == nil {
+		var entry tokenCacheEntry
+		if json.Unmarshal(cached, &entry) == nil && entry.User != nil && entry.Expiry.After(fetchedAt) {
+			c.stat.redisHits.Add(1)
+			if c.lru != nil {
+				c.lru.put(key, entry.User, entry.Expiry, fetchedAt)
+			}
+			return entry.User, entry.Expiry, true
+		}
+	}
+
+	c.stat.misses.Add(1)
+	return nil, time.Time{}, false
+}
+
+// setScript stores a lookup unless the token or its user has just been invalidated.
+var setScript = redis.NewScript(`
+if redis.call('EXISTS', KEYS[3]) == 1 or redis.call('EXISTS', KEYS[4]) == 1 then
+	return 0
+end
+redis.call('SET', KEYS[1], ARGV[1], 'PX', ARGV[2])
+redis.call('SADD', KEYS[2], KEYS[1])
+redis.call('PEXPIRE', KEYS[2], ARGV[2])
+return 1
+`)
+
+// set stores a lookup of a token expiring at expiry, started at fetchedAt. It is kept
+// for the cache TTL, or until the token expires if that is sooner.
+func (c *TokenCache) set(ctx context.Context, key string, user *User, expiry, fetchedAt time.Time) {
+	ttl := min(c.ttl, time.Until(expiry))
+	if ttl < time.Millisecond {
+		return
+	}
+
+	if c.lru != nil {
+		c.lru.put(key, user, expiry, fetchedAt)
+	}
+
+	js, err := json.Marshal(tokenCacheEntry{User: user, Expiry: expiry})
+	if err != nil {
+		return
+	}
+
+	index := userIndexKey(user.ID)
+	keys := []string{key, index, tombstoneKey(key), tombstoneKey(index)}
+	setScript.Run(ctx, c.rdb, keys, js, ttl.Milliseconds())
+}
+
+// invalidateUserScript removes every entry of a user and leaves a tombstone behind.
+var invalidateUserScript = redis.NewScript(`
+redis.call('SET', KEYS[2], 1, 'PX', ARGV[1])
+local keys = redis.call('SMEMBERS', KEYS[1])
+for _, key in ipairs(keys) do
+	redis.call('DEL', key)
+end
+redis.call('DEL', KEYS[1])
+return #keys
+`)
+
+// invalidateUser drops every cached token of a user, on every instance.
+func (c *TokenCache) invalidateUser(ctx context.Context, userID int64) {
+	if c.lru != nil {
+		c.lru.invalidateUser(userID)
+	}
+
+	c.invalidate(ctx, "user:"+strconv.FormatInt(userID, 10), func(ctx context.Context) error {
+		index := userIndexKey(userID)
+		return invalidateUserScript.Run(ctx, c.rdb, []string{index, tombstoneKey(index)}, tokenInvalidationWindow.Milliseconds()).Err()
+	})
+}
+
+// invalidateToken drops a single cached token, on every instance.
+func (c *TokenCache) invalidateToken(ctx context.Context, scope, tokenPlaintext string) {
+	key := tokenCacheKey(scope, tokenPlaintext)
+	if c.lru != nil {
+		c.lru.invalidateKey(key)
+	}
+
+	c.invalidate(ctx, "token:"+key, func(ctx context.Context) error {
+		_, err := c.rdb.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, tombstoneKey(key), 1, tokenInvalidationWindow)
+			pipe.Del(ctx, key)
+			return nil
+		})
+		return err
+	})
+}
+
+// invalidate runs the Redis side of an invalidation then broadcasts msg. It runs even if
+// ctx was cancelled after the write went through; failures are recorded on the span.
+func (c *TokenCache) invalidate(ctx context.Context, msg string, fn func(context.Context) error) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), time.Second)
+	defer cancel()
+
+	err := fn(ctx)
+	if err == nil {
+		err = c.rdb.Publish(ctx, tokenInvalidationChannel, msg).Err()
+	}
+	if err != nil {
+		trace.SpanFromContext(ctx).RecordError(fmt.Errorf("invalidate token cache: %w", err))
+	}
+}
+
+/*
+WithTokenCache returns m with token lookups served from cache and invalidated by the
+user and token writes, including those made in its transactions.
+*/
+func (m Models) WithTokenCache(cache *TokenCache) Models {
+	return m.decorate(func(m Models) Models {
+		m.User = &CachedUserModel{UserRepository: m.User, cache: cache, afterCommit: m.afterCommit}
+		m.Token = &CachedTokenModel{TokenRepository: m.Token, cache: cache, afterCommit: m.afterCommit}
+		return m
+	})
+}
+
+/*
+CachedUserModel serves GetForToken from a TokenCache and invalidates it when a user is
+updated or deleted. All other methods are passed through.
+*/
+type CachedUserModel struct {
+	UserRepository
+	cache *TokenCache
+	// afterCommit is set when the model is bound to a transaction, see
+	// Models.AfterCommit.
+	afterCommit func(fn func())
+}
+
+var _ UserRepository = (*CachedUserModel)(nil)
+
+func NewCachedUserModel(next UserRepository, cache *TokenCache) *CachedUserModel {
+	return &CachedUserModel{UserRepository: next, cache: cache}
+}
+
+// GetForToken bypasses the cache inside transactions, whose reads may be rolled back.
+func (m *CachedUserModel) GetForToken(ctx context.Context, tokenScope, tokenPlainText string) (*User, time.Time, error) {
+	if m.afterCommit != nil {
+		return m.UserRepository.GetForToken(ctx, tokenScope, tokenPlainText)
+	}
+
+	key := tokenCacheKey(tokenScope, tokenPlainText)
+	if user, expiry, ok := m.cache.get(ctx, key); ok {
+		return user, expiry, nil
+	}
+
+	fetchedAt := time.Now()
+
+	user, expiry, err := m.UserRepository.GetForToken(ctx, tokenScope, tokenPlainText)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	m.cache.set(ctx, key, user, expiry, fetchedAt)
+	return user, expiry, nil
+}
+
+func (m *CachedUserModel) Update(ctx context.Context, user *User) error {
+	err := m.UserRepository.Update(ctx, user)
+	if err != nil {
+		return err
+	}
+
+	afterCommit(m.afterCommit, func() { m.cache.invalidateUser(ctx, user.ID) })
+	return nil
+}
+
+func (m *CachedUserModel) Delete(ctx context.Context, id int64) error {
+	err := m.UserRepository.Delete(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	afterCommit(m.afterCommit, func() { m.cache.invalidateUser(ctx, id) })
+	return nil
+}
+
+/*
+CachedTokenModel invalidates a TokenCache when tokens are deleted. Expired tokens are
+not invalidated by DeleteExpired: their entries never outlive the token.
+*/
+type CachedTokenModel struct {
+	TokenRepository
+	cache       *TokenCache
+	afterCommit func(fn func())
+}
+
+var _ TokenRepository = (*CachedTokenModel)(nil)
+
+func NewCachedTokenModel(next TokenRepository, cache *TokenCache) *CachedTokenModel {
+	return &CachedTokenModel{TokenRepository: next, cache: cache}
+}
+
+func (m *CachedTokenModel) Delete(ctx context.Context, scope, tokenPlaintext string) error {
+	err := m.TokenRepository.Delete(ctx, scope, tokenPlaintext)
+	if err != nil {
+		return err
+	}
+
+	afterCommit(m.afterCommit, func() { m.cache.invalidateToken(ctx, scope, tokenPlaintext) })
+	return nil
+}
+
+// DeleteAllForUser invalidates the user's cached tokens of every scope.
+func (m *CachedTokenModel) DeleteAllForUser(ctx context.Context, scope string, userID int64) error {
+	err := m.TokenRepository.DeleteAllForUser(ctx, scope, userID)
+	if err != nil {
+		return err
+	}
+
+	afterCommit(m.afterCommit, func() { m.cache.invalidateUser(ctx, userID) })
+	return nil
+}
+
+/*
+tokenLRU is the in-process layer of TokenCache. Like the Redis layer it remembers
+recent invalidations, so that a lookup started before one is not stored after it.
+*/
+type tokenLRU struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List
+	entries map[string]*list.Element
+	// invalidated maps "user:<id>" and token keys to the time they were invalidated.
+	invalidated map[string]time.Time
+}
+
+type tokenLRUEntry struct {
+	key  string
+	user User
+	// expiry is the token's; expires is when the entry is dropped, never after it.
+	expiry  time.Time
+	expires time.Time
+}
+
+func newTokenLRU(size int, ttl time.Duration) *tokenLRU {
+	return &tokenLRU{
+		size:        size,
+		ttl:         ttl,
+		order:       list.New(),
+		entries:     make(map[string]*list.Element),
+		invalidated: make(map[string]time.Time),
+	}
+}
+
+func (l *tokenLRU) get(key string) (*User, time.Time, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	elem, ok := l.entries[key]
+	if !ok {
+		return nil, time.Time{}, false
+	}
+
+	entry := elem.Value.(*tokenLRUEntry)
+	if !time.Now().Before(entry.expires) {
+		l.order.Remove(elem)
+		delete(l.entries, key)
+		return nil, time.Time{}, false
+	}
+
+	l.order.MoveToFront(elem)
+	user := entry.user
+	return &user, entry.expiry, true
+}
+
+// put stores a lookup of a token expiring at expiry that started at fetchedAt, unless it
+// was invalidated since.
+func (l *tokenLRU) put(key string, user *User, expiry, fetchedAt time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	for _, mark := range []string{key, "user:" + strconv.FormatInt(user.ID, 10)} {
+		if at, ok := l.invalidated[mark]; ok && !at.Before(fetchedAt) {
+			return
+		}
+	}
+
+	expires := time.Now().Add(l.ttl)
+	if expiry.Before(expires) {
+		expires = expiry
+	}
+
+	entry := &tokenLRUEntry{key: key, user: *user, expiry: expiry, expires: expires}
+	if elem, ok := l.entries[key]; ok {
+		elem.Value = entry
+		l.order.MoveToFront(elem)
+		return
+	}
+
+	l.entries[key] = l.order.PushFront(entry)
+	if l.order.Len() > l.size {
+		oldest := l.order.Back()
+		l.order.Remove(oldest)
+		delete(l.entries, oldest.Value.(*tokenLRUEntry).key)
+	}
+}
+
+func (l *tokenLRU) invalidateUser(userID int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.markInvalidated("user:" + strconv.FormatInt(userID, 10))
+	for key, elem := range l.entries {
+		if elem.Value.(*tokenLRUEntry).user.ID == userID {
+			l.order.Remove(elem)
+			delete(l.entries, key)
+		}
+	}
+}
+
+func (l *tokenLRU) invalidateKey(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.markInvalidated(key)
+	if elem, ok := l.entries[key]; ok {
+		l.order.Remove(elem)
+		delete(l.entries, key)
+	}
+}
+
+// markInvalidated records an invalidation and forgets those older than the window.
+// The caller must hold l.mu.
+func (l *tokenLRU) markInvalidated(mark string) {
+	now := time.Now()
+	for m, at := range l.invalidated {
+		if now.Sub(at) > tokenInvalidationWindow {
+			delete(l.invalidated, m)
+		}
+	}
+	l.invalidated[mark] = now
+}
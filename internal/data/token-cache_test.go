@@ -0,0 +1,65 @@
+package data
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+)
+
+func TestTokenCacheStopsAtTokenExpiry(t *testing.T) {
+	ctx := context.Background()
+
+	for _, localSize := range []int{0, 10} {
+		mr := miniredis.RunT(t)
+		rdb := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+		t.Cleanup(func() { rdb.Close() })
+
+		cache := NewTokenCache(rdb, TokenCacheOptions{TTL: time.Hour, LocalSize: localSize, LocalTTL: time.Hour})
+		models := NewMemoryModels().WithTokenCache(cache)
+
+		user := &User{Name: "Asha", PhoneNumber: "9876543210"}
+		if err := models.User.Insert(ctx, user); err != nil {
+			t.Fatal(err)
+		}
+		token, err := models.Token.New(ctx, user.ID, 200*time.Millisecond, ScopeAuthentication)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, expiry, err := models.User.GetForToken(ctx, ScopeAuthentication, token.Plaintext)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !expiry.Equal(token.Expiry) {
+			t.Errorf("local size %d: expiry = %v, want %v", localSize, expiry, token.Expiry)
+		}
+
+		// The entry is kept for the token's lifetime, not the hour of the cache TTL.
+		ttl := mr.TTL(tokenCacheKey(ScopeAuthentication, token.Plaintext))
+		if ttl <= 0 || ttl > 200*time.Millisecond {
+			t.Errorf("local size %d: Redis TTL = %v, want at most the token's 200ms", localSize, ttl)
+		}
+
+		// Served from cache while the token is valid.
+		if _, _, err := models.User.GetForToken(ctx, ScopeAuthentication, token.Plaintext); err != nil {
+			t.Fatal(err)
+		}
+
+		time.Sleep(250 * time.Millisecond)
+		mr.FastForward(250 * time.Millisecond)
+
+		_, _, err = models.User.GetForToken(ctx, ScopeAuthentication, token.Plaintext)
+		if !errors.Is(err, ErrRecordNotFound) {
+			t.Errorf("local size %d: after the token expired: error = %v, want %v", localSize, err, ErrRecordNotFound)
+		}
+
+		stats := cache.Stats()
+		if stats.LocalHits+stats.RedisHits != 1 || stats.Misses != 2 {
+			t.Errorf("local size %d: stats = %+v, want one hit while valid and a miss once expired", localSize, stats)
+		}
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/sha256"
-	"database/sql"
 	"encoding/base32"
 	"time"
 )
@@ -22,7 +21,7 @@ type Token struct {
 }
 
 type TokenModel struct {
-	DB *sql.DB
+	DB DBTX
 }
 
 /*
@@ -62,35 +61,77 @@ func generateToken(userId int64, ttl time.Duration, scope string) (*Token, error
 
 }
 
-func (m TokenModel) Insert(token *Token) error {
+func (m TokenModel) Insert(ctx context.Context, token *Token) (err error) {
 	query := `INSERT INTO tokens (hash, user_id, expiry, scope)
 	VALUES ($1, $2, $3, $4)`
 
 	args := []interface{}{token.Hash, token.UserId, token.Expiry, token.Scope}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
-	defer cancel()
+	ctx, span := startSpan(ctx, "TokenModel.Insert", "tokens", "INSERT")
+	defer func() { endSpan(span, err) }()
 
-	_, err := m.DB.ExecContext(ctx, query, args...)
+	_, err = m.DB.ExecContext(ctx, query, args...)
 	return err
 }
 
-func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
+func (m TokenModel) DeleteAllForUser(ctx context.Context, scope string, userID int64) (err error) {
 	query := `DELETE FROM tokens  WHERE user_id = $1 AND scope = $2`
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
-	defer cancel()
+	ctx, span := startSpan(ctx, "TokenModel.DeleteAllForUser", "tokens", "DELETE")
+	defer func() { endSpan(span, err) }()
 
-	_, err := m.DB.ExecContext(ctx, query, userID, scope)
+	_, err = m.DB.ExecContext(ctx, query, userID, scope)
 	return err
 }
 
-func (m TokenModel) New(userId int64, ttl time.Duration, scope string) (*Token, error) {
+// Delete removes the token with the given plaintext, as done on logout. ErrRecordNotFound
+// is returned if there is no such token.
+func (m TokenModel) Delete(ctx context.Context, scope, tokenPlaintext string) (err error) {
+	query := `DELETE FROM tokens WHERE hash = $1 AND scope = $2`
+
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	ctx, span := startSpan(ctx, "TokenModel.Delete", "tokens", "DELETE")
+	defer func() { endSpan(span, err) }()
+
+	result, err := m.DB.ExecContext(ctx, query, tokenHash[:], scope)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// DeleteExpired removes every expired token and returns how many were removed.
+func (m TokenModel) DeleteExpired(ctx context.Context) (_ int64, err error) {
+	query := `DELETE FROM tokens WHERE expiry <= $1`
+
+	ctx, span := startSpan(ctx, "TokenModel.DeleteExpired", "tokens", "DELETE")
+	defer func() { endSpan(span, err) }()
+
+	result, err := m.DB.ExecContext(ctx, query, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+func (m TokenModel) New(ctx context.Context, userId int64, ttl time.Duration, scope string) (*Token, error) {
 	token, err := generateToken(userId, ttl, scope)
 	if err != nil {
 		return nil, err
 	}
 
-	err = m.Insert(token)
+	err = m.Insert(ctx, token)
 	return token, err
 }
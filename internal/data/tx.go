@@ -0,0 +1,121 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+)
+
+// DBTX is the subset of *sql.DB and *sql.Tx used by the Postgres models, so the same
+// model can run either directly against the pool or inside a transaction.
+type DBTX interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+/*
+WithTx runs fn with a copy of the models bound to a single transaction. The transaction
+is committed if fn returns nil and rolled back otherwise (including when fn panics).
+Calling WithTx on models that are already bound to a transaction simply runs fn in
+that transaction. The models given to fn are wrapped in the same decorators, such as
+caches, as m.
+*/
+func (m Models) WithTx(ctx context.Context, fn func(tx Models) error) error {
+	if m.tx == nil {
+		return errors.New("models do not support transactions")
+	}
+	return m.tx(ctx, fn)
+}
+
+/*
+AfterCommit runs fn once the transaction m is bound to has committed, and never if it
+is rolled back. Outside of a transaction fn runs straight away. Caches use it so that
+they are not invalidated before the writes they reflect are visible to other readers.
+*/
+func (m Models) AfterCommit(fn func()) {
+	afterCommit(m.afterCommit, fn)
+}
+
+// afterCommit hands fn to the queue of a transaction's AfterCommit functions, or runs it
+// straight away if queue is nil. The cache decorators keep the queue of the models they
+// were created from.
+func afterCommit(queue func(fn func()), fn func()) {
+	if queue == nil {
+		fn()
+		return
+	}
+	queue(fn)
+}
+
+// joinTx returns m bound to a running transaction: functions passed to AfterCommit are
+// handed to onCommit, and nested calls to WithTx just join the transaction.
+func (m Models) joinTx(onCommit func(fn func())) Models {
+	m.afterCommit = onCommit
+	m.tx = func(ctx context.Context, fn func(Models) error) error {
+		return fn(m)
+	}
+	return m
+}
+
+/*
+decorate returns wrap(m), and makes WithTx hand the models of every transaction through
+wrap too, so that writes made inside transactions go through the same decorators.
+*/
+func (m Models) decorate(wrap func(Models) Models) Models {
+	run := m.tx
+	d := wrap(m)
+
+	if run != nil {
+		d.tx = func(ctx context.Context, fn func(Models) error) error {
+			return run(ctx, func(tx Models) error {
+				return fn(tx.decorate(wrap))
+			})
+		}
+	}
+
+	return d
+}
+
+// commitHooks collects the functions passed to AfterCommit during a transaction.
+type commitHooks []func()
+
+func (h *commitHooks) add(fn func()) {
+	*h = append(*h, fn)
+}
+
+func (h commitHooks) run() {
+	for _, fn := range h {
+		fn()
+	}
+}
+
+// postgresTx returns the transaction runner used by NewModels.
+func postgresTx(db *sql.DB) func(context.Context, func(Models) error) error {
+	return func(ctx context.Context, fn func(Models) error) (err error) {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("begin transaction: %w", err)
+		}
+
+		var hooks commitHooks
+
+		defer func() {
+			if p := recover(); p != nil {
+				tx.Rollback()
+				panic(p)
+			}
+			if err != nil {
+				tx.Rollback()
+				return
+			}
+			err = tx.Commit()
+			if err == nil {
+				hooks.run()
+			}
+		}()
+
+		return fn(newModels(tx).joinTx(hooks.add))
+	}
+}
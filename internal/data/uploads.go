@@ -0,0 +1,222 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+/*
+Upload is a resumable (tus) upload in progress. Each PATCH request stores the bytes it
+received as a separate chunk object; once Offset reaches Length the chunks are
+concatenated into a single object stored under Key and the chunks are removed.
+*/
+type Upload struct {
+	ID        string    `json:"id"`
+	UserID    int64     `json:"-"`
+	Filename  string    `json:"filename"`
+	Length    int64     `json:"length"`
+	Offset    int64     `json:"offset"`
+	Chunks    []string  `json:"-"`
+	Key       string    `json:"-"`
+	ExpiresAt time.Time `json:"expires_at"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Done reports whether every byte of the upload has been received.
+func (u *Upload) Done() bool {
+	return u.Offset == u.Length
+}
+
+// Expired reports whether the upload can no longer be resumed or attached.
+func (u *Upload) Expired() bool {
+	return !time.Now().Before(u.ExpiresAt)
+}
+
+type UploadModel struct {
+	DB DBTX
+}
+
+func (m UploadModel) Insert(ctx context.Context, upload *Upload) (err error) {
+	query := `
+		INSERT INTO tus_uploads (id, user_id, filename, upload_length, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING created_at
+	`
+
+	args := []interface{}{upload.ID, upload.UserID, upload.Filename, upload.Length, upload.ExpiresAt}
+
+	ctx, span := startSpan(ctx, "UploadModel.Insert", "tus_uploads", "INSERT")
+	defer func() { endSpan(span, err) }()
+
+	return m.DB.QueryRowContext(ctx, query, args...).Scan(&upload.CreatedAt)
+}
+
+func (m UploadModel) Get(ctx context.Context, id string) (_ *Upload, err error) {
+	query := `
+		SELECT id, user_id, filename, upload_length, upload_offset, chunks, coalesce(storage_key, ''), expires_at, created_at
+		FROM tus_uploads
+		WHERE id = $1
+	`
+
+	ctx, span := startSpan(ctx, "UploadModel.Get", "tus_uploads", "SELECT")
+	defer func() { endSpan(span, err) }()
+
+	var upload Upload
+	err = m.DB.QueryRowContext(ctx, query, id).Scan(
+		&upload.ID,
+		&upload.UserID,
+		&upload.Filename,
+		&upload.Length,
+		&upload.Offset,
+		pq.Array(&upload.Chunks),
+		&upload.Key,
+		&upload.ExpiresAt,
+		&upload.CreatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &upload, nil
+}
+
+/*
+AppendChunk records a chunk of size bytes stored under key at the upload's current
+offset, and advances upload.Offset. ErrEditConflict is returned if the offset changed
+since the upload was read, i.e. another request appended a chunk concurrently.
+*/
+func (m UploadModel) AppendChunk(ctx context.Context, upload *Upload, key string, size int64) (err error) {
+	query := `
+		UPDATE tus_uploads
+		SET upload_offset = upload_offset + $1, chunks = array_append(chunks, $2)
+		WHERE id = $3 AND upload_offset = $4
+		RETURNING upload_offset, chunks
+	`
+
+	ctx, span := startSpan(ctx, "UploadModel.AppendChunk", "tus_uploads", "UPDATE")
+	defer func() { endSpan(span, err) }()
+
+	err = m.DB.QueryRowContext(ctx, query, size, key, upload.ID, upload.Offset).Scan(&upload.Offset, pq.Array(&upload.Chunks))
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Complete records the object the chunks were concatenated into, and forgets the chunks.
+func (m UploadModel) Complete(ctx context.Context, upload *Upload, key string) (err error) {
+	query := `
+		UPDATE tus_uploads
+		SET storage_key = $1, chunks = '{}'
+		WHERE id = $2 AND upload_offset = upload_length
+	`
+
+	ctx, span := startSpan(ctx, "UploadModel.Complete", "tus_uploads", "UPDATE")
+	defer func() { endSpan(span, err) }()
+
+	result, err := m.DB.ExecContext(ctx, query, key, upload.ID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	upload.Key = key
+	upload.Chunks = nil
+	return nil
+}
+
+func (m UploadModel) Delete(ctx context.Context, id string) (err error) {
+	query := `DELETE FROM tus_uploads WHERE id = $1`
+
+	ctx, span := startSpan(ctx, "UploadModel.Delete", "tus_uploads", "DELETE")
+	defer func() { endSpan(span, err) }()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// DeleteExpired removes every expired upload and returns how many were removed. Their
+// objects are left to the garbage collector.
+func (m UploadModel) DeleteExpired(ctx context.Context) (_ int64, err error) {
+	query := `DELETE FROM tus_uploads WHERE expires_at <= $1`
+
+	ctx, span := startSpan(ctx, "UploadModel.DeleteExpired", "tus_uploads", "DELETE")
+	defer func() { endSpan(span, err) }()
+
+	result, err := m.DB.ExecContext(ctx, query, time.Now())
+	if err != nil {
+		return 0, err
+	}
+
+	return result.RowsAffected()
+}
+
+// ReferencedKeys returns the storage keys of the chunks and completed objects of every
+// upload.
+func (m UploadModel) ReferencedKeys(ctx context.Context) (_ []string, err error) {
+	query := `
+		SELECT unnest(chunks) FROM tus_uploads
+		UNION ALL
+		SELECT storage_key FROM tus_uploads WHERE storage_key IS NOT NULL
+	`
+
+	ctx, span := startSpan(ctx, "UploadModel.ReferencedKeys", "tus_uploads", "SELECT")
+	defer func() { endSpan(span, err) }()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []string{}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,94 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+const (
+	PlanFree = "free"
+	PlanPro  = "pro"
+)
+
+// PlanLimits are the upload quotas of a plan, stored in the plans table.
+type PlanLimits struct {
+	CreativesPerDay int   `json:"creatives_per_day"`
+	TotalBytes      int64 `json:"total_bytes"`
+	FileBytes       int64 `json:"file_bytes"`
+}
+
+// DefaultPlans are the plans created by the migrations. The in-memory models use them
+// as their plans table.
+var DefaultPlans = map[string]PlanLimits{
+	PlanFree: {CreativesPerDay: 20, TotalBytes: 100 << 20, FileBytes: 10 << 20},
+	PlanPro:  {CreativesPerDay: 200, TotalBytes: 10 << 30, FileBytes: 50 << 20},
+}
+
+/*
+Usage reports a user's plan limits and how much of them is used. Creatives count
+towards the daily limit on the UTC day they were uploaded, and towards the storage
+limit until they are deleted.
+*/
+type Usage struct {
+	Plan           string     `json:"plan"`
+	Limits         PlanLimits `json:"limits"`
+	CreativesToday int        `json:"creatives_today"`
+	BytesStored    int64      `json:"bytes_stored"`
+}
+
+// CreativesLeftToday returns how many more creatives can be uploaded today.
+func (u *Usage) CreativesLeftToday() int {
+	return max(u.Limits.CreativesPerDay-u.CreativesToday, 0)
+}
+
+// BytesLeft returns how many more bytes can be stored.
+func (u *Usage) BytesLeft() int64 {
+	return max(u.Limits.TotalBytes-u.BytesStored, 0)
+}
+
+// startOfUTCDay returns midnight UTC of the day of t, from which the daily quota counts.
+func startOfUTCDay(t time.Time) time.Time {
+	y, m, d := t.UTC().Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+type UsageModel struct {
+	DB DBTX
+}
+
+// Get returns the usage of a user, or ErrRecordNotFound if the user does not exist.
+func (m UsageModel) Get(ctx context.Context, userID int64) (_ *Usage, err error) {
+	query := `
+		SELECT u.plan, p.max_creatives_per_day, p.max_total_bytes, p.max_file_bytes,
+			(SELECT count(*) FROM creatives c WHERE c.user_id = u.id AND c.created_at >= $2),
+			(SELECT coalesce(sum(c.size_bytes), 0) FROM creatives c WHERE c.user_id = u.id)
+		FROM users u
+		JOIN plans p ON p.name = u.plan
+		WHERE u.id = $1
+	`
+
+	ctx, span := startSpan(ctx, "UsageModel.Get", "creatives", "SELECT")
+	defer func() { endSpan(span, err) }()
+
+	var usage Usage
+	err = m.DB.QueryRowContext(ctx, query, userID, startOfUTCDay(time.Now())).Scan(
+		&usage.Plan,
+		&usage.Limits.CreativesPerDay,
+		&usage.Limits.TotalBytes,
+		&usage.Limits.FileBytes,
+		&usage.CreativesToday,
+		&usage.BytesStored,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &usage, nil
+}
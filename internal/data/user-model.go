@@ -5,19 +5,30 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"errors"
+	"log/slog"
 	"time"
 )
 
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
+// Roles lists every role accepted by the users.role check constraint.
+var Roles = []string{RoleUser, RoleAdmin}
+
 type User struct {
 	ID          int64     `json:"id"`
 	CreatedAt   time.Time `json:"created_at"`
 	Name        string    `json:"name"`
 	PhoneNumber string    `json:"phone_number"`
+	Role        string    `json:"role"`
+	Plan        string    `json:"plan"`
 	Version     int       `json:"version"`
 }
 
 type UserModel struct {
-	DB *sql.DB
+	DB DBTX
 }
 
 var AnonymousUser = &User{}
@@ -26,52 +37,101 @@ func (m *User) IsAnonymous() bool {
 	return m == AnonymousUser
 }
 
-func (m UserModel) Insert(user *User) error {
+// LogValue implements slog.LogValuer so that logging a user only writes its ID and phone
+// number as separate attributes, which lets the logger mask the phone number.
+func (m *User) LogValue() slog.Value {
+	if m == nil {
+		return slog.AnyValue(nil)
+	}
+	return slog.GroupValue(
+		slog.Int64("id", m.ID),
+		slog.String("phone_number", m.PhoneNumber),
+	)
+}
+
+func (m UserModel) Insert(ctx context.Context, user *User) (err error) {
 	query := `
 		INSERT INTO users (name, phone_number)
 		VALUES ($1, $2)
-		RETURNING id, created_at, version
+		RETURNING id, created_at, role, plan, version
 	`
 
 	args := []interface{}{user.Name, user.PhoneNumber}
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
-	defer cancel()
+	ctx, span := startSpan(ctx, "UserModel.Insert", "users", "INSERT")
+	defer func() { endSpan(span, err) }()
 
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Version)
+	err = m.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Role, &user.Plan, &user.Version)
 	if err != nil {
-		return err
+		switch {
+		case isUniqueViolation(err, "users_phone_number_key"):
+			return ErrDuplicatePhoneNumber
+		default:
+			return err
+		}
 	}
 
 	return nil
 }
 
-func (m UserModel) GetByPhoneNumber(PhoneNumber string) (*User, error) {
+/*
+Upsert returns the user registered with user.PhoneNumber, creating it first if it does
+not exist. It is a single INSERT ... ON CONFLICT statement, so concurrent calls for the
+same phone number cannot race into a unique constraint error. The no-op update on
+conflict makes RETURNING yield the existing row; user.Name is left unchanged in that
+case. The boolean result reports whether a new user was created.
+*/
+func (m UserModel) Upsert(ctx context.Context, user *User) (_ bool, err error) {
 	query := `
-		SELECT id, created_at, name, phone_number, version
+		INSERT INTO users (name, phone_number)
+		VALUES ($1, $2)
+		ON CONFLICT (phone_number) DO UPDATE SET phone_number = EXCLUDED.phone_number
+		RETURNING id, created_at, name, role, plan, version, (xmax = 0) AS inserted
+	`
+
+	ctx, span := startSpan(ctx, "UserModel.Upsert", "users", "INSERT")
+	defer func() { endSpan(span, err) }()
+
+	var inserted bool
+	err = m.DB.QueryRowContext(ctx, query, user.Name, user.PhoneNumber).Scan(&user.ID, &user.CreatedAt, &user.Name, &user.Role, &user.Plan, &user.Version, &inserted)
+	if err != nil {
+		return false, err
+	}
+
+	return inserted, nil
+}
+
+func (m UserModel) GetByPhoneNumber(ctx context.Context, PhoneNumber string) (_ *User, err error) {
+	query := `
+		SELECT id, created_at, name, phone_number, role, plan, version
         FROM users
         WHERE phone_number = $1
 	`
 
 	var user User
 
-	ctx, cancel := context.WithTimeout(context.Background(), time.Second*3)
-	defer cancel()
+	ctx, span := startSpan(ctx, "UserModel.GetByPhoneNumber", "users", "SELECT")
+	defer func() { endSpan(span, err) }()
 
-	err := m.DB.QueryRowContext(ctx, query, PhoneNumber).Scan(&user.ID, &user.CreatedAt, &user.Name, &user.PhoneNumber, &user.Version)
+	err = m.DB.QueryRowContext(ctx, query, PhoneNumber).Scan(&user.ID, &user.CreatedAt, &user.Name, &user.PhoneNumber, &user.Role, &user.Plan, &user.Version)
 
 	if err != nil {
-		return nil, err
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
 	}
 
 	return &user, nil
 }
 
-func (m UserModel) GetForToken(tokenScope, tokenPlainText string) (*User, error) {
+func (m UserModel) GetForToken(ctx context.Context, tokenScope, tokenPlainText string) (_ *User, _ time.Time, err error) {
 
 	tokenHash := sha256.Sum256([]byte(tokenPlainText))
 
-	query := `SELECT users.id, users.created_at, users.name,  users.phone_number,  users.version
+	query := `SELECT users.id, users.created_at, users.name,  users.phone_number, users.role, users.plan, users.version, tokens.expiry
 	FROM users
 	INNER JOIN tokens
 	ON users.id = tokens.user_id
@@ -80,21 +140,105 @@ func (m UserModel) GetForToken(tokenScope, tokenPlainText string) (*User, error)
 
 	args := []interface{}{tokenHash[:], tokenScope, time.Now()}
 
+	var user User
+	var expiry time.Time
+
+	ctx, span := startSpan(ctx, "UserModel.GetForToken", "users", "SELECT")
+	defer func() { endSpan(span, err) }()
+
+	err = m.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Name, &user.PhoneNumber, &user.Role, &user.Plan, &user.Version, &expiry)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, time.Time{}, ErrRecordNotFound
+		default:
+			return nil, time.Time{}, err
+
+		}
+	}
+
+	return &user, expiry, nil
+}
+
+func (m UserModel) Get(ctx context.Context, id int64) (_ *User, err error) {
+	query := `
+		SELECT id, created_at, name, phone_number, role, plan, version
+		FROM users
+		WHERE id = $1
+	`
+
 	var user User
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
-	defer cancel()
+	ctx, span := startSpan(ctx, "UserModel.Get", "users", "SELECT")
+	defer func() { endSpan(span, err) }()
 
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.Name, &user.PhoneNumber, &user.Version)
+	err = m.DB.QueryRowContext(ctx, query, id).Scan(&user.ID, &user.CreatedAt, &user.Name, &user.PhoneNumber, &user.Role, &user.Plan, &user.Version)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
 			return nil, ErrRecordNotFound
 		default:
 			return nil, err
-
 		}
 	}
 
 	return &user, nil
 }
+
+/*
+Update saves the user's name, role and plan. The version column is used for optimistic
+locking: if the row changed since it was read, ErrEditConflict is returned and nothing
+is written. ErrUnknownPlan is returned if the plan does not exist.
+*/
+func (m UserModel) Update(ctx context.Context, user *User) (err error) {
+	query := `
+		UPDATE users
+		SET name = $1, role = $2, plan = $3, version = version + 1
+		WHERE id = $4 AND version = $5
+		RETURNING version
+	`
+
+	args := []interface{}{user.Name, user.Role, user.Plan, user.ID, user.Version}
+
+	ctx, span := startSpan(ctx, "UserModel.Update", "users", "UPDATE")
+	defer func() { endSpan(span, err) }()
+
+	err = m.DB.QueryRowContext(ctx, query, args...).Scan(&user.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		case isForeignKeyViolation(err, "users_plan_fkey"):
+			return ErrUnknownPlan
+		default:
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Delete removes a user. Their tokens and creatives are removed by the ON DELETE CASCADE
+// foreign keys.
+func (m UserModel) Delete(ctx context.Context, id int64) (err error) {
+	query := `DELETE FROM users WHERE id = $1`
+
+	ctx, span := startSpan(ctx, "UserModel.Delete", "users", "DELETE")
+	defer func() { endSpan(span, err) }()
+
+	result, err := m.DB.ExecContext(ctx, query, id)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
@@ -0,0 +1,153 @@
+package data
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+// Watermark positions, the corner of the image the logo is drawn in.
+const (
+	WatermarkTopLeft     = "top-left"
+	WatermarkTopRight    = "top-right"
+	WatermarkBottomLeft  = "bottom-left"
+	WatermarkBottomRight = "bottom-right"
+)
+
+var WatermarkPositions = []string{WatermarkTopLeft, WatermarkTopRight, WatermarkBottomLeft, WatermarkBottomRight}
+
+/*
+Watermark is the logo a user has drawn onto their rendered creatives. Scale is the width
+of the logo as a fraction of the image's width, and Opacity ranges from 0 (invisible) to
+1. Version is incremented every time the settings change, which invalidates the images
+rendered with older versions.
+*/
+type Watermark struct {
+	UserID    int64     `json:"-"`
+	LogoKey   string    `json:"-"`
+	Position  string    `json:"position"`
+	Opacity   float64   `json:"opacity"`
+	Scale     float64   `json:"scale"`
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type WatermarkModel struct {
+	DB DBTX
+}
+
+func (m WatermarkModel) Get(ctx context.Context, userID int64) (_ *Watermark, err error) {
+	query := `
+		SELECT user_id, logo_key, position, opacity, scale, version, created_at, updated_at
+		FROM watermarks
+		WHERE user_id = $1
+	`
+
+	ctx, span := startSpan(ctx, "WatermarkModel.Get", "watermarks", "SELECT")
+	defer func() { endSpan(span, err) }()
+
+	var watermark Watermark
+	err = m.DB.QueryRowContext(ctx, query, userID).Scan(
+		&watermark.UserID,
+		&watermark.LogoKey,
+		&watermark.Position,
+		&watermark.Opacity,
+		&watermark.Scale,
+		&watermark.Version,
+		&watermark.CreatedAt,
+		&watermark.UpdatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, err
+		}
+	}
+
+	return &watermark, nil
+}
+
+// Upsert saves the watermark of a user, replacing their settings and incrementing the
+// version if they already have one.
+func (m WatermarkModel) Upsert(ctx context.Context, watermark *Watermark) (err error) {
+	query := `
+		INSERT INTO watermarks (user_id, logo_key, position, opacity, scale)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (user_id) DO UPDATE
+		SET logo_key = EXCLUDED.logo_key, position = EXCLUDED.position, opacity = EXCLUDED.opacity,
+			scale = EXCLUDED.scale, version = watermarks.version + 1, updated_at = NOW()
+		RETURNING version, created_at, updated_at
+	`
+
+	args := []interface{}{watermark.UserID, watermark.LogoKey, watermark.Position, watermark.Opacity, watermark.Scale}
+
+	ctx, span := startSpan(ctx, "WatermarkModel.Upsert", "watermarks", "INSERT")
+	defer func() { endSpan(span, err) }()
+
+	err = m.DB.QueryRowContext(ctx, query, args...).Scan(&watermark.Version, &watermark.CreatedAt, &watermark.UpdatedAt)
+	if err != nil {
+		if isForeignKeyViolation(err, "watermarks_user_id_fkey") {
+			return ErrRecordNotFound
+		}
+		return err
+	}
+
+	return nil
+}
+
+// Delete removes the watermark of a user. Its logo is left to the garbage collector.
+func (m WatermarkModel) Delete(ctx context.Context, userID int64) (err error) {
+	query := `DELETE FROM watermarks WHERE user_id = $1`
+
+	ctx, span := startSpan(ctx, "WatermarkModel.Delete", "watermarks", "DELETE")
+	defer func() { endSpan(span, err) }()
+
+	result, err := m.DB.ExecContext(ctx, query, userID)
+	if err != nil {
+		return err
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// ReferencedKeys returns the storage keys of every logo.
+func (m WatermarkModel) ReferencedKeys(ctx context.Context) (_ []string, err error) {
+	query := `SELECT logo_key FROM watermarks`
+
+	ctx, span := startSpan(ctx, "WatermarkModel.ReferencedKeys", "watermarks", "SELECT")
+	defer func() { endSpan(span, err) }()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	keys := []string{}
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return keys, nil
+}
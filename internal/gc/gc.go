@@ -0,0 +1,143 @@
+/*
+Package gc removes stored objects that no creative references any more: files stored by
+uploads whose creative could not be saved, and files of creatives deleted directly or by
+the cascade when their owner was deleted.
+*/
+package gc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/vishaaxl/cheershare/internal/storage"
+)
+
+/*
+ErrNoReferences is returned, and nothing is deleted, when there are orphans but not a
+single object is referenced. That is far more likely to be a misconfiguration, such as
+the wrong database or a storage root that differs from the one the URLs were recorded
+with, than a real state, and collecting would delete every object.
+*/
+var ErrNoReferences = errors.New("gc: no object is referenced, refusing to delete")
+
+// ReferenceSource is implemented by the repositories recording stored objects.
+type ReferenceSource interface {
+	// ReferencedURLs returns the URLs, as returned by storage.Storage.URL, of the objects
+	// in use.
+	ReferencedURLs(ctx context.Context) ([]string, error)
+}
+
+// KeySource adapts a function listing storage keys, rather than URLs, to a
+// ReferenceSource.
+type KeySource struct {
+	Storage storage.Storage
+	Keys    func(ctx context.Context) ([]string, error)
+}
+
+func (s KeySource) ReferencedURLs(ctx context.Context) ([]string, error) {
+	keys, err := s.Keys(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	urls := make([]string, len(keys))
+	for i, key := range keys {
+		urls[i] = s.Storage.URL(key)
+	}
+
+	return urls, nil
+}
+
+/*
+Collector reconciles the objects in Storage against the URLs recorded by Sources.
+Objects modified within Grace are kept even if unreferenced, since an upload stores its
+file before the creative referencing it is inserted.
+*/
+type Collector struct {
+	Storage storage.Storage
+	Sources []ReferenceSource
+	Grace   time.Duration
+}
+
+// Report describes a collection run.
+type Report struct {
+	DryRun bool `json:"dry_run"`
+	// Scanned is the number of objects found in storage.
+	Scanned int `json:"scanned"`
+	// Referenced is the number of objects in use.
+	Referenced int `json:"referenced"`
+	// Recent is the number of unreferenced objects kept because of the grace period.
+	Recent int `json:"recent"`
+	// Orphans lists the unreferenced objects older than the grace period. They were
+	// deleted unless DryRun is set or their key is listed in Failed.
+	Orphans []storage.Object `json:"orphans"`
+	// Failed lists the orphans that could not be deleted.
+	Failed []string `json:"failed,omitempty"`
+	// BytesFreed is the total size of the deleted orphans, or of all orphans on a dry run.
+	BytesFreed int64 `json:"bytes_freed"`
+}
+
+/*
+Run performs a collection. With dryRun set, the orphans are reported but not deleted.
+Objects are listed before the references are read, so that an object stored and
+referenced during the run is always seen as referenced. A failed deletion does not stop
+the run; its key is listed in the report and the returned error is non-nil.
+*/
+func (c *Collector) Run(ctx context.Context, dryRun bool) (*Report, error) {
+	objects, err := c.Storage.List(ctx, "")
+	if err != nil {
+		return nil, fmt.Errorf("gc: list objects: %w", err)
+	}
+
+	referenced := make(map[string]bool)
+	for _, source := range c.Sources {
+		urls, err := source.ReferencedURLs(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("gc: read references: %w", err)
+		}
+		for _, url := range urls {
+			referenced[url] = true
+		}
+	}
+
+	report := &Report{DryRun: dryRun, Scanned: len(objects), Orphans: []storage.Object{}}
+	cutoff := time.Now().Add(-c.Grace)
+
+	for _, object := range objects {
+		switch {
+		case referenced[c.Storage.URL(object.Key)]:
+			report.Referenced++
+		case object.ModTime.After(cutoff):
+			report.Recent++
+		default:
+			report.Orphans = append(report.Orphans, object)
+		}
+	}
+
+	if report.Referenced == 0 && len(report.Orphans) > 0 {
+		return report, ErrNoReferences
+	}
+
+	var errs []error
+	for _, object := range report.Orphans {
+		if dryRun {
+			report.BytesFreed += object.Size
+			continue
+		}
+
+		err := c.Storage.Delete(ctx, object.Key)
+		if err != nil {
+			report.Failed = append(report.Failed, object.Key)
+			errs = append(errs, fmt.Errorf("gc: delete %s: %w", object.Key, err))
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		report.BytesFreed += object.Size
+	}
+
+	return report, errors.Join(errs...)
+}
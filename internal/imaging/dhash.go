@@ -0,0 +1,121 @@
+/*
+Package imaging decodes and processes the images of creatives. It computes perceptual
+hashes, used to find creatives that show the same picture even though their files
+differ, e.g. after being re-saved, resized or re-compressed, draws the text and
+watermarks of personalised creatives, and encodes WebP renditions.
+*/
+package imaging
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"io"
+	"math/bits"
+
+	// Register the formats accepted for creatives.
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+)
+
+// MaxPixels bounds the size of the images decoded by Decode, which would otherwise
+// allocate memory in proportion to the dimensions declared by a small file.
+const MaxPixels = 40_000_000
+
+var ErrTooLarge = errors.New("imaging: image has too many pixels")
+
+// Decode decodes a GIF, JPEG or PNG image. Images larger than MaxPixels are rejected
+// with ErrTooLarge before their pixels are decoded.
+func Decode(r io.Reader) (image.Image, error) {
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > MaxPixels {
+		return nil, ErrTooLarge
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(content))
+	return img, err
+}
+
+const (
+	hashWidth  = 9
+	hashHeight = 8
+	// maxSamples bounds the pixels averaged along each side of a cell, so that hashing
+	// a large image costs no more than hashing a small one.
+	maxSamples = 16
+)
+
+/*
+DHash returns the difference hash of img. The image is reduced to 9x8 grey levels, each
+the average of the pixels it covers, and each of the 64 bits records whether a level is
+brighter than its right neighbour. Scaling, compression and small colour changes leave
+most bits unchanged, so similar images have hashes at a small Distance.
+*/
+func DHash(img image.Image) uint64 {
+	var levels [hashHeight][hashWidth]uint32
+
+	b := img.Bounds()
+	for cy := 0; cy < hashHeight; cy++ {
+		y0, y1 := cellRange(b.Min.Y, b.Dy(), cy, hashHeight)
+		for cx := 0; cx < hashWidth; cx++ {
+			x0, x1 := cellRange(b.Min.X, b.Dx(), cx, hashWidth)
+			levels[cy][cx] = averageLuma(img, x0, x1, y0, y1)
+		}
+	}
+
+	var hash uint64
+	for y := 0; y < hashHeight; y++ {
+		for x := 0; x < hashWidth-1; x++ {
+			hash <<= 1
+			if levels[y][x] > levels[y][x+1] {
+				hash |= 1
+			}
+		}
+	}
+
+	return hash
+}
+
+// Distance returns the number of bits that differ between two hashes, from 0 for
+// identical images to 64.
+func Distance(a, b uint64) int {
+	return bits.OnesCount64(a ^ b)
+}
+
+// cellRange returns the pixels [start, end) covered by cell i of n along a side of
+// length size starting at min. Every cell covers at least one pixel.
+func cellRange(min, size, i, n int) (int, int) {
+	start := min + i*size/n
+	end := min + (i+1)*size/n
+	if end <= start {
+		end = start + 1
+	}
+	return start, end
+}
+
+// averageLuma returns the average luminance, in [0, 65535], of up to maxSamples² pixels
+// spread evenly over the rectangle.
+func averageLuma(img image.Image, x0, x1, y0, y1 int) uint32 {
+	xStep := max(1, (x1-x0)/maxSamples)
+	yStep := max(1, (y1-y0)/maxSamples)
+
+	var sum, count uint64
+	for y := y0; y < y1; y += yStep {
+		for x := x0; x < x1; x += xStep {
+			r, g, b, _ := img.At(x, y).RGBA()
+			// The weights of color.GrayModel.
+			sum += uint64((19595*r + 38470*g + 7471*b + 1<<15) >> 16)
+			count++
+		}
+	}
+
+	return uint32(sum / count)
+}
@@ -0,0 +1,186 @@
+package imaging
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"sort"
+	"sync"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/gobolditalic"
+	"golang.org/x/image/font/gofont/goitalic"
+	"golang.org/x/image/font/gofont/gomedium"
+	"golang.org/x/image/font/gofont/gomono"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// fontFiles are the bundled fonts, the Go font family, by name.
+var fontFiles = map[string][]byte{
+	"regular":     goregular.TTF,
+	"medium":      gomedium.TTF,
+	"bold":        gobold.TTF,
+	"italic":      goitalic.TTF,
+	"bold-italic": gobolditalic.TTF,
+	"mono":        gomono.TTF,
+}
+
+var (
+	fontsMu sync.Mutex
+	fonts   = make(map[string]*opentype.Font)
+)
+
+// Fonts returns the names of the bundled fonts, sorted.
+func Fonts() []string {
+	names := make([]string, 0, len(fontFiles))
+	for name := range fontFiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// HasFont reports whether name is a bundled font.
+func HasFont(name string) bool {
+	_, ok := fontFiles[name]
+	return ok
+}
+
+// loadFont parses a bundled font the first time it is used.
+func loadFont(name string) (*opentype.Font, error) {
+	fontsMu.Lock()
+	defer fontsMu.Unlock()
+
+	if f, ok := fonts[name]; ok {
+		return f, nil
+	}
+
+	file, ok := fontFiles[name]
+	if !ok {
+		return nil, fmt.Errorf("imaging: unknown font %q", name)
+	}
+
+	f, err := opentype.Parse(file)
+	if err != nil {
+		return nil, err
+	}
+	fonts[name] = f
+	return f, nil
+}
+
+// Align places text horizontally within its region.
+type Align int
+
+const (
+	AlignLeft Align = iota
+	AlignCenter
+	AlignRight
+)
+
+// MinTextSize is the smallest size, in pixels, text is shrunk to when fitting its region.
+const MinTextSize = 8
+
+/*
+Text is a line of text to draw with DrawText. X and Y are the top left corner of its
+region, which is MaxWidth pixels wide and Size pixels tall. The text is drawn at Size
+pixels if it fits, and otherwise shrunk as needed and centered vertically in the region;
+text still too wide at MinTextSize is cut short with an ellipsis.
+*/
+type Text struct {
+	Text     string
+	X        int
+	Y        int
+	MaxWidth int
+	Font     string
+	Size     float64
+	Color    color.Color
+	Align    Align
+}
+
+// DrawText draws t onto dst.
+func DrawText(dst draw.Image, t Text) error {
+	f, err := loadFont(t.Font)
+	if err != nil {
+		return err
+	}
+
+	face, size, text, err := fitText(f, t)
+	if err != nil {
+		return err
+	}
+	defer face.Close()
+
+	d := &font.Drawer{Dst: dst, Src: image.NewUniform(t.Color), Face: face}
+	width := d.MeasureString(text).Ceil()
+
+	x := t.X
+	switch t.Align {
+	case AlignCenter:
+		x += (t.MaxWidth - width) / 2
+	case AlignRight:
+		x += t.MaxWidth - width
+	}
+
+	y := fixed.Int26_6((float64(t.Y) + (t.Size-size)/2) * 64)
+	d.Dot = fixed.Point26_6{X: fixed.I(x), Y: y + face.Metrics().Ascent}
+	d.DrawString(text)
+
+	return nil
+}
+
+// fitText returns the face at the largest size, down to MinTextSize, at which the text
+// fits within t.MaxWidth, that size, and the text, cut short if it does not fit at all.
+func fitText(f *opentype.Font, t Text) (font.Face, float64, string, error) {
+	size := t.Size
+	for {
+		face, err := opentype.NewFace(f, &opentype.FaceOptions{Size: size, DPI: 72, Hinting: font.HintingFull})
+		if err != nil {
+			return nil, 0, "", err
+		}
+
+		width := font.MeasureString(face, t.Text).Ceil()
+		if width <= t.MaxWidth {
+			return face, size, t.Text, nil
+		}
+		if size <= MinTextSize {
+			return face, size, truncateText(face, t.Text, t.MaxWidth), nil
+		}
+		face.Close()
+
+		// Scaling is close to linear; the loop corrects for hinting.
+		size = max(MinTextSize, min(size-1, size*float64(t.MaxWidth)/float64(width)))
+	}
+}
+
+// truncateText cuts text short, ending it with an ellipsis, so that it fits in width.
+func truncateText(face font.Face, text string, width int) string {
+	runes := []rune(text)
+	for len(runes) > 0 {
+		runes = runes[:len(runes)-1]
+		cut := string(runes) + "…"
+		if font.MeasureString(face, cut).Ceil() <= width {
+			return cut
+		}
+	}
+	return ""
+}
+
+// Render returns a copy of img with texts drawn on it, in order.
+func Render(img image.Image, texts []Text) (*image.RGBA, error) {
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Src)
+
+	for _, t := range texts {
+		err := DrawText(dst, t)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return dst, nil
+}
@@ -0,0 +1,65 @@
+package imaging
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+
+	xdraw "golang.org/x/image/draw"
+)
+
+// Corner is the corner of an image a watermark is drawn in.
+type Corner int
+
+const (
+	TopLeft Corner = iota
+	TopRight
+	BottomLeft
+	BottomRight
+)
+
+/*
+Watermark describes a logo drawn onto images by DrawWatermark. The logo is resized to
+Scale times the width of the image, keeping its aspect ratio, and drawn in Corner with a
+margin of 2% of the image's width. Opacity ranges from 0 (invisible) to 1.
+*/
+type Watermark struct {
+	Logo    image.Image
+	Corner  Corner
+	Scale   float64
+	Opacity float64
+}
+
+// DrawWatermark draws wm onto dst.
+func DrawWatermark(dst draw.Image, wm Watermark) {
+	b := dst.Bounds()
+	lb := wm.Logo.Bounds()
+	if lb.Empty() || b.Empty() {
+		return
+	}
+
+	margin := max(1, b.Dx()/50)
+
+	// The logo is shrunk further if it would not fit the image's height.
+	w := max(1, int(wm.Scale*float64(b.Dx())))
+	h := max(1, w*lb.Dy()/lb.Dx())
+	if maxH := b.Dy() - 2*margin; h > maxH && maxH > 0 {
+		h = maxH
+		w = max(1, h*lb.Dx()/lb.Dy())
+	}
+
+	x, y := b.Min.X+margin, b.Min.Y+margin
+	if wm.Corner == TopRight || wm.Corner == BottomRight {
+		x = b.Max.X - margin - w
+	}
+	if wm.Corner == BottomLeft || wm.Corner == BottomRight {
+		y = b.Max.Y - margin - h
+	}
+
+	logo := image.NewRGBA(image.Rect(0, 0, w, h))
+	xdraw.CatmullRom.Scale(logo, logo.Bounds(), wm.Logo, lb, xdraw.Src, nil)
+
+	opacity := min(1, max(0, wm.Opacity))
+	mask := image.NewUniform(color.Alpha16{A: uint16(opacity * 0xffff)})
+	draw.DrawMask(dst, image.Rect(x, y, x+w, y+h), logo, image.Point{}, mask, image.Point{}, draw.Over)
+}
@@ -0,0 +1,16 @@
+package imaging
+
+import (
+	"image"
+	"io"
+
+	"github.com/HugoSmits86/nativewebp"
+)
+
+/*
+EncodeWebP writes img to w as a lossless WebP image. Lossless WebP files are usually
+much smaller than PNG files of the same image, but rarely smaller than lossy JPEG ones.
+*/
+func EncodeWebP(w io.Writer, img image.Image) error {
+	return nativewebp.Encode(w, img, nil)
+}
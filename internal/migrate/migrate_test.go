@@ -0,0 +1,291 @@
+package migrate
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/lib/pq"
+	"github.com/vishaaxl/cheershare/migrations"
+)
+
+/*
+testDB creates an empty database for the test and drops it afterwards. It connects with
+the DSN in TEST_DB_DSN (for instance the Postgres of docker-compose.yml), and skips the
+test when the variable is not set.
+*/
+func testDB(t *testing.T) *sql.DB {
+	t.Helper()
+
+	dsn := os.Getenv("TEST_DB_DSN")
+	if dsn == "" {
+		t.Skip("TEST_DB_DSN is not set")
+	}
+
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		var err error
+		dsn, err = pq.ParseURL(dsn)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	admin, err := sql.Open("postgres", dsn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { admin.Close() })
+
+	name := fmt.Sprintf("cheershare_migrate_test_%d", time.Now().UnixNano())
+	_, err = admin.Exec(`CREATE DATABASE ` + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Later keywords override earlier ones in a DSN.
+	db, err := sql.Open("postgres", dsn+" dbname="+name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		db.Close()
+		if _, err := admin.Exec(`DROP DATABASE IF EXISTS ` + name); err != nil {
+			t.Errorf("drop test database: %v", err)
+		}
+	})
+
+	return db
+}
+
+// version returns the rows of schema_migrations.
+func version(t *testing.T, db *sql.DB) (versions []int64, dirty bool) {
+	t.Helper()
+
+	rows, err := db.Query(`SELECT version, dirty FROM schema_migrations`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			v int64
+			d bool
+		)
+		if err := rows.Scan(&v, &d); err != nil {
+			t.Fatal(err)
+		}
+		versions = append(versions, v)
+		dirty = dirty || d
+	}
+	if err := rows.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	return versions, dirty
+}
+
+// tableExists reports whether a table of the given name is in the public schema.
+func tableExists(t *testing.T, db *sql.DB, table string) bool {
+	t.Helper()
+
+	var exists bool
+	err := db.QueryRow(`SELECT to_regclass('public.' || $1) IS NOT NULL`, table).Scan(&exists)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return exists
+}
+
+func TestUpDownUp(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+
+	m, err := New(db, migrations.FS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for round := 1; round <= 2; round++ {
+		err = m.Up(ctx)
+		if err != nil {
+			t.Fatalf("up (round %d): %v", round, err)
+		}
+
+		// One clean row holding the latest version, as golang-migrate records it.
+		versions, dirty := version(t, db)
+		if len(versions) != 1 || versions[0] != int64(m.Latest()) || dirty {
+			t.Fatalf("schema_migrations = %v (dirty %v), want [%d]", versions, dirty, m.Latest())
+		}
+		if !tableExists(t, db, "creatives") {
+			t.Fatal("creatives table missing after up")
+		}
+
+		err = m.Up(ctx)
+		if !errors.Is(err, ErrNoChange) {
+			t.Fatalf("second up = %v, want ErrNoChange", err)
+		}
+
+		err = m.Down(ctx, len(m.migrations))
+		if err != nil {
+			t.Fatalf("down (round %d): %v", round, err)
+		}
+
+		versions, _ = version(t, db)
+		if len(versions) != 0 {
+			t.Fatalf("schema_migrations = %v after rolling back everything, want no rows", versions)
+		}
+		for _, table := range []string{"users", "tokens", "creatives", "blobs", "renditions"} {
+			if tableExists(t, db, table) {
+				t.Errorf("%s table left behind by the down migrations", table)
+			}
+		}
+	}
+}
+
+func TestDownSteps(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+
+	m, err := New(db, migrations.FS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Up(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Down(ctx, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	want := m.migrations[len(m.migrations)-3].Version
+	current, statuses, err := m.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current != want {
+		t.Fatalf("version = %d after rolling back 2 migrations, want %d", current, want)
+	}
+	for _, status := range statuses {
+		if status.Applied != (status.Version <= want) {
+			t.Errorf("migration %d applied = %v", status.Version, status.Applied)
+		}
+	}
+}
+
+func TestDirtyDatabaseIsNotMigrated(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+
+	m, err := New(db, migrations.FS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.To(ctx, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	// golang-migrate leaves the flag set when a migration fails half way.
+	_, err = db.Exec(`UPDATE schema_migrations SET dirty = true`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.Up(ctx)
+	if !errors.Is(err, ErrDirty) {
+		t.Fatalf("up = %v, want ErrDirty", err)
+	}
+	if tableExists(t, db, "tokens") {
+		t.Error("migrations applied over a dirty database")
+	}
+}
+
+func TestFailedMigrationLeavesNoTrace(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+
+	m, err := New(db, fstest.MapFS{
+		"000001_first.up.sql":    {Data: []byte(`CREATE TABLE first (id int)`)},
+		"000001_first.down.sql":  {Data: []byte(`DROP TABLE first`)},
+		"000002_broken.up.sql":   {Data: []byte(`CREATE TABLE second (id int); SELECT no_such_function()`)},
+		"000002_broken.down.sql": {Data: []byte(`DROP TABLE second`)},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = m.Up(ctx)
+	if err == nil {
+		t.Fatal("up succeeded with a broken migration")
+	}
+
+	versions, dirty := version(t, db)
+	if len(versions) != 1 || versions[0] != 1 || dirty {
+		t.Errorf("schema_migrations = %v (dirty %v), want [1]", versions, dirty)
+	}
+	if tableExists(t, db, "second") {
+		t.Error("broken migration was partially applied")
+	}
+}
+
+func TestConcurrentRunsWaitForTheLock(t *testing.T) {
+	ctx := context.Background()
+	db := testDB(t)
+
+	m, err := New(db, migrations.FS)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// While another session holds the lock, a run waits rather than migrating.
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, lockKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	waitCtx, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	err = m.Up(waitCtx)
+	cancel()
+	if err == nil {
+		t.Fatal("up ran while the lock was held")
+	}
+
+	_, err = conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1)`, lockKey)
+	conn.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Replicas starting together apply the migrations once: one run does the work and
+	// the others find nothing left to do.
+	errs := make(chan error, 3)
+	for i := 0; i < cap(errs); i++ {
+		go func() { errs <- m.Up(ctx) }()
+	}
+
+	var applied int
+	for i := 0; i < cap(errs); i++ {
+		err := <-errs
+		switch {
+		case err == nil:
+			applied++
+		case !errors.Is(err, ErrNoChange):
+			t.Errorf("concurrent up: %v", err)
+		}
+	}
+	if applied != 1 {
+		t.Errorf("%d runs applied migrations, want 1", applied)
+	}
+}
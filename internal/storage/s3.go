@@ -0,0 +1,200 @@
+package storage
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+// s3PartSize bounds the memory used by Put, which streams objects of unknown size as
+// multipart uploads buffered one part at a time.
+const s3PartSize = 16 << 20
+
+// S3Config configures an S3 compatible backend such as AWS S3 or MinIO.
+type S3Config struct {
+	// Endpoint is the host and optional port of the service, e.g. "localhost:9000".
+	Endpoint  string
+	Bucket    string
+	Region    string
+	AccessKey string
+	SecretKey string
+	// UseSSL selects https rather than http.
+	UseSSL bool
+}
+
+// S3 stores objects in a bucket of an S3 compatible service. Clients can upload to it
+// directly with presigned URLs.
+type S3 struct {
+	client *minio.Client
+	bucket string
+}
+
+// NewS3 returns an S3 backend storing objects in cfg.Bucket, creating the bucket if it
+// does not exist.
+func NewS3(ctx context.Context, cfg S3Config) (*S3, error) {
+	client, err := minio.New(cfg.Endpoint, &minio.Options{
+		Creds:  credentials.NewStaticV4(cfg.AccessKey, cfg.SecretKey, ""),
+		Secure: cfg.UseSSL,
+		Region: cfg.Region,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	exists, err := client.BucketExists(ctx, cfg.Bucket)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		err = client.MakeBucket(ctx, cfg.Bucket, minio.MakeBucketOptions{Region: cfg.Region})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &S3{client: client, bucket: cfg.Bucket}, nil
+}
+
+func (s *S3) Put(ctx context.Context, key string, r io.Reader) (int64, error) {
+	if err := checkKey(key); err != nil {
+		return 0, err
+	}
+
+	info, err := s.client.PutObject(ctx, s.bucket, key, r, -1, minio.PutObjectOptions{PartSize: s3PartSize})
+	if err != nil {
+		return 0, err
+	}
+	return info.Size, nil
+}
+
+func (s *S3) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	if err := checkKey(key); err != nil {
+		return nil, err
+	}
+
+	obj, err := s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, s3Error(err)
+	}
+
+	// GetObject is lazy; stat the object so that a missing key is reported here. The
+	// object is an io.ReadSeeker whose reads after a seek are ranged GETs, so it can be
+	// served with http.ServeContent without being read into memory.
+	_, err = obj.Stat()
+	if err != nil {
+		obj.Close()
+		return nil, s3Error(err)
+	}
+
+	return obj, nil
+}
+
+// Stat reports the SHA-256 of objects uploaded with an x-amz-checksum-sha256 header.
+func (s *S3) Stat(ctx context.Context, key string) (Object, error) {
+	if err := checkKey(key); err != nil {
+		return Object{}, err
+	}
+
+	info, err := s.client.StatObject(ctx, s.bucket, key, minio.StatObjectOptions{Checksum: true})
+	if err != nil {
+		return Object{}, s3Error(err)
+	}
+
+	obj := Object{Key: key, Size: info.Size, ModTime: info.LastModified}
+	if sum, err := base64.StdEncoding.DecodeString(info.ChecksumSHA256); err == nil && len(sum) > 0 {
+		obj.SHA256 = hex.EncodeToString(sum)
+	}
+
+	return obj, nil
+}
+
+// Move copies the object within the bucket, then removes the original.
+func (s *S3) Move(ctx context.Context, src, dst string) error {
+	if err := checkKey(src); err != nil {
+		return err
+	}
+	if err := checkKey(dst); err != nil {
+		return err
+	}
+
+	if src == dst {
+		return nil
+	}
+
+	_, err := s.client.CopyObject(ctx,
+		minio.CopyDestOptions{Bucket: s.bucket, Object: dst},
+		minio.CopySrcOptions{Bucket: s.bucket, Object: src},
+	)
+	if err != nil {
+		return s3Error(err)
+	}
+
+	return s.client.RemoveObject(ctx, s.bucket, src, minio.RemoveObjectOptions{})
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	if err := checkKey(key); err != nil {
+		return err
+	}
+
+	return s.client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{})
+}
+
+func (s *S3) List(ctx context.Context, prefix string) ([]Object, error) {
+	var objects []Object
+
+	for info := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if info.Err != nil {
+			return nil, info.Err
+		}
+		objects = append(objects, Object{Key: info.Key, Size: info.Size, ModTime: info.LastModified})
+	}
+
+	return objects, nil
+}
+
+// URL returns the path style URL of the object, e.g. "http://localhost:9000/bucket/key".
+func (s *S3) URL(key string) string {
+	return s.client.EndpointURL().String() + "/" + s.bucket + "/" + key
+}
+
+// Ping checks that the bucket exists.
+func (s *S3) Ping(ctx context.Context) error {
+	exists, err := s.client.BucketExists(ctx, s.bucket)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return fmt.Errorf("storage: bucket %q does not exist", s.bucket)
+	}
+	return nil
+}
+
+func (s *S3) PresignPut(ctx context.Context, key string, expiry time.Duration, headers http.Header) (string, error) {
+	if err := checkKey(key); err != nil {
+		return "", err
+	}
+
+	u, err := s.client.PresignHeader(ctx, http.MethodPut, s.bucket, key, expiry, nil, headers)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+// s3Error maps the service's missing object errors to ErrNotFound.
+func s3Error(err error) error {
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchKey", "NoSuchObject":
+		return ErrNotFound
+	default:
+		return err
+	}
+}
@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+var (
+	ErrNotFound    = errors.New("storage: object not found")
+	ErrInvalidKey  = errors.New("storage: invalid key")
+	ErrUnsupported = errors.New("storage: operation not supported by the backend")
+)
+
+// Object describes a stored object.
+type Object struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+	// SHA256 is the hex encoded SHA-256 digest of the content, if the backend recorded it.
+	SHA256 string `json:",omitempty"`
+}
+
+/*
+Storage is implemented by every backend that can hold uploaded creatives.
+Keys are slash separated relative paths such as "3f1c...e2.png" or
+"blobs/9b/9b74...c1.png"; backends are responsible for mapping them to their own
+namespace.
+*/
+type Storage interface {
+	// Put stores the contents of r under key, replacing any existing object, and
+	// returns the number of bytes written.
+	Put(ctx context.Context, key string, r io.Reader) (int64, error)
+	// Open returns a reader for the object stored under key.
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	// Stat returns the metadata of the object stored under key.
+	Stat(ctx context.Context, key string) (Object, error)
+	// Move renames the object stored under src to dst, replacing any existing object.
+	// Moving an object to its own key does nothing.
+	Move(ctx context.Context, src, dst string) error
+	// Delete removes the object stored under key. Deleting a missing object is not an error.
+	Delete(ctx context.Context, key string) error
+	// List returns every object whose key starts with prefix.
+	List(ctx context.Context, prefix string) ([]Object, error)
+	// URL returns the location recorded for the object in the creatives table.
+	URL(key string) string
+	// Ping checks that the backend is reachable and writable.
+	Ping(ctx context.Context) error
+}
+
+/*
+Presigner is implemented by backends that clients can upload to directly, without the
+bytes passing through the API.
+*/
+type Presigner interface {
+	// PresignPut returns a URL accepting a single PUT request storing the object under
+	// key until expiry has passed. The request must carry the given headers, which are
+	// covered by the signature.
+	PresignPut(ctx context.Context, key string, expiry time.Duration, headers http.Header) (string, error)
+}
+
+// checkKey rejects keys that are empty, absolute, or that would escape the backend's
+// namespace.
+func checkKey(key string) error {
+	if key == "" || strings.HasPrefix(key, "/") || path.Clean(key) != key || strings.HasPrefix(key, "../") || key == ".." {
+		return ErrInvalidKey
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/vishaaxl/cheershare/internal/storage")
+
+// traced wraps a Storage so that every operation is recorded as a span.
+type traced struct {
+	next    Storage
+	backend string
+}
+
+// WithTracing returns a Storage that records a span for each call made to s. The backend
+// name (e.g. "disk") is attached to every span.
+func WithTracing(s Storage, backend string) Storage {
+	return &traced{next: s, backend: backend}
+}
+
+func (t *traced) start(ctx context.Context, op, key string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, "storage."+op,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String("storage.backend", t.backend),
+			attribute.String("storage.key", key),
+		),
+	)
+}
+
+func end(span trace.Span, err error) {
+	if err != nil && err != ErrNotFound {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+func (t *traced) Put(ctx context.Context, key string, r io.Reader) (int64, error) {
+	ctx, span := t.start(ctx, "Put", key)
+	n, err := t.next.Put(ctx, key, r)
+	span.SetAttributes(attribute.Int64("storage.bytes", n))
+	end(span, err)
+	return n, err
+}
+
+func (t *traced) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	ctx, span := t.start(ctx, "Open", key)
+	rc, err := t.next.Open(ctx, key)
+	end(span, err)
+	return rc, err
+}
+
+func (t *traced) Stat(ctx context.Context, key string) (Object, error) {
+	ctx, span := t.start(ctx, "Stat", key)
+	obj, err := t.next.Stat(ctx, key)
+	end(span, err)
+	return obj, err
+}
+
+func (t *traced) Move(ctx context.Context, src, dst string) error {
+	ctx, span := t.start(ctx, "Move", src)
+	span.SetAttributes(attribute.String("storage.destination", dst))
+	err := t.next.Move(ctx, src, dst)
+	end(span, err)
+	return err
+}
+
+func (t *traced) Delete(ctx context.Context, key string) error {
+	ctx, span := t.start(ctx, "Delete", key)
+	err := t.next.Delete(ctx, key)
+	end(span, err)
+	return err
+}
+
+func (t *traced) List(ctx context.Context, prefix string) ([]Object, error) {
+	ctx, span := t.start(ctx, "List", prefix)
+	objects, err := t.next.List(ctx, prefix)
+	span.SetAttributes(attribute.Int("storage.objects", len(objects)))
+	end(span, err)
+	return objects, err
+}
+
+func (t *traced) URL(key string) string {
+	return t.next.URL(key)
+}
+
+func (t *traced) Ping(ctx context.Context) error {
+	ctx, span := t.start(ctx, "Ping", "")
+	err := t.next.Ping(ctx)
+	end(span, err)
+	return err
+}
+
+// PresignPut is passed to the wrapped backend, which returns ErrUnsupported unless it is
+// a Presigner.
+func (t *traced) PresignPut(ctx context.Context, key string, expiry time.Duration, headers http.Header) (string, error) {
+	presigner, ok := t.next.(Presigner)
+	if !ok {
+		return "", ErrUnsupported
+	}
+
+	ctx, span := t.start(ctx, "PresignPut", key)
+	u, err := presigner.PresignPut(ctx, key, expiry, headers)
+	end(span, err)
+	return u, err
+}
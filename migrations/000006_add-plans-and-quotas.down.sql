@@ -0,0 +1,8 @@
+DROP TRIGGER IF EXISTS creatives_enforce_quota ON creatives;
+DROP FUNCTION IF EXISTS enforce_creative_quota();
+
+DROP INDEX IF EXISTS creatives_user_id_created_at_idx;
+ALTER TABLE creatives DROP COLUMN IF EXISTS size_bytes;
+ALTER TABLE users DROP COLUMN IF EXISTS plan;
+
+DROP TABLE IF EXISTS plans;
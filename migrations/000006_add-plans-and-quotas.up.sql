@@ -0,0 +1,75 @@
+CREATE TABLE IF NOT EXISTS plans (
+    name text PRIMARY KEY,
+    max_creatives_per_day integer NOT NULL CHECK (max_creatives_per_day >= 0),
+    max_total_bytes bigint NOT NULL CHECK (max_total_bytes >= 0),
+    max_file_bytes bigint NOT NULL CHECK (max_file_bytes >= 0)
+);
+
+-- Keep in sync with data.DefaultPlans, used by the in-memory models.
+INSERT INTO plans (name, max_creatives_per_day, max_total_bytes, max_file_bytes) VALUES
+    ('free', 20, 104857600, 10485760),
+    ('pro', 200, 10737418240, 52428800)
+ON CONFLICT (name) DO NOTHING;
+
+ALTER TABLE users ADD COLUMN IF NOT EXISTS plan text NOT NULL DEFAULT 'free' REFERENCES plans (name);
+
+-- Creatives uploaded before this migration count as 0 bytes.
+ALTER TABLE creatives ADD COLUMN IF NOT EXISTS size_bytes bigint NOT NULL DEFAULT 0 CHECK (size_bytes >= 0);
+
+CREATE INDEX IF NOT EXISTS creatives_user_id_created_at_idx ON creatives (user_id, created_at);
+
+/*
+Quotas are enforced when a creative is inserted. Locking the owner's row serialises
+inserts per user, and each statement of a plpgsql function takes a new snapshot, so the
+counts below include creatives committed by a concurrent insert that held the lock.
+The errors name a constraint so that the application can tell them apart.
+*/
+CREATE OR REPLACE FUNCTION enforce_creative_quota() RETURNS trigger AS $$
+DECLARE
+    limits plans%ROWTYPE;
+    created_today integer;
+    stored_bytes bigint;
+BEGIN
+    SELECT p.* INTO limits
+    FROM users u
+    JOIN plans p ON p.name = u.plan
+    WHERE u.id = NEW.user_id
+    FOR NO KEY UPDATE OF u;
+
+    IF NOT FOUND THEN
+        -- The foreign key reports the missing user.
+        RETURN NEW;
+    END IF;
+
+    IF NEW.size_bytes > limits.max_file_bytes THEN
+        RAISE EXCEPTION 'file of % bytes exceeds the limit of % bytes', NEW.size_bytes, limits.max_file_bytes
+            USING ERRCODE = 'check_violation', CONSTRAINT = 'creatives_file_size_quota';
+    END IF;
+
+    SELECT count(*) INTO created_today
+    FROM creatives
+    WHERE user_id = NEW.user_id
+      AND created_at >= date_trunc('day', now() AT TIME ZONE 'UTC') AT TIME ZONE 'UTC';
+
+    IF created_today >= limits.max_creatives_per_day THEN
+        RAISE EXCEPTION 'daily limit of % creatives reached', limits.max_creatives_per_day
+            USING ERRCODE = 'check_violation', CONSTRAINT = 'creatives_daily_quota';
+    END IF;
+
+    SELECT coalesce(sum(size_bytes), 0) INTO stored_bytes
+    FROM creatives
+    WHERE user_id = NEW.user_id;
+
+    IF stored_bytes + NEW.size_bytes > limits.max_total_bytes THEN
+        RAISE EXCEPTION 'storage limit of % bytes reached', limits.max_total_bytes
+            USING ERRCODE = 'check_violation', CONSTRAINT = 'creatives_storage_quota';
+    END IF;
+
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS creatives_enforce_quota ON creatives;
+CREATE TRIGGER creatives_enforce_quota
+    BEFORE INSERT ON creatives
+    FOR EACH ROW EXECUTE FUNCTION enforce_creative_quota();
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS tus_uploads (
+    id uuid PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    filename text NOT NULL,
+    upload_length bigint NOT NULL CHECK (upload_length > 0),
+    upload_offset bigint NOT NULL DEFAULT 0 CHECK (upload_offset BETWEEN 0 AND upload_length),
+    chunks text[] NOT NULL DEFAULT '{}',
+    storage_key text,
+    expires_at timestamp(0) with time zone NOT NULL,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS tus_uploads_expires_at_idx ON tus_uploads (expires_at);
@@ -0,0 +1,13 @@
+CREATE TABLE IF NOT EXISTS direct_uploads (
+    id uuid PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    filename text NOT NULL,
+    storage_key text NOT NULL UNIQUE,
+    size_bytes bigint NOT NULL CHECK (size_bytes > 0),
+    content_type text NOT NULL,
+    sha256 text NOT NULL CHECK (sha256 ~ '^[0-9a-f]{64}$'),
+    expires_at timestamp(0) with time zone NOT NULL,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS direct_uploads_expires_at_idx ON direct_uploads (expires_at);
@@ -0,0 +1,4 @@
+DROP TABLE IF EXISTS bulk_upload_jobs;
+
+ALTER TABLE creatives DROP COLUMN IF EXISTS tags;
+ALTER TABLE creatives DROP COLUMN IF EXISTS caption;
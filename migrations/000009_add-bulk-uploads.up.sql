@@ -0,0 +1,17 @@
+ALTER TABLE creatives ADD COLUMN IF NOT EXISTS caption text NOT NULL DEFAULT '';
+ALTER TABLE creatives ADD COLUMN IF NOT EXISTS tags text[] NOT NULL DEFAULT '{}';
+
+CREATE TABLE IF NOT EXISTS bulk_upload_jobs (
+    id uuid PRIMARY KEY,
+    user_id bigint NOT NULL REFERENCES users ON DELETE CASCADE,
+    status text NOT NULL DEFAULT 'pending' CHECK (status IN ('pending', 'running', 'completed', 'failed')),
+    archive_key text,
+    items jsonb NOT NULL DEFAULT '[]',
+    error text NOT NULL DEFAULT '',
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    finished_at timestamp(0) with time zone
+);
+
+CREATE INDEX IF NOT EXISTS bulk_upload_jobs_unfinished_idx ON bulk_upload_jobs (updated_at)
+    WHERE status IN ('pending', 'running');
@@ -0,0 +1,6 @@
+DROP TRIGGER IF EXISTS creatives_count_blob_refs ON creatives;
+DROP FUNCTION IF EXISTS count_blob_refs();
+
+ALTER TABLE creatives DROP COLUMN IF EXISTS sha256;
+
+DROP TABLE IF EXISTS blobs;
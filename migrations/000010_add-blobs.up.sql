@@ -0,0 +1,44 @@
+/*
+Uploaded files are stored once per distinct content, keyed by their SHA-256. Creatives
+reference the blob they were created from; creatives uploaded before this migration
+have no blob and keep their own object.
+*/
+CREATE TABLE IF NOT EXISTS blobs (
+    sha256 text PRIMARY KEY CHECK (sha256 ~ '^[0-9a-f]{64}$'),
+    storage_key text NOT NULL UNIQUE,
+    size_bytes bigint NOT NULL CHECK (size_bytes >= 0),
+    ref_count integer NOT NULL DEFAULT 0 CHECK (ref_count >= 0),
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS blobs_unreferenced_idx ON blobs (updated_at) WHERE ref_count = 0;
+
+ALTER TABLE creatives ADD COLUMN IF NOT EXISTS sha256 text REFERENCES blobs (sha256);
+
+CREATE INDEX IF NOT EXISTS creatives_user_id_sha256_idx ON creatives (user_id, sha256) WHERE sha256 IS NOT NULL;
+
+/*
+ref_count counts the creatives referencing each blob. It is maintained here rather than
+by the application so that creatives deleted by the cascade from users are counted too.
+updated_at is bumped on every change, so that an unreferenced blob is only collected
+once it has stayed unreferenced for the grace period.
+*/
+CREATE OR REPLACE FUNCTION count_blob_refs() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP IN ('UPDATE', 'DELETE') AND OLD.sha256 IS NOT NULL THEN
+        UPDATE blobs SET ref_count = ref_count - 1, updated_at = NOW() WHERE sha256 = OLD.sha256;
+    END IF;
+
+    IF TG_OP IN ('INSERT', 'UPDATE') AND NEW.sha256 IS NOT NULL THEN
+        UPDATE blobs SET ref_count = ref_count + 1, updated_at = NOW() WHERE sha256 = NEW.sha256;
+    END IF;
+
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS creatives_count_blob_refs ON creatives;
+CREATE TRIGGER creatives_count_blob_refs
+    AFTER INSERT OR DELETE OR UPDATE OF sha256 ON creatives
+    FOR EACH ROW EXECUTE FUNCTION count_blob_refs();
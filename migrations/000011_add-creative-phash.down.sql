@@ -0,0 +1,3 @@
+DROP FUNCTION IF EXISTS hamming_distance(bigint, bigint);
+
+ALTER TABLE creatives DROP COLUMN IF EXISTS phash;
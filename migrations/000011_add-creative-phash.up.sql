@@ -0,0 +1,13 @@
+-- The perceptual hash (dHash) of the image, stored as the 64 bits of a bigint. It is
+-- NULL for creatives uploaded before this migration and for files that could not be
+-- decoded.
+ALTER TABLE creatives ADD COLUMN IF NOT EXISTS phash bigint;
+
+/*
+hamming_distance returns the number of bits that differ between two hashes. bit_count
+only exists from PostgreSQL 14, so the bits set in the XOR are counted from its text
+form instead.
+*/
+CREATE OR REPLACE FUNCTION hamming_distance(a bigint, b bigint) RETURNS integer AS $$
+    SELECT length(replace((a # b)::bit(64)::text, '0', ''));
+$$ LANGUAGE sql IMMUTABLE STRICT PARALLEL SAFE;
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS creatives_tags_idx;
+
+ALTER TABLE creatives DROP COLUMN IF EXISTS alt_text;
+ALTER TABLE creatives DROP COLUMN IF EXISTS language;
+ALTER TABLE creatives DROP COLUMN IF EXISTS title;
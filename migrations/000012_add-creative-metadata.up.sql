@@ -0,0 +1,6 @@
+ALTER TABLE creatives ADD COLUMN IF NOT EXISTS title text NOT NULL DEFAULT '';
+ALTER TABLE creatives ADD COLUMN IF NOT EXISTS language text NOT NULL DEFAULT '';
+ALTER TABLE creatives ADD COLUMN IF NOT EXISTS alt_text text NOT NULL DEFAULT '';
+
+-- Serves the tag filters, e.g. tags @> '{birthday}'.
+CREATE INDEX IF NOT EXISTS creatives_tags_idx ON creatives USING gin (tags);
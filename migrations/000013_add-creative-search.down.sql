@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS creatives_search_idx;
+
+ALTER TABLE creatives DROP COLUMN IF EXISTS search;
+
+DROP FUNCTION IF EXISTS creative_search_document(text, text, text, text, text[]);
+DROP FUNCTION IF EXISTS creative_search_config(text);
@@ -0,0 +1,46 @@
+/*
+creative_search_config returns the text search configuration for the language of a
+creative, e.g. english for "en-GB". Languages without a stemmer in every supported
+PostgreSQL version use the simple configuration, which only lower-cases words.
+*/
+CREATE OR REPLACE FUNCTION creative_search_config(language text) RETURNS regconfig AS $$
+    SELECT CASE lower(split_part(language, '-', 1))
+        WHEN 'ar' THEN 'arabic'
+        WHEN 'de' THEN 'german'
+        WHEN 'en' THEN 'english'
+        WHEN 'es' THEN 'spanish'
+        WHEN 'fr' THEN 'french'
+        WHEN 'id' THEN 'indonesian'
+        WHEN 'it' THEN 'italian'
+        WHEN 'nl' THEN 'dutch'
+        WHEN 'pt' THEN 'portuguese'
+        WHEN 'ru' THEN 'russian'
+        WHEN 'ta' THEN 'tamil'
+        WHEN 'tr' THEN 'turkish'
+        ELSE 'simple'
+    END::regconfig;
+$$ LANGUAGE sql IMMUTABLE PARALLEL SAFE;
+
+/*
+creative_search_document returns the searchable text of a creative, weighted from the
+title (A) through the tags (B) and caption (C) to the alt text (D). Words are indexed both
+stemmed in the creative's language and as written, so that a search in another language
+still finds exact words.
+*/
+CREATE OR REPLACE FUNCTION creative_search_document(language text, title text, caption text, alt_text text, tags text[])
+RETURNS tsvector AS $$
+    SELECT
+        setweight(to_tsvector(creative_search_config(language), title), 'A') ||
+        setweight(to_tsvector('simple', title), 'A') ||
+        setweight(to_tsvector(creative_search_config(language), array_to_string(tags, ' ')), 'B') ||
+        setweight(to_tsvector('simple', array_to_string(tags, ' ')), 'B') ||
+        setweight(to_tsvector(creative_search_config(language), caption), 'C') ||
+        setweight(to_tsvector('simple', caption), 'C') ||
+        setweight(to_tsvector(creative_search_config(language), alt_text), 'D') ||
+        setweight(to_tsvector('simple', alt_text), 'D');
+$$ LANGUAGE sql IMMUTABLE PARALLEL SAFE;
+
+ALTER TABLE creatives ADD COLUMN IF NOT EXISTS search tsvector
+    GENERATED ALWAYS AS (creative_search_document(language, title, caption, alt_text, tags)) STORED;
+
+CREATE INDEX IF NOT EXISTS creatives_search_idx ON creatives USING gin (search);
@@ -0,0 +1,9 @@
+-- A template makes a creative personalised: its overlays are text regions, usually
+-- holding the recipient's name, drawn onto the image when it is rendered.
+CREATE TABLE IF NOT EXISTS creative_templates (
+    creative_id bigint PRIMARY KEY REFERENCES creatives ON DELETE CASCADE,
+    overlays jsonb NOT NULL DEFAULT '[]',
+    version integer NOT NULL DEFAULT 1,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
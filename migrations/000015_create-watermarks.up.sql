@@ -0,0 +1,13 @@
+-- A user's watermark is drawn onto every creative of theirs that is rendered. The logo
+-- is kept in storage under logo_key; the creatives themselves are never modified.
+CREATE TABLE IF NOT EXISTS watermarks (
+    user_id bigint PRIMARY KEY REFERENCES users ON DELETE CASCADE,
+    logo_key text NOT NULL,
+    position text NOT NULL DEFAULT 'bottom-right'
+        CHECK (position IN ('top-left', 'top-right', 'bottom-left', 'bottom-right')),
+    opacity double precision NOT NULL DEFAULT 0.8 CHECK (opacity > 0 AND opacity <= 1),
+    scale double precision NOT NULL DEFAULT 0.2 CHECK (scale > 0 AND scale <= 1),
+    version integer NOT NULL DEFAULT 1,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    updated_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
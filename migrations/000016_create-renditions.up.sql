@@ -0,0 +1,11 @@
+-- Renditions are copies of blobs converted to more efficient formats, served in their
+-- place to the clients that accept them. storage_key is NULL when the original is
+-- served to every client instead, e.g. because the converted file was no smaller.
+CREATE TABLE IF NOT EXISTS renditions (
+    sha256 text NOT NULL REFERENCES blobs ON DELETE CASCADE,
+    format text NOT NULL CHECK (format IN ('webp')),
+    storage_key text UNIQUE,
+    size_bytes bigint NOT NULL CHECK (size_bytes >= 0),
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (sha256, format)
+);
@@ -0,0 +1,10 @@
+// Package migrations embeds the SQL migration files so the binary can apply them
+// without the external migrate CLI.
+package migrations
+
+import "embed"
+
+// FS holds every NNNNNN_name.up.sql and NNNNNN_name.down.sql file in this directory.
+//
+//go:embed *.sql
+var FS embed.FS